@@ -0,0 +1,200 @@
+// Copyright 2017 Jonathan Pincas
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jpincas/ghost/ghost"
+	"github.com/lib/pq"
+	"github.com/pressly/chi/render"
+)
+
+//APIKeyHeader is the header API keys are read from.  They can also be sent as 'Authorization: ApiKey {key}'
+const APIKeyHeader = "X-API-Key"
+
+//apiKeyPrefix starts every key, so that keys are easy to recognise, e.g. by secret scanners
+const apiKeyPrefix = "ghost_"
+
+//ErrInvalidAPIKey is returned when an API key is malformed, unknown, expired or wrong
+var ErrInvalidAPIKey = errors.New("Invalid API key")
+
+//validScope is read or write access to a schema, or to all schemas with *
+var validScope = regexp.MustCompile(`^(read|write):(\*|[a-z_][a-z0-9_]*)$`)
+
+//APIKey is a key for machine-to-machine access, which acts as its owner with its own role.
+//Keys with scopes can only use the REST routes of those schemas; keys without scopes can do everything their role can.
+//A zero expiry means the key doesn't expire
+type APIKey struct {
+	UserID  string
+	Role    string
+	Scopes  []string
+	Name    string
+	Expires time.Time
+}
+
+//CreateAPIKey stores a new API key and returns it.  Only a hash of the key is stored,
+//so it can't be shown again.  The database is passed in, so that keys can be created from the command line
+func CreateAPIKey(db *sql.DB, k APIKey) (string, error) {
+
+	if k.UserID == "" || k.Role == "" {
+		return "", errors.New("API keys must have a user and a role")
+	}
+
+	for _, scope := range k.Scopes {
+		if !validScope.MatchString(scope) {
+			return "", errors.New("Invalid scope " + scope + ", use read:{schema} or write:{schema}")
+		}
+	}
+
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	keyID := hex.EncodeToString(id)
+	key := apiKeyPrefix + keyID + "_" + base64.RawURLEncoding.EncodeToString(secret)
+
+	var expires interface{}
+	if !k.Expires.IsZero() {
+		expires = k.Expires
+	}
+
+	_, err := db.Exec(ghost.SQLToCreateAPIKey, keyID, hashAPIKey(key), k.UserID, k.Role, pq.Array(k.Scopes), k.Name, expires)
+	return key, err
+
+}
+
+//hashAPIKey hashes a key for storing.  Keys are long and random, so a fast hash is enough
+func hashAPIKey(key string) string {
+
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+
+}
+
+//apiKeyFromRequest returns the key in the X-API-Key header, or else the Authorization header with the ApiKey scheme
+func apiKeyFromRequest(r *http.Request) string {
+
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		return strings.TrimSpace(key)
+	}
+
+	if header := r.Header.Get("Authorization"); len(header) > 7 && strings.EqualFold(header[:7], "apikey ") {
+		return strings.TrimSpace(header[7:])
+	}
+
+	return ""
+
+}
+
+//checkAPIKey returns the unexpired API key matching the key string
+func checkAPIKey(key string) (APIKey, error) {
+
+	parts := strings.SplitN(strings.TrimPrefix(key, apiKeyPrefix), "_", 2)
+	if !strings.HasPrefix(key, apiKeyPrefix) || len(parts) != 2 {
+		return APIKey{}, ErrInvalidAPIKey
+	}
+
+	var (
+		hash string
+		k    APIKey
+	)
+	err := ghost.App.DB.QueryRow(ghost.SQLToGetAPIKey, parts[0]).Scan(&hash, &k.UserID, &k.Role, pq.Array(&k.Scopes))
+	if err == sql.ErrNoRows {
+		return APIKey{}, ErrInvalidAPIKey
+	} else if err != nil {
+		return APIKey{}, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashAPIKey(key)), []byte(hash)) != 1 {
+		return APIKey{}, ErrInvalidAPIKey
+	}
+
+	return k, nil
+
+}
+
+//scopeAllows checks that the scopes allow the request to the schema.  Reading is GET and HEAD,
+//and write access includes read access.  No scopes means no restriction
+func scopeAllows(scopes []string, method string, schema interface{}) bool {
+
+	if len(scopes) == 0 {
+		return true
+	}
+
+	//Scoped keys can only be used on the REST routes, which put the schema on the context
+	s, _ := schema.(string)
+	if s == "" {
+		return false
+	}
+
+	read := method == http.MethodGet || method == http.MethodHead
+	for _, scope := range scopes {
+		parts := strings.SplitN(scope, ":", 2)
+		if len(parts) == 2 && (parts[1] == "*" || parts[1] == s) && (parts[0] == "write" || read) {
+			return true
+		}
+	}
+
+	return false
+
+}
+
+//APIKeyAuthenticator authorises requests with an API key, setting the same 'role' and 'userID' context values
+//as Authorizator, along with 'apiKeyScopes'.  API keys are for machines, so they are never MFA verified,
+//but they are created by the database superuser, so they aren't refused for roles that require two-factor authentication
+func APIKeyAuthenticator(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		k, err := checkAPIKey(apiKeyFromRequest(r))
+		if err != nil {
+			render.Status(r, http.StatusUnauthorized)
+			render.JSON(w, r, ghost.ResponseError{http.StatusUnauthorized, "", err.Error(), "", "", ""})
+			return
+		}
+
+		ctx := r.Context()
+		if !scopeAllows(k.Scopes, r.Method, ctx.Value("schema")) {
+			render.Status(r, http.StatusForbidden)
+			render.JSON(w, r, ghost.ResponseError{http.StatusForbidden, "", "API key is not allowed to do this", "", "", ""})
+			return
+		}
+
+		ctx = context.WithValue(ctx, "role", k.Role)
+		ctx = context.WithValue(ctx, "userID", k.UserID)
+		ctx = context.WithValue(ctx, "mfa", false)
+		ctx = context.WithValue(ctx, "apiKeyScopes", k.Scopes)
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+
+}
@@ -0,0 +1,148 @@
+// Copyright 2017 Jonathan Pincas
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jpincas/ghost/ghost"
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+const apiKeyTestUser = "3c9e6a1d-5b7f-4e2a-9c8d-1f0e2d3c4b5a"
+
+func TestCreateAPIKey(t *testing.T) {
+
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+
+	expires := time.Now().Add(time.Hour)
+	mock.ExpectExec("INSERT INTO api_keys").WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), apiKeyTestUser, "server", sqlmock.AnyArg(), "cron", expires).WillReturnResult(sqlmock.NewResult(0, 1))
+	key, err := CreateAPIKey(db, APIKey{UserID: apiKeyTestUser, Role: "server", Scopes: []string{"read:*", "write:shop"}, Name: "cron", Expires: expires})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//The secret is base64url encoded, so may contain underscores itself
+	parts := strings.SplitN(key, "_", 3)
+	if len(parts) != 3 || parts[0]+"_" != apiKeyPrefix || len(parts[1]) != 16 || len(parts[2]) != 43 {
+		t.Errorf("Unexpected key format %s", key)
+	}
+
+	//Keys without an expiry never expire
+	mock.ExpectExec("INSERT INTO api_keys").WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), apiKeyTestUser, "server", sqlmock.AnyArg(), "", nil).WillReturnResult(sqlmock.NewResult(0, 1))
+	other, _ := CreateAPIKey(db, APIKey{UserID: apiKeyTestUser, Role: "server"})
+	if other == key {
+		t.Error("Expected keys to be random")
+	}
+
+	for _, scope := range []string{"read", "delete:shop", "write:Shop; DROP TABLE users", "read:"} {
+		if _, err := CreateAPIKey(db, APIKey{UserID: apiKeyTestUser, Role: "server", Scopes: []string{scope}}); err == nil {
+			t.Errorf("Expected scope %s to be refused", scope)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+}
+
+func TestAPIKeyAuthenticator(t *testing.T) {
+
+	const key = "ghost_0123456789abcdef_c2VjcmV0LXNlY3JldC1zZWNyZXQtc2VjcmV0LXNlY3I"
+
+	var tests = []struct {
+		name         string
+		header       string
+		value        string
+		scopes       string
+		found        bool
+		method       string
+		schema       string
+		expectedCode int
+	}{
+		{"X-API-Key", APIKeyHeader, key, "{}", true, "GET", "", http.StatusOK},
+		{"Authorization", "Authorization", "ApiKey " + key, "{}", true, "DELETE", "shop", http.StatusOK},
+		{"wrong secret", APIKeyHeader, key + "x", "{}", true, "GET", "", http.StatusUnauthorized},
+		{"unknown or expired", APIKeyHeader, key, "{}", false, "GET", "", http.StatusUnauthorized},
+		{"read scope", APIKeyHeader, key, "{read:shop}", true, "GET", "shop", http.StatusOK},
+		{"read scope writing", APIKeyHeader, key, "{read:shop}", true, "POST", "shop", http.StatusForbidden},
+		{"write scope reading", APIKeyHeader, key, "{write:shop}", true, "GET", "shop", http.StatusOK},
+		{"other schema", APIKeyHeader, key, "{write:shop}", true, "GET", "blog", http.StatusForbidden},
+		{"all schemas", APIKeyHeader, key, "{read:*}", true, "HEAD", "blog", http.StatusOK},
+		{"scoped outside REST routes", APIKeyHeader, key, "{write:*}", true, "POST", "", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+
+		db, mock, _ := sqlmock.New()
+		ghost.App.DB = db
+		query := mock.ExpectQuery("SELECT hash, user_id, role, scopes FROM api_keys").WithArgs("0123456789abcdef")
+		if test.found {
+			query.WillReturnRows(sqlmock.NewRows([]string{"hash", "user_id", "role", "scopes"}).AddRow(hashAPIKey(key), apiKeyTestUser, "partner", test.scopes))
+		} else {
+			query.WillReturnRows(sqlmock.NewRows([]string{"hash", "user_id", "role", "scopes"}))
+		}
+
+		var role, userID interface{}
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			role = r.Context().Value("role")
+			userID = r.Context().Value("userID")
+		})
+
+		req, _ := http.NewRequest(test.method, "/", nil)
+		req.Header.Set(test.header, test.value)
+		if test.schema != "" {
+			req = req.WithContext(context.WithValue(req.Context(), "schema", test.schema))
+		}
+
+		//Authenticator hands requests with an API key to APIKeyAuthenticator
+		rr := httptest.NewRecorder()
+		Authenticator(next).ServeHTTP(rr, req)
+
+		if rr.Code != test.expectedCode {
+			t.Errorf("%s: expected %v, got %v: %s", test.name, test.expectedCode, rr.Code, rr.Body)
+		}
+
+		if test.expectedCode == http.StatusOK && (role != "partner" || userID != apiKeyTestUser) {
+			t.Errorf("%s: expected the key's role and user on the context, got %v, %v", test.name, role, userID)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+
+		db.Close()
+
+	}
+
+	//Malformed keys aren't looked up
+	for _, malformed := range []string{"0123456789abcdef_secret", "ghost_nosecret"} {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set(APIKeyHeader, malformed)
+		rr := httptest.NewRecorder()
+		APIKeyAuthenticator(http.NotFoundHandler()).ServeHTTP(rr, req)
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("Expected %s to be refused, got %v", malformed, rr.Code)
+		}
+	}
+
+}
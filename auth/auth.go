@@ -18,14 +18,11 @@ package auth
 
 import (
 	"errors"
-	"fmt"
 	"html/template"
+	"net/url"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
-	"github.com/diegobernardes/ttlcache"
 	"github.com/jpincas/ghost/ghost"
-	"github.com/spf13/viper"
 )
 
 //Template holder
@@ -35,6 +32,12 @@ var templates *template.Template
 func Activate() error {
 	ghost.Log("AUTH", true, "Activating...", nil)
 	parseTemplates()
+	//Use the configured store for magic codes
+	MagicCodes = newCodeStore(ghost.App.Config.MagicCodeStore)
+	//Load the keys for signing tokens, if any
+	if err := LoadKeys(ghost.App.Config.JWTKeys, ghost.App.Config.JWTSigningKey); err != nil {
+		return err
+	}
 	//Set the routes for the package
 	setRoutes()
 	return nil
@@ -47,31 +50,17 @@ func parseTemplates() {
 
 }
 
-//MagicCodeCache is the cache for storing email/temp pw combinations for passwordless authorisation
-var MagicCodeCache = initCache(300) //5 minute expiry
-
-func initCache(exp time.Duration) *ttlcache.Cache {
-
-	if exp < 1 {
-		ghost.Log("AUTH", false, "Cache expiry cannot be zero or negative", nil)
-	}
-
-	newCache := ttlcache.NewCache()
-	newCache.SetTTL(time.Duration(exp * time.Second))
-	return newCache
-}
-
-//RequestMagicCode generates a magic code, stores it in the cache against the user's email and sends it to them by email
+//RequestMagicCode generates a magic code, stores its hash against the user's email and sends it to them by email
 func RequestMagicCode(email string) error {
 
 	//If system email is not configured, this can't be done, so exit straight away
-	if !ecomail.MailServer.Working {
+	if !ghost.App.MailServer.Working {
 		return errors.New("System email is not configured, so could not send magic code")
 	}
 
 	//First, lookup the email in the users table
 	var id string
-	err := ghost.App.DB.QueryRow(fmt.Sprintf(ghost.SQLToFindUserByEmail, email)).Scan(&id)
+	err := ghost.App.DB.QueryRow(ghost.SQLToFindUserByEmail, email).Scan(&id)
 
 	//If the user doesn't exist in the App.DB
 	if err != nil {
@@ -79,10 +68,16 @@ func RequestMagicCode(email string) error {
 	}
 
 	//User exists in the App.DB
-	//Create a temporary, one-off password consisting of 6 random characters
-	pw := ghost.RandomString(6)
-	//Set it in the cache
-	MagicCodeCache.Set(email, pw)
+	//Create a temporary, one-off password consisting of 6 random digits
+	pw, err := newMagicCode()
+	if err != nil {
+		return err
+	}
+	//Store its hash until it expires
+	expiry := time.Duration(ghost.App.Config.MagicCodeExpiry) * time.Second
+	if err := MagicCodes.SetCode(email, hashCode(email, pw), expiry); err != nil {
+		return err
+	}
 
 	//Set up the data map to go to the email sending function
 	data := map[string]string{
@@ -90,9 +85,9 @@ func RequestMagicCode(email string) error {
 	}
 
 	//Send it to them by mail
-	err = ecomail.MailServer.SendEmail(
+	err = ghost.App.MailServer.SendEmail(
 		[]string{email},                                     //Recipient
-		"Your Magic Code from "+ecomail.MailServer.FromName, //Subject
+		"Your Magic Code from "+ghost.App.MailServer.FromName, //Subject
 		data, //Data to include in the email
 		templates,
 		"defaultmagiccodeemail.html") //Email template to use
@@ -102,22 +97,48 @@ func RequestMagicCode(email string) error {
 
 }
 
-//GetUserToken returns a JWT string encoded with a user id
-func GetUserToken(userID string) (string, error) {
+//MagicLinkPath is the route magic links are requested from, and which they point to
+const MagicLinkPath = "/auth/magiclink"
+
+//RequestMagicLink sends the user a link by email which logs them in when visited.
+//The link contains a signed token, which expires along with magic codes and can only be used once
+func RequestMagicLink(email string) error {
 
-	//Error for empty user ID
-	if userID == "" {
-		return "", errors.New("Empty user ID")
+	//If system email is not configured, this can't be done, so exit straight away
+	if !ghost.App.MailServer.Working {
+		return errors.New("System email is not configured, so could not send magic link")
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"userID": userID,
-		//TODO: Rest of claims, expiry etc.
-	})
+	//First, lookup the email in the users table
+	var id string
+	if err := ghost.App.DB.QueryRow(ghost.SQLToFindUserByEmail, email).Scan(&id); err != nil {
+		return errors.New("Email address not in user database")
+	}
 
-	// Sign and get the complete encoded token as a string using the secret
-	tokenString, err := token.SignedString([]byte(viper.GetString("secret")))
+	link, err := newMagicLink(id)
+	if err != nil {
+		return err
+	}
+
+	//Send it to them by mail
+	return ghost.App.MailServer.SendEmail(
+		[]string{email},
+		"Your Magic Link from "+ghost.App.MailServer.FromName,
+		map[string]string{"link": link},
+		templates,
+		"defaultmagiclinkemail.html")
+
+}
+
+//newMagicLink returns a link to log in the user, containing a signed one-time token
+func newMagicLink(userID string) (string, error) {
+
+	expiry := time.Duration(ghost.App.Config.MagicCodeExpiry) * time.Second
+	token, err := signClaims(newClaims(userID, "", MagicLinkToken, expiry))
+	if err != nil {
+		return "", err
+	}
 
-	return tokenString, err
+	return ghost.App.Config.BaseURL() + MagicLinkPath + "?" + url.Values{"token": {token}}.Encode(), nil
 
 }
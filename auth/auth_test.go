@@ -15,23 +15,19 @@
 package auth
 
 import (
-	"fmt"
+	"bytes"
+	"regexp"
+	"strings"
 	"testing"
 
 	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
 
 	"log"
 
-	ghost "github.com/jpincas/ghost/tools"
-	ecomail "github.com/jpincas/ghost/email"
+	"github.com/jpincas/ghost/ghost"
 	"github.com/spf13/viper"
 )
 
-func TestInitCache(t *testing.T) {
-	initCache(1000)
-	//TODO: test conditions that cause fatal error (exp < 1)
-}
-
 func TestRequestMagicCodeEmailDisabled(t *testing.T) {
 	setup()
 	err := RequestMagicCode("user@notindb")
@@ -44,7 +40,7 @@ func TestRequestMagicCodeEmailDisabled(t *testing.T) {
 func TestRequestMagicCodeUserNotInDB(t *testing.T) {
 	setup()
 	//Flag the email server as enabled
-	ecomail.MailServer.Working = true
+	ghost.App.MailServer.Working = true
 	err := RequestMagicCode("user@notindb")
 	if err.Error() != "Email address not in user database" {
 		t.Error("User is not in App.DB, should return an error")
@@ -57,7 +53,7 @@ func TestRequestMagicCodeUserNotInDB(t *testing.T) {
 func TestRequestMagicCodeUserInDB(t *testing.T) {
 	setup()
 	//Flag the email server as enabled
-	ecomail.MailServer.Working = true
+	ghost.App.MailServer.Working = true
 	err := RequestMagicCode("user@isindb")
 	if err.Error() == "Email address not in user database" {
 		t.Error(err.Error())
@@ -70,15 +66,24 @@ func TestGetToken(t *testing.T) {
 
 	//Set the secret
 	viper.Set("secret", "secret")
+	setTokenConfig()
 
 	//With a proper user Id
-	s, err := GetUserToken("692e8a64-7676-4790-b3f8-a86a5083d5bb")
+	s, err := GetUserToken("692e8a64-7676-4790-b3f8-a86a5083d5bb", "admin")
 	if err != nil {
 		t.Error(err.Error(), "Token: ", s)
 	}
 
+	claims, err := ParseToken(s, AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["userID"] != "692e8a64-7676-4790-b3f8-a86a5083d5bb" || claims["role"] != "admin" || claims["iss"] != "Test Realm" {
+		t.Errorf("Unexpected claims %v", claims)
+	}
+
 	//With empty string
-	s, err = GetUserToken("")
+	s, err = GetUserToken("", "anon")
 	if err == nil {
 		t.Error("Empty user ID should be an error")
 	}
@@ -101,7 +106,7 @@ func setup() {
 	//Give it some data
 	var columns = []string{"id"}
 	dataRows := sqlmock.NewRows(columns).FromCSVString("692e8a64-7676-4790-b3f8-a86a5083d5bb")
-	mock.ExpectQuery(fmt.Sprintf(ghost.SQLToFindUserByEmail, "user@isindb")).WillReturnRows(dataRows)
+	mock.ExpectQuery(regexp.QuoteMeta(ghost.SQLToFindUserByEmail)).WithArgs("user@isindb").WillReturnRows(dataRows)
 
 	//Parse the package templates
 	parseTemplates()
@@ -111,3 +116,22 @@ func setup() {
 func teardown() {
 	ghost.App.DB.Close()
 }
+
+func TestMagicLinkEmailTemplate(t *testing.T) {
+
+	parseTemplates()
+
+	var b bytes.Buffer
+	err := templates.ExecuteTemplate(&b, "defaultmagiclinkemail.html", map[string]interface{}{
+		"To":   "me@me.com",
+		"Data": map[string]string{"link": "http://localhost:3000/auth/magiclink?token=abc"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(b.String(), `href="http://localhost:3000/auth/magiclink?token=abc"`) {
+		t.Error("Expected the email to contain the link")
+	}
+
+}
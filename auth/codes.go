@@ -0,0 +1,322 @@
+// Copyright 2017 Jonathan Pincas
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jpincas/ghost/ghost"
+	"github.com/spf13/viper"
+)
+
+//CodeStore stores magic codes against emails, and counts failed login attempts.
+//Only hashes of codes are stored
+type CodeStore interface {
+	//SetCode stores the hash of a code for an email until it expires, replacing any previous code
+	SetCode(email, hash string, ttl time.Duration) error
+	//UseCode removes the code for an email if the hash matches and it hasn't expired,
+	//and returns whether it did, so that each code can only be used once
+	UseCode(email, hash string) (bool, error)
+	//DeleteCode removes the code for an email, if any
+	DeleteCode(email string) error
+	//AddFailure counts an attempt for a key, which is forgotten only once one succeeds,
+	//and returns the number of attempts since the first one in the current window
+	AddFailure(key string, window time.Duration) (int, error)
+	//Failures returns the number of failures for a key in the current window
+	Failures(key string) (int, error)
+	//ResetFailures forgets the failures for a key
+	ResetFailures(key string) error
+}
+
+//MagicCodes is the store for magic codes used for passwordless authorisation.
+//It is in memory unless Postgres is configured, which is needed for codes to survive restarts
+//and to work across multiple servers
+var MagicCodes CodeStore = NewMemoryCodeStore()
+
+//newCodeStore returns the configured store: memory or postgres
+func newCodeStore(store string) CodeStore {
+
+	if store == "postgres" {
+		return NewPostgresCodeStore()
+	}
+
+	return NewMemoryCodeStore()
+
+}
+
+//newMagicCode is a cryptographically random 6 digit code
+func newMagicCode() (string, error) {
+
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+
+	code := n.String()
+	return strings.Repeat("0", 6-len(code)) + code, nil
+
+}
+
+//hashCode hashes a code for storing, keyed with the secret and bound to the email.
+//Codes are short lived and attempts are limited, so a fast hash is enough
+func hashCode(email, code string) string {
+
+	mac := hmac.New(sha256.New, []byte(viper.GetString("secret")))
+	mac.Write([]byte(strings.ToLower(email) + ":" + code))
+	return hex.EncodeToString(mac.Sum(nil))
+
+}
+
+//memoryCodeStore keeps codes and failures in process
+type memoryCodeStore struct {
+	mu       sync.Mutex
+	codes    map[string]expiringValue
+	failures map[string]expiringValue
+}
+
+type expiringValue struct {
+	hash    string
+	count   int
+	expires time.Time
+}
+
+//NewMemoryCodeStore creates a code store which keeps codes in memory, so they don't survive restarts
+func NewMemoryCodeStore() CodeStore {
+
+	return &memoryCodeStore{
+		codes:    map[string]expiringValue{},
+		failures: map[string]expiringValue{},
+	}
+
+}
+
+func (s *memoryCodeStore) SetCode(email, hash string, ttl time.Duration) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prune()
+	s.codes[email] = expiringValue{hash: hash, expires: time.Now().Add(ttl)}
+	return nil
+
+}
+
+func (s *memoryCodeStore) UseCode(email, hash string) (bool, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	code, ok := s.codes[email]
+	if !ok || time.Now().After(code.expires) || subtle.ConstantTimeCompare([]byte(code.hash), []byte(hash)) != 1 {
+		return false, nil
+	}
+
+	delete(s.codes, email)
+	return true, nil
+
+}
+
+func (s *memoryCodeStore) DeleteCode(email string) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.codes, email)
+	return nil
+
+}
+
+func (s *memoryCodeStore) AddFailure(key string, window time.Duration) (int, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	failure, ok := s.failures[key]
+	if !ok || time.Now().After(failure.expires) {
+		failure = expiringValue{expires: time.Now().Add(window)}
+	}
+
+	failure.count++
+	s.failures[key] = failure
+	return failure.count, nil
+
+}
+
+func (s *memoryCodeStore) Failures(key string) (int, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	failure, ok := s.failures[key]
+	if !ok || time.Now().After(failure.expires) {
+		return 0, nil
+	}
+
+	return failure.count, nil
+
+}
+
+func (s *memoryCodeStore) ResetFailures(key string) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.failures, key)
+	return nil
+
+}
+
+//prune removes expired codes and failures.  The lock must be held
+func (s *memoryCodeStore) prune() {
+
+	now := time.Now()
+	for _, values := range []map[string]expiringValue{s.codes, s.failures} {
+		for key, value := range values {
+			if now.After(value.expires) {
+				delete(values, key)
+			}
+		}
+	}
+
+}
+
+//postgresCodeStore keeps codes and failures in the magic_codes and login_failures tables
+type postgresCodeStore struct{}
+
+//NewPostgresCodeStore creates a code store which keeps codes in the database,
+//so they survive restarts and are shared by all servers
+func NewPostgresCodeStore() CodeStore {
+
+	return postgresCodeStore{}
+
+}
+
+func (s postgresCodeStore) SetCode(email, hash string, ttl time.Duration) error {
+
+	//Expired codes and failures don't need to be kept
+	ghost.App.DB.Exec(ghost.SQLToPruneMagicCodes)
+
+	_, err := ghost.App.DB.Exec(ghost.SQLToSetMagicCode, email, hash, ttl.Seconds())
+	return err
+
+}
+
+func (s postgresCodeStore) UseCode(email, hash string) (bool, error) {
+
+	result, err := ghost.App.DB.Exec(ghost.SQLToUseMagicCode, email, hash)
+	if err != nil {
+		return false, err
+	}
+
+	used, err := result.RowsAffected()
+	return used == 1, err
+
+}
+
+func (s postgresCodeStore) DeleteCode(email string) error {
+
+	_, err := ghost.App.DB.Exec(ghost.SQLToDeleteMagicCode, email)
+	return err
+
+}
+
+func (s postgresCodeStore) AddFailure(key string, window time.Duration) (int, error) {
+
+	var count int
+	err := ghost.App.DB.QueryRow(ghost.SQLToAddLoginFailure, key, window.Seconds()).Scan(&count)
+	return count, err
+
+}
+
+func (s postgresCodeStore) Failures(key string) (int, error) {
+
+	var count int
+	err := ghost.App.DB.QueryRow(ghost.SQLToGetLoginFailures, key).Scan(&count)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	return count, err
+
+}
+
+func (s postgresCodeStore) ResetFailures(key string) error {
+
+	_, err := ghost.App.DB.Exec(ghost.SQLToResetLoginFailures, key)
+	return err
+
+}
+
+//failureKeys are the keys attempts are counted against, for the email and the client's IP
+func failureKeys(email, ip string) (string, string) {
+
+	return "email:" + strings.ToLower(email), "ip:" + ip
+
+}
+
+//countAttempt counts an attempt for the email and from the IP before it is checked, so attempts made
+//in parallel can't all get past the limit, and returns whether either is now over it.
+//Once the email is locked out, the code stored under codeKey, if any, is removed so a new one has to be requested.
+//A maximum of zero means no limit
+func countAttempt(email, ip, codeKey string) (bool, error) {
+
+	emailKey, ipKey := failureKeys(email, ip)
+	lockout := time.Duration(ghost.App.Config.MagicCodeLockout) * time.Second
+
+	ipAttempts, err := MagicCodes.AddFailure(ipKey, lockout)
+	if err != nil {
+		return false, err
+	}
+
+	emailAttempts, err := MagicCodes.AddFailure(emailKey, lockout)
+	if err != nil {
+		return false, err
+	}
+
+	if max := ghost.App.Config.MagicCodeMaxAttempts; max > 0 && emailAttempts > max {
+		if codeKey == "" {
+			return true, nil
+		}
+		return true, MagicCodes.DeleteCode(codeKey)
+	}
+
+	if max := ghost.App.Config.MagicCodeMaxAttemptsPerIP; max > 0 && ipAttempts > max {
+		return true, nil
+	}
+
+	return false, nil
+
+}
+
+//resetFailures forgets the attempts for an email and from an IP after a successful login
+func resetFailures(email, ip string) error {
+
+	emailKey, ipKey := failureKeys(email, ip)
+	if err := MagicCodes.ResetFailures(emailKey); err != nil {
+		return err
+	}
+
+	return MagicCodes.ResetFailures(ipKey)
+
+}
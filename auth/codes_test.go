@@ -0,0 +1,329 @@
+// Copyright 2017 Jonathan Pincas
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"bytes"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jpincas/ghost/ghost"
+	"github.com/spf13/viper"
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+//setCodeConfig sets the magic code settings used by the tests
+func setCodeConfig() {
+	ghost.App.Config.MagicCodeExpiry = 300
+	ghost.App.Config.MagicCodeMaxAttempts = 3
+	ghost.App.Config.MagicCodeMaxAttemptsPerIP = 5
+	ghost.App.Config.MagicCodeLockout = 900
+}
+
+func TestNewMagicCode(t *testing.T) {
+
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		code, err := newMagicCode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !regexp.MustCompile(`^[0-9]{6}$`).MatchString(code) {
+			t.Errorf("Expected a 6 digit code, got %s", code)
+		}
+		seen[code] = true
+	}
+
+	if len(seen) < 90 {
+		t.Errorf("Expected codes to be random, got %v distinct codes out of 100", len(seen))
+	}
+
+}
+
+func TestHashCode(t *testing.T) {
+
+	viper.Set("secret", "secret")
+
+	if hashCode("me@me.com", "123456") == "123456" {
+		t.Error("Expected codes to be hashed")
+	}
+
+	if hashCode("Me@me.com", "123456") != hashCode("me@me.com", "123456") {
+		t.Error("Expected hashes not to depend on the case of the email")
+	}
+
+	if hashCode("you@me.com", "123456") == hashCode("me@me.com", "123456") {
+		t.Error("Expected hashes to be bound to the email")
+	}
+
+}
+
+func TestMemoryCodeStore(t *testing.T) {
+
+	s := NewMemoryCodeStore()
+
+	s.SetCode("me@me.com", "hash", time.Minute)
+	s.SetCode("expired@me.com", "hash", -time.Minute)
+
+	if used, _ := s.UseCode("me@me.com", "wrong"); used {
+		t.Error("Expected the wrong code not to be used")
+	}
+
+	if used, _ := s.UseCode("me@me.com", "hash"); !used {
+		t.Error("Expected the code to be used")
+	}
+
+	if used, _ := s.UseCode("me@me.com", "hash"); used {
+		t.Error("Expected the code to only be usable once")
+	}
+
+	if used, _ := s.UseCode("expired@me.com", "hash"); used {
+		t.Error("Expected an expired code not to be used")
+	}
+
+	for i := 1; i <= 3; i++ {
+		if count, _ := s.AddFailure("key", time.Minute); count != i {
+			t.Errorf("Expected %v failures, got %v", i, count)
+		}
+	}
+
+	if count, _ := s.Failures("key"); count != 3 {
+		t.Errorf("Expected 3 failures, got %v", count)
+	}
+
+	s.ResetFailures("key")
+	if count, _ := s.Failures("key"); count != 0 {
+		t.Errorf("Expected failures to be reset, got %v", count)
+	}
+
+	//Failures are forgotten once the window is over
+	s.AddFailure("other", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if count, _ := s.AddFailure("other", time.Minute); count != 1 {
+		t.Errorf("Expected a new window, got %v failures", count)
+	}
+
+}
+
+func TestPostgresCodeStore(t *testing.T) {
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ghost.App.DB = db
+	defer db.Close()
+
+	s := NewPostgresCodeStore()
+
+	mock.ExpectExec("DELETE FROM magic_codes WHERE expires").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO magic_codes").WithArgs("me@me.com", "hash", float64(300)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM magic_codes WHERE email = \\$1 AND hash").WithArgs("me@me.com", "hash").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM magic_codes WHERE email = \\$1 AND hash").WithArgs("me@me.com", "hash").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("INSERT INTO login_failures").WithArgs("email:me@me.com", float64(900)).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	mock.ExpectQuery("SELECT count FROM login_failures").WithArgs("ip:127.0.0.1").WillReturnRows(sqlmock.NewRows([]string{"count"}))
+
+	if err := s.SetCode("me@me.com", "hash", 5*time.Minute); err != nil {
+		t.Error(err)
+	}
+
+	if used, err := s.UseCode("me@me.com", "hash"); !used || err != nil {
+		t.Errorf("Expected the code to be used, got %v, %v", used, err)
+	}
+
+	if used, err := s.UseCode("me@me.com", "hash"); used || err != nil {
+		t.Errorf("Expected the code to only be usable once, got %v, %v", used, err)
+	}
+
+	if count, err := s.AddFailure("email:me@me.com", 15*time.Minute); count != 2 || err != nil {
+		t.Errorf("Expected 2 failures, got %v, %v", count, err)
+	}
+
+	if count, err := s.Failures("ip:127.0.0.1"); count != 0 || err != nil {
+		t.Errorf("Expected no failures, got %v, %v", count, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+}
+
+//After too many failed attempts for an email, even the right code is refused
+func TestRequestLoginLockout(t *testing.T) {
+
+	viper.Set("secret", "secret")
+	viper.Set("demomode", false)
+	setTokenConfig()
+	setCodeConfig()
+	MagicCodes = NewMemoryCodeStore()
+
+	db, mock, _ := sqlmock.New()
+	ghost.App.DB = db
+	defer db.Close()
+
+	MagicCodes.SetCode("is@registered.com", hashCode("is@registered.com", "666"), time.Minute)
+
+	login := func(code, ip string) int {
+		req, _ := http.NewRequest("POST", "", bytes.NewBufferString(`{"email": "is@registered.com", "code": "`+code+`"}`))
+		req.RemoteAddr = ip + ":1234"
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(requestLogin).ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	for i := 0; i < 3; i++ {
+		mock.ExpectQuery("SELECT id from users").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("130e6150-7098-4f72-8842-0e16629f32de"))
+		if code := login("000000", "10.0.0.1"); code != http.StatusUnauthorized {
+			t.Errorf("Expected 401 for a wrong code, got %v", code)
+		}
+	}
+
+	//Locked out before the database is queried
+	if code := login("666", "10.0.0.2"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 once locked out, got %v", code)
+	}
+
+	//The code was removed on lockout, so a new one is needed even once the lockout is reset
+	resetFailures("is@registered.com", "10.0.0.2")
+	mock.ExpectQuery("SELECT id from users").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("130e6150-7098-4f72-8842-0e16629f32de"))
+	if code := login("666", "10.0.0.2"); code != http.StatusUnauthorized {
+		t.Errorf("Expected the code to have been removed on lockout, got %v", code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+}
+
+//After too many failed attempts from an IP, attempts for any email are refused
+func TestRequestLoginLockoutPerIP(t *testing.T) {
+
+	viper.Set("demomode", false)
+	setCodeConfig()
+	MagicCodes = NewMemoryCodeStore()
+
+	db, mock, _ := sqlmock.New()
+	ghost.App.DB = db
+	defer db.Close()
+
+	for i := 0; i < 5; i++ {
+		mock.ExpectQuery("SELECT id from users").WillReturnError(sql.ErrNoRows)
+		req, _ := http.NewRequest("POST", "", bytes.NewBufferString(`{"email": "user`+string(rune('a'+i))+`@me.com", "code": "000000"}`))
+		req.RemoteAddr = "10.0.0.1:1234"
+		http.HandlerFunc(requestLogin).ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	req, _ := http.NewRequest("POST", "", bytes.NewBufferString(`{"email": "other@me.com", "code": "000000"}`))
+	req.RemoteAddr = "10.0.0.1:1234"
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(requestLogin).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 once the IP is locked out, got %v", rr.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+}
+
+//However the email is typed, codes and failed attempts are recorded against the same address
+func TestRequestLoginEmailCase(t *testing.T) {
+
+	viper.Set("secret", "secret")
+	viper.Set("demomode", false)
+	setTokenConfig()
+	setCodeConfig()
+	MagicCodes = NewMemoryCodeStore()
+
+	db, mock, _ := sqlmock.New()
+	ghost.App.DB = db
+	defer db.Close()
+
+	login := func(email, code string) int {
+		req, _ := http.NewRequest("POST", "", bytes.NewBufferString(`{"email": "`+email+`", "code": "`+code+`"}`))
+		req.RemoteAddr = "10.0.0.1:1234"
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(requestLogin).ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	//A code sent to the address as typed one way can be used with it typed another
+	MagicCodes.SetCode("is@registered.com", hashCode("is@registered.com", "666"), time.Minute)
+	mock.ExpectQuery("SELECT id from users").WithArgs("is@registered.com").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("130e6150-7098-4f72-8842-0e16629f32de"))
+	mock.ExpectExec("UPDATE users SET password = NULL").WithArgs("130e6150-7098-4f72-8842-0e16629f32de").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT role from users").WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("admin"))
+	if code := login(" Is@Registered.com", "666"); code != http.StatusOK {
+		t.Errorf("Expected 200 for the code with the email in a different case, got %v", code)
+	}
+
+	//Failed attempts with the email in any case count towards one lockout
+	for _, email := range []string{"IS@registered.com", "is@REGISTERED.com", "is@registered.com"} {
+		mock.ExpectQuery("SELECT id from users").WithArgs("is@registered.com").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("130e6150-7098-4f72-8842-0e16629f32de"))
+		login(email, "000000")
+	}
+
+	if locked, _ := countAttempt("is@registered.com", "10.0.0.2", ""); !locked {
+		t.Error("Expected failed attempts with the email in any case to lock it out")
+	}
+	resetFailures("is@registered.com", "10.0.0.2")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+}
+
+//Attempts are counted before they are checked, so no more than the limit get through however many are made at once
+func TestCountAttemptParallel(t *testing.T) {
+
+	setCodeConfig()
+	MagicCodes = NewMemoryCodeStore()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if locked, err := countAttempt("is@registered.com", "10.0.0.1", "is@registered.com"); err == nil && !locked {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != ghost.App.Config.MagicCodeMaxAttempts {
+		t.Errorf("Expected %d attempts to be allowed, got %d", ghost.App.Config.MagicCodeMaxAttempts, allowed)
+	}
+
+	//A successful attempt forgets them
+	resetFailures("is@registered.com", "10.0.0.1")
+	if locked, _ := countAttempt("is@registered.com", "10.0.0.1", ""); locked {
+		t.Error("Expected the attempts to have been forgotten")
+	}
+
+}
@@ -16,10 +16,17 @@ package auth
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 
-	ghost "github.com/jpincas/ghost/tools"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/jpincas/ghost/ghost"
+	"github.com/lib/pq"
 	uuid "github.com/satori/go.uuid"
 	"github.com/spf13/viper"
 )
@@ -27,6 +34,26 @@ import (
 //ApiMagicCode processes a request for a magic code
 func magicCode(w http.ResponseWriter, r *http.Request) {
 
+	sendToEmail(w, r, RequestMagicCode)
+
+}
+
+//magicLink processes a request for a magic link
+func magicLink(w http.ResponseWriter, r *http.Request) {
+
+	sendToEmail(w, r, RequestMagicLink)
+
+}
+
+//NormaliseEmail is the form of an email address that users are stored and looked up by, and that
+//magic codes and failed attempts are recorded against, so that however it is typed it is the same user
+func NormaliseEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+//sendToEmail reads the email from the request body and sends the user a magic code or link with the send function
+func sendToEmail(w http.ResponseWriter, r *http.Request, send func(email string) error) {
+
 	//Set content type to JSON
 	w.Header().Set("Content-Type", ghost.ContentTypeJSON)
 
@@ -63,9 +90,9 @@ func magicCode(w http.ResponseWriter, r *http.Request) {
 	email, ok := requestBody["email"]
 	if ok && email != "" {
 
-		//If 'email' is set, request a magic code
-		err := RequestMagicCode(email.(string))
-		//If sending of the magic code fails (user doesn't exist, email fails etc)
+		//If 'email' is set, send the magic code or link
+		err := send(NormaliseEmail(fmt.Sprint(email)))
+		//If sending fails (user doesn't exist, email fails etc)
 		if err != nil {
 
 			w.WriteHeader(http.StatusServiceUnavailable)
@@ -75,7 +102,7 @@ func magicCode(w http.ResponseWriter, r *http.Request) {
 
 		}
 
-		//If the magic code goes through OK, just return a blank 200
+		//If it goes through OK, just return a blank 200
 		w.Write([]byte{})
 		return
 
@@ -91,7 +118,8 @@ func magicCode(w http.ResponseWriter, r *http.Request) {
 
 func requestNewUserToken(w http.ResponseWriter, r *http.Request) {
 
-	tokenString, err := GetUserToken(fmt.Sprint(uuid.NewV4()))
+	//New users aren't in the users table, so are always anon
+	tokens, err := IssueTokens(fmt.Sprint(uuid.NewV4()), "anon")
 
 	if err != nil {
 
@@ -102,9 +130,7 @@ func requestNewUserToken(w http.ResponseWriter, r *http.Request) {
 
 	}
 
-	b, _ := json.Marshal(map[string]string{
-		"token": tokenString,
-	})
+	b, _ := json.Marshal(tokens)
 	w.Write([]byte(b))
 	return
 
@@ -162,10 +188,34 @@ func requestLogin(w http.ResponseWriter, r *http.Request) {
 
 	}
 
+	emailString, _ := email.(string)
+	emailString = NormaliseEmail(emailString)
+	codeString, _ := code.(string)
+	totp, _ := requestBody["totp"].(string)
+	ip := clientIP(r)
+
+	//Count the attempt before the code is checked, and refuse to check any more codes
+	//after too many attempts for the email or from the IP
+	locked, err := countAttempt(emailString, ip, emailString)
+	if err != nil {
+
+		w.WriteHeader(http.StatusServiceUnavailable)
+		b, _ := json.Marshal(ghost.ResponseError{http.StatusServiceUnavailable, "", err.Error(), "", "", ""})
+		w.Write([]byte(b))
+		return
+
+	} else if locked {
+
+		w.WriteHeader(http.StatusTooManyRequests)
+		b, _ := json.Marshal(ghost.ResponseError{http.StatusTooManyRequests, "", "Too many failed attempts, please try again later", "", "", ""})
+		w.Write([]byte(b))
+		return
+
+	}
+
 	//Lookup the email in the users table
 	var id string
-	err := ghost.App.DB.QueryRow(fmt.Sprintf(ghost.SQLToFindUserByEmail, email)).Scan(&id)
-	cachedCode, emailIsInCache := MagicCodeCache.Get(email.(string))
+	err = ghost.App.DB.QueryRow(ghost.SQLToFindUserByEmail, emailString).Scan(&id)
 
 	//For Demo Mode ONLY - bypass the magic code
 	//checking and just send back the id
@@ -173,51 +223,436 @@ func requestLogin(w http.ResponseWriter, r *http.Request) {
 	//and tell demo users to log in with that email and password 123456
 	if viper.GetBool("demomode") && err == nil && code == "123456" {
 
-		tokenString, err := GetUserToken(id)
+		resetFailures(emailString, ip)
+		respondWithTokens(w, id, false)
+		return
+
+	}
+
+	if err == nil {
+
+		//If the user exists in the database and the code supplied matches their magic code,
+		//it is removed from the store so it can't be used again
+		used, err := MagicCodes.UseCode(emailString, hashCode(emailString, codeString))
 		if err != nil {
 
-			//Output and return
 			w.WriteHeader(http.StatusServiceUnavailable)
 			b, _ := json.Marshal(ghost.ResponseError{http.StatusServiceUnavailable, "", err.Error(), "", "", ""})
 			w.Write([]byte(b))
 			return
 
+		} else if used {
+
+			if err := dropUnverifiedPassword(id); err != nil {
+				ghost.Log("AUTH", false, "Error removing unverified password", err)
+			}
+			loginWithTOTP(w, id, emailString, ip, totp)
+			return
+
 		}
 
-		b, _ := json.Marshal(map[string]string{
-			"token": tokenString,
-		})
+	}
+
+	//Default to unauthorised
+	w.WriteHeader(http.StatusUnauthorized)
+	b, _ := json.Marshal(ghost.ResponseError{http.StatusUnauthorized, "", "Could not log in with those credentials", "", "", ""})
+	w.Write([]byte(b))
+	return
+
+}
+
+//refreshTokens exchanges a refresh token for a new pair of tokens.
+//Each refresh token can only be used once: it is revoked when used, and reusing it is refused
+func refreshTokens(w http.ResponseWriter, r *http.Request) {
+
+	claims, ok := readRefreshToken(w, r)
+	if !ok {
+		return
+	}
+
+	revoked, err := RevokeToken(claims)
+	if err != nil {
+
+		w.WriteHeader(http.StatusServiceUnavailable)
+		b, _ := json.Marshal(ghost.ResponseError{http.StatusServiceUnavailable, "", err.Error(), "", "", ""})
 		w.Write([]byte(b))
 		return
 
-	} else if emailIsInCache && err == nil && code.(string) == cachedCode {
+	}
 
-		//If the user exists in the database, the email is in the magic cache and the password supplied matches the magic code,
-		//delete the email/magic code combo in the cache so it can't be used again
-		MagicCodeCache.Remove(email.(string))
-		tokenString, err := GetUserToken(id)
-		if err != nil {
+	if !revoked {
 
-			//Output and return
-			w.WriteHeader(http.StatusServiceUnavailable)
-			b, _ := json.Marshal(ghost.ResponseError{http.StatusServiceUnavailable, "", err.Error(), "", "", ""})
-			w.Write([]byte(b))
-			return
+		w.WriteHeader(http.StatusUnauthorized)
+		b, _ := json.Marshal(ghost.ResponseError{http.StatusUnauthorized, "", "Refresh token has already been used", "", "", ""})
+		w.Write([]byte(b))
+		return
 
-		}
+	}
+
+	//The role is looked up again, so that changes to it take effect on refresh
+	userID, _ := claims["userID"].(string)
+	respondWithTokens(w, userID, claims["mfa"] == true)
+	return
+
+}
+
+//logout revokes a refresh token so that it can't be used to get new tokens,
+//and the access token sent with the request, if any, so that it can't be used either
+func logout(w http.ResponseWriter, r *http.Request) {
+
+	claims, ok := readRefreshToken(w, r)
+	if !ok {
+		return
+	}
+
+	_, err := RevokeToken(claims)
+	if access, parseErr := ParseToken(tokenFromRequest(r), AccessToken); err == nil && parseErr == nil {
+		_, err = RevokeToken(access)
+	}
+
+	if err != nil {
 
-		b, _ := json.Marshal(map[string]string{
-			"token": tokenString,
-		})
+		w.WriteHeader(http.StatusServiceUnavailable)
+		b, _ := json.Marshal(ghost.ResponseError{http.StatusServiceUnavailable, "", err.Error(), "", "", ""})
 		w.Write([]byte(b))
 		return
 
 	}
 
-	//Default to unauthorised
-	w.WriteHeader(http.StatusUnauthorized)
-	b, _ := json.Marshal(ghost.ResponseError{http.StatusUnauthorized, "", "Could not log in with those credentials", "", "", ""})
+	w.Write([]byte{})
+	return
+
+}
+
+//readRefreshToken reads and verifies the refresh token in the request body.
+//If it is missing or invalid the error is written and ok is false
+func readRefreshToken(w http.ResponseWriter, r *http.Request) (claims jwt.MapClaims, ok bool) {
+
+	w.Header().Set("Content-Type", ghost.ContentTypeJSON)
+
+	var requestBody struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+
+	if r.Body == nil || json.NewDecoder(r.Body).Decode(&requestBody) != nil || requestBody.RefreshToken == "" {
+
+		w.WriteHeader(http.StatusBadRequest)
+		b, _ := json.Marshal(ghost.ResponseError{http.StatusBadRequest, "", "No refresh token provided", "", "", ""})
+		w.Write([]byte(b))
+		return nil, false
+
+	}
+
+	parsed, err := ParseToken(requestBody.RefreshToken, RefreshToken)
+	if err != nil {
+
+		w.WriteHeader(http.StatusUnauthorized)
+		b, _ := json.Marshal(ghost.ResponseError{http.StatusUnauthorized, "", err.Error(), "", "", ""})
+		w.Write([]byte(b))
+		return nil, false
+
+	}
+
+	return parsed, true
+
+}
+
+//useMagicLink logs in the user with the one-time token in a magic link.
+//If a redirect is configured, the browser is sent there with the tokens, otherwise the tokens are returned
+func useMagicLink(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", ghost.ContentTypeJSON)
+
+	claims, err := ParseToken(r.URL.Query().Get("token"), MagicLinkToken)
+	if err != nil {
+
+		w.WriteHeader(http.StatusUnauthorized)
+		b, _ := json.Marshal(ghost.ResponseError{http.StatusUnauthorized, "", err.Error(), "", "", ""})
+		w.Write([]byte(b))
+		return
+
+	}
+
+	//Links are revoked when used, so they only work once
+	revoked, err := RevokeToken(claims)
+	if err != nil {
+
+		w.WriteHeader(http.StatusServiceUnavailable)
+		b, _ := json.Marshal(ghost.ResponseError{http.StatusServiceUnavailable, "", err.Error(), "", "", ""})
+		w.Write([]byte(b))
+		return
+
+	} else if !revoked {
+
+		w.WriteHeader(http.StatusUnauthorized)
+		b, _ := json.Marshal(ghost.ResponseError{http.StatusUnauthorized, "", "Magic link has already been used", "", "", ""})
+		w.Write([]byte(b))
+		return
+
+	}
+
+	userID, _ := claims["userID"].(string)
+	if err := dropUnverifiedPassword(userID); err != nil {
+		ghost.Log("AUTH", false, "Error removing unverified password", err)
+	}
+
+	if redirect := ghost.App.Config.MagicLinkRedirect; redirect != "" {
+		redirectWithTokens(w, r, redirect, userID)
+		return
+	}
+
+	respondWithTokens(w, userID, false)
+
+}
+
+//redirectWithTokens issues a new pair of tokens for the user and redirects the browser to the frontend
+//with them in the URL fragment, which isn't sent to servers
+func redirectWithTokens(w http.ResponseWriter, r *http.Request, redirect, userID string) {
+
+	tokens, err := issueTokensFor(userID, false)
+	if err != nil {
+
+		w.WriteHeader(http.StatusServiceUnavailable)
+		b, _ := json.Marshal(ghost.ResponseError{http.StatusServiceUnavailable, "", err.Error(), "", "", ""})
+		w.Write([]byte(b))
+		return
+
+	}
+
+	fragment := url.Values{
+		"token":        {tokens.Token},
+		"refreshToken": {tokens.RefreshToken},
+		"expiresIn":    {strconv.Itoa(tokens.ExpiresIn)},
+	}
+	http.Redirect(w, r, redirect+"#"+fragment.Encode(), http.StatusSeeOther)
+
+}
+
+//clientIP is the IP address of the client, without the port.
+//Behind a proxy, use the RealIP middleware so that this is the client's and not the proxy's
+func clientIP(r *http.Request) string {
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+
+}
+
+//respondWithTokens issues and writes a new pair of tokens for the user, with their current role,
+//marked as MFA verified if they have passed two-factor authentication
+func respondWithTokens(w http.ResponseWriter, userID string, mfa bool) {
+
+	tokens, err := issueTokensFor(userID, mfa)
+	if err != nil {
+
+		w.WriteHeader(http.StatusServiceUnavailable)
+		b, _ := json.Marshal(ghost.ResponseError{http.StatusServiceUnavailable, "", err.Error(), "", "", ""})
+		w.Write([]byte(b))
+		return
+
+	}
+
+	b, _ := json.Marshal(tokens)
 	w.Write([]byte(b))
+
+}
+
+//passwordRequest is the body of the password routes
+type passwordRequest struct {
+	Email           string `json:"email"`
+	Password        string `json:"password"`
+	CurrentPassword string `json:"currentPassword"`
+	Token           string `json:"token"`
+	TOTP            string `json:"totp"`
+}
+
+//readPasswordRequest reads the body of a password route, requiring the password.
+//If it is missing or invalid the error is written and ok is false
+func readPasswordRequest(w http.ResponseWriter, r *http.Request) (body passwordRequest, ok bool) {
+
+	w.Header().Set("Content-Type", ghost.ContentTypeJSON)
+
+	if r.Body == nil || json.NewDecoder(r.Body).Decode(&body) != nil || body.Password == "" {
+
+		w.WriteHeader(http.StatusBadRequest)
+		b, _ := json.Marshal(ghost.ResponseError{http.StatusBadRequest, "", "No password provided", "", "", ""})
+		w.Write([]byte(b))
+		return body, false
+
+	}
+
+	body.Email = NormaliseEmail(body.Email)
+	return body, true
+
+}
+
+//register creates a user with an email and password, and emails them a link to confirm the address.
+//They aren't logged in, as the password can't be used until the link is
+func register(w http.ResponseWriter, r *http.Request) {
+
+	body, ok := readPasswordRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if body.Email == "" {
+
+		w.WriteHeader(http.StatusBadRequest)
+		b, _ := json.Marshal(ghost.ResponseError{http.StatusBadRequest, "", "No email address provided", "", "", ""})
+		w.Write([]byte(b))
+		return
+
+	}
+
+	if _, err := RegisterUser(body.Email, body.Password); err != nil {
+		respondWithPasswordError(w, err)
+		return
+	}
+
+	w.Write([]byte{})
 	return
 
 }
+
+//passwordLogin logs in a user with their email and password.
+//Failed attempts count towards the same lockout as magic codes
+func passwordLogin(w http.ResponseWriter, r *http.Request) {
+
+	body, ok := readPasswordRequest(w, r)
+	if !ok {
+		return
+	}
+
+	ip := clientIP(r)
+	locked, err := countAttempt(body.Email, ip, body.Email)
+	if err != nil {
+
+		w.WriteHeader(http.StatusServiceUnavailable)
+		b, _ := json.Marshal(ghost.ResponseError{http.StatusServiceUnavailable, "", err.Error(), "", "", ""})
+		w.Write([]byte(b))
+		return
+
+	} else if locked {
+
+		w.WriteHeader(http.StatusTooManyRequests)
+		b, _ := json.Marshal(ghost.ResponseError{http.StatusTooManyRequests, "", "Too many failed attempts, please try again later", "", "", ""})
+		w.Write([]byte(b))
+		return
+
+	}
+
+	id, err := PasswordLogin(body.Email, body.Password)
+	if err != nil {
+		respondWithPasswordError(w, err)
+		return
+	}
+
+	loginWithTOTP(w, id, body.Email, ip, body.TOTP)
+	return
+
+}
+
+//changePassword sets the logged in user's password.  If they already have one, it must be given as currentPassword
+func changePassword(w http.ResponseWriter, r *http.Request) {
+
+	body, ok := readPasswordRequest(w, r)
+	if !ok {
+		return
+	}
+
+	userID := fmt.Sprint(r.Context().Value("userID"))
+	if err := ChangePassword(userID, body.CurrentPassword, body.Password); err != nil {
+		respondWithPasswordError(w, err)
+		return
+	}
+
+	w.Write([]byte{})
+	return
+
+}
+
+//forgotPassword emails a password reset link
+func forgotPassword(w http.ResponseWriter, r *http.Request) {
+
+	sendToEmail(w, r, RequestPasswordReset)
+
+}
+
+//resetPassword sets a new password with the token from a reset link
+func resetPassword(w http.ResponseWriter, r *http.Request) {
+
+	body, ok := readPasswordRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if err := ResetPassword(body.Token, body.Password); err != nil {
+		respondWithPasswordError(w, err)
+		return
+	}
+
+	w.Write([]byte{})
+	return
+
+}
+
+//confirmPassword verifies a registered password with the token from a confirmation link,
+//which is either opened straight from the email or posted by the frontend page it went to
+func confirmPassword(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", ghost.ContentTypeJSON)
+
+	var body struct {
+		Token string `json:"token"`
+	}
+
+	if r.Method == http.MethodGet {
+		body.Token = r.URL.Query().Get("token")
+	} else if r.Body != nil {
+		json.NewDecoder(r.Body).Decode(&body)
+	}
+
+	if body.Token == "" {
+
+		w.WriteHeader(http.StatusBadRequest)
+		b, _ := json.Marshal(ghost.ResponseError{http.StatusBadRequest, "", "No confirmation token provided", "", "", ""})
+		w.Write([]byte(b))
+		return
+
+	}
+
+	if err := ConfirmPassword(body.Token); err != nil {
+		respondWithPasswordError(w, err)
+		return
+	}
+
+	w.Write([]byte{})
+	return
+
+}
+
+//respondWithPasswordError writes the error from a password route with the right status
+func respondWithPasswordError(w http.ResponseWriter, err error) {
+
+	code := http.StatusServiceUnavailable
+	switch err {
+	case ErrPasswordTooShort:
+		code = http.StatusBadRequest
+	case ErrWrongPassword, ErrInvalidResetLink, ErrInvalidConfirmLink:
+		code = http.StatusUnauthorized
+	case ErrPasswordNotVerified:
+		code = http.StatusForbidden
+	}
+
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		code, err = http.StatusConflict, errors.New("Email address is already registered")
+	}
+
+	w.WriteHeader(code)
+	b, _ := json.Marshal(ghost.ResponseError{code, "", err.Error(), "", "", ""})
+	w.Write([]byte(b))
+
+}
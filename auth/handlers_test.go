@@ -17,15 +17,18 @@ package auth
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
+	"time"
 
 	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
 
 	"fmt"
 
-	ghost "github.com/jpincas/ghost/tools"
+	"github.com/jpincas/ghost/ghost"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/suite"
 )
@@ -52,6 +55,31 @@ func TestAuthHandlerTests(t *testing.T) {
 func (suite *AuthHandlerTests) SetupTest() {
 	suite.Req, _ = http.NewRequest("GET", "", nil)
 	suite.Rr = httptest.NewRecorder()
+	viper.Set("secret", "secret")
+	setTokenConfig()
+	setCodeConfig()
+	MagicCodes = NewMemoryCodeStore()
+	ghost.App.Config.Protocol, ghost.App.Config.Host, ghost.App.Config.ApiPort = "http", "localhost", "3000"
+}
+
+//hasTokensFor checks that the response is a valid pair of tokens for the user and role
+func (suite *AuthHandlerTests) hasTokensFor(userID, role string) Tokens {
+
+	var tokens Tokens
+	suite.NoError(json.Unmarshal(suite.Rr.Body.Bytes(), &tokens), fmt.Sprint(suite.Rr.Body))
+	suite.Equal(ghost.App.Config.JWTExpiry, tokens.ExpiresIn)
+
+	claims, err := ParseToken(tokens.Token, AccessToken)
+	suite.NoError(err)
+	suite.Equal(userID, claims["userID"])
+	suite.Equal(role, claims["role"])
+
+	claims, err = ParseToken(tokens.RefreshToken, RefreshToken)
+	suite.NoError(err)
+	suite.Equal(userID, claims["userID"])
+
+	return tokens
+
 }
 
 func (suite *AuthHandlerTests) TestMagicCode_nobody() {
@@ -112,6 +140,12 @@ func (suite *AuthHandlerTests) TestRequestNewUserToken() {
 	suite.Equal(http.StatusOK, suite.Rr.Code)
 	suite.NotEmpty(suite.Rr.Body, "Response should not be empty")
 
+	var tokens Tokens
+	json.Unmarshal(suite.Rr.Body.Bytes(), &tokens)
+	claims, err := ParseToken(tokens.Token, AccessToken)
+	suite.NoError(err)
+	suite.Equal("anon", claims["role"])
+
 }
 
 func (suite *AuthHandlerTests) TestRequestLogin_nobody() {
@@ -180,20 +214,19 @@ func (suite *AuthHandlerTests) TestRequestLogin_demomode() {
 
 	ghost.App.DB, suite.Mock, _ = sqlmock.New()
 	rows := sqlmock.NewRows([]string{"id"}).AddRow("130e6150-7098-4f72-8842-0e16629f32de")
-	suite.Mock.ExpectQuery("is@registered.com").WillReturnRows(rows)
+	suite.Mock.ExpectQuery("SELECT id from users").WithArgs("is@registered.com").WillReturnRows(rows)
 
-	MagicCodeCache.Set("is@registered.com", "666")
+	MagicCodes.SetCode("is@registered.com", hashCode("is@registered.com", "666"), time.Minute)
 	viper.Set("demomode", true)
 
-	t, _ := GetUserToken("130e6150-7098-4f72-8842-0e16629f32de")
-	expectedToken := fmt.Sprintf("{%q:%q}", "token", t)
+	suite.Mock.ExpectQuery("SELECT role from users").WithArgs("130e6150-7098-4f72-8842-0e16629f32de").WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("admin"))
 
 	b := []byte(`{"email": "is@registered.com", "code": "123456"}`)
 	suite.Req, _ = http.NewRequest("POST", "", bytes.NewBuffer(b))
 
 	http.HandlerFunc(requestLogin).ServeHTTP(suite.Rr, suite.Req)
 	suite.Equal(http.StatusOK, suite.Rr.Code, fmt.Sprint(suite.Rr.Body))
-	suite.Equal(expectedToken, fmt.Sprint(suite.Rr.Body), fmt.Sprint(suite.Rr.Body))
+	suite.hasTokensFor("130e6150-7098-4f72-8842-0e16629f32de", "admin")
 
 }
 
@@ -202,9 +235,9 @@ func (suite *AuthHandlerTests) TestRequestLogin_fail() {
 
 	ghost.App.DB, suite.Mock, _ = sqlmock.New()
 	rows := sqlmock.NewRows([]string{"id"}).AddRow("130e6150-7098-4f72-8842-0e16629f32de")
-	suite.Mock.ExpectQuery("is@registered.com").WillReturnRows(rows)
+	suite.Mock.ExpectQuery("SELECT id from users").WithArgs("is@registered.com").WillReturnRows(rows)
 
-	MagicCodeCache.Set("is@registered.com", "666")
+	MagicCodes.SetCode("is@registered.com", hashCode("is@registered.com", "666"), time.Minute)
 	viper.Set("demomode", false)
 
 	b := []byte(`{"email": "is@registered.com", "code": "123456"}`)
@@ -219,19 +252,219 @@ func (suite *AuthHandlerTests) TestRequestLogin_ok() {
 
 	ghost.App.DB, suite.Mock, _ = sqlmock.New()
 	rows := sqlmock.NewRows([]string{"id"}).AddRow("130e6150-7098-4f72-8842-0e16629f32de")
-	suite.Mock.ExpectQuery("is@registered.com").WillReturnRows(rows)
+	suite.Mock.ExpectQuery("SELECT id from users").WithArgs("is@registered.com").WillReturnRows(rows)
 
-	MagicCodeCache.Set("is@registered.com", "666")
+	MagicCodes.SetCode("is@registered.com", hashCode("is@registered.com", "666"), time.Minute)
 	viper.Set("demomode", false)
 
-	t, _ := GetUserToken("130e6150-7098-4f72-8842-0e16629f32de")
-	expectedToken := fmt.Sprintf("{%q:%q}", "token", t)
+	suite.Mock.ExpectExec("UPDATE users SET password = NULL").WithArgs("130e6150-7098-4f72-8842-0e16629f32de").WillReturnResult(sqlmock.NewResult(0, 0))
+	suite.Mock.ExpectQuery("SELECT role from users").WithArgs("130e6150-7098-4f72-8842-0e16629f32de").WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("admin"))
 
 	b := []byte(`{"email": "is@registered.com", "code": "666"}`)
 	suite.Req, _ = http.NewRequest("POST", "", bytes.NewBuffer(b))
 
 	http.HandlerFunc(requestLogin).ServeHTTP(suite.Rr, suite.Req)
 	suite.Equal(http.StatusOK, suite.Rr.Code, fmt.Sprint(suite.Rr.Body))
-	suite.Equal(expectedToken, fmt.Sprint(suite.Rr.Body), fmt.Sprint(suite.Rr.Body))
+	suite.hasTokensFor("130e6150-7098-4f72-8842-0e16629f32de", "admin")
+
+}
+
+func (suite *AuthHandlerTests) TestRefresh_ok() {
+
+	tokens, _ := IssueTokens("130e6150-7098-4f72-8842-0e16629f32de", "anon")
+
+	ghost.App.DB, suite.Mock, _ = sqlmock.New()
+	suite.Mock.ExpectExec("DELETE FROM revoked_tokens").WillReturnResult(sqlmock.NewResult(0, 0))
+	suite.Mock.ExpectExec("INSERT INTO revoked_tokens").WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	suite.Mock.ExpectQuery("SELECT role from users").WithArgs("130e6150-7098-4f72-8842-0e16629f32de").WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("admin"))
+
+	b, _ := json.Marshal(map[string]string{"refreshToken": tokens.RefreshToken})
+	suite.Req, _ = http.NewRequest("POST", "", bytes.NewBuffer(b))
+
+	http.HandlerFunc(refreshTokens).ServeHTTP(suite.Rr, suite.Req)
+	suite.Equal(http.StatusOK, suite.Rr.Code, fmt.Sprint(suite.Rr.Body))
+	//The role has changed since the refresh token was issued
+	refreshed := suite.hasTokensFor("130e6150-7098-4f72-8842-0e16629f32de", "admin")
+	suite.NotEqual(tokens.RefreshToken, refreshed.RefreshToken)
+	suite.NoError(suite.Mock.ExpectationsWereMet())
+
+}
+
+//Refresh tokens can only be used once
+func (suite *AuthHandlerTests) TestRefresh_reused() {
+
+	tokens, _ := IssueTokens("130e6150-7098-4f72-8842-0e16629f32de", "anon")
+
+	ghost.App.DB, suite.Mock, _ = sqlmock.New()
+	suite.Mock.ExpectExec("DELETE FROM revoked_tokens").WillReturnResult(sqlmock.NewResult(0, 0))
+	suite.Mock.ExpectExec("INSERT INTO revoked_tokens").WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	b, _ := json.Marshal(map[string]string{"refreshToken": tokens.RefreshToken})
+	suite.Req, _ = http.NewRequest("POST", "", bytes.NewBuffer(b))
+
+	http.HandlerFunc(refreshTokens).ServeHTTP(suite.Rr, suite.Req)
+	suite.Equal(http.StatusUnauthorized, suite.Rr.Code, fmt.Sprint(suite.Rr.Body))
+	suite.NoError(suite.Mock.ExpectationsWereMet())
+
+}
+
+//An access token can't be used to get new tokens
+func (suite *AuthHandlerTests) TestRefresh_accesstoken() {
+
+	tokens, _ := IssueTokens("130e6150-7098-4f72-8842-0e16629f32de", "anon")
+
+	b, _ := json.Marshal(map[string]string{"refreshToken": tokens.Token})
+	suite.Req, _ = http.NewRequest("POST", "", bytes.NewBuffer(b))
+
+	http.HandlerFunc(refreshTokens).ServeHTTP(suite.Rr, suite.Req)
+	suite.Equal(http.StatusUnauthorized, suite.Rr.Code, fmt.Sprint(suite.Rr.Body))
+
+}
+
+func (suite *AuthHandlerTests) TestRefresh_notoken() {
+
+	b := []byte(`{"email": "me@me.com"}`)
+	suite.Req, _ = http.NewRequest("POST", "", bytes.NewBuffer(b))
+
+	http.HandlerFunc(refreshTokens).ServeHTTP(suite.Rr, suite.Req)
+	suite.Equal(http.StatusBadRequest, suite.Rr.Code, fmt.Sprint(suite.Rr.Body))
+
+}
+
+func (suite *AuthHandlerTests) TestLogout() {
+
+	tokens, _ := IssueTokens("130e6150-7098-4f72-8842-0e16629f32de", "anon")
+
+	ghost.App.DB, suite.Mock, _ = sqlmock.New()
+	suite.Mock.ExpectExec("DELETE FROM revoked_tokens").WillReturnResult(sqlmock.NewResult(0, 0))
+	suite.Mock.ExpectExec("INSERT INTO revoked_tokens").WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	b, _ := json.Marshal(map[string]string{"refreshToken": tokens.RefreshToken})
+	suite.Req, _ = http.NewRequest("POST", "", bytes.NewBuffer(b))
+
+	http.HandlerFunc(logout).ServeHTTP(suite.Rr, suite.Req)
+	suite.Equal(http.StatusOK, suite.Rr.Code, fmt.Sprint(suite.Rr.Body))
+	suite.NoError(suite.Mock.ExpectationsWereMet())
+
+}
+
+func (suite *AuthHandlerTests) TestLogout_revokesaccesstoken() {
+
+	tokens, _ := IssueTokens("130e6150-7098-4f72-8842-0e16629f32de", "anon")
+	access, _ := ParseToken(tokens.Token, AccessToken)
+
+	ghost.App.DB, suite.Mock, _ = sqlmock.New()
+	suite.Mock.ExpectExec("DELETE FROM revoked_tokens").WillReturnResult(sqlmock.NewResult(0, 0))
+	suite.Mock.ExpectExec("INSERT INTO revoked_tokens").WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	suite.Mock.ExpectExec("DELETE FROM revoked_tokens").WillReturnResult(sqlmock.NewResult(0, 0))
+	suite.Mock.ExpectExec("INSERT INTO revoked_tokens").WithArgs(access["jti"], sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	b, _ := json.Marshal(map[string]string{"refreshToken": tokens.RefreshToken})
+	suite.Req, _ = http.NewRequest("POST", "", bytes.NewBuffer(b))
+	suite.Req.Header.Set("Authorization", "Bearer "+tokens.Token)
+
+	http.HandlerFunc(logout).ServeHTTP(suite.Rr, suite.Req)
+	suite.Equal(http.StatusOK, suite.Rr.Code, fmt.Sprint(suite.Rr.Body))
+	suite.NoError(suite.Mock.ExpectationsWereMet())
+
+}
+
+func (suite *AuthHandlerTests) TestMagicLink_emailsystemnotactivated() {
+
+	ghost.App.MailServer.Working = false
+	b := []byte(`{"email":"me@me.com"}`)
+	suite.Req, _ = http.NewRequest("POST", "", bytes.NewBuffer(b))
+	http.HandlerFunc(magicLink).ServeHTTP(suite.Rr, suite.Req)
+	suite.Equal(http.StatusServiceUnavailable, suite.Rr.Code)
+
+}
+
+func (suite *AuthHandlerTests) TestMagicLink_noemail() {
+
+	b := []byte(`{"gmail":""}`)
+	suite.Req, _ = http.NewRequest("POST", "", bytes.NewBuffer(b))
+	http.HandlerFunc(magicLink).ServeHTTP(suite.Rr, suite.Req)
+	suite.Equal(http.StatusBadRequest, suite.Rr.Code)
+
+}
+
+//expectMagicLinkUse sets up a magic link for the user and expects it to be revoked when used
+func (suite *AuthHandlerTests) expectMagicLinkUse(firstUse bool) string {
+
+	link, err := newMagicLink("130e6150-7098-4f72-8842-0e16629f32de")
+	suite.NoError(err)
+
+	ghost.App.DB, suite.Mock, _ = sqlmock.New()
+	suite.Mock.ExpectExec("DELETE FROM revoked_tokens").WillReturnResult(sqlmock.NewResult(0, 0))
+	if firstUse {
+		suite.Mock.ExpectExec("INSERT INTO revoked_tokens").WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+		suite.Mock.ExpectExec("UPDATE users SET password = NULL").WithArgs("130e6150-7098-4f72-8842-0e16629f32de").WillReturnResult(sqlmock.NewResult(0, 0))
+		suite.Mock.ExpectQuery("SELECT role from users").WithArgs("130e6150-7098-4f72-8842-0e16629f32de").WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("admin"))
+	} else {
+		suite.Mock.ExpectExec("INSERT INTO revoked_tokens").WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+
+	return link
+
+}
+
+func (suite *AuthHandlerTests) TestUseMagicLink_ok() {
+
+	ghost.App.Config.MagicLinkRedirect = ""
+	link := suite.expectMagicLinkUse(true)
+	suite.Contains(link, "://localhost:3000/auth/magiclink?token=")
+
+	suite.Req, _ = http.NewRequest("GET", link, nil)
+	http.HandlerFunc(useMagicLink).ServeHTTP(suite.Rr, suite.Req)
+	suite.Equal(http.StatusOK, suite.Rr.Code, fmt.Sprint(suite.Rr.Body))
+	suite.hasTokensFor("130e6150-7098-4f72-8842-0e16629f32de", "admin")
+	suite.NoError(suite.Mock.ExpectationsWereMet())
+
+}
+
+func (suite *AuthHandlerTests) TestUseMagicLink_redirect() {
+
+	ghost.App.Config.MagicLinkRedirect = "https://app.example.com/login"
+	defer func() { ghost.App.Config.MagicLinkRedirect = "" }()
+	link := suite.expectMagicLinkUse(true)
+
+	suite.Req, _ = http.NewRequest("GET", link, nil)
+	http.HandlerFunc(useMagicLink).ServeHTTP(suite.Rr, suite.Req)
+	suite.Equal(http.StatusSeeOther, suite.Rr.Code, fmt.Sprint(suite.Rr.Body))
+
+	location, err := url.Parse(suite.Rr.Header().Get("Location"))
+	suite.NoError(err)
+	suite.Equal("app.example.com", location.Host)
+	suite.Empty(location.RawQuery, "Tokens should not be sent to the frontend's server")
+
+	fragment, _ := url.ParseQuery(location.Fragment)
+	claims, err := ParseToken(fragment.Get("token"), AccessToken)
+	suite.NoError(err)
+	suite.Equal("admin", claims["role"])
+	_, err = ParseToken(fragment.Get("refreshToken"), RefreshToken)
+	suite.NoError(err)
+	suite.NoError(suite.Mock.ExpectationsWereMet())
+
+}
+
+func (suite *AuthHandlerTests) TestUseMagicLink_reused() {
+
+	link := suite.expectMagicLinkUse(false)
+
+	suite.Req, _ = http.NewRequest("GET", link, nil)
+	http.HandlerFunc(useMagicLink).ServeHTTP(suite.Rr, suite.Req)
+	suite.Equal(http.StatusUnauthorized, suite.Rr.Code, fmt.Sprint(suite.Rr.Body))
+	suite.NoError(suite.Mock.ExpectationsWereMet())
+
+}
+
+//Other tokens can't be used as magic links
+func (suite *AuthHandlerTests) TestUseMagicLink_accesstoken() {
+
+	token, _ := GetUserToken("130e6150-7098-4f72-8842-0e16629f32de", "admin")
+
+	suite.Req, _ = http.NewRequest("GET", "/auth/magiclink?token="+token, nil)
+	http.HandlerFunc(useMagicLink).ServeHTTP(suite.Rr, suite.Req)
+	suite.Equal(http.StatusUnauthorized, suite.Rr.Code, fmt.Sprint(suite.Rr.Body))
 
 }
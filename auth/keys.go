@@ -0,0 +1,385 @@
+// Copyright 2017 Jonathan Pincas
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"sync"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/jpincas/ghost/ghost"
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+)
+
+//JWKSPath is where the public keys used to verify tokens are published,
+//so that other services can verify tokens without sharing a secret
+const JWKSPath = "/.well-known/jwks.json"
+
+//SigningMethodEdDSA signs tokens with Ed25519 keys, which jwt-go doesn't support itself
+var SigningMethodEdDSA = &signingMethodEd25519{}
+
+func init() {
+	jwt.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
+
+type signingMethodEd25519 struct{}
+
+func (m *signingMethodEd25519) Alg() string {
+	return "EdDSA"
+}
+
+func (m *signingMethodEd25519) Sign(signingString string, key interface{}) (string, error) {
+
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+
+	return jwt.EncodeSegment(ed25519.Sign(privateKey, []byte(signingString))), nil
+
+}
+
+func (m *signingMethodEd25519) Verify(signingString, signature string, key interface{}) error {
+
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+		return errors.New("EdDSA signature is invalid")
+	}
+
+	return nil
+
+}
+
+//signingKey is a loaded key pair.  Keys only used for verification have no private key
+type signingKey struct {
+	id         string
+	method     jwt.SigningMethod
+	privateKey crypto.Signer
+	publicKey  crypto.PublicKey
+}
+
+//keySet holds the key tokens are signed with and the keys they can be verified with.
+//With no keys loaded, tokens are signed and verified with the HMAC secret
+type keySet struct {
+	mu        sync.RWMutex
+	signing   *signingKey
+	verifying map[string]*signingKey
+	//ordered is the order the keys were configured in, for publishing
+	ordered []*signingKey
+}
+
+var keys = &keySet{}
+
+//LoadKeys loads the configured keys from their PEM files, replacing any loaded before.
+//Tokens are signed with the key with the active id, and verified with any of the keys,
+//so to rotate keys: add a new key, make it active, and remove the old one once the tokens it signed have expired
+func LoadKeys(configured []ghost.JWTKey, activeID string) error {
+
+	loaded := &keySet{verifying: map[string]*signingKey{}}
+
+	for _, k := range configured {
+
+		key, err := loadKey(k)
+		if err != nil {
+			return errors.New("Could not load key " + k.ID + ": " + err.Error())
+		}
+
+		if _, ok := loaded.verifying[key.id]; ok {
+			return errors.New("Key " + k.ID + " is configured more than once")
+		}
+
+		loaded.verifying[key.id] = key
+		loaded.ordered = append(loaded.ordered, key)
+
+		if key.id == activeID {
+			if key.privateKey == nil {
+				return errors.New("Active key " + k.ID + " has no private key to sign with")
+			}
+			loaded.signing = key
+		}
+
+	}
+
+	if len(configured) > 0 && loaded.signing == nil {
+		return errors.New("No active signing key " + activeID + " among the configured keys")
+	}
+
+	keys.mu.Lock()
+	keys.signing, keys.verifying, keys.ordered = loaded.signing, loaded.verifying, loaded.ordered
+	keys.mu.Unlock()
+
+	return nil
+
+}
+
+//loadKey reads a key's PEM files and checks the keys are right for its algorithm
+func loadKey(k ghost.JWTKey) (*signingKey, error) {
+
+	if k.ID == "" {
+		return nil, errors.New("Keys must have an id")
+	}
+
+	key := &signingKey{id: k.ID, method: jwt.GetSigningMethod(k.Algorithm)}
+
+	switch k.Algorithm {
+	case "RS256", "ES256", "EdDSA":
+	default:
+		return nil, errors.New("Unsupported algorithm " + k.Algorithm + ", use RS256, ES256 or EdDSA")
+	}
+
+	if k.PrivateKeyFile != "" {
+		b, err := afero.ReadFile(ghost.App.FileSystem, k.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if key.privateKey, err = parsePrivateKey(b); err != nil {
+			return nil, err
+		}
+		key.publicKey = key.privateKey.Public()
+	}
+
+	if k.PublicKeyFile != "" {
+		b, err := afero.ReadFile(ghost.App.FileSystem, k.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if key.publicKey, err = parsePublicKey(b); err != nil {
+			return nil, err
+		}
+	}
+
+	if key.publicKey == nil {
+		return nil, errors.New("No private or public key file")
+	}
+
+	switch publicKey := key.publicKey.(type) {
+	case *rsa.PublicKey:
+		if k.Algorithm == "RS256" {
+			return key, nil
+		}
+	case *ecdsa.PublicKey:
+		if k.Algorithm == "ES256" && publicKey.Curve == elliptic.P256() {
+			return key, nil
+		}
+	case ed25519.PublicKey:
+		if k.Algorithm == "EdDSA" {
+			return key, nil
+		}
+	}
+
+	return nil, errors.New("Key type does not match algorithm " + k.Algorithm)
+
+}
+
+//parsePrivateKey parses a PKCS8, PKCS1 (RSA) or SEC1 (EC) private key
+func parsePrivateKey(b []byte) (crypto.Signer, error) {
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("Private key file is not PEM encoded")
+	}
+
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	return nil, errors.New("Could not parse private key")
+
+}
+
+//parsePublicKey parses a PKIX or PKCS1 (RSA) public key, or a certificate
+func parsePublicKey(b []byte) (crypto.PublicKey, error) {
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("Public key file is not PEM encoded")
+	}
+
+	if key, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+		return cert.PublicKey, nil
+	}
+
+	return nil, errors.New("Could not parse public key")
+
+}
+
+//sign signs the token with the active key, setting its id in the kid header,
+//or with the secret if there are no keys
+func (s *keySet) sign(claims jwt.MapClaims) (string, error) {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.signing == nil {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(viper.GetString("secret")))
+	}
+
+	token := jwt.NewWithClaims(s.signing.method, claims)
+	token.Header["kid"] = s.signing.id
+	return token.SignedString(s.signing.privateKey)
+
+}
+
+//verificationKey returns the key to verify a token with, as long as the token was signed
+//with the algorithm of that key.  Tokens without a kid are verified with the secret, if there is one,
+//but only while there are no keys, unless accepting the secret during the move to keys is configured
+func (s *keySet) verificationKey(token *jwt.Token) (interface{}, error) {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		if len(s.verifying) > 0 && !ghost.App.Config.JWTAcceptSecret {
+			return nil, errors.New("Tokens signed with the secret are no longer accepted")
+		}
+		secret := viper.GetString("secret")
+		if token.Method != jwt.SigningMethodHS256 || secret == "" {
+			return nil, errors.New("Unexpected signing method: " + token.Method.Alg())
+		}
+		return []byte(secret), nil
+	}
+
+	key, ok := s.verifying[kid]
+	if !ok {
+		return nil, errors.New("Unknown key " + kid)
+	}
+
+	if token.Method != key.method {
+		return nil, errors.New("Unexpected signing method: " + token.Method.Alg())
+	}
+
+	return key.publicKey, nil
+
+}
+
+//JWK is a public key in JSON Web Key format
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	//RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	//EC and OKP
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+	Y     string `json:"y,omitempty"`
+}
+
+//JWKS is a set of JSON Web Keys
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+//jwks returns the public keys, including those only used for verification.
+//The secret is never published
+func (s *keySet) jwks() JWKS {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	set := JWKS{Keys: []JWK{}}
+	encode := base64.RawURLEncoding.EncodeToString
+
+	for _, key := range s.ordered {
+
+		jwk := JWK{KeyID: key.id, Use: "sig", Algorithm: key.method.Alg()}
+
+		switch publicKey := key.publicKey.(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = encode(publicKey.N.Bytes())
+			jwk.E = encode(big.NewInt(int64(publicKey.E)).Bytes())
+		case *ecdsa.PublicKey:
+			jwk.KeyType = "EC"
+			jwk.Curve = publicKey.Curve.Params().Name
+			size := (publicKey.Curve.Params().BitSize + 7) / 8
+			jwk.X = encode(padded(publicKey.X.Bytes(), size))
+			jwk.Y = encode(padded(publicKey.Y.Bytes(), size))
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = encode(publicKey)
+		}
+
+		set.Keys = append(set.Keys, jwk)
+
+	}
+
+	return set
+
+}
+
+//padded left pads b with zeros to size bytes, as required for EC coordinates
+func padded(b []byte, size int) []byte {
+
+	if len(b) >= size {
+		return b
+	}
+
+	return append(make([]byte, size-len(b)), b...)
+
+}
+
+//getJWKS serves the public keys that tokens can be verified with
+func getJWKS(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", ghost.ContentTypeJSON)
+	json.NewEncoder(w).Encode(keys.jwks())
+
+}
@@ -0,0 +1,292 @@
+// Copyright 2017 Jonathan Pincas
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/jpincas/ghost/ghost"
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+)
+
+//writeKeyFiles writes a key pair to PEM files and returns its config
+func writeKeyFiles(t *testing.T, id, algorithm string, privateKey crypto.Signer, withPrivateKey bool) ghost.JWTKey {
+
+	key := ghost.JWTKey{ID: id, Algorithm: algorithm}
+
+	if withPrivateKey {
+		b, err := x509.MarshalPKCS8PrivateKey(privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key.PrivateKeyFile = "keys/" + id + ".key"
+		afero.WriteFile(ghost.App.FileSystem, key.PrivateKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b}), 0600)
+	}
+
+	b, err := x509.MarshalPKIXPublicKey(privateKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key.PublicKeyFile = "keys/" + id + ".pub"
+	afero.WriteFile(ghost.App.FileSystem, key.PublicKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: b}), 0644)
+
+	return key
+
+}
+
+//testKeys generates a key pair for each supported algorithm
+func testKeys() map[string]crypto.Signer {
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	return map[string]crypto.Signer{"RS256": rsaKey, "ES256": ecKey, "EdDSA": edKey}
+
+}
+
+func TestAsymmetricSigning(t *testing.T) {
+
+	ghost.App.FileSystem = afero.NewMemMapFs()
+	viper.Set("secret", "")
+	setTokenConfig()
+	defer LoadKeys(nil, "")
+	defer viper.Set("secret", "secret")
+
+	for algorithm, privateKey := range testKeys() {
+
+		key := writeKeyFiles(t, "key-"+algorithm, algorithm, privateKey, true)
+		if err := LoadKeys([]ghost.JWTKey{key}, key.ID); err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := GetUserToken("692e8a64-7676-4790-b3f8-a86a5083d5bb", "anon")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		token, err := parseToken(s, AccessToken)
+		if err != nil {
+			t.Fatalf("%s: %s", algorithm, err)
+		}
+
+		if token.Header["kid"] != key.ID || token.Method.Alg() != algorithm {
+			t.Errorf("%s: unexpected header %v", algorithm, token.Header)
+		}
+
+		//Without a secret, tokens signed with the secret aren't accepted
+		hmac, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, newClaims("692e8a64-7676-4790-b3f8-a86a5083d5bb", "admin", AccessToken, time.Minute)).SignedString([]byte(""))
+		if _, err := ParseToken(hmac, AccessToken); err == nil {
+			t.Errorf("%s: expected a token signed with an empty secret to be refused", algorithm)
+		}
+
+	}
+
+}
+
+func TestKeyRotation(t *testing.T) {
+
+	ghost.App.FileSystem = afero.NewMemMapFs()
+	setTokenConfig()
+	defer LoadKeys(nil, "")
+
+	generated := testKeys()
+	oldKey := writeKeyFiles(t, "2017-01", "RS256", generated["RS256"], true)
+	newKey := writeKeyFiles(t, "2017-02", "ES256", generated["ES256"], true)
+
+	LoadKeys([]ghost.JWTKey{oldKey}, oldKey.ID)
+	oldToken, _ := GetUserToken("692e8a64-7676-4790-b3f8-a86a5083d5bb", "anon")
+
+	//The old key is kept, only for verification, until its tokens expire
+	oldKey = writeKeyFiles(t, "2017-01", "RS256", generated["RS256"], false)
+	if err := LoadKeys([]ghost.JWTKey{newKey, oldKey}, newKey.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	newToken, _ := GetUserToken("692e8a64-7676-4790-b3f8-a86a5083d5bb", "anon")
+
+	if token, err := parseToken(newToken, AccessToken); err != nil || token.Header["kid"] != newKey.ID {
+		t.Errorf("Expected new tokens to be signed with the new key, got %v", err)
+	}
+
+	if _, err := ParseToken(oldToken, AccessToken); err != nil {
+		t.Errorf("Expected tokens signed with the old key to still be valid, got %s", err)
+	}
+
+	LoadKeys([]ghost.JWTKey{newKey}, newKey.ID)
+
+	if _, err := ParseToken(oldToken, AccessToken); err == nil {
+		t.Error("Expected tokens signed with a removed key to be refused")
+	}
+
+}
+
+func TestSecretRefusedWithKeys(t *testing.T) {
+
+	ghost.App.FileSystem = afero.NewMemMapFs()
+	viper.Set("secret", "secret")
+	setTokenConfig()
+	defer LoadKeys(nil, "")
+	defer func() { ghost.App.Config.JWTAcceptSecret = false }()
+
+	LoadKeys(nil, "")
+	secretToken, _ := GetUserToken("692e8a64-7676-4790-b3f8-a86a5083d5bb", "anon")
+
+	key := writeKeyFiles(t, "2017-01", "EdDSA", testKeys()["EdDSA"], true)
+	if err := LoadKeys([]ghost.JWTKey{key}, key.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ParseToken(secretToken, AccessToken); err == nil {
+		t.Error("Expected tokens signed with the secret to be refused once there are keys")
+	}
+
+	//Unless they are still accepted while moving to keys
+	ghost.App.Config.JWTAcceptSecret = true
+	if _, err := ParseToken(secretToken, AccessToken); err != nil {
+		t.Errorf("Expected tokens signed with the secret to be accepted, got %s", err)
+	}
+
+}
+
+func TestLoadKeysErrors(t *testing.T) {
+
+	ghost.App.FileSystem = afero.NewMemMapFs()
+	defer LoadKeys(nil, "")
+
+	generated := testKeys()
+	rsaKey := writeKeyFiles(t, "rsa", "RS256", generated["RS256"], true)
+	verifyOnly := writeKeyFiles(t, "verify", "EdDSA", generated["EdDSA"], false)
+
+	wrongAlgorithm := rsaKey
+	wrongAlgorithm.Algorithm = "ES256"
+
+	unsupported := rsaKey
+	unsupported.Algorithm = "HS256"
+
+	missingFile := rsaKey
+	missingFile.PrivateKeyFile = "keys/missing.key"
+
+	var tests = []struct {
+		name     string
+		keys     []ghost.JWTKey
+		activeID string
+	}{
+		{"wrong algorithm", []ghost.JWTKey{wrongAlgorithm}, "rsa"},
+		{"unsupported algorithm", []ghost.JWTKey{unsupported}, "rsa"},
+		{"missing file", []ghost.JWTKey{missingFile}, "rsa"},
+		{"no active key", []ghost.JWTKey{rsaKey}, "other"},
+		{"active key can't sign", []ghost.JWTKey{rsaKey, verifyOnly}, "verify"},
+		{"duplicate id", []ghost.JWTKey{rsaKey, rsaKey}, "rsa"},
+	}
+
+	for _, test := range tests {
+		if err := LoadKeys(test.keys, test.activeID); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+
+}
+
+//A token must use the algorithm of the key it names,
+//so the public key can't be used as an HMAC secret
+func TestAlgorithmConfusion(t *testing.T) {
+
+	ghost.App.FileSystem = afero.NewMemMapFs()
+	setTokenConfig()
+	defer LoadKeys(nil, "")
+
+	key := writeKeyFiles(t, "rsa", "RS256", testKeys()["RS256"], true)
+	LoadKeys([]ghost.JWTKey{key}, key.ID)
+
+	publicPEM, _ := afero.ReadFile(ghost.App.FileSystem, key.PublicKeyFile)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, newClaims("692e8a64-7676-4790-b3f8-a86a5083d5bb", "admin", AccessToken, time.Minute))
+	token.Header["kid"] = key.ID
+	forged, _ := token.SignedString(publicPEM)
+
+	if _, err := ParseToken(forged, AccessToken); err == nil {
+		t.Error("Expected a token signed with the public key as a secret to be refused")
+	}
+
+}
+
+func TestGetJWKS(t *testing.T) {
+
+	ghost.App.FileSystem = afero.NewMemMapFs()
+	setTokenConfig()
+	defer LoadKeys(nil, "")
+
+	generated := testKeys()
+	LoadKeys([]ghost.JWTKey{
+		writeKeyFiles(t, "rsa", "RS256", generated["RS256"], true),
+		writeKeyFiles(t, "ec", "ES256", generated["ES256"], false),
+		writeKeyFiles(t, "ed", "EdDSA", generated["EdDSA"], false),
+	}, "rsa")
+
+	req, _ := http.NewRequest("GET", JWKSPath, nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(getJWKS).ServeHTTP(rr, req)
+
+	var set JWKS
+	if err := json.Unmarshal(rr.Body.Bytes(), &set); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(set.Keys) != 3 {
+		t.Fatalf("Expected all 3 keys to be published, got %v", set.Keys)
+	}
+
+	//Another service can rebuild the RSA key and verify a token with it
+	decode := func(s string) *big.Int {
+		b, _ := base64.RawURLEncoding.DecodeString(s)
+		return new(big.Int).SetBytes(b)
+	}
+	jwk := set.Keys[0]
+	if jwk.KeyID != "rsa" || jwk.KeyType != "RSA" || jwk.Algorithm != "RS256" || jwk.Use != "sig" {
+		t.Errorf("Unexpected key %+v", jwk)
+	}
+	publicKey := &rsa.PublicKey{N: decode(jwk.N), E: int(decode(jwk.E).Int64())}
+
+	s, _ := GetUserToken("692e8a64-7676-4790-b3f8-a86a5083d5bb", "anon")
+	if _, err := jwt.Parse(s, func(*jwt.Token) (interface{}, error) { return publicKey, nil }); err != nil {
+		t.Errorf("Expected the published key to verify tokens, got %s", err)
+	}
+
+	ecKey := generated["ES256"].Public().(*ecdsa.PublicKey)
+	if jwk := set.Keys[1]; jwk.KeyType != "EC" || jwk.Curve != "P-256" || decode(jwk.X).Cmp(ecKey.X) != 0 || decode(jwk.Y).Cmp(ecKey.Y) != 0 {
+		t.Errorf("Unexpected key %+v", jwk)
+	}
+
+	if jwk := set.Keys[2]; jwk.KeyType != "OKP" || jwk.Curve != "Ed25519" || jwk.Algorithm != "EdDSA" {
+		t.Errorf("Unexpected key %+v", jwk)
+	}
+
+}
@@ -17,53 +17,164 @@ package auth
 import (
 	"context"
 	"database/sql"
-	"fmt"
+	"strings"
 
 	"net/http"
 
 	jwt "github.com/dgrijalva/jwt-go"
-	ghost "github.com/jpincas/ghost/tools"
+	"github.com/jpincas/ghost/ghost"
 	"github.com/pressly/chi/render"
 )
 
+//TokenCookieName is the cookie the access token is read from, if there is no Authorization header
+const TokenCookieName = "token"
+
+//Authenticator verifies the access token and then authorises the user with their role,
+//so it is all that is needed in front of routes that require a logged in user.
+//Requests with an API key are authorised with the key instead
+func Authenticator(next http.Handler) http.Handler {
+
+	withToken := Verifier(Authorizator(next))
+	withAPIKey := APIKeyAuthenticator(next)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if apiKeyFromRequest(r) != "" {
+			withAPIKey.ServeHTTP(w, r)
+			return
+		}
+
+		withToken.ServeHTTP(w, r)
+	})
+
+}
+
+//Verifier reads the access token from the Authorization header (Bearer) or the token cookie,
+//verifies its signature and claims, checks it hasn't been revoked, and puts the parsed token on the 'user' context value.
+//Requests without a valid access token are refused
+func Verifier(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		tokenString := tokenFromRequest(r)
+		if tokenString == "" {
+			render.Status(r, http.StatusUnauthorized)
+			render.JSON(w, r, ghost.ResponseError{http.StatusUnauthorized, "", "No access token provided", "", "", ""})
+			return
+		}
+
+		token, err := parseToken(tokenString, AccessToken)
+		if err != nil {
+			render.Status(r, http.StatusUnauthorized)
+			render.JSON(w, r, ghost.ResponseError{http.StatusUnauthorized, "", err.Error(), "", "", ""})
+			return
+		}
+
+		//Tokens revoked on logout are refused, even though they haven't expired
+		revoked, err := tokenRevoked(token.Claims.(jwt.MapClaims))
+		if err != nil {
+			render.Status(r, http.StatusServiceUnavailable)
+			render.JSON(w, r, ghost.ResponseError{http.StatusServiceUnavailable, "", "Could not check whether the access token has been revoked", "", "", ""})
+			return
+		} else if revoked {
+			render.Status(r, http.StatusUnauthorized)
+			render.JSON(w, r, ghost.ResponseError{http.StatusUnauthorized, "", "Access token has been revoked", "", "", ""})
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "user", token)))
+	})
+
+}
+
+//tokenFromRequest returns the bearer token in the Authorization header, or else the token cookie
+func tokenFromRequest(r *http.Request) string {
+
+	if header := r.Header.Get("Authorization"); len(header) > 7 && strings.EqualFold(header[:7], "bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+
+	if cookie, err := r.Cookie(TokenCookieName); err == nil {
+		return cookie.Value
+	}
+
+	return ""
+
+}
+
 //This is the first level of authorisation:
-//The JWT contains the userId.  We look this up in the users table in the database and if found
+//The JWT, verified by Verifier, contains the userId.  We look this up in the users table in the database and if found
 //attach the specified role.  If nothing is found, we default to anon
 //Beyond this, we do not know anything about database privelages - this is handled
-//further down the line
+//further down the line.
+//Users whose role requires two-factor authentication are refused unless the token has the mfa claim.
+//Whether the session is MFA verified is put on the 'mfa' context value
 func Authorizator(next http.Handler) http.Handler {
 
+	return authorize(next, true)
+
+}
+
+//totpAuthenticator is Authenticator without requiring two-factor authentication,
+//so that users can set it up and verify their session
+func totpAuthenticator(next http.Handler) http.Handler {
+
+	return Verifier(authorize(next, false))
+
+}
+
+func authorize(next http.Handler, requireMFA bool) http.Handler {
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 		ctx := r.Context()
-		//This is a bit hairy. The jwt middleware puts the whole parsed Token
+		//Verifier (or another jwt middleware) puts the whole parsed Token
 		//on the 'user' context value.  From there you have to reference 'Claims'
 		//and then cast that to jwt.MapClaims to be able to reference the individual claims
-		//Also: use the forked version of the go-jwt-middlware, not the auth0 version
-		claims := ctx.Value("user").(*jwt.Token).Claims.(jwt.MapClaims)
+		token, _ := ctx.Value("user").(*jwt.Token)
+		if token == nil {
+			render.Status(r, http.StatusUnauthorized)
+			render.JSON(w, r, ghost.ResponseError{http.StatusUnauthorized, "", "No verified token", "", "", ""})
+			return
+		}
+		claims, _ := token.Claims.(jwt.MapClaims)
 		userID := claims["userID"]
 
+		//Refresh tokens can only be exchanged for new tokens, not used to access the API
+		if claims["typ"] == RefreshToken {
+			render.Status(r, http.StatusUnauthorized)
+			render.JSON(w, r, ghost.ResponseError{http.StatusUnauthorized, "", "Refresh tokens can't be used for access", "", "", ""})
+			return
+		}
+
 		var role string
 		//Search the user table for the user's role
-		err := ghost.App.DB.QueryRow(fmt.Sprintf(ghost.SQLToGetUsersRole, userID)).Scan(&role)
+		err := ghost.App.DB.QueryRow(ghost.SQLToGetUsersRole, userID).Scan(&role)
 
 		//If an error comes back
 		if err != nil {
 			//If its an error due to the id not being found in the user table, then just set the role to anon
 			if err == sql.ErrNoRows {
-				ctx = context.WithValue(ctx, "role", "anon")
+				role = "anon"
 			} else {
 				//Else if there is any other error, don't authorise
 				render.Status(r, http.StatusUnauthorized)
 				render.JSON(w, r, ghost.ResponseError{http.StatusUnauthorized, "", err.Error(), "", "", ""})
 				return
 			}
-		} else {
-			//If a user has been found, return their role.  The database always defaults to anon, so there will always be a role
-			ctx = context.WithValue(ctx, "role", role)
+		}
+		//If a user has been found, return their role.  The database always defaults to anon, so there will always be a role
+		ctx = context.WithValue(ctx, "role", role)
+
+		mfa := claims["mfa"] == true
+		if requireMFA && !mfa && totpRequired(role) {
+			render.Status(r, http.StatusForbidden)
+			render.JSON(w, r, ghost.ResponseError{http.StatusForbidden, "", "Two-factor authentication is required", "", "", ""})
+			return
 		}
 
 		ctx = context.WithValue(ctx, "userID", userID)
+		ctx = context.WithValue(ctx, "mfa", mfa)
 
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
@@ -0,0 +1,112 @@
+// Copyright 2017 Jonathan Pincas
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jpincas/ghost/ghost"
+	"github.com/spf13/viper"
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestAuthenticator(t *testing.T) {
+
+	viper.Set("secret", "secret")
+	setTokenConfig()
+
+	tokens, _ := IssueTokens("692e8a64-7676-4790-b3f8-a86a5083d5bb", "anon")
+	expired, _ := signClaims(newClaims("692e8a64-7676-4790-b3f8-a86a5083d5bb", "anon", AccessToken, -time.Minute))
+
+	var tests = []struct {
+		name         string
+		header       string
+		cookie       string
+		revoked      bool
+		expectedCode int
+	}{
+		{"header", "Bearer " + tokens.Token, "", false, http.StatusOK},
+		{"lower case scheme", "bearer " + tokens.Token, "", false, http.StatusOK},
+		{"cookie", "", tokens.Token, false, http.StatusOK},
+		{"no token", "", "", false, http.StatusUnauthorized},
+		{"not bearer", "Basic " + tokens.Token, "", false, http.StatusUnauthorized},
+		{"expired", "Bearer " + expired, "", false, http.StatusUnauthorized},
+		{"refresh token", "Bearer " + tokens.RefreshToken, "", false, http.StatusUnauthorized},
+		{"garbage", "Bearer abc.def.ghi", "", false, http.StatusUnauthorized},
+		{"revoked", "Bearer " + tokens.Token, "", true, http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+
+		db, mock, _ := sqlmock.New()
+		ghost.App.DB = db
+		if test.expectedCode == http.StatusOK || test.revoked {
+			mock.ExpectQuery("SELECT EXISTS").WithArgs(sqlmock.AnyArg()).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(test.revoked))
+		}
+		if test.expectedCode == http.StatusOK {
+			mock.ExpectQuery("SELECT role from users").WithArgs("692e8a64-7676-4790-b3f8-a86a5083d5bb").WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("admin"))
+		}
+
+		var role, userID interface{}
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			role = r.Context().Value("role")
+			userID = r.Context().Value("userID")
+		})
+
+		req, _ := http.NewRequest("GET", "/", nil)
+		if test.header != "" {
+			req.Header.Set("Authorization", test.header)
+		}
+		if test.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: TokenCookieName, Value: test.cookie})
+		}
+
+		rr := httptest.NewRecorder()
+		Authenticator(next).ServeHTTP(rr, req)
+
+		if rr.Code != test.expectedCode {
+			t.Errorf("%s: expected %v, got %v: %s", test.name, test.expectedCode, rr.Code, rr.Body)
+		}
+
+		if test.expectedCode == http.StatusOK && (role != "admin" || userID != "692e8a64-7676-4790-b3f8-a86a5083d5bb") {
+			t.Errorf("%s: expected the user's role and id on the context, got %v, %v", test.name, role, userID)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+
+		db.Close()
+
+	}
+
+}
+
+//Authorizator on its own refuses requests that haven't been verified, rather than panicking
+func TestAuthorizatorWithoutToken(t *testing.T) {
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	rr := httptest.NewRecorder()
+
+	Authorizator(http.NotFoundHandler()).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401, got %v", rr.Code)
+	}
+
+}
@@ -0,0 +1,609 @@
+// Copyright 2017 Jonathan Pincas
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/jpincas/ghost/ghost"
+)
+
+//OIDCPath is the base route for logging in with OpenID Connect providers
+const OIDCPath = "/auth/oidc"
+
+//OIDCStateToken is the type of the token in the cookie that keeps the state of a login
+//between the redirect to the provider and the callback
+const OIDCStateToken = "oidcstate"
+
+//oidcCookieName is the cookie the login state is kept in.  It is only sent to the callback
+const oidcCookieName = "ghost_oidc"
+
+//oidcLoginExpiry is how long the user has to log in with the provider
+const oidcLoginExpiry = 10 * time.Minute
+
+//oidcClient is used for all requests to providers
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+//ErrOIDCLogin is returned when a login with a provider fails validation
+var ErrOIDCLogin = errors.New("Could not log in with the identity provider")
+
+//oidcDiscovery is the part of the provider's discovery document that is used
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+//oidcProvider is a configured provider, with its discovery document and keys once fetched
+type oidcProvider struct {
+	ghost.OIDCProvider
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+}
+
+var oidcProviders = struct {
+	sync.Mutex
+	m map[string]*oidcProvider
+}{m: map[string]*oidcProvider{}}
+
+//getOIDCProvider returns the configured provider with the name
+func getOIDCProvider(name string) (*oidcProvider, error) {
+
+	oidcProviders.Lock()
+	defer oidcProviders.Unlock()
+
+	if p, ok := oidcProviders.m[name]; ok {
+		return p, nil
+	}
+
+	for _, configured := range ghost.App.Config.OIDCProviders {
+		if configured.Name == name {
+			p := &oidcProvider{OIDCProvider: configured}
+			oidcProviders.m[name] = p
+			return p, nil
+		}
+	}
+
+	return nil, errors.New("No identity provider called " + name)
+
+}
+
+//redirectURL is where the provider sends the user back to
+func (p *oidcProvider) redirectURL() string {
+
+	if p.RedirectURL != "" {
+		return p.RedirectURL
+	}
+
+	return ghost.App.Config.BaseURL() + OIDCPath + "/callback"
+
+}
+
+//getDiscovery fetches the provider's discovery document the first time it is needed
+func (p *oidcProvider) getDiscovery() (*oidcDiscovery, error) {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var d oidcDiscovery
+	if err := getJSON(strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, err
+	}
+
+	//The document must be for the configured issuer, or tokens from it will never validate
+	if d.Issuer != p.Issuer {
+		return nil, errors.New("Discovery document is for issuer " + d.Issuer + ", not " + p.Issuer)
+	}
+
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("Discovery document is missing endpoints")
+	}
+
+	p.discovery = &d
+	return p.discovery, nil
+
+}
+
+//key returns the provider's public key with the id.  The keys are fetched again if the id is unknown,
+//as the provider may have rotated them, but no more than once a minute
+func (p *oidcProvider) key(kid string) (crypto.PublicKey, error) {
+
+	d, err := p.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	if time.Since(p.keysFetched) < time.Minute {
+		return nil, errors.New("Unknown key " + kid)
+	}
+
+	var set JWKS
+	if err := getJSON(d.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+
+	p.keys = map[string]crypto.PublicKey{}
+	p.keysFetched = time.Now()
+	for _, jwk := range set.Keys {
+		//Keys which can't be used are skipped, rather than failing all logins
+		if key, err := jwk.publicKey(); err == nil && (jwk.Use == "" || jwk.Use == "sig") {
+			p.keys[jwk.KeyID] = key
+		}
+	}
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	return nil, errors.New("Unknown key " + kid)
+
+}
+
+//publicKey decodes an RSA, P-256 or Ed25519 JSON Web Key
+func (k JWK) publicKey() (crypto.PublicKey, error) {
+
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		return new(big.Int).SetBytes(b), err
+	}
+
+	switch {
+	case k.KeyType == "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case k.KeyType == "EC" && k.Curve == "P-256":
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("Key is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	case k.KeyType == "OKP" && k.Curve == "Ed25519":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("Invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, errors.New("Unsupported key type " + k.KeyType)
+
+}
+
+//getJSON fetches and decodes a JSON document
+func getJSON(url string, v interface{}) error {
+
+	resp, err := oidcClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Fetching %s returned %s", url, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+
+}
+
+//randomURLString is a random string of n bytes, base64url encoded
+func randomURLString(n int) (string, error) {
+
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+
+}
+
+//oidcLogin redirects the user to log in with the provider named in the provider parameter,
+//using the authorization code flow with PKCE.  The state, nonce and code verifier are kept in a signed cookie
+func oidcLogin(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", ghost.ContentTypeJSON)
+
+	p, err := getOIDCProvider(r.URL.Query().Get("provider"))
+	if err != nil {
+
+		w.WriteHeader(http.StatusNotFound)
+		b, _ := json.Marshal(ghost.ResponseError{http.StatusNotFound, "", err.Error(), "", "", ""})
+		w.Write([]byte(b))
+		return
+
+	}
+
+	authorizationURL, cookie, err := p.startLogin()
+	if err != nil {
+
+		w.WriteHeader(http.StatusBadGateway)
+		b, _ := json.Marshal(ghost.ResponseError{http.StatusBadGateway, "", err.Error(), "", "", ""})
+		w.Write([]byte(b))
+		return
+
+	}
+
+	http.SetCookie(w, cookie)
+	http.Redirect(w, r, authorizationURL, http.StatusFound)
+
+}
+
+//startLogin returns the provider's authorization URL and the cookie holding the state of the login
+func (p *oidcProvider) startLogin() (string, *http.Cookie, error) {
+
+	d, err := p.getDiscovery()
+	if err != nil {
+		return "", nil, err
+	}
+
+	var state, nonce, verifier string
+	for _, s := range []*string{&state, &nonce, &verifier} {
+		if *s, err = randomURLString(32); err != nil {
+			return "", nil, err
+		}
+	}
+
+	claims := newClaims("", "", OIDCStateToken, oidcLoginExpiry)
+	claims["provider"], claims["state"], claims["nonce"], claims["verifier"] = p.Name, state, nonce, verifier
+	signed, err := signClaims(claims)
+	if err != nil {
+		return "", nil, err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	scopes := append([]string{"openid", "email"}, p.Scopes...)
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.redirectURL()},
+		"scope":                 {strings.Join(scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	separator := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+
+	return d.AuthorizationEndpoint + separator + query.Encode(), oidcCookie(signed, int(oidcLoginExpiry.Seconds())), nil
+
+}
+
+//oidcCookie is the cookie holding the state of a login.  A negative maxAge removes it
+func oidcCookie(value string, maxAge int) *http.Cookie {
+
+	return &http.Cookie{
+		Name:     oidcCookieName,
+		Value:    value,
+		Path:     OIDCPath,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   ghost.App.Config.Protocol == "https",
+		//The callback is a top level navigation from the provider, so Lax still sends the cookie
+		SameSite: http.SameSiteLaxMode,
+	}
+
+}
+
+//oidcCallback completes a login when the provider redirects the user back.
+//The code is exchanged for an ID token, which is validated, and the user is logged in
+//as the ghost user linked to the identity, or with the same verified email
+func oidcCallback(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", ghost.ContentTypeJSON)
+
+	//The login is over whatever happens
+	http.SetCookie(w, oidcCookie("", -1))
+
+	userID, err := completeOIDCLogin(r)
+	if err != nil {
+
+		//Details of failed validation are only logged, in debug mode
+		code := http.StatusBadGateway
+		if err == ErrOIDCLogin || err == errNoLinkedUser {
+			code = http.StatusUnauthorized
+		}
+
+		w.WriteHeader(code)
+		b, _ := json.Marshal(ghost.ResponseError{code, "", err.Error(), "", "", ""})
+		w.Write([]byte(b))
+		return
+
+	}
+
+	if redirect := ghost.App.Config.OIDCRedirect; redirect != "" {
+		redirectWithTokens(w, r, redirect, userID)
+		return
+	}
+
+	respondWithTokens(w, userID, false)
+
+}
+
+//completeOIDCLogin checks the callback against the login state, exchanges the code and links the user
+func completeOIDCLogin(r *http.Request) (string, error) {
+
+	cookie, err := r.Cookie(oidcCookieName)
+	if err != nil {
+		return "", ErrOIDCLogin
+	}
+
+	login, err := ParseToken(cookie.Value, OIDCStateToken)
+	if err != nil {
+		return "", ErrOIDCLogin
+	}
+
+	query := r.URL.Query()
+	state, _ := login["state"].(string)
+	if query.Get("error") != "" || query.Get("code") == "" || subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state)) != 1 {
+		return "", ErrOIDCLogin
+	}
+
+	providerName, _ := login["provider"].(string)
+	p, err := getOIDCProvider(providerName)
+	if err != nil {
+		return "", err
+	}
+
+	verifier, _ := login["verifier"].(string)
+	idToken, err := p.exchangeCode(query.Get("code"), verifier)
+	if err != nil {
+		return "", err
+	}
+
+	nonce, _ := login["nonce"].(string)
+	identity, err := p.validateIDToken(idToken, nonce)
+	if err != nil {
+		ghost.LogDebug("AUTH", false, "OIDC ID token is invalid", err)
+		return "", ErrOIDCLogin
+	}
+
+	return linkIdentity(p, identity)
+
+}
+
+//exchangeCode exchanges an authorization code for an ID token at the provider's token endpoint
+func (p *oidcProvider) exchangeCode(code, verifier string) (string, error) {
+
+	d, err := p.getDiscovery()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectURL()},
+		"client_id":     {p.ClientID},
+		"code_verifier": {verifier},
+	}
+
+	req, err := http.NewRequest("POST", d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	//Confidential clients authenticate with their secret, public clients rely on PKCE alone
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+
+	if resp.StatusCode != http.StatusOK || body.IDToken == "" {
+		return "", errors.New("Identity provider refused the code: " + body.Error + " " + body.ErrorDescription)
+	}
+
+	return body.IDToken, nil
+
+}
+
+//oidcIdentity is the identity of the user from a validated ID token
+type oidcIdentity struct {
+	Subject string
+	Email   string
+}
+
+//validateIDToken checks the ID token is signed by the provider, for this client and login,
+//and has a verified email
+func (p *oidcProvider) validateIDToken(idToken, nonce string) (oidcIdentity, error) {
+
+	token, err := jwt.Parse(idToken, func(token *jwt.Token) (interface{}, error) {
+
+		kid, _ := token.Header["kid"].(string)
+		key, err := p.key(kid)
+		if err != nil {
+			return nil, err
+		}
+
+		//The algorithm must match the key, which rules out none and HMAC
+		switch key.(type) {
+		case *rsa.PublicKey:
+			if token.Method == jwt.SigningMethodRS256 {
+				return key, nil
+			}
+		case *ecdsa.PublicKey:
+			if token.Method == jwt.SigningMethodES256 {
+				return key, nil
+			}
+		case ed25519.PublicKey:
+			if token.Method == SigningMethodEdDSA {
+				return key, nil
+			}
+		}
+
+		return nil, errors.New("Unexpected signing method: " + token.Method.Alg())
+
+	})
+	if err != nil {
+		return oidcIdentity{}, err
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+
+	if iss, _ := claims["iss"].(string); iss != p.Issuer {
+		return oidcIdentity{}, errors.New("ID token is from issuer " + iss)
+	}
+
+	if !audienceContains(claims["aud"], p.ClientID) {
+		return oidcIdentity{}, errors.New("ID token is not for this client")
+	}
+
+	//With several audiences, the token must have been issued to this client
+	if azp, ok := claims["azp"].(string); ok && azp != p.ClientID {
+		return oidcIdentity{}, errors.New("ID token was issued to another client")
+	}
+
+	if _, ok := claims["exp"]; !ok {
+		return oidcIdentity{}, errors.New("ID token has no expiry")
+	}
+
+	if tokenNonce, _ := claims["nonce"].(string); nonce == "" || subtle.ConstantTimeCompare([]byte(tokenNonce), []byte(nonce)) != 1 {
+		return oidcIdentity{}, errors.New("ID token is not for this login")
+	}
+
+	identity := oidcIdentity{}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Email, _ = claims["email"].(string)
+	identity.Email = NormaliseEmail(identity.Email)
+	if identity.Subject == "" {
+		return oidcIdentity{}, errors.New("ID token has no subject")
+	}
+
+	//Some providers send email_verified as a string
+	if verified := claims["email_verified"]; identity.Email == "" || (verified != true && verified != "true") {
+		return oidcIdentity{}, errors.New("ID token has no verified email")
+	}
+
+	return identity, nil
+
+}
+
+//audienceContains checks the aud claim, which may be a string or an array
+func audienceContains(aud interface{}, clientID string) bool {
+
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+
+	return false
+
+}
+
+//errNoLinkedUser is returned when there is no user for an identity and the provider doesn't create them
+var errNoLinkedUser = errors.New("There is no user with this email address")
+
+//linkIdentity returns the user linked to the identity.  The first time an identity is used, it is linked to the user
+//with the same email, who is created if the provider is configured to create users
+func linkIdentity(p *oidcProvider, identity oidcIdentity) (string, error) {
+
+	var id string
+	err := ghost.App.DB.QueryRow(ghost.SQLToFindUserByIdentity, p.Issuer, identity.Subject).Scan(&id)
+	if err == nil {
+		return id, nil
+	} else if err != sql.ErrNoRows {
+		return "", err
+	}
+
+	err = ghost.App.DB.QueryRow(ghost.SQLToFindUserByEmail, identity.Email).Scan(&id)
+	if err == sql.ErrNoRows && p.CreateUsers {
+		err = ghost.App.DB.QueryRow(ghost.SQLToCreateUserWithEmail, identity.Email).Scan(&id)
+	} else if err == sql.ErrNoRows {
+		return "", errNoLinkedUser
+	} else if err == nil {
+		err = dropUnverifiedPassword(id)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := ghost.App.DB.Exec(ghost.SQLToLinkIdentity, p.Issuer, identity.Subject, id); err != nil {
+		return "", err
+	}
+
+	return id, nil
+
+}
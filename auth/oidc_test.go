@@ -0,0 +1,345 @@
+// Copyright 2017 Jonathan Pincas
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/jpincas/ghost/ghost"
+	"github.com/spf13/viper"
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+const oidcTestUser = "5d6c3a2e-8f43-4c1e-9d7a-2b1f0e9c8a71"
+
+//fakeIdP is a stand in identity provider, which issues an ID token for the code "thecode"
+//as long as the PKCE verifier matches the challenge of the last login
+type fakeIdP struct {
+	server    *httptest.Server
+	key       *rsa.PrivateKey
+	challenge string
+	nonce     string
+	//idToken makes the ID token from the default claims, so tests can tamper with it
+	idToken func(claims jwt.MapClaims) string
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := &fakeIdP{key: key}
+	idp.idToken = idp.sign
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                idp.server.URL,
+			AuthorizationEndpoint: idp.server.URL + "/authorize",
+			TokenEndpoint:         idp.server.URL + "/token",
+			JWKSURI:               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(JWKS{Keys: []JWK{{
+			KeyType: "RSA",
+			KeyID:   "idp",
+			Use:     "sig",
+			N:       base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:       base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		clientID, secret, _ := r.BasicAuth()
+		if r.PostForm.Get("code") != "thecode" ||
+			base64.RawURLEncoding.EncodeToString(challenge[:]) != idp.challenge ||
+			clientID != "ghost" || secret != "s3cret" ||
+			r.PostForm.Get("redirect_uri") != "http://localhost:3000/auth/oidc/callback" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idp.idToken(idp.claims())})
+	})
+	idp.server = httptest.NewServer(mux)
+
+	return idp
+
+}
+
+//claims are the claims of a valid ID token for the last login
+func (idp *fakeIdP) claims() jwt.MapClaims {
+
+	return jwt.MapClaims{
+		"iss":            idp.server.URL,
+		"aud":            "ghost",
+		"sub":            "idp-user-1",
+		"email":          "me@me.com",
+		"email_verified": true,
+		"nonce":          idp.nonce,
+		"iat":            time.Now().Unix(),
+		"exp":            time.Now().Add(time.Minute).Unix(),
+	}
+
+}
+
+func (idp *fakeIdP) sign(claims jwt.MapClaims) string {
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "idp"
+	signed, _ := token.SignedString(idp.key)
+	return signed
+
+}
+
+//setOIDCConfig configures the fake provider, and forgets providers from previous tests
+func setOIDCConfig(idp *fakeIdP, createUsers bool) {
+
+	viper.Set("secret", "secret")
+	setTokenConfig()
+	ghost.App.Config.Protocol, ghost.App.Config.Host, ghost.App.Config.ApiPort = "http", "localhost", "3000"
+	ghost.App.Config.OIDCRedirect = ""
+	ghost.App.Config.OIDCProviders = []ghost.OIDCProvider{{
+		Name:         "test",
+		Issuer:       idp.server.URL,
+		ClientID:     "ghost",
+		ClientSecret: "s3cret",
+		CreateUsers:  createUsers,
+	}}
+	oidcProviders.m = map[string]*oidcProvider{}
+
+}
+
+//startOIDCLogin starts a login with the fake provider, as the browser would,
+//and returns the login cookie and the state the provider would send back
+func startOIDCLogin(t *testing.T, idp *fakeIdP) (*http.Cookie, string) {
+
+	req, _ := http.NewRequest("GET", "/auth/oidc/login?provider=test", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(oidcLogin).ServeHTTP(rr, req)
+	if rr.Code != http.StatusFound {
+		t.Fatalf("Expected a redirect to the provider, got %v: %s", rr.Code, rr.Body)
+	}
+
+	location, _ := url.Parse(rr.Header().Get("Location"))
+	query := location.Query()
+	if location.Path != "/authorize" || query.Get("client_id") != "ghost" || query.Get("code_challenge_method") != "S256" || query.Get("scope") != "openid email" {
+		t.Errorf("Unexpected authorization URL %s", location)
+	}
+
+	idp.challenge, idp.nonce = query.Get("code_challenge"), query.Get("nonce")
+
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oidcCookieName || !cookies[0].HttpOnly {
+		t.Fatalf("Expected an HttpOnly login cookie, got %v", cookies)
+	}
+
+	return cookies[0], query.Get("state")
+
+}
+
+//finishOIDCLogin calls back with the code and state, as the provider would
+func finishOIDCLogin(cookie *http.Cookie, state string) *httptest.ResponseRecorder {
+
+	req, _ := http.NewRequest("GET", "/auth/oidc/callback?"+url.Values{"code": {"thecode"}, "state": {state}}.Encode(), nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(oidcCallback).ServeHTTP(rr, req)
+	return rr
+
+}
+
+func TestOIDCLogin(t *testing.T) {
+
+	idp := newFakeIdP(t)
+	defer idp.server.Close()
+	setOIDCConfig(idp, false)
+
+	db, mock, _ := sqlmock.New()
+	ghost.App.DB = db
+	defer db.Close()
+
+	//First login links the identity to the user with the email
+	mock.ExpectQuery("SELECT user_id FROM user_identities").WithArgs(idp.server.URL, "idp-user-1").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("SELECT id from users").WithArgs("me@me.com").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(oidcTestUser))
+	mock.ExpectExec("UPDATE users SET password = NULL").WithArgs(oidcTestUser).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO user_identities").WithArgs(idp.server.URL, "idp-user-1", oidcTestUser).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT role from users").WithArgs(oidcTestUser).WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("admin"))
+
+	rr := finishOIDCLogin(startOIDCLogin(t, idp))
+	var tokens Tokens
+	json.Unmarshal(rr.Body.Bytes(), &tokens)
+	if claims, err := ParseToken(tokens.Token, AccessToken); err != nil || claims["userID"] != oidcTestUser || claims["role"] != "admin" {
+		t.Errorf("Expected to log in as the user, got %v: %s", rr.Code, rr.Body)
+	}
+
+	if cookies := rr.Result().Cookies(); len(cookies) != 1 || cookies[0].MaxAge >= 0 {
+		t.Errorf("Expected the login cookie to be removed, got %v", cookies)
+	}
+
+	//After that, the identity is enough
+	mock.ExpectQuery("SELECT user_id FROM user_identities").WithArgs(idp.server.URL, "idp-user-1").WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(oidcTestUser))
+	mock.ExpectQuery("SELECT role from users").WithArgs(oidcTestUser).WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("admin"))
+
+	ghost.App.Config.OIDCRedirect = "https://app.example.com/login"
+	rr = finishOIDCLogin(startOIDCLogin(t, idp))
+	location, _ := url.Parse(rr.Header().Get("Location"))
+	fragment, _ := url.ParseQuery(location.Fragment)
+	if _, err := ParseToken(fragment.Get("token"), AccessToken); rr.Code != http.StatusSeeOther || location.Host != "app.example.com" || err != nil {
+		t.Errorf("Expected to be redirected to the frontend with tokens, got %v: %s", rr.Code, location)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+}
+
+func TestOIDCLoginCreateUsers(t *testing.T) {
+
+	idp := newFakeIdP(t)
+	defer idp.server.Close()
+
+	db, mock, _ := sqlmock.New()
+	ghost.App.DB = db
+	defer db.Close()
+
+	//Unknown users are refused unless the provider creates them
+	setOIDCConfig(idp, false)
+	mock.ExpectQuery("SELECT user_id FROM user_identities").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("SELECT id from users").WithArgs("me@me.com").WillReturnError(sql.ErrNoRows)
+	if rr := finishOIDCLogin(startOIDCLogin(t, idp)); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected an unknown user to be refused, got %v: %s", rr.Code, rr.Body)
+	}
+
+	setOIDCConfig(idp, true)
+	mock.ExpectQuery("SELECT user_id FROM user_identities").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("SELECT id from users").WithArgs("me@me.com").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("INSERT INTO users").WithArgs("me@me.com").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(oidcTestUser))
+	mock.ExpectExec("INSERT INTO user_identities").WithArgs(idp.server.URL, "idp-user-1", oidcTestUser).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT role from users").WithArgs(oidcTestUser).WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("user"))
+	if rr := finishOIDCLogin(startOIDCLogin(t, idp)); rr.Code != http.StatusOK {
+		t.Errorf("Expected the user to be created, got %v: %s", rr.Code, rr.Body)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+}
+
+func TestOIDCLoginRefused(t *testing.T) {
+
+	idp := newFakeIdP(t)
+	defer idp.server.Close()
+
+	db, mock, _ := sqlmock.New()
+	ghost.App.DB = db
+	defer db.Close()
+
+	tamper := func(change func(claims jwt.MapClaims)) func(jwt.MapClaims) string {
+		return func(claims jwt.MapClaims) string {
+			change(claims)
+			return idp.sign(claims)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		idToken func(claims jwt.MapClaims) string
+	}{
+		{"wrong nonce", tamper(func(c jwt.MapClaims) { c["nonce"] = "replayed" })},
+		{"unverified email", tamper(func(c jwt.MapClaims) { c["email_verified"] = false })},
+		{"no email", tamper(func(c jwt.MapClaims) { delete(c, "email") })},
+		{"wrong audience", tamper(func(c jwt.MapClaims) { c["aud"] = "someone else" })},
+		{"other authorized party", tamper(func(c jwt.MapClaims) { c["aud"], c["azp"] = []string{"ghost", "other"}, "other" })},
+		{"wrong issuer", tamper(func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" })},
+		{"no expiry", tamper(func(c jwt.MapClaims) { delete(c, "exp") })},
+		{"expired", tamper(func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() })},
+		{"no subject", tamper(func(c jwt.MapClaims) { delete(c, "sub") })},
+		{"HS256 with the public key", func(c jwt.MapClaims) string {
+			token := jwt.NewWithClaims(jwt.SigningMethodHS256, c)
+			token.Header["kid"] = "idp"
+			signed, _ := token.SignedString(idp.key.N.Bytes())
+			return signed
+		}},
+		{"unsigned", func(c jwt.MapClaims) string {
+			token := jwt.NewWithClaims(jwt.SigningMethodNone, c)
+			token.Header["kid"] = "idp"
+			signed, _ := token.SignedString(jwt.UnsafeAllowNoneSignatureType)
+			return signed
+		}},
+	}
+
+	for _, test := range tests {
+
+		setOIDCConfig(idp, true)
+		idp.idToken = test.idToken
+		if rr := finishOIDCLogin(startOIDCLogin(t, idp)); rr.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected the login to be refused, got %v: %s", test.name, rr.Code, rr.Body)
+		}
+
+	}
+	idp.idToken = idp.sign
+
+	//The callback must be for the login in the cookie
+	cookie, _ := startOIDCLogin(t, idp)
+	if rr := finishOIDCLogin(cookie, "forged"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the wrong state to be refused, got %v: %s", rr.Code, rr.Body)
+	}
+
+	_, state := startOIDCLogin(t, idp)
+	if rr := finishOIDCLogin(nil, state); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a callback without the cookie to be refused, got %v: %s", rr.Code, rr.Body)
+	}
+
+	//Without the verifier, the provider won't exchange the code
+	cookie, state = startOIDCLogin(t, idp)
+	idp.challenge = "someone else's"
+	if rr := finishOIDCLogin(cookie, state); rr.Code != http.StatusBadGateway {
+		t.Errorf("Expected the code exchange to fail, got %v: %s", rr.Code, rr.Body)
+	}
+
+	//None of these should get as far as the database
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	req, _ := http.NewRequest("GET", "/auth/oidc/login?provider=nobody", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(oidcLogin).ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown provider to be not found, got %v: %s", rr.Code, rr.Body)
+	}
+
+}
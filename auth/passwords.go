@@ -0,0 +1,354 @@
+// Copyright 2017 Jonathan Pincas
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jpincas/ghost/ghost"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+//PasswordResetToken is the type of the token in password reset links
+const PasswordResetToken = "passwordreset"
+
+//PasswordConfirmToken is the type of the token in the links that confirm a registered email address
+const PasswordConfirmToken = "passwordconfirm"
+
+//ErrPasswordTooShort is returned when a new password is shorter than the configured minimum
+var ErrPasswordTooShort = errors.New("Password is too short")
+
+//ErrWrongPassword is returned when a password doesn't match the user's
+var ErrWrongPassword = errors.New("Wrong email or password")
+
+//ErrInvalidResetLink is returned when a password reset token is invalid, expired or already used
+var ErrInvalidResetLink = errors.New("Password reset link is invalid or has already been used")
+
+//ErrPasswordNotVerified is returned when logging in with a password that was registered
+//but the email address it was registered with hasn't been confirmed yet
+var ErrPasswordNotVerified = errors.New("Please confirm your email address with the link sent to it before logging in with a password")
+
+//ErrInvalidConfirmLink is returned when a confirmation token is invalid, expired or already used
+var ErrInvalidConfirmLink = errors.New("Confirmation link is invalid or has already been used")
+
+//argon2id parameters for new hashes
+const (
+	argon2Time    = 1
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+//dummyHash is checked against when there is no user, so that logging in takes as long
+//whether or not the email is registered
+var dummyHash, _ = hashArgon2id("not a real password")
+
+//HashPassword hashes a password with the configured algorithm, argon2id or bcrypt
+func HashPassword(password string) (string, error) {
+
+	if len(password) < ghost.App.Config.PasswordMinLength {
+		return "", ErrPasswordTooShort
+	}
+
+	if ghost.App.Config.PasswordHash == "bcrypt" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		return string(hash), err
+	}
+
+	return hashArgon2id(password)
+
+}
+
+//hashArgon2id hashes a password with argon2id and encodes it in the PHC string format
+func hashArgon2id(password string) (string, error) {
+
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+
+}
+
+//CheckPassword checks a password against an argon2id or bcrypt hash,
+//so hashes keep working when the configured algorithm changes
+func CheckPassword(password, hash string) (bool, error) {
+
+	if strings.HasPrefix(hash, "$2") {
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false, errors.New("Unrecognised password hash")
+	}
+
+	var (
+		version, memory, iterations uint32
+		threads                     uint8
+	)
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, errors.New("Unsupported argon2 version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return false, err
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, err
+	}
+
+	other := argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+
+}
+
+//PasswordLogin returns the id of the user with the email, if the password is theirs
+func PasswordLogin(email, password string) (string, error) {
+
+	var (
+		id       string
+		hash     sql.NullString
+		verified bool
+	)
+	err := ghost.App.DB.QueryRow(ghost.SQLToGetUsersPassword, email).Scan(&id, &hash, &verified)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+
+	//Users who have never set a password can't log in with one
+	if err == sql.ErrNoRows || !hash.Valid {
+		CheckPassword(password, dummyHash)
+		return "", ErrWrongPassword
+	}
+
+	ok, err := CheckPassword(password, hash.String)
+	if err != nil {
+		return "", err
+	} else if !ok {
+		return "", ErrWrongPassword
+	}
+
+	//Anyone can register any email, so the password only works once the owner of the email has confirmed it
+	if !verified {
+		return "", ErrPasswordNotVerified
+	}
+
+	return id, nil
+
+}
+
+//RegisterUser creates a user with the email and an unverified password, and returns their id.
+//The user is emailed a link to confirm the address, and can't log in with the password until it is used
+func RegisterUser(email, password string) (string, error) {
+
+	//If system email is not configured, the address can't be confirmed, so exit straight away
+	if !ghost.App.MailServer.Working {
+		return "", errors.New("System email is not configured, so could not send confirmation link")
+	}
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		return "", err
+	}
+
+	var id string
+	if err := ghost.App.DB.QueryRow(ghost.SQLToRegisterUser, email, hash).Scan(&id); err != nil {
+		return "", err
+	}
+
+	expiry := time.Duration(ghost.App.Config.MagicCodeExpiry) * time.Second
+	token, err := signClaims(newClaims(id, "", PasswordConfirmToken, expiry))
+	if err != nil {
+		return "", err
+	}
+
+	return id, ghost.App.MailServer.SendEmail(
+		[]string{email},
+		"Confirm your email address for "+ghost.App.MailServer.FromName,
+		map[string]string{"link": passwordLink(confirmURL(), token)},
+		templates,
+		"defaultpasswordconfirmemail.html")
+
+}
+
+//ConfirmPassword verifies the password registered by the user the confirmation token was sent to
+func ConfirmPassword(tokenString string) error {
+
+	claims, err := ParseToken(tokenString, PasswordConfirmToken)
+	if err != nil {
+		return ErrInvalidConfirmLink
+	}
+
+	revoked, err := RevokeToken(claims)
+	if err != nil {
+		return err
+	} else if !revoked {
+		return ErrInvalidConfirmLink
+	}
+
+	userID, _ := claims["userID"].(string)
+	_, err = ghost.App.DB.Exec(ghost.SQLToVerifyUsersPassword, userID)
+	return err
+
+}
+
+//dropUnverifiedPassword removes a password that was registered but never confirmed, when the owner of the email
+//logs in another way, so whoever registered it can't log in to their account with it
+func dropUnverifiedPassword(userID string) error {
+
+	_, err := ghost.App.DB.Exec(ghost.SQLToDropUnverifiedPassword, userID)
+	return err
+
+}
+
+//passwordLink is a link with the token to the page at the URL
+func passwordLink(pageURL, token string) string {
+
+	return pageURL + "?" + url.Values{"token": {token}}.Encode()
+
+}
+
+//confirmURL is the frontend page confirmation links go to, which posts the token to /auth/password/confirm.
+//Without one, they go straight to the route
+func confirmURL() string {
+
+	if configured := ghost.App.Config.PasswordConfirmURL; configured != "" {
+		return configured
+	}
+
+	return ghost.App.Config.BaseURL() + "/auth/password/confirm"
+
+}
+
+//ChangePassword sets a user's password.  If they already have one, the current password must be given
+func ChangePassword(userID, currentPassword, password string) error {
+
+	var hash sql.NullString
+	if err := ghost.App.DB.QueryRow(ghost.SQLToGetUsersPasswordByID, userID).Scan(&hash); err != nil {
+		return err
+	}
+
+	if hash.Valid {
+		ok, err := CheckPassword(currentPassword, hash.String)
+		if err != nil {
+			return err
+		} else if !ok {
+			return ErrWrongPassword
+		}
+	}
+
+	return setPassword(userID, password)
+
+}
+
+//setPassword hashes and stores a new password for a user
+func setPassword(userID, password string) error {
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	_, err = ghost.App.DB.Exec(ghost.SQLToSetUsersPassword, userID, hash)
+	return err
+
+}
+
+//RequestPasswordReset emails the user a link to reset their password.
+//The link contains a signed token, which expires along with magic codes and can only be used once
+func RequestPasswordReset(email string) error {
+
+	//If system email is not configured, this can't be done, so exit straight away
+	if !ghost.App.MailServer.Working {
+		return errors.New("System email is not configured, so could not send password reset")
+	}
+
+	//The new password is chosen on the frontend's reset page, so without one there is nowhere to link to
+	if ghost.App.Config.PasswordResetURL == "" {
+		return errors.New("Password reset URL is not configured, so could not send password reset")
+	}
+
+	var id string
+	if err := ghost.App.DB.QueryRow(ghost.SQLToFindUserByEmail, email).Scan(&id); err != nil {
+		return errors.New("Email address not in user database")
+	}
+
+	expiry := time.Duration(ghost.App.Config.MagicCodeExpiry) * time.Second
+	token, err := signClaims(newClaims(id, "", PasswordResetToken, expiry))
+	if err != nil {
+		return err
+	}
+
+	//The link goes to the frontend's reset page, which posts the token and new password to /auth/password/reset
+	return ghost.App.MailServer.SendEmail(
+		[]string{email},
+		"Reset your password for "+ghost.App.MailServer.FromName,
+		map[string]string{"link": passwordLink(ghost.App.Config.PasswordResetURL, token)},
+		templates,
+		"defaultpasswordresetemail.html")
+
+}
+
+//ResetPassword sets a new password for the user the reset token was sent to
+func ResetPassword(tokenString, password string) error {
+
+	claims, err := ParseToken(tokenString, PasswordResetToken)
+	if err != nil {
+		return ErrInvalidResetLink
+	}
+
+	//Check the password before using up the token
+	if len(password) < ghost.App.Config.PasswordMinLength {
+		return ErrPasswordTooShort
+	}
+
+	revoked, err := RevokeToken(claims)
+	if err != nil {
+		return err
+	} else if !revoked {
+		return ErrInvalidResetLink
+	}
+
+	userID, _ := claims["userID"].(string)
+	return setPassword(userID, password)
+
+}
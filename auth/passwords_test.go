@@ -0,0 +1,332 @@
+// Copyright 2017 Jonathan Pincas
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jpincas/ghost/ghost"
+	"github.com/lib/pq"
+	"github.com/spf13/viper"
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+//setPasswordConfig sets the password settings used by the tests
+func setPasswordConfig() {
+	ghost.App.Config.PasswordHash = "argon2id"
+	ghost.App.Config.PasswordMinLength = 8
+}
+
+func TestHashPassword(t *testing.T) {
+
+	setPasswordConfig()
+	defer setPasswordConfig()
+
+	for _, algorithm := range []string{"argon2id", "bcrypt"} {
+
+		ghost.App.Config.PasswordHash = algorithm
+
+		hash, err := HashPassword("correct horse")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if strings.Contains(hash, "correct horse") {
+			t.Errorf("%s: expected the password to be hashed", algorithm)
+		}
+
+		other, _ := HashPassword("correct horse")
+		if hash == other {
+			t.Errorf("%s: expected hashes to be salted", algorithm)
+		}
+
+		if ok, err := CheckPassword("correct horse", hash); !ok || err != nil {
+			t.Errorf("%s: expected the password to match, got %v, %v", algorithm, ok, err)
+		}
+
+		if ok, err := CheckPassword("battery staple", hash); ok || err != nil {
+			t.Errorf("%s: expected a wrong password not to match, got %v, %v", algorithm, ok, err)
+		}
+
+	}
+
+	if _, err := HashPassword("short"); err != ErrPasswordTooShort {
+		t.Errorf("Expected a short password to be refused, got %v", err)
+	}
+
+	if _, err := CheckPassword("correct horse", "plaintext"); err == nil {
+		t.Error("Expected an unrecognised hash to be an error")
+	}
+
+}
+
+func TestPasswordLogin(t *testing.T) {
+
+	db, mock, _ := sqlmock.New()
+	ghost.App.DB = db
+	defer db.Close()
+
+	hash, _ := hashArgon2id("correct horse")
+
+	mock.ExpectQuery("SELECT id, password, password_verified FROM users").WithArgs("me@me.com").WillReturnRows(sqlmock.NewRows([]string{"id", "password", "password_verified"}).AddRow("692e8a64-7676-4790-b3f8-a86a5083d5bb", hash, true))
+	mock.ExpectQuery("SELECT id, password, password_verified FROM users").WithArgs("me@me.com").WillReturnRows(sqlmock.NewRows([]string{"id", "password", "password_verified"}).AddRow("692e8a64-7676-4790-b3f8-a86a5083d5bb", hash, true))
+	mock.ExpectQuery("SELECT id, password, password_verified FROM users").WithArgs("magic@me.com").WillReturnRows(sqlmock.NewRows([]string{"id", "password", "password_verified"}).AddRow("692e8a64-7676-4790-b3f8-a86a5083d5bb", nil, false))
+	mock.ExpectQuery("SELECT id, password, password_verified FROM users").WithArgs("nobody@me.com").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("SELECT id, password, password_verified FROM users").WithArgs("new@me.com").WillReturnRows(sqlmock.NewRows([]string{"id", "password", "password_verified"}).AddRow("692e8a64-7676-4790-b3f8-a86a5083d5bb", hash, false))
+
+	if id, err := PasswordLogin("me@me.com", "correct horse"); id != "692e8a64-7676-4790-b3f8-a86a5083d5bb" || err != nil {
+		t.Errorf("Expected to log in, got %s, %v", id, err)
+	}
+
+	if _, err := PasswordLogin("me@me.com", "battery staple"); err != ErrWrongPassword {
+		t.Errorf("Expected the wrong password to be refused, got %v", err)
+	}
+
+	//Users who only use magic codes have no password
+	if _, err := PasswordLogin("magic@me.com", ""); err != ErrWrongPassword {
+		t.Errorf("Expected a user without a password to be refused, got %v", err)
+	}
+
+	if _, err := PasswordLogin("nobody@me.com", "correct horse"); err != ErrWrongPassword {
+		t.Errorf("Expected an unknown email to be refused like a wrong password, got %v", err)
+	}
+
+	//Registered passwords can't be used until the email is confirmed
+	if _, err := PasswordLogin("new@me.com", "correct horse"); err != ErrPasswordNotVerified {
+		t.Errorf("Expected an unverified password to be refused, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+}
+
+//postPassword posts a password request to a handler
+func postPassword(handler http.HandlerFunc, body passwordRequest, ctx context.Context) *httptest.ResponseRecorder {
+
+	b, _ := json.Marshal(body)
+	req, _ := http.NewRequest("POST", "", bytes.NewBuffer(b))
+	req.RemoteAddr = "10.0.0.1:1234"
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req.WithContext(ctx))
+	return rr
+
+}
+
+//postConfirm posts a confirmation token
+func postConfirm(token string) *httptest.ResponseRecorder {
+
+	req, _ := http.NewRequest("POST", "", strings.NewReader(`{"token": "`+token+`"}`))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(confirmPassword).ServeHTTP(rr, req)
+	return rr
+
+}
+
+func TestPasswordHandlers(t *testing.T) {
+
+	viper.Set("secret", "secret")
+	setTokenConfig()
+	setCodeConfig()
+	setPasswordConfig()
+	MagicCodes = NewMemoryCodeStore()
+
+	db, mock, _ := sqlmock.New()
+	ghost.App.DB = db
+	defer db.Close()
+
+	const id = "692e8a64-7676-4790-b3f8-a86a5083d5bb"
+	hash, _ := hashArgon2id("correct horse")
+
+	//Register.  Without email the address can't be confirmed, so registering is refused
+	defer func() { ghost.App.MailServer.Working = false }()
+	ghost.App.MailServer.Working = false
+	if rr := postPassword(register, passwordRequest{Email: "me@me.com", Password: "correct horse"}, context.Background()); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected registering to be refused without email, got %v: %s", rr.Code, rr.Body)
+	}
+
+	//The confirmation email fails to send in the tests, but either way registering doesn't log in
+	ghost.App.MailServer.Working = true
+	mock.ExpectQuery("INSERT INTO users").WithArgs("me@me.com", sqlmock.AnyArg()).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(id))
+	if rr := postPassword(register, passwordRequest{Email: "Me@me.com", Password: "correct horse"}, context.Background()); strings.Contains(rr.Body.String(), "token") {
+		t.Errorf("Expected registering not to log in, got %v: %s", rr.Code, rr.Body)
+	}
+
+	mock.ExpectQuery("INSERT INTO users").WillReturnError(&pq.Error{Code: "23505"})
+	if rr := postPassword(register, passwordRequest{Email: "me@me.com", Password: "correct horse"}, context.Background()); rr.Code != http.StatusConflict {
+		t.Errorf("Expected a registered email to conflict, got %v: %s", rr.Code, rr.Body)
+	}
+
+	if rr := postPassword(register, passwordRequest{Email: "me@me.com", Password: "short"}, context.Background()); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected a short password to be refused, got %v: %s", rr.Code, rr.Body)
+	}
+
+	//Confirm
+	confirmToken, _ := signClaims(newClaims(id, "", PasswordConfirmToken, time.Minute))
+	mock.ExpectExec("DELETE FROM revoked_tokens").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO revoked_tokens").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE users SET password_verified = true").WithArgs(id).WillReturnResult(sqlmock.NewResult(0, 1))
+	if rr := postConfirm(confirmToken); rr.Code != http.StatusOK {
+		t.Errorf("Expected the email to be confirmed, got %v: %s", rr.Code, rr.Body)
+	}
+
+	mock.ExpectExec("DELETE FROM revoked_tokens").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO revoked_tokens").WillReturnResult(sqlmock.NewResult(0, 0))
+	if rr := postConfirm(confirmToken); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a used confirmation link to be refused, got %v: %s", rr.Code, rr.Body)
+	}
+
+	//A reset token isn't a confirmation token
+	otherToken, _ := signClaims(newClaims(id, "", PasswordResetToken, time.Minute))
+	if rr := postConfirm(otherToken); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a reset token to be refused, got %v: %s", rr.Code, rr.Body)
+	}
+
+	//Log in, which isn't possible until the email is confirmed
+	mock.ExpectQuery("SELECT id, password, password_verified FROM users").WithArgs("me@me.com").WillReturnRows(sqlmock.NewRows([]string{"id", "password", "password_verified"}).AddRow(id, hash, false))
+	if rr := postPassword(passwordLogin, passwordRequest{Email: "me@me.com", Password: "correct horse"}, context.Background()); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected an unverified password to be refused, got %v: %s", rr.Code, rr.Body)
+	}
+
+	mock.ExpectQuery("SELECT id, password, password_verified FROM users").WithArgs("me@me.com").WillReturnRows(sqlmock.NewRows([]string{"id", "password", "password_verified"}).AddRow(id, hash, true))
+	mock.ExpectQuery("SELECT role from users").WithArgs(id).WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("admin"))
+	rr := postPassword(passwordLogin, passwordRequest{Email: "me@me.com", Password: "correct horse"}, context.Background())
+	var tokens Tokens
+	json.Unmarshal(rr.Body.Bytes(), &tokens)
+	if claims, err := ParseToken(tokens.Token, AccessToken); err != nil || claims["role"] != "admin" {
+		t.Errorf("Expected to log in as admin, got %v: %s", rr.Code, rr.Body)
+	}
+
+	//Wrong passwords lock out the email
+	for i := 0; i < 3; i++ {
+		mock.ExpectQuery("SELECT id, password, password_verified FROM users").WithArgs("me@me.com").WillReturnRows(sqlmock.NewRows([]string{"id", "password", "password_verified"}).AddRow(id, hash, true))
+		if rr := postPassword(passwordLogin, passwordRequest{Email: "me@me.com", Password: "battery staple"}, context.Background()); rr.Code != http.StatusUnauthorized {
+			t.Errorf("Expected a wrong password to be refused, got %v: %s", rr.Code, rr.Body)
+		}
+	}
+	if rr := postPassword(passwordLogin, passwordRequest{Email: "me@me.com", Password: "correct horse"}, context.Background()); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected to be locked out, got %v: %s", rr.Code, rr.Body)
+	}
+
+	//Change
+	ctx := context.WithValue(context.Background(), "userID", id)
+	mock.ExpectQuery("SELECT password FROM users").WithArgs(id).WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow(hash))
+	if rr := postPassword(changePassword, passwordRequest{CurrentPassword: "battery staple", Password: "new password"}, ctx); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the current password to be required, got %v: %s", rr.Code, rr.Body)
+	}
+
+	mock.ExpectQuery("SELECT password FROM users").WithArgs(id).WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow(hash))
+	mock.ExpectExec("UPDATE users SET password").WithArgs(id, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	if rr := postPassword(changePassword, passwordRequest{CurrentPassword: "correct horse", Password: "new password"}, ctx); rr.Code != http.StatusOK {
+		t.Errorf("Expected the password to be changed, got %v: %s", rr.Code, rr.Body)
+	}
+
+	//Users without a password can set one
+	mock.ExpectQuery("SELECT password FROM users").WithArgs(id).WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow(nil))
+	mock.ExpectExec("UPDATE users SET password").WithArgs(id, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	if rr := postPassword(changePassword, passwordRequest{Password: "new password"}, ctx); rr.Code != http.StatusOK {
+		t.Errorf("Expected the password to be set, got %v: %s", rr.Code, rr.Body)
+	}
+
+	//Reset
+	resetToken, _ := signClaims(newClaims(id, "", PasswordResetToken, time.Minute))
+	mock.ExpectExec("DELETE FROM revoked_tokens").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO revoked_tokens").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE users SET password").WithArgs(id, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	if rr := postPassword(resetPassword, passwordRequest{Token: resetToken, Password: "new password"}, context.Background()); rr.Code != http.StatusOK {
+		t.Errorf("Expected the password to be reset, got %v: %s", rr.Code, rr.Body)
+	}
+
+	mock.ExpectExec("DELETE FROM revoked_tokens").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO revoked_tokens").WillReturnResult(sqlmock.NewResult(0, 0))
+	if rr := postPassword(resetPassword, passwordRequest{Token: resetToken, Password: "new password"}, context.Background()); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a used reset link to be refused, got %v: %s", rr.Code, rr.Body)
+	}
+
+	//An access token isn't a reset token
+	accessToken, _ := GetUserToken(id, "admin")
+	if rr := postPassword(resetPassword, passwordRequest{Token: accessToken, Password: "new password"}, context.Background()); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected an access token to be refused, got %v: %s", rr.Code, rr.Body)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+}
+
+//Without a frontend page, confirmation links are opened straight from the email
+func TestConfirmPasswordLink(t *testing.T) {
+
+	viper.Set("secret", "secret")
+	setTokenConfig()
+	ghost.App.Config.PasswordConfirmURL = ""
+
+	db, mock, _ := sqlmock.New()
+	ghost.App.DB = db
+	defer db.Close()
+
+	const id = "692e8a64-7676-4790-b3f8-a86a5083d5bb"
+	token, _ := signClaims(newClaims(id, "", PasswordConfirmToken, time.Minute))
+	mock.ExpectExec("DELETE FROM revoked_tokens").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO revoked_tokens").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE users SET password_verified = true").WithArgs(id).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	link := passwordLink(confirmURL(), token)
+	if !strings.HasPrefix(link, ghost.App.Config.BaseURL()+"/auth/password/confirm?token=") {
+		t.Errorf("Expected the link to go to the API, got %s", link)
+	}
+
+	req, _ := http.NewRequest("GET", link, nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(confirmPassword).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected the link to confirm the password, got %v: %s", rr.Code, rr.Body)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+}
+
+//Reset links can only go to the frontend page, where the new password is chosen
+func TestRequestPasswordResetNeedsURL(t *testing.T) {
+
+	db, mock, _ := sqlmock.New()
+	ghost.App.DB = db
+	defer db.Close()
+	defer func() { ghost.App.MailServer.Working = false }()
+
+	ghost.App.MailServer.Working = true
+	ghost.App.Config.PasswordResetURL = ""
+	if err := RequestPasswordReset("me@me.com"); err == nil {
+		t.Error("Expected the reset to be refused without a reset URL")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+}
@@ -15,18 +15,56 @@
 package auth
 
 import (
-	ghost "github.com/jpincas/ghost/tools"
+	"github.com/jpincas/ghost/ghost"
 	"github.com/pressly/chi"
 )
 
 //SetRoutes adds the routes the router
 func setRoutes() {
 
+	ghost.App.Router.Get(JWKSPath, getJWKS)
+
 	ghost.App.Router.Route("/auth", func(r chi.Router) {
 
 		r.Get("/newuser", requestNewUserToken)
 		r.Post("/login", requestLogin)
 		r.Post("/magiccode", magicCode)
+		r.Post("/magiclink", magicLink)
+		r.Get("/magiclink", useMagicLink)
+		r.Post("/refresh", refreshTokens)
+		r.Post("/logout", logout)
+
+		//Anonymous users register with an email, keeping their id
+		r.With(Authenticator).Post("/upgrade", requestUpgrade)
+		r.With(Authenticator).Post("/upgrade/confirm", confirmUpgrade)
+
+		//Two-factor authentication is set up and verified with a logged in session
+		r.Route("/totp", func(r chi.Router) {
+			r.Use(totpAuthenticator)
+			r.Post("/enroll", enrollTOTP)
+			r.Post("/confirm", confirmTOTP)
+			r.Post("/verify", verifyTOTP)
+			r.Post("/disable", disableTOTP)
+		})
+
+		//Login with OpenID Connect providers, if any are configured
+		if len(ghost.App.Config.OIDCProviders) > 0 {
+			r.Get("/oidc/login", oidcLogin)
+			r.Get("/oidc/callback", oidcCallback)
+		}
+
+		//Password login is optional
+		if ghost.App.Config.PasswordLogin {
+			r.Post("/register", register)
+			r.Route("/password", func(r chi.Router) {
+				r.Post("/login", passwordLogin)
+				r.With(Authenticator).Post("/change", changePassword)
+				r.Post("/forgot", forgotPassword)
+				r.Post("/reset", resetPassword)
+				r.Get("/confirm", confirmPassword)
+				r.Post("/confirm", confirmPassword)
+			})
+		}
 
 	})
 }
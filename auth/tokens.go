@@ -0,0 +1,246 @@
+// Copyright 2017 Jonathan Pincas
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/jpincas/ghost/ghost"
+)
+
+//Token types, set in the typ claim, so that a refresh token can't be used
+//to access the API or an access token to get new tokens
+const (
+	AccessToken    = "access"
+	RefreshToken   = "refresh"
+	MagicLinkToken = "magiclink"
+)
+
+//Tokens are issued on login: a short lived access token and a long lived refresh token
+//which can be exchanged for new tokens at /auth/refresh before it expires
+type Tokens struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+	//ExpiresIn is the number of seconds the access token is valid for
+	ExpiresIn int `json:"expiresIn"`
+}
+
+//IssueTokens creates a new access and refresh token pair for a user with the given role
+func IssueTokens(userID, role string) (Tokens, error) {
+
+	return issueTokens(userID, role, false)
+
+}
+
+//issueTokens creates a token pair, which has the mfa claim if the user has passed two-factor authentication.
+//The refresh token has it too, so that the session stays verified when it is refreshed
+func issueTokens(userID, role string, mfa bool) (tokens Tokens, err error) {
+
+	//Error for empty user ID
+	if userID == "" {
+		return tokens, errors.New("Empty user ID")
+	}
+
+	access := newClaims(userID, role, AccessToken, time.Duration(ghost.App.Config.JWTExpiry)*time.Second)
+	refresh := newClaims(userID, role, RefreshToken, time.Duration(ghost.App.Config.JWTRefreshExpiry)*time.Second)
+	if mfa {
+		access["mfa"], refresh["mfa"] = true, true
+	}
+
+	if tokens.Token, err = signClaims(access); err != nil {
+		return tokens, err
+	}
+
+	if tokens.RefreshToken, err = signClaims(refresh); err != nil {
+		return tokens, err
+	}
+
+	tokens.ExpiresIn = ghost.App.Config.JWTExpiry
+	return tokens, nil
+
+}
+
+//GetUserToken returns a signed access token for a user with the given role
+func GetUserToken(userID, role string) (string, error) {
+
+	//Error for empty user ID
+	if userID == "" {
+		return "", errors.New("Empty user ID")
+	}
+
+	expiry := time.Duration(ghost.App.Config.JWTExpiry) * time.Second
+	return signClaims(newClaims(userID, role, AccessToken, expiry))
+
+}
+
+//newClaims are the standard claims for a token of the given type, valid from now until the expiry.
+//The issuer is the JWT realm, and the audience is only set if configured
+func newClaims(userID, role, tokenType string, expiry time.Duration) jwt.MapClaims {
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"userID": userID,
+		"sub":    userID,
+		"role":   role,
+		"typ":    tokenType,
+		"jti":    randomTokenID(),
+		"iss":    ghost.App.Config.JWTRealm,
+		"iat":    now.Unix(),
+		"nbf":    now.Unix(),
+		"exp":    now.Add(expiry).Unix(),
+	}
+
+	if audience := ghost.App.Config.JWTAudience; audience != "" {
+		claims["aud"] = audience
+	}
+
+	return claims
+
+}
+
+//signClaims signs the claims using the active key, or the secret if there are no keys,
+//and returns the complete encoded token
+func signClaims(claims jwt.MapClaims) (string, error) {
+
+	return keys.sign(claims)
+
+}
+
+//ParseToken verifies the signature and claims of a token of the given type, and returns the claims.
+//Tokens must have an expiry, and must have been issued for this realm and audience
+func ParseToken(tokenString, tokenType string) (jwt.MapClaims, error) {
+
+	token, err := parseToken(tokenString, tokenType)
+	if err != nil {
+		return nil, err
+	}
+
+	return token.Claims.(jwt.MapClaims), nil
+
+}
+
+//parseToken verifies a token of the given type and returns the parsed token
+func parseToken(tokenString, tokenType string) (*jwt.Token, error) {
+
+	token, err := jwt.Parse(tokenString, keys.verificationKey)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, errors.New("Invalid token claims")
+	}
+
+	//The expiry is checked when the token is parsed, but only if it is present
+	if _, ok := claims["exp"]; !ok {
+		return nil, errors.New("Token has no expiry")
+	}
+
+	if realm := ghost.App.Config.JWTRealm; !claims.VerifyIssuer(realm, realm != "") {
+		return nil, errors.New("Token was issued by another realm")
+	}
+
+	if audience := ghost.App.Config.JWTAudience; audience != "" && !claims.VerifyAudience(audience, true) {
+		return nil, errors.New("Token was issued for another audience")
+	}
+
+	if claims["typ"] != tokenType {
+		return nil, errors.New("Expected a token of type " + tokenType)
+	}
+
+	return token, nil
+
+}
+
+//RevokeToken adds a token to the revocation list until it expires.
+//Revoked access tokens are refused by Verifier.
+//Returns false if it had already been revoked
+func RevokeToken(claims jwt.MapClaims) (bool, error) {
+
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return false, errors.New("Token has no id, so can't be revoked")
+	}
+
+	//Expiry has already been checked when the token was parsed
+	exp, _ := claims["exp"].(float64)
+
+	//Expired tokens don't need to be remembered
+	ghost.App.DB.Exec(ghost.SQLToPruneRevokedTokens)
+
+	result, err := ghost.App.DB.Exec(ghost.SQLToRevokeToken, jti, time.Unix(int64(exp), 0))
+	if err != nil {
+		return false, err
+	}
+
+	revoked, err := result.RowsAffected()
+	return revoked == 1, err
+
+}
+
+//tokenRevoked returns whether a token is on the revocation list.
+//Tokens without an id can't have been revoked
+func tokenRevoked(claims jwt.MapClaims) (bool, error) {
+
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return false, nil
+	}
+
+	var revoked bool
+	err := ghost.App.DB.QueryRow(ghost.SQLToIsTokenRevoked, jti).Scan(&revoked)
+	return revoked, err
+
+}
+
+//issueTokensFor issues tokens for a user with their current role
+func issueTokensFor(userID string, mfa bool) (Tokens, error) {
+
+	role, err := userRole(userID)
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	return issueTokens(userID, role, mfa)
+
+}
+
+//userRole looks up the role of a user.  Users who aren't in the users table are anon
+func userRole(userID string) (string, error) {
+
+	var role string
+	err := ghost.App.DB.QueryRow(ghost.SQLToGetUsersRole, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "anon", nil
+	}
+
+	return role, err
+
+}
+
+//randomTokenID is a random, unique id for a token, so that it can be revoked
+func randomTokenID() string {
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+
+}
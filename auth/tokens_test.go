@@ -0,0 +1,132 @@
+// Copyright 2017 Jonathan Pincas
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/jpincas/ghost/ghost"
+	"github.com/spf13/viper"
+)
+
+//setTokenConfig sets the token settings used by the tests
+func setTokenConfig() {
+	ghost.App.Config.JWTRealm = "Test Realm"
+	ghost.App.Config.JWTAudience = ""
+	ghost.App.Config.JWTExpiry = 60
+	ghost.App.Config.JWTRefreshExpiry = 3600
+}
+
+func TestIssueTokens(t *testing.T) {
+
+	viper.Set("secret", "secret")
+	setTokenConfig()
+	ghost.App.Config.JWTAudience = "test-audience"
+	defer setTokenConfig()
+
+	tokens, err := IssueTokens("692e8a64-7676-4790-b3f8-a86a5083d5bb", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	access, err := ParseToken(tokens.Token, AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refresh, err := ParseToken(tokens.RefreshToken, RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if access["aud"] != "test-audience" || access["sub"] != "692e8a64-7676-4790-b3f8-a86a5083d5bb" {
+		t.Errorf("Unexpected claims %v", access)
+	}
+
+	if lifetime := access["exp"].(float64) - access["iat"].(float64); lifetime != 60 {
+		t.Errorf("Expected the access token to last 60s, got %v", lifetime)
+	}
+
+	if lifetime := refresh["exp"].(float64) - refresh["iat"].(float64); lifetime != 3600 {
+		t.Errorf("Expected the refresh token to last 3600s, got %v", lifetime)
+	}
+
+	if access["jti"] == refresh["jti"] {
+		t.Error("Expected each token to have its own id")
+	}
+
+}
+
+func TestParseToken(t *testing.T) {
+
+	viper.Set("secret", "secret")
+	setTokenConfig()
+
+	valid := func() jwt.MapClaims {
+		return newClaims("692e8a64-7676-4790-b3f8-a86a5083d5bb", "anon", AccessToken, time.Minute)
+	}
+
+	sign := func(claims jwt.MapClaims) string {
+		s, _ := signClaims(claims)
+		return s
+	}
+
+	expired := valid()
+	expired["exp"] = time.Now().Add(-time.Minute).Unix()
+
+	notYetValid := valid()
+	notYetValid["nbf"] = time.Now().Add(time.Minute).Unix()
+
+	noExpiry := valid()
+	delete(noExpiry, "exp")
+
+	otherRealm := valid()
+	otherRealm["iss"] = "Another Realm"
+
+	otherAudience := valid()
+	otherAudience["aud"] = "another-audience"
+
+	otherSecret, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, valid()).SignedString([]byte("another secret"))
+	unsigned, _ := jwt.NewWithClaims(jwt.SigningMethodNone, valid()).SignedString(jwt.UnsafeAllowNoneSignatureType)
+
+	var tests = []struct {
+		name, token, tokenType string
+		audience               string
+		ok                     bool
+	}{
+		{"valid", sign(valid()), AccessToken, "", true},
+		{"wrong type", sign(valid()), RefreshToken, "", false},
+		{"expired", sign(expired), AccessToken, "", false},
+		{"not yet valid", sign(notYetValid), AccessToken, "", false},
+		{"no expiry", sign(noExpiry), AccessToken, "", false},
+		{"other realm", sign(otherRealm), AccessToken, "", false},
+		{"other audience", sign(otherAudience), AccessToken, "test-audience", false},
+		{"no audience", sign(valid()), AccessToken, "test-audience", false},
+		{"other secret", otherSecret, AccessToken, "", false},
+		{"unsigned", unsigned, AccessToken, "", false},
+	}
+
+	for _, test := range tests {
+		ghost.App.Config.JWTAudience = test.audience
+		if _, err := ParseToken(test.token, test.tokenType); (err == nil) != test.ok {
+			t.Errorf("%s: expected ok to be %v, got error %v", test.name, test.ok, err)
+		}
+	}
+
+	setTokenConfig()
+
+}
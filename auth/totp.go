@@ -0,0 +1,464 @@
+// Copyright 2017 Jonathan Pincas
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jpincas/ghost/ghost"
+)
+
+//TOTP parameters, which are the defaults of authenticator apps
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	//totpSkew is the number of time steps either side of now that are accepted, for clock drift
+	totpSkew          = 1
+	totpSecretLen     = 20
+	recoveryCodeCount = 10
+	recoveryCodeLen   = 10
+)
+
+//ErrTOTPNotEnabled is returned when a TOTP code is given for a user who hasn't set up two-factor authentication
+var ErrTOTPNotEnabled = errors.New("Two-factor authentication is not enabled")
+
+//ErrTOTPAlreadyEnabled is returned when a user who has set up two-factor authentication tries to set it up again
+var ErrTOTPAlreadyEnabled = errors.New("Two-factor authentication is already enabled, disable it first")
+
+//ErrWrongTOTP is returned when a TOTP or recovery code is wrong or has already been used
+var ErrWrongTOTP = errors.New("Wrong two-factor authentication code")
+
+//ErrNotRegistered is returned when a user who isn't in the users table tries to set up two-factor authentication
+var ErrNotRegistered = errors.New("Only registered users can enable two-factor authentication")
+
+//base32NoPadding is how TOTP secrets are encoded for authenticator apps
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+//TOTPEnrollment is the secret for a user's authenticator app.
+//The URI is the otpauth:// provisioning URI to show as a QR code
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+//totpRequired returns whether users with the role must use two-factor authentication
+func totpRequired(role string) bool {
+
+	for _, r := range ghost.App.Config.TOTPRoles {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
+
+}
+
+//totpCode is the TOTP code for the time step, as in RFC 6238 with SHA1
+func totpCode(secret []byte, counter int64) string {
+
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, uint64(counter))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%06d", value%1000000)
+
+}
+
+//matchTOTP checks a code against the time steps around now, and returns the time step it is for
+func matchTOTP(secret, code string, now time.Time) (int64, bool) {
+
+	key, err := base32NoPadding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for counter := current - totpSkew; counter <= current+totpSkew; counter++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, counter)), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+
+	return 0, false
+
+}
+
+//getTOTP returns a user's TOTP secret, whether it has been confirmed and the last time step used
+func getTOTP(userID string) (secret string, confirmed bool, lastCounter int64, err error) {
+
+	err = ghost.App.DB.QueryRow(ghost.SQLToGetTOTP, userID).Scan(&secret, &confirmed, &lastCounter)
+	return
+
+}
+
+//EnrollTOTP creates a new TOTP secret for a user.  It isn't used until it is confirmed
+//with a code from the authenticator app, so an unfinished enrollment can be started again
+func EnrollTOTP(userID string) (TOTPEnrollment, error) {
+
+	var email sql.NullString
+	err := ghost.App.DB.QueryRow(ghost.SQLToGetUsersEmail, userID).Scan(&email)
+	if err == sql.ErrNoRows {
+		return TOTPEnrollment{}, ErrNotRegistered
+	} else if err != nil {
+		return TOTPEnrollment{}, err
+	}
+
+	_, confirmed, _, err := getTOTP(userID)
+	if err != nil && err != sql.ErrNoRows {
+		return TOTPEnrollment{}, err
+	} else if confirmed {
+		return TOTPEnrollment{}, ErrTOTPAlreadyEnabled
+	}
+
+	key := make([]byte, totpSecretLen)
+	if _, err := rand.Read(key); err != nil {
+		return TOTPEnrollment{}, err
+	}
+	secret := base32NoPadding.EncodeToString(key)
+
+	if _, err := ghost.App.DB.Exec(ghost.SQLToSetTOTP, userID, secret); err != nil {
+		return TOTPEnrollment{}, err
+	}
+
+	//The account is shown in the app as issuer:email
+	issuer, account := ghost.App.Config.JWTRealm, userID
+	if email.Valid && email.String != "" {
+		account = email.String
+	}
+
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+
+	return TOTPEnrollment{
+		Secret: secret,
+		URI:    "otpauth://totp/" + url.PathEscape(issuer+":"+account) + "?" + query.Encode(),
+	}, nil
+
+}
+
+//ConfirmTOTP turns on two-factor authentication for a user, once they have shown that their app gives the right codes,
+//and returns their recovery codes.  These are only ever shown once
+func ConfirmTOTP(userID, code string) ([]string, error) {
+
+	secret, confirmed, _, err := getTOTP(userID)
+	if err == sql.ErrNoRows {
+		return nil, ErrTOTPNotEnabled
+	} else if err != nil {
+		return nil, err
+	} else if confirmed {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+
+	counter, ok := matchTOTP(secret, code, time.Now())
+	if !ok {
+		return nil, ErrWrongTOTP
+	}
+
+	result, err := ghost.App.DB.Exec(ghost.SQLToConfirmTOTP, userID, counter)
+	if err != nil {
+		return nil, err
+	}
+	if updated, err := result.RowsAffected(); err != nil {
+		return nil, err
+	} else if updated != 1 {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+
+	return newRecoveryCodes(userID)
+
+}
+
+//newRecoveryCodes replaces a user's recovery codes.  Only their hashes are stored
+func newRecoveryCodes(userID string) ([]string, error) {
+
+	if _, err := ghost.App.DB.Exec(ghost.SQLToDeleteRecoveryCodes, userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+
+		b := make([]byte, recoveryCodeLen)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+
+		code := strings.ToLower(base32NoPadding.EncodeToString(b))
+		if _, err := ghost.App.DB.Exec(ghost.SQLToAddRecoveryCode, userID, hashCode(userID, code)); err != nil {
+			return nil, err
+		}
+
+		//Grouped to be easier to copy down
+		codes[i] = code[:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:]
+
+	}
+
+	return codes, nil
+
+}
+
+//VerifyTOTP checks a TOTP code, or a recovery code, for a user.
+//Each code can only be used once: a TOTP code's time step and anything before it is used up,
+//and a recovery code is removed
+func VerifyTOTP(userID, code string) error {
+
+	secret, confirmed, lastCounter, err := getTOTP(userID)
+	if err == sql.ErrNoRows || (err == nil && !confirmed) {
+		return ErrTOTPNotEnabled
+	} else if err != nil {
+		return err
+	}
+
+	code = strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(code))
+
+	var result sql.Result
+	if len(code) == totpDigits {
+
+		counter, ok := matchTOTP(secret, code, time.Now())
+		if !ok || counter <= lastCounter {
+			return ErrWrongTOTP
+		}
+		result, err = ghost.App.DB.Exec(ghost.SQLToUseTOTPCounter, userID, counter)
+
+	} else {
+
+		result, err = ghost.App.DB.Exec(ghost.SQLToUseRecoveryCode, userID, hashCode(userID, code))
+
+	}
+	if err != nil {
+		return err
+	}
+
+	//Nothing is updated if the code was used at the same time by another request
+	if used, err := result.RowsAffected(); err != nil {
+		return err
+	} else if used != 1 {
+		return ErrWrongTOTP
+	}
+
+	return nil
+
+}
+
+//DisableTOTP turns off two-factor authentication for a user and removes their recovery codes
+func DisableTOTP(userID string) error {
+
+	if _, err := ghost.App.DB.Exec(ghost.SQLToDeleteTOTP, userID); err != nil {
+		return err
+	}
+
+	_, err := ghost.App.DB.Exec(ghost.SQLToDeleteRecoveryCodes, userID)
+	return err
+
+}
+
+//loginWithTOTP finishes a login.  With a TOTP or recovery code the session is MFA verified,
+//otherwise it can be verified afterwards at /auth/totp/verify.
+//Failed attempts for the email are only forgotten once the TOTP code, if given, is right
+func loginWithTOTP(w http.ResponseWriter, userID, email, ip, code string) {
+
+	if code == "" {
+		resetFailures(email, ip)
+		respondWithTokens(w, userID, false)
+		return
+	}
+
+	if err := VerifyTOTP(userID, code); err != nil {
+		respondWithTOTPError(w, err)
+		return
+	}
+
+	resetFailures(email, ip)
+	respondWithTokens(w, userID, true)
+
+}
+
+//readTOTPCode reads the code from the body of a TOTP route.
+//If it is missing the error is written and ok is false
+func readTOTPCode(w http.ResponseWriter, r *http.Request) (code string, ok bool) {
+
+	var body struct {
+		Code string `json:"code"`
+	}
+
+	if r.Body == nil || json.NewDecoder(r.Body).Decode(&body) != nil || body.Code == "" {
+
+		w.WriteHeader(http.StatusBadRequest)
+		b, _ := json.Marshal(ghost.ResponseError{http.StatusBadRequest, "", "No two-factor authentication code provided", "", "", ""})
+		w.Write([]byte(b))
+		return "", false
+
+	}
+
+	return body.Code, true
+
+}
+
+//enrollTOTP starts setting up two-factor authentication for the logged in user
+func enrollTOTP(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", ghost.ContentTypeJSON)
+
+	enrollment, err := EnrollTOTP(fmt.Sprint(r.Context().Value("userID")))
+	if err != nil {
+		respondWithTOTPError(w, err)
+		return
+	}
+
+	b, _ := json.Marshal(enrollment)
+	w.Write([]byte(b))
+
+}
+
+//totpConfirmation is the response to confirming two-factor authentication:
+//the recovery codes, and new tokens for the now verified session
+type totpConfirmation struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+	Tokens
+}
+
+//confirmTOTP finishes setting up two-factor authentication with a code from the user's app
+func confirmTOTP(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", ghost.ContentTypeJSON)
+
+	code, ok := readTOTPCode(w, r)
+	if !ok {
+		return
+	}
+
+	userID := fmt.Sprint(r.Context().Value("userID"))
+	codes, err := ConfirmTOTP(userID, code)
+	if err != nil {
+		respondWithTOTPError(w, err)
+		return
+	}
+
+	tokens, err := issueTokensFor(userID, true)
+	if err != nil {
+		respondWithTOTPError(w, err)
+		return
+	}
+
+	b, _ := json.Marshal(totpConfirmation{codes, tokens})
+	w.Write([]byte(b))
+
+}
+
+//verifyTOTP exchanges the logged in user's tokens for MFA verified ones, with a TOTP or recovery code.
+//Failed attempts count towards the same lockout as magic codes, against the user id
+func verifyTOTP(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", ghost.ContentTypeJSON)
+
+	code, ok := readTOTPCode(w, r)
+	if !ok {
+		return
+	}
+
+	userID, ip := fmt.Sprint(r.Context().Value("userID")), clientIP(r)
+	locked, err := countAttempt(userID, ip, "")
+	if err != nil {
+
+		w.WriteHeader(http.StatusServiceUnavailable)
+		b, _ := json.Marshal(ghost.ResponseError{http.StatusServiceUnavailable, "", err.Error(), "", "", ""})
+		w.Write([]byte(b))
+		return
+
+	} else if locked {
+
+		w.WriteHeader(http.StatusTooManyRequests)
+		b, _ := json.Marshal(ghost.ResponseError{http.StatusTooManyRequests, "", "Too many failed attempts, please try again later", "", "", ""})
+		w.Write([]byte(b))
+		return
+
+	}
+
+	if err := VerifyTOTP(userID, code); err != nil {
+		respondWithTOTPError(w, err)
+		return
+	}
+
+	resetFailures(userID, ip)
+	respondWithTokens(w, userID, true)
+
+}
+
+//disableTOTP turns off two-factor authentication for the logged in user, whose session must be MFA verified
+func disableTOTP(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", ghost.ContentTypeJSON)
+
+	if r.Context().Value("mfa") != true {
+
+		w.WriteHeader(http.StatusForbidden)
+		b, _ := json.Marshal(ghost.ResponseError{http.StatusForbidden, "", "Two-factor authentication is required", "", "", ""})
+		w.Write([]byte(b))
+		return
+
+	}
+
+	if err := DisableTOTP(fmt.Sprint(r.Context().Value("userID"))); err != nil {
+		respondWithTOTPError(w, err)
+		return
+	}
+
+	w.Write([]byte{})
+
+}
+
+//respondWithTOTPError writes the error from a TOTP route with the right status
+func respondWithTOTPError(w http.ResponseWriter, err error) {
+
+	code := http.StatusServiceUnavailable
+	switch err {
+	case ErrTOTPNotEnabled, ErrNotRegistered:
+		code = http.StatusBadRequest
+	case ErrWrongTOTP:
+		code = http.StatusUnauthorized
+	case ErrTOTPAlreadyEnabled:
+		code = http.StatusConflict
+	}
+
+	w.WriteHeader(code)
+	b, _ := json.Marshal(ghost.ResponseError{code, "", err.Error(), "", "", ""})
+	w.Write([]byte(b))
+
+}
@@ -0,0 +1,418 @@
+// Copyright 2017 Jonathan Pincas
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base32"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jpincas/ghost/ghost"
+	"github.com/spf13/viper"
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+const totpTestUser = "0f8b5d4c-2a6e-4f1b-8c3d-7e9a1b2c3d4e"
+
+func TestTOTPCode(t *testing.T) {
+
+	//Test vectors from RFC 6238, truncated to 6 digits
+	secret := []byte("12345678901234567890")
+
+	var tests = []struct {
+		time     int64
+		expected string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, test := range tests {
+		if code := totpCode(secret, test.time/totpPeriod); code != test.expected {
+			t.Errorf("At %v expected %s, got %s", test.time, test.expected, code)
+		}
+	}
+
+}
+
+func TestMatchTOTP(t *testing.T) {
+
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1111111109, 0)
+	counter := now.Unix() / totpPeriod
+	key := []byte("12345678901234567890")
+
+	var tests = []struct {
+		name     string
+		code     string
+		expected bool
+	}{
+		{"now", totpCode(key, counter), true},
+		{"previous step", totpCode(key, counter-1), true},
+		{"next step", totpCode(key, counter+1), true},
+		{"too old", totpCode(key, counter-2), false},
+		{"too new", totpCode(key, counter+2), false},
+		{"wrong length", "12345", false},
+	}
+
+	for _, test := range tests {
+		if _, ok := matchTOTP(secret, test.code, now); ok != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, ok)
+		}
+	}
+
+	if step, _ := matchTOTP(secret, totpCode(key, counter-1), now); step != counter-1 {
+		t.Errorf("Expected the time step of the code, got %v", step)
+	}
+
+}
+
+func TestVerifyTOTP(t *testing.T) {
+
+	viper.Set("secret", "secret")
+
+	db, mock, _ := sqlmock.New()
+	ghost.App.DB = db
+	defer db.Close()
+
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	key, _ := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	counter := time.Now().Unix() / totpPeriod
+	code := totpCode(key, counter)
+	rows := func(confirmed bool, lastCounter int64) *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"secret", "confirmed", "last_counter"}).AddRow(secret, confirmed, lastCounter)
+	}
+
+	mock.ExpectQuery("SELECT secret, confirmed, last_counter FROM user_totp").WithArgs(totpTestUser).WillReturnRows(rows(true, counter-5))
+	mock.ExpectExec("UPDATE user_totp SET last_counter").WithArgs(totpTestUser, counter).WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := VerifyTOTP(totpTestUser, code); err != nil {
+		t.Errorf("Expected the code to be accepted, got %v", err)
+	}
+
+	//Codes can't be replayed
+	mock.ExpectQuery("SELECT secret, confirmed, last_counter FROM user_totp").WithArgs(totpTestUser).WillReturnRows(rows(true, counter))
+	if err := VerifyTOTP(totpTestUser, code); err != ErrWrongTOTP {
+		t.Errorf("Expected a used code to be refused, got %v", err)
+	}
+
+	//Or used twice at the same time
+	mock.ExpectQuery("SELECT secret, confirmed, last_counter FROM user_totp").WithArgs(totpTestUser).WillReturnRows(rows(true, counter-5))
+	mock.ExpectExec("UPDATE user_totp SET last_counter").WithArgs(totpTestUser, counter).WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := VerifyTOTP(totpTestUser, code); err != ErrWrongTOTP {
+		t.Errorf("Expected a concurrently used code to be refused, got %v", err)
+	}
+
+	//Recovery codes are matched on their hash, however they are typed
+	mock.ExpectQuery("SELECT secret, confirmed, last_counter FROM user_totp").WithArgs(totpTestUser).WillReturnRows(rows(true, counter))
+	mock.ExpectExec("DELETE FROM user_recovery_codes").WithArgs(totpTestUser, hashCode(totpTestUser, "abcdefghijklmnop")).WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := VerifyTOTP(totpTestUser, "ABCD-efgh-ijkl-mnop"); err != nil {
+		t.Errorf("Expected the recovery code to be accepted, got %v", err)
+	}
+
+	mock.ExpectQuery("SELECT secret, confirmed, last_counter FROM user_totp").WithArgs(totpTestUser).WillReturnRows(rows(false, 0))
+	if err := VerifyTOTP(totpTestUser, code); err != ErrTOTPNotEnabled {
+		t.Errorf("Expected an unconfirmed secret not to be used, got %v", err)
+	}
+
+	mock.ExpectQuery("SELECT secret, confirmed, last_counter FROM user_totp").WithArgs(totpTestUser).WillReturnError(sql.ErrNoRows)
+	if err := VerifyTOTP(totpTestUser, code); err != ErrTOTPNotEnabled {
+		t.Errorf("Expected TOTP not to be enabled, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+}
+
+//serveTOTP calls a TOTP route as the logged in user
+func serveTOTP(handler http.HandlerFunc, code string, mfa bool) *httptest.ResponseRecorder {
+
+	b, _ := json.Marshal(map[string]string{"code": code})
+	req, _ := http.NewRequest("POST", "", bytes.NewBuffer(b))
+	req.RemoteAddr = "10.0.0.1:1234"
+	ctx := context.WithValue(context.WithValue(context.Background(), "userID", totpTestUser), "mfa", mfa)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req.WithContext(ctx))
+	return rr
+
+}
+
+func TestTOTPHandlers(t *testing.T) {
+
+	viper.Set("secret", "secret")
+	setTokenConfig()
+	setCodeConfig()
+	MagicCodes = NewMemoryCodeStore()
+
+	db, mock, _ := sqlmock.New()
+	ghost.App.DB = db
+	defer db.Close()
+
+	//Enroll
+	mock.ExpectQuery("SELECT email from users").WithArgs(totpTestUser).WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow("admin@me.com"))
+	mock.ExpectQuery("SELECT secret, confirmed, last_counter FROM user_totp").WithArgs(totpTestUser).WillReturnError(sql.ErrNoRows)
+	mock.ExpectExec("INSERT INTO user_totp").WithArgs(totpTestUser, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	rr := serveTOTP(enrollTOTP, "", false)
+	var enrollment TOTPEnrollment
+	json.Unmarshal(rr.Body.Bytes(), &enrollment)
+	uri, err := url.Parse(enrollment.URI)
+	if rr.Code != http.StatusOK || err != nil || uri.Scheme != "otpauth" || uri.Host != "totp" || uri.Path != "/Test Realm:admin@me.com" || uri.Query().Get("secret") != enrollment.Secret {
+		t.Fatalf("Expected a provisioning URI, got %v: %s", rr.Code, rr.Body)
+	}
+
+	key, _ := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(enrollment.Secret)
+	counter := time.Now().Unix() / totpPeriod
+
+	//Confirm
+	mock.ExpectQuery("SELECT secret, confirmed, last_counter FROM user_totp").WithArgs(totpTestUser).WillReturnRows(sqlmock.NewRows([]string{"secret", "confirmed", "last_counter"}).AddRow(enrollment.Secret, false, 0))
+	if rr := serveTOTP(confirmTOTP, "000000", false); rr.Code != http.StatusUnauthorized && totpCode(key, counter) != "000000" {
+		t.Errorf("Expected a wrong code not to confirm, got %v: %s", rr.Code, rr.Body)
+	}
+
+	mock.ExpectQuery("SELECT secret, confirmed, last_counter FROM user_totp").WithArgs(totpTestUser).WillReturnRows(sqlmock.NewRows([]string{"secret", "confirmed", "last_counter"}).AddRow(enrollment.Secret, false, 0))
+	mock.ExpectExec("UPDATE user_totp SET confirmed").WithArgs(totpTestUser, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM user_recovery_codes").WithArgs(totpTestUser).WillReturnResult(sqlmock.NewResult(0, 0))
+	for i := 0; i < recoveryCodeCount; i++ {
+		mock.ExpectExec("INSERT INTO user_recovery_codes").WithArgs(totpTestUser, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectQuery("SELECT role from users").WithArgs(totpTestUser).WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("admin"))
+	rr = serveTOTP(confirmTOTP, totpCode(key, counter), false)
+	var confirmation totpConfirmation
+	json.Unmarshal(rr.Body.Bytes(), &confirmation)
+	if len(confirmation.RecoveryCodes) != recoveryCodeCount || len(confirmation.RecoveryCodes[0]) != 19 {
+		t.Errorf("Expected recovery codes, got %v: %s", rr.Code, rr.Body)
+	}
+	if claims, err := ParseToken(confirmation.Token, AccessToken); err != nil || claims["mfa"] != true {
+		t.Errorf("Expected an MFA verified token, got %v", err)
+	}
+
+	//Enrolling again once confirmed is refused
+	mock.ExpectQuery("SELECT email from users").WithArgs(totpTestUser).WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow("admin@me.com"))
+	mock.ExpectQuery("SELECT secret, confirmed, last_counter FROM user_totp").WithArgs(totpTestUser).WillReturnRows(sqlmock.NewRows([]string{"secret", "confirmed", "last_counter"}).AddRow(enrollment.Secret, true, counter))
+	if rr := serveTOTP(enrollTOTP, "", true); rr.Code != http.StatusConflict {
+		t.Errorf("Expected enrolling again to conflict, got %v: %s", rr.Code, rr.Body)
+	}
+
+	//Verify a session
+	mock.ExpectQuery("SELECT secret, confirmed, last_counter FROM user_totp").WithArgs(totpTestUser).WillReturnRows(sqlmock.NewRows([]string{"secret", "confirmed", "last_counter"}).AddRow(enrollment.Secret, true, counter-1))
+	mock.ExpectExec("UPDATE user_totp SET last_counter").WithArgs(totpTestUser, counter).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT role from users").WithArgs(totpTestUser).WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("admin"))
+	rr = serveTOTP(verifyTOTP, totpCode(key, counter), false)
+	var tokens Tokens
+	json.Unmarshal(rr.Body.Bytes(), &tokens)
+	if claims, err := ParseToken(tokens.RefreshToken, RefreshToken); err != nil || claims["mfa"] != true {
+		t.Errorf("Expected MFA verified tokens, got %v: %s", rr.Code, rr.Body)
+	}
+
+	//Wrong codes lock the user out
+	for i := 0; i < 3; i++ {
+		mock.ExpectQuery("SELECT secret, confirmed, last_counter FROM user_totp").WithArgs(totpTestUser).WillReturnRows(sqlmock.NewRows([]string{"secret", "confirmed", "last_counter"}).AddRow(enrollment.Secret, true, counter))
+		if rr := serveTOTP(verifyTOTP, totpCode(key, counter), false); rr.Code != http.StatusUnauthorized {
+			t.Errorf("Expected a used code to be refused, got %v: %s", rr.Code, rr.Body)
+		}
+	}
+	if rr := serveTOTP(verifyTOTP, totpCode(key, counter), false); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected to be locked out, got %v: %s", rr.Code, rr.Body)
+	}
+
+	//Disable
+	if rr := serveTOTP(disableTOTP, "", false); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected disabling to need a verified session, got %v: %s", rr.Code, rr.Body)
+	}
+
+	mock.ExpectExec("DELETE FROM user_totp").WithArgs(totpTestUser).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM user_recovery_codes").WithArgs(totpTestUser).WillReturnResult(sqlmock.NewResult(0, 10))
+	if rr := serveTOTP(disableTOTP, "", true); rr.Code != http.StatusOK {
+		t.Errorf("Expected to disable, got %v: %s", rr.Code, rr.Body)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+}
+
+func TestAuthorizatorRequiresMFA(t *testing.T) {
+
+	viper.Set("secret", "secret")
+	setTokenConfig()
+	ghost.App.Config.TOTPRoles = []string{"admin"}
+	defer func() { ghost.App.Config.TOTPRoles = []string{} }()
+
+	unverified, _ := issueTokens(totpTestUser, "admin", false)
+	verified, _ := issueTokens(totpTestUser, "admin", true)
+
+	var tests = []struct {
+		name         string
+		token        string
+		role         string
+		middleware   func(http.Handler) http.Handler
+		expectedCode int
+	}{
+		{"verified", verified.Token, "admin", Authenticator, http.StatusOK},
+		{"unverified", unverified.Token, "admin", Authenticator, http.StatusForbidden},
+		{"role without TOTP", unverified.Token, "user", Authenticator, http.StatusOK},
+		{"setting up TOTP", unverified.Token, "admin", totpAuthenticator, http.StatusOK},
+	}
+
+	for _, test := range tests {
+
+		db, mock, _ := sqlmock.New()
+		ghost.App.DB = db
+		mock.ExpectQuery("SELECT EXISTS").WithArgs(sqlmock.AnyArg()).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+		mock.ExpectQuery("SELECT role from users").WithArgs(totpTestUser).WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(test.role))
+
+		var mfa interface{}
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mfa = r.Context().Value("mfa")
+		})
+
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+test.token)
+		rr := httptest.NewRecorder()
+		test.middleware(next).ServeHTTP(rr, req)
+
+		if rr.Code != test.expectedCode {
+			t.Errorf("%s: expected %v, got %v: %s", test.name, test.expectedCode, rr.Code, rr.Body)
+		}
+
+		if test.expectedCode == http.StatusOK && mfa != (test.token == verified.Token) {
+			t.Errorf("%s: expected whether the session is verified on the context, got %v", test.name, mfa)
+		}
+
+		db.Close()
+
+	}
+
+}
+
+//Logging in with a magic code and a TOTP code gives a verified session straight away
+func TestRequestLoginWithTOTP(t *testing.T) {
+
+	viper.Set("secret", "secret")
+	setTokenConfig()
+	setCodeConfig()
+	MagicCodes = NewMemoryCodeStore()
+
+	db, mock, _ := sqlmock.New()
+	ghost.App.DB = db
+	defer db.Close()
+
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	key, _ := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	counter := time.Now().Unix() / totpPeriod
+
+	login := func(totp string) *httptest.ResponseRecorder {
+		MagicCodes.SetCode("admin@me.com", hashCode("admin@me.com", "123456"), time.Minute)
+		req, _ := http.NewRequest("POST", "", strings.NewReader(`{"email": "admin@me.com", "code": "123456", "totp": "`+totp+`"}`))
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(requestLogin).ServeHTTP(rr, req)
+		return rr
+	}
+
+	expectUser := func() {
+		mock.ExpectQuery("SELECT id from users").WithArgs("admin@me.com").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(totpTestUser))
+		mock.ExpectExec("UPDATE users SET password = NULL").WithArgs(totpTestUser).WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+
+	expectUser()
+	mock.ExpectQuery("SELECT secret, confirmed, last_counter FROM user_totp").WithArgs(totpTestUser).WillReturnRows(sqlmock.NewRows([]string{"secret", "confirmed", "last_counter"}).AddRow(secret, true, 0))
+	mock.ExpectExec("UPDATE user_totp SET last_counter").WithArgs(totpTestUser, counter).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT role from users").WithArgs(totpTestUser).WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("admin"))
+	rr := login(totpCode(key, counter))
+	var tokens Tokens
+	json.Unmarshal(rr.Body.Bytes(), &tokens)
+	if claims, err := ParseToken(tokens.Token, AccessToken); err != nil || claims["mfa"] != true {
+		t.Errorf("Expected an MFA verified token, got %v: %s", rr.Code, rr.Body)
+	}
+
+	//Without one, the session has to be verified afterwards
+	expectUser()
+	mock.ExpectQuery("SELECT role from users").WithArgs(totpTestUser).WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("admin"))
+	rr = login("")
+	json.Unmarshal(rr.Body.Bytes(), &tokens)
+	if claims, err := ParseToken(tokens.Token, AccessToken); err != nil || claims["mfa"] != nil {
+		t.Errorf("Expected a token without the mfa claim, got %v: %s", rr.Code, rr.Body)
+	}
+
+	expectUser()
+	mock.ExpectQuery("SELECT secret, confirmed, last_counter FROM user_totp").WithArgs(totpTestUser).WillReturnRows(sqlmock.NewRows([]string{"secret", "confirmed", "last_counter"}).AddRow(secret, true, counter))
+	if rr := login(totpCode(key, counter)); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a used TOTP code to be refused, got %v: %s", rr.Code, rr.Body)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+}
+
+//A right password doesn't forget failed attempts until the TOTP code is right too,
+//so guessing the TOTP code with a known password locks out the email
+func TestPasswordLoginWrongTOTPLockout(t *testing.T) {
+
+	viper.Set("secret", "secret")
+	setTokenConfig()
+	setCodeConfig()
+	setPasswordConfig()
+
+	db, mock, _ := sqlmock.New()
+	ghost.App.DB = db
+	defer db.Close()
+	resetFailures("admin@me.com", "10.0.0.3")
+	defer resetFailures("admin@me.com", "10.0.0.3")
+
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	key, _ := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	wrong := totpCode(key, time.Now().Unix()/totpPeriod+100)
+	hash, _ := hashArgon2id("correct horse")
+
+	login := func() int {
+		req, _ := http.NewRequest("POST", "", strings.NewReader(`{"email": "admin@me.com", "password": "correct horse", "totp": "`+wrong+`"}`))
+		req.RemoteAddr = "10.0.0.3:1234"
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(passwordLogin).ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	for i := 0; i < ghost.App.Config.MagicCodeMaxAttempts; i++ {
+		mock.ExpectQuery("SELECT id, password, password_verified FROM users").WithArgs("admin@me.com").WillReturnRows(sqlmock.NewRows([]string{"id", "password", "password_verified"}).AddRow(totpTestUser, hash, true))
+		mock.ExpectQuery("SELECT secret, confirmed, last_counter FROM user_totp").WithArgs(totpTestUser).WillReturnRows(sqlmock.NewRows([]string{"secret", "confirmed", "last_counter"}).AddRow(secret, true, 0))
+		if code := login(); code != http.StatusUnauthorized {
+			t.Errorf("Expected a wrong TOTP code to be refused, got %v", code)
+		}
+	}
+
+	if code := login(); code != http.StatusTooManyRequests {
+		t.Errorf("Expected to be locked out, got %v", code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+}
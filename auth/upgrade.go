@@ -0,0 +1,184 @@
+// Copyright 2017 Jonathan Pincas
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jpincas/ghost/ghost"
+	"github.com/lib/pq"
+)
+
+//ErrAlreadyRegistered is returned when a user who is already in the users table, or an email that is, tries to register
+var ErrAlreadyRegistered = errors.New("Email address or user is already registered")
+
+//ErrInvalidUpgradeCode is returned when the code to register an anonymous user is wrong or has expired
+var ErrInvalidUpgradeCode = errors.New("Could not register with those credentials")
+
+//upgradeKey is the key upgrade codes are stored under, so they are kept apart from login codes for the email
+func upgradeKey(email string) string {
+
+	return "upgrade:" + email
+
+}
+
+//upgradeCodeHash binds the code to the anonymous user who asked for it, as well as the email
+func upgradeCodeHash(userID, email, code string) string {
+
+	return hashCode(email, userID+":"+code)
+
+}
+
+//RequestUpgradeCode emails a magic code to an email address that isn't registered yet,
+//which the anonymous user can use to register with it
+func RequestUpgradeCode(userID, email string) error {
+
+	//If system email is not configured, this can't be done, so exit straight away
+	if !ghost.App.MailServer.Working {
+		return errors.New("System email is not configured, so could not send magic code")
+	}
+
+	var id string
+	err := ghost.App.DB.QueryRow(ghost.SQLToFindUserByEmail, email).Scan(&id)
+	if err == nil {
+		return ErrAlreadyRegistered
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+
+	var role string
+	err = ghost.App.DB.QueryRow(ghost.SQLToGetUsersRole, userID).Scan(&role)
+	if err == nil {
+		return ErrAlreadyRegistered
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+
+	code, err := newMagicCode()
+	if err != nil {
+		return err
+	}
+
+	expiry := time.Duration(ghost.App.Config.MagicCodeExpiry) * time.Second
+	if err := MagicCodes.SetCode(upgradeKey(email), upgradeCodeHash(userID, email, code), expiry); err != nil {
+		return err
+	}
+
+	return ghost.App.MailServer.SendEmail(
+		[]string{email},
+		"Your Magic Code from "+ghost.App.MailServer.FromName,
+		map[string]string{"password": code},
+		templates,
+		"defaultmagiccodeemail.html")
+
+}
+
+//UpgradeUser registers an anonymous user with the email the code was sent to.
+//The user keeps their id, so anything they created while anonymous stays theirs
+func UpgradeUser(userID, email, code string) error {
+
+	used, err := MagicCodes.UseCode(upgradeKey(email), upgradeCodeHash(userID, email, code))
+	if err != nil {
+		return err
+	} else if !used {
+		return ErrInvalidUpgradeCode
+	}
+
+	_, err = ghost.App.DB.Exec(ghost.SQLToRegisterAnonUser, userID, email)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		return ErrAlreadyRegistered
+	}
+
+	return err
+
+}
+
+//requestUpgrade emails a magic code for the logged in anonymous user to register with
+func requestUpgrade(w http.ResponseWriter, r *http.Request) {
+
+	userID := fmt.Sprint(r.Context().Value("userID"))
+	sendToEmail(w, r, func(email string) error {
+		return RequestUpgradeCode(userID, email)
+	})
+
+}
+
+//confirmUpgrade registers the logged in anonymous user with their email and the code sent to it,
+//and returns new tokens for them as a registered user.
+//Failed attempts count towards the same lockout as magic codes
+func confirmUpgrade(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", ghost.ContentTypeJSON)
+
+	var body struct {
+		Email string `json:"email"`
+		Code  string `json:"code"`
+	}
+
+	if r.Body == nil || json.NewDecoder(r.Body).Decode(&body) != nil || body.Email == "" || body.Code == "" {
+
+		w.WriteHeader(http.StatusBadRequest)
+		b, _ := json.Marshal(ghost.ResponseError{http.StatusBadRequest, "", "Email address and magic code must be provided", "", "", ""})
+		w.Write([]byte(b))
+		return
+
+	}
+
+	body.Email = NormaliseEmail(body.Email)
+	ip := clientIP(r)
+	locked, err := countAttempt(body.Email, ip, upgradeKey(body.Email))
+	if err != nil {
+
+		w.WriteHeader(http.StatusServiceUnavailable)
+		b, _ := json.Marshal(ghost.ResponseError{http.StatusServiceUnavailable, "", err.Error(), "", "", ""})
+		w.Write([]byte(b))
+		return
+
+	} else if locked {
+
+		w.WriteHeader(http.StatusTooManyRequests)
+		b, _ := json.Marshal(ghost.ResponseError{http.StatusTooManyRequests, "", "Too many failed attempts, please try again later", "", "", ""})
+		w.Write([]byte(b))
+		return
+
+	}
+
+	userID := fmt.Sprint(r.Context().Value("userID"))
+	if err := UpgradeUser(userID, body.Email, body.Code); err != nil {
+
+		code := http.StatusServiceUnavailable
+		switch err {
+		case ErrInvalidUpgradeCode:
+			code = http.StatusUnauthorized
+		case ErrAlreadyRegistered:
+			code = http.StatusConflict
+		}
+
+		w.WriteHeader(code)
+		b, _ := json.Marshal(ghost.ResponseError{code, "", err.Error(), "", "", ""})
+		w.Write([]byte(b))
+		return
+
+	}
+
+	resetFailures(body.Email, ip)
+	respondWithTokens(w, userID, false)
+
+}
@@ -0,0 +1,157 @@
+// Copyright 2017 Jonathan Pincas
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jpincas/ghost/ghost"
+	"github.com/lib/pq"
+	"github.com/spf13/viper"
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+const anonTestUser = "9a7b5c3d-1e2f-4a6b-8c0d-2e4f6a8b0c1d"
+
+func TestRequestUpgradeCode(t *testing.T) {
+
+	db, mock, _ := sqlmock.New()
+	ghost.App.DB = db
+	defer db.Close()
+	defer func() { ghost.App.MailServer.Working = false }()
+
+	ghost.App.MailServer.Working = false
+	if err := RequestUpgradeCode(anonTestUser, "new@me.com"); err == nil {
+		t.Error("Expected the request to fail without email")
+	}
+
+	ghost.App.MailServer.Working = true
+	mock.ExpectQuery("SELECT id from users").WithArgs("taken@me.com").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("692e8a64-7676-4790-b3f8-a86a5083d5bb"))
+	if err := RequestUpgradeCode(anonTestUser, "taken@me.com"); err != ErrAlreadyRegistered {
+		t.Errorf("Expected a registered email to be refused, got %v", err)
+	}
+
+	mock.ExpectQuery("SELECT id from users").WithArgs("new@me.com").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("SELECT role from users").WithArgs(anonTestUser).WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("anon"))
+	if err := RequestUpgradeCode(anonTestUser, "new@me.com"); err != ErrAlreadyRegistered {
+		t.Errorf("Expected a registered user to be refused, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+}
+
+//postUpgrade confirms an upgrade as the anonymous user
+func postUpgrade(body string) *httptest.ResponseRecorder {
+
+	req, _ := http.NewRequest("POST", "", strings.NewReader(body))
+	req.RemoteAddr = "10.0.0.1:1234"
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(confirmUpgrade).ServeHTTP(rr, req.WithContext(context.WithValue(context.Background(), "userID", anonTestUser)))
+	return rr
+
+}
+
+func TestConfirmUpgrade(t *testing.T) {
+
+	viper.Set("secret", "secret")
+	setTokenConfig()
+	setCodeConfig()
+	MagicCodes = NewMemoryCodeStore()
+
+	db, mock, _ := sqlmock.New()
+	ghost.App.DB = db
+	defer db.Close()
+
+	if rr := postUpgrade(`{"email": "new@me.com"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected a missing code to be refused, got %v: %s", rr.Code, rr.Body)
+	}
+
+	//Codes are bound to the anonymous user who asked for them
+	MagicCodes.SetCode(upgradeKey("new@me.com"), upgradeCodeHash("692e8a64-7676-4790-b3f8-a86a5083d5bb", "new@me.com", "123456"), time.Minute)
+	if rr := postUpgrade(`{"email": "new@me.com", "code": "123456"}`); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected another user's code to be refused, got %v: %s", rr.Code, rr.Body)
+	}
+
+	//Login codes can't be used to register
+	MagicCodes.SetCode("new@me.com", hashCode("new@me.com", "123456"), time.Minute)
+	if rr := postUpgrade(`{"email": "new@me.com", "code": "123456"}`); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a login code to be refused, got %v: %s", rr.Code, rr.Body)
+	}
+
+	MagicCodes.SetCode(upgradeKey("new@me.com"), upgradeCodeHash(anonTestUser, "new@me.com", "123456"), time.Minute)
+	mock.ExpectExec("INSERT INTO users").WithArgs(anonTestUser, "new@me.com").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT role from users").WithArgs(anonTestUser).WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("anon"))
+	rr := postUpgrade(`{"email": "new@me.com", "code": "123456"}`)
+	var tokens Tokens
+	json.Unmarshal(rr.Body.Bytes(), &tokens)
+	if claims, err := ParseToken(tokens.Token, AccessToken); err != nil || claims["userID"] != anonTestUser {
+		t.Errorf("Expected tokens for the same user, got %v: %s", rr.Code, rr.Body)
+	}
+
+	//Each code can only be used once
+	if rr := postUpgrade(`{"email": "new@me.com", "code": "123456"}`); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a used code to be refused, got %v: %s", rr.Code, rr.Body)
+	}
+
+	MagicCodes.SetCode(upgradeKey("taken@me.com"), upgradeCodeHash(anonTestUser, "taken@me.com", "123456"), time.Minute)
+	mock.ExpectExec("INSERT INTO users").WithArgs(anonTestUser, "taken@me.com").WillReturnError(&pq.Error{Code: "23505"})
+	if rr := postUpgrade(`{"email": "taken@me.com", "code": "123456"}`); rr.Code != http.StatusConflict {
+		t.Errorf("Expected a registered email to conflict, got %v: %s", rr.Code, rr.Body)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+}
+
+//On lockout the upgrade code is removed, not the login code for the email
+func TestConfirmUpgradeLockout(t *testing.T) {
+
+	viper.Set("secret", "secret")
+	setCodeConfig()
+	MagicCodes = NewMemoryCodeStore()
+
+	MagicCodes.SetCode(upgradeKey("locked@me.com"), upgradeCodeHash(anonTestUser, "locked@me.com", "123456"), time.Minute)
+	MagicCodes.SetCode("locked@me.com", hashCode("locked@me.com", "654321"), time.Minute)
+
+	for i := 0; i < ghost.App.Config.MagicCodeMaxAttempts; i++ {
+		if rr := postUpgrade(`{"email": "locked@me.com", "code": "000000"}`); rr.Code != http.StatusUnauthorized {
+			t.Errorf("Expected a wrong code to be refused, got %v: %s", rr.Code, rr.Body)
+		}
+	}
+
+	if rr := postUpgrade(`{"email": "locked@me.com", "code": "123456"}`); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected to be locked out, got %v: %s", rr.Code, rr.Body)
+	}
+
+	if used, _ := MagicCodes.UseCode(upgradeKey("locked@me.com"), upgradeCodeHash(anonTestUser, "locked@me.com", "123456")); used {
+		t.Error("Expected the upgrade code to have been removed on lockout")
+	}
+	if used, _ := MagicCodes.UseCode("locked@me.com", hashCode("locked@me.com", "654321")); !used {
+		t.Error("Expected the login code to have been kept")
+	}
+
+}
@@ -0,0 +1,552 @@
+// Copyright 2017 Jonathan Pincas
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmds
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jpincas/ghost/ghost"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+)
+
+//checksumsFileName lists the SHA-256 of every other file in a packed bundle, in the format of sha256sum.
+//It is inside the archive, so it detects a corrupted or incomplete archive, but not one that has been tampered with,
+//as whoever changes the files can change it too.  For that, check the digest of the whole archive with --sha256
+const checksumsFileName = "CHECKSUMS"
+
+//maxBundleArchiveSize is the most a bundle archive can unpack to
+const maxBundleArchiveSize = 64 << 20
+
+var packOutputDir, installGitRef, installSHA256 string
+
+func init() {
+	RootCmd.AddCommand(bundleCmd)
+	bundleCmd.AddCommand(bundlePackCmd)
+	bundlePackCmd.Flags().StringVarP(&packOutputDir, "output", "o", ".", "Folder to write the archive to")
+}
+
+// bundleCmd represents the bundle command
+var bundleCmd = &cobra.Command{
+	Use:   "bundle [command]",
+	Short: "Work with ghost bundles",
+}
+
+var bundlePackCmd = &cobra.Command{
+	Use:   "pack [bundle]",
+	Short: "Package a bundle for distribution",
+	Long: `Packs the named bundle folder into {name}-{version}.tar.gz, with a
+	CHECKSUMS file listing the SHA-256 of every file.  The bundle must have a
+	bundle.json manifest with a version.  Install the archive elsewhere with
+	'ghost install {name}-{version}.tar.gz --sha256 {digest}', using the
+	SHA-256 of the archive that is printed once it is packed`,
+	RunE: packBundle,
+}
+
+func packBundle(cmd *cobra.Command, args []string) error {
+
+	//Check for bundle name
+	if len(args) < 1 {
+		return errors.New("a bundle name must be provided")
+	}
+
+	if ghost.App.FileSystem == nil {
+		ghost.App.FileSystem = afero.NewOsFs()
+	}
+
+	archive, err := packBundleArchive(args[0])
+	if err != nil {
+		ghost.LogFatal("BUNDLE", false, "Could not pack bundle '"+args[0]+"'", err)
+	}
+
+	if err := ghost.App.FileSystem.MkdirAll(packOutputDir, os.ModePerm); err != nil {
+		ghost.LogFatal("BUNDLE", false, "Could not create output folder", err)
+	}
+
+	filename := filepath.Join(packOutputDir, archive.Name)
+	if err := afero.WriteFile(ghost.App.FileSystem, filename, archive.Bytes, 0644); err != nil {
+		ghost.LogFatal("BUNDLE", false, "Could not write "+filename, err)
+	}
+
+	//The digest is published with the archive, so that it can be checked with 'ghost install --sha256'
+	sum := sha256.Sum256(archive.Bytes)
+	ghost.Log("BUNDLE", true, "Packed bundle '"+args[0]+"' into "+filename+" with SHA-256 "+hex.EncodeToString(sum[:]), nil)
+	return nil
+
+}
+
+//packedBundle is a bundle archive and the name to save it as
+type packedBundle struct {
+	Name  string
+	Bytes []byte
+}
+
+//packBundleArchive packs a bundle's folder into a gzipped tar, with every file under a folder
+//named after the bundle, and adds the checksums of the files
+func packBundleArchive(bundleName string) (packedBundle, error) {
+
+	m, err := readManifest(bundleName)
+	if err != nil {
+		return packedBundle{}, err
+	}
+	if m.Version == "" {
+		return packedBundle{}, errors.New("Bundles need a bundle.json manifest with a version to be packed")
+	}
+
+	basePath := path.Join("bundles", bundleName)
+	files := map[string][]byte{}
+
+	err = afero.Walk(ghost.App.FileSystem, basePath, func(filename string, info os.FileInfo, err error) error {
+
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		name := filepath.ToSlash(strings.TrimPrefix(filename, basePath+string(filepath.Separator)))
+		if name == checksumsFileName {
+			return nil
+		}
+
+		files[name], err = afero.ReadFile(ghost.App.FileSystem, filename)
+		return err
+
+	})
+	if err != nil {
+		return packedBundle{}, err
+	}
+
+	files[checksumsFileName] = checksums(files)
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	for _, name := range sortedFileNames(files) {
+
+		header := &tar.Header{Name: bundleName + "/" + name, Mode: 0644, Size: int64(len(files[name])), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(header); err != nil {
+			return packedBundle{}, err
+		}
+		if _, err := tw.Write(files[name]); err != nil {
+			return packedBundle{}, err
+		}
+
+	}
+
+	if err := tw.Close(); err != nil {
+		return packedBundle{}, err
+	}
+	if err := gz.Close(); err != nil {
+		return packedBundle{}, err
+	}
+
+	return packedBundle{Name: bundleName + "-" + m.Version + ".tar.gz", Bytes: buf.Bytes()}, nil
+
+}
+
+//sortedFileNames returns the names of the files in order
+func sortedFileNames(files map[string][]byte) []string {
+
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+
+}
+
+//checksums lists the SHA-256 of each file, one per line, in the format of sha256sum
+func checksums(files map[string][]byte) []byte {
+
+	var buf bytes.Buffer
+	for _, name := range sortedFileNames(files) {
+		sum := sha256.Sum256(files[name])
+		fmt.Fprintf(&buf, "%s  %s\n", hex.EncodeToString(sum[:]), name)
+	}
+
+	return buf.Bytes()
+
+}
+
+//checkArchiveDigest checks the SHA-256 of a whole archive against the expected one, if there is one
+func checkArchiveDigest(archive []byte, expected string) error {
+
+	if expected == "" {
+		return nil
+	}
+
+	sum := sha256.Sum256(archive)
+	if digest := hex.EncodeToString(sum[:]); !strings.EqualFold(digest, strings.TrimSpace(expected)) {
+		return errors.New("SHA-256 of the archive is " + digest + ", not " + expected)
+	}
+
+	return nil
+
+}
+
+//verifyChecksums checks that every file of a bundle is listed in its checksums file with the right checksum,
+//and that every file listed is there
+func verifyChecksums(files map[string][]byte) error {
+
+	list, ok := files[checksumsFileName]
+	if !ok {
+		return errors.New("Bundle has no " + checksumsFileName + " file")
+	}
+
+	listed := map[string]bool{}
+	scanner := bufio.NewScanner(bytes.NewReader(list))
+	for scanner.Scan() {
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		parts := strings.SplitN(line, "  ", 2)
+		if len(parts) != 2 {
+			return errors.New("Malformed checksum line: " + line)
+		}
+
+		contents, ok := files[parts[1]]
+		if !ok {
+			return errors.New("File " + parts[1] + " is listed in the checksums, but missing")
+		}
+
+		sum := sha256.Sum256(contents)
+		if hex.EncodeToString(sum[:]) != parts[0] {
+			return errors.New("Checksum of " + parts[1] + " does not match")
+		}
+
+		listed[parts[1]] = true
+
+	}
+
+	for name := range files {
+		if name != checksumsFileName && !listed[name] {
+			return errors.New("File " + name + " is not listed in the checksums")
+		}
+	}
+
+	return scanner.Err()
+
+}
+
+//readBundleArchive reads the regular files from a tar, optionally gzipped, by path.
+//Files are limited in total size, and paths must stay inside the archive
+func readBundleArchive(r io.Reader, gzipped bool) (map[string][]byte, error) {
+
+	if gzipped {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	files := map[string][]byte{}
+	tr := tar.NewReader(r)
+	var total int64
+
+	for {
+
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		//Folders are implied by the files in them, and links are not followed
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := path.Clean(header.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return nil, errors.New("Archive contains a file outside the bundle: " + header.Name)
+		}
+
+		total += header.Size
+		if total > maxBundleArchiveSize {
+			return nil, errors.New("Archive is too large")
+		}
+
+		if files[name], err = ioutil.ReadAll(tr); err != nil {
+			return nil, err
+		}
+
+	}
+
+	//Archives packed by ghost have every file in a folder named after the bundle
+	if _, ok := files[manifestFileName]; !ok {
+		files = withoutTopFolder(files)
+	}
+
+	return files, nil
+
+}
+
+//withoutTopFolder removes the folder that all the files are in, if they are all in the same one
+func withoutTopFolder(files map[string][]byte) map[string][]byte {
+
+	top := ""
+	for name := range files {
+		i := strings.Index(name, "/")
+		if i < 0 || (top != "" && name[:i] != top) {
+			return files
+		}
+		top = name[:i]
+	}
+
+	stripped := map[string][]byte{}
+	for name, contents := range files {
+		stripped[strings.TrimPrefix(name, top+"/")] = contents
+	}
+
+	return stripped
+
+}
+
+//unpackedBundles are the folders bundles from archives and repositories have been unpacked into, by name.
+//They are installed from there, and only replace the bundle's folder in 'bundles' once they are installed
+var unpackedBundles = map[string]string{}
+
+//bundlePath is the path in a bundle's folder, or in the folder it has been unpacked into if it is being installed
+func bundlePath(bundleName string, elem ...string) string {
+
+	base, ok := unpackedBundles[bundleName]
+	if !ok {
+		base = path.Join("bundles", bundleName)
+	}
+
+	return path.Join(append([]string{base}, elem...)...)
+
+}
+
+//keepUnpackedBundles moves the bundles unpacked for an installation into their folders in 'bundles',
+//replacing the folders that were there
+func keepUnpackedBundles() error {
+
+	for bundleName, unpacked := range unpackedBundles {
+
+		basePath := path.Join("bundles", bundleName)
+		replaced := path.Join("bundles", "."+bundleName+".replaced")
+		if err := ghost.App.FileSystem.RemoveAll(replaced); err != nil {
+			return err
+		}
+
+		if exists, _ := afero.Exists(ghost.App.FileSystem, basePath); exists {
+			if err := moveFolder(basePath, replaced); err != nil {
+				return err
+			}
+		}
+		if err := moveFolder(unpacked, basePath); err != nil {
+			return err
+		}
+		if err := ghost.App.FileSystem.RemoveAll(replaced); err != nil {
+			return err
+		}
+
+		delete(unpackedBundles, bundleName)
+
+	}
+
+	return nil
+
+}
+
+//moveFolder moves the files in a folder to another one, file by file, as not every file system can rename a folder
+func moveFolder(from, to string) error {
+
+	err := afero.Walk(ghost.App.FileSystem, from, func(filename string, info os.FileInfo, err error) error {
+
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		moved := path.Join(to, strings.TrimPrefix(filename, from))
+		if err := ghost.App.FileSystem.MkdirAll(path.Dir(moved), os.ModePerm); err != nil {
+			return err
+		}
+		return ghost.App.FileSystem.Rename(filename, moved)
+
+	})
+	if err != nil {
+		return err
+	}
+
+	return ghost.App.FileSystem.RemoveAll(from)
+
+}
+
+//discardUnpackedBundles removes the bundles unpacked for an installation that didn't happen,
+//leaving the folders in 'bundles' as they were
+func discardUnpackedBundles() {
+
+	for bundleName, unpacked := range unpackedBundles {
+		if err := ghost.App.FileSystem.RemoveAll(unpacked); err != nil {
+			ghost.Log("INSTALL", false, "Could not remove "+unpacked, err)
+		}
+		delete(unpackedBundles, bundleName)
+	}
+
+}
+
+//unpackBundle writes the files of a bundle from an archive or repository into a folder next to its folder
+//in 'bundles', once its manifest and any checksums have been checked, and returns its name.
+//The bundle is installed from there, and only replaces an existing bundle folder, if replace is set, once kept
+func unpackBundle(files map[string][]byte, requireChecksums, replace bool) (string, error) {
+
+	if _, ok := files[checksumsFileName]; ok || requireChecksums {
+		if err := verifyChecksums(files); err != nil {
+			return "", err
+		}
+	}
+
+	contents, ok := files[manifestFileName]
+	if !ok {
+		return "", errors.New("Bundle has no " + manifestFileName + " manifest")
+	}
+
+	var m bundleManifest
+	if err := json.Unmarshal(contents, &m); err != nil {
+		return "", fmt.Errorf("Could not read the bundle's manifest: %s", err)
+	}
+	if err := checkBundleName(m.Name); err != nil {
+		return "", err
+	}
+
+	basePath := path.Join("bundles", m.Name)
+	if exists, _ := afero.Exists(ghost.App.FileSystem, basePath); exists && !replace {
+		return "", errors.New("Bundle folder " + basePath + " already exists.  Use --reinstall to replace it")
+	}
+
+	//Anything left from an installation that was interrupted is removed first
+	unpacked := path.Join("bundles", "."+m.Name+".unpacked")
+	if err := ghost.App.FileSystem.RemoveAll(unpacked); err != nil {
+		return "", err
+	}
+	unpackedBundles[m.Name] = unpacked
+
+	for _, name := range sortedFileNames(files) {
+
+		filename := path.Join(unpacked, name)
+		if err := ghost.App.FileSystem.MkdirAll(path.Dir(filename), os.ModePerm); err != nil {
+			return "", err
+		}
+		if err := afero.WriteFile(ghost.App.FileSystem, filename, files[name], 0644); err != nil {
+			return "", err
+		}
+
+	}
+
+	ghost.Log("INSTALL", true, "Unpacked bundle '"+m.Name+"' version "+m.Version+" into "+unpacked, nil)
+	return m.Name, nil
+
+}
+
+//fetchBundle unpacks the bundle to install next to 'bundles' if it is an archive or git repository,
+//and returns the name of the bundle to install.  Anything else is taken to be the name of a bundle already there
+func fetchBundle(source string, replace bool) (string, error) {
+
+	if strings.HasSuffix(source, ".tar.gz") || strings.HasSuffix(source, ".tgz") || strings.HasSuffix(source, ".tar") {
+
+		archive, err := afero.ReadFile(ghost.App.FileSystem, source)
+		if err != nil {
+			return "", err
+		}
+
+		if err := checkArchiveDigest(archive, installSHA256); err != nil {
+			return "", err
+		}
+
+		files, err := readBundleArchive(bytes.NewReader(archive), !strings.HasSuffix(source, ".tar"))
+		if err != nil {
+			return "", fmt.Errorf("Could not read archive %s: %s", source, err)
+		}
+
+		//Archives have to be packed with checksums, so they are always verified
+		return unpackBundle(files, true, replace)
+
+	}
+
+	//Only an archive has a digest to check
+	if installSHA256 != "" {
+		return "", errors.New("--sha256 can only be used when installing from an archive")
+	}
+
+	if isGitRepository(source) {
+
+		ref := installGitRef
+		if ref == "" {
+			ref = "HEAD"
+		}
+
+		var stdout, stderr bytes.Buffer
+		git := exec.Command("git", "-C", source, "archive", "--format=tar", ref)
+		git.Stdout, git.Stderr = &stdout, &stderr
+		if err := git.Run(); err != nil {
+			return "", fmt.Errorf("Could not read %s from git repository %s: %s", ref, source, strings.TrimSpace(stderr.String()))
+		}
+
+		files, err := readBundleArchive(&stdout, false)
+		if err != nil {
+			return "", err
+		}
+
+		//Git checks the integrity of its own files, so checksums are verified only if the bundle has them
+		return unpackBundle(files, false, replace)
+
+	}
+
+	return source, nil
+
+}
+
+//isGitRepository returns whether the path is a git repository, either a working copy or bare
+func isGitRepository(source string) bool {
+
+	if !strings.ContainsAny(source, `/\`) && source != "." {
+		return false
+	}
+
+	for _, marker := range []string{".git", "HEAD"} {
+		if exists, _ := afero.Exists(ghost.App.FileSystem, filepath.Join(source, marker)); exists {
+			return true
+		}
+	}
+
+	return false
+
+}
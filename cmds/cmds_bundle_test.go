@@ -0,0 +1,300 @@
+// Copyright 2017 Jonathan Pincas
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmds
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jpincas/ghost/ghost"
+	"github.com/spf13/afero"
+)
+
+var testBundleFiles = map[string]string{
+	"bundle.json":                         `{"name": "invoicing", "version": "1.2.0"}`,
+	"install/00_install.sql":              "CREATE TABLE invoices (id int);",
+	"migrations/0001_add_totals.up.sql":   "ALTER TABLE invoices ADD COLUMN total int;",
+	"migrations/0001_add_totals.down.sql": "ALTER TABLE invoices DROP COLUMN total;",
+}
+
+func TestPackAndUnpackBundle(t *testing.T) {
+
+	ghost.App.FileSystem = afero.NewMemMapFs()
+	for name, contents := range testBundleFiles {
+		afero.WriteFile(ghost.App.FileSystem, "bundles/invoicing/"+name, []byte(contents), 0644)
+	}
+
+	packed, err := packBundleArchive("invoicing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packed.Name != "invoicing-1.2.0.tar.gz" {
+		t.Errorf("Unexpected archive name %s", packed.Name)
+	}
+
+	files, err := readBundleArchive(bytes.NewReader(packed.Bytes), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := files[checksumsFileName]; !ok || len(files) != len(testBundleFiles)+1 {
+		t.Errorf("Unexpected files in archive %v", sortedFileNames(files))
+	}
+
+	//The existing folder is only replaced when asked to
+	if _, err := unpackBundle(files, true, false); err == nil {
+		t.Error("Expected an error unpacking over an existing bundle")
+	}
+
+	ghost.App.FileSystem = afero.NewMemMapFs()
+	name, err := unpackBundle(files, true, false)
+	if err != nil || name != "invoicing" {
+		t.Fatalf("Expected invoicing to be unpacked, got %s, %v", name, err)
+	}
+
+	//It is only moved into 'bundles' once kept
+	if exists, _ := afero.Exists(ghost.App.FileSystem, "bundles/invoicing"); exists {
+		t.Error("Expected the bundle not to be in 'bundles' until it is kept")
+	}
+	if err := keepUnpackedBundles(); err != nil {
+		t.Fatal(err)
+	}
+	for filename, contents := range testBundleFiles {
+		if b, _ := afero.ReadFile(ghost.App.FileSystem, "bundles/invoicing/"+filename); string(b) != contents {
+			t.Errorf("Unexpected contents of %s: %s", filename, b)
+		}
+	}
+
+}
+
+//A bundle unpacked to replace another is installed from its own folder, and the folder it replaces
+//is left as it was unless it is kept
+func TestUnpackBundleReplace(t *testing.T) {
+
+	ghost.App.FileSystem = afero.NewMemMapFs()
+	afero.WriteFile(ghost.App.FileSystem, "bundles/invoicing/bundle.json", []byte(`{"name": "invoicing", "version": "1.1.0"}`), 0644)
+	afero.WriteFile(ghost.App.FileSystem, "bundles/invoicing/install/99_old.sql", []byte("CREATE TABLE old (id int);"), 0644)
+
+	files := map[string][]byte{}
+	for name, contents := range testBundleFiles {
+		files[name] = []byte(contents)
+	}
+
+	if _, err := unpackBundle(files, false, true); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := readManifest("invoicing"); err != nil || m.Version != "1.2.0" {
+		t.Errorf("Expected the unpacked bundle to be installed, got %v, %v", m, err)
+	}
+
+	discardUnpackedBundles()
+	if m, err := readManifest("invoicing"); err != nil || m.Version != "1.1.0" {
+		t.Errorf("Expected the bundle folder to be left as it was, got %v, %v", m, err)
+	}
+	if exists, _ := afero.Exists(ghost.App.FileSystem, "bundles/.invoicing.unpacked"); exists {
+		t.Error("Expected the unpacked bundle to be removed")
+	}
+
+	if _, err := unpackBundle(files, false, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := keepUnpackedBundles(); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := readManifest("invoicing"); err != nil || m.Version != "1.2.0" {
+		t.Errorf("Expected the bundle folder to be replaced, got %v, %v", m, err)
+	}
+	if exists, _ := afero.Exists(ghost.App.FileSystem, "bundles/invoicing/install/99_old.sql"); exists {
+		t.Error("Expected the files of the replaced bundle to be gone")
+	}
+
+}
+
+//The checksums inside an archive can be changed along with its files, so the whole archive is checked with --sha256
+func TestFetchBundleSHA256(t *testing.T) {
+
+	ghost.App.FileSystem = afero.NewMemMapFs()
+	for name, contents := range testBundleFiles {
+		afero.WriteFile(ghost.App.FileSystem, "bundles/invoicing/"+name, []byte(contents), 0644)
+	}
+	packed, err := packBundleArchive("invoicing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(packed.Bytes)
+	defer func() { installSHA256 = "" }()
+
+	ghost.App.FileSystem = afero.NewMemMapFs()
+	afero.WriteFile(ghost.App.FileSystem, packed.Name, packed.Bytes, 0644)
+
+	installSHA256 = strings.Repeat("0", 64)
+	if _, err := fetchBundle(packed.Name, false); err == nil {
+		t.Error("Expected an archive with a different SHA-256 to be refused")
+	}
+	if exists, _ := afero.Exists(ghost.App.FileSystem, "bundles/invoicing"); exists {
+		t.Error("Expected the refused archive not to be unpacked")
+	}
+
+	installSHA256 = strings.ToUpper(hex.EncodeToString(sum[:]))
+	if name, err := fetchBundle(packed.Name, false); err != nil || name != "invoicing" {
+		t.Errorf("Expected the archive to be unpacked, got %s, %v", name, err)
+	}
+	discardUnpackedBundles()
+
+	//Only archives have a digest to check
+	if _, err := fetchBundle("invoicing", false); err == nil {
+		t.Error("Expected --sha256 to be refused for a bundle folder")
+	}
+
+}
+
+func TestVerifyChecksums(t *testing.T) {
+
+	files := map[string][]byte{}
+	for name, contents := range testBundleFiles {
+		files[name] = []byte(contents)
+	}
+	files[checksumsFileName] = checksums(files)
+
+	if err := verifyChecksums(files); err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := func(change func(files map[string][]byte)) map[string][]byte {
+		copied := map[string][]byte{}
+		for name, contents := range files {
+			copied[name] = contents
+		}
+		change(copied)
+		return copied
+	}
+
+	for description, files := range map[string]map[string][]byte{
+		"changed file": tampered(func(f map[string][]byte) { f["install/00_install.sql"] = []byte("DROP TABLE users;") }),
+		"added file":   tampered(func(f map[string][]byte) { f["install/01_extra.sql"] = []byte("DROP TABLE users;") }),
+		"removed file": tampered(func(f map[string][]byte) { delete(f, "install/00_install.sql") }),
+		"no checksums": tampered(func(f map[string][]byte) { delete(f, checksumsFileName) }),
+		"malformed":    tampered(func(f map[string][]byte) { f[checksumsFileName] = []byte("nonsense") }),
+	} {
+		if err := verifyChecksums(files); err == nil {
+			t.Errorf("Expected an error for %s", description)
+		}
+		if _, err := unpackBundle(files, true, true); err == nil {
+			t.Errorf("Expected %s not to be unpacked", description)
+		}
+	}
+
+}
+
+//Bundle names are also schema names, so only safe identifiers are unpacked
+func TestUnpackBundleInvalidName(t *testing.T) {
+
+	ghost.App.FileSystem = afero.NewMemMapFs()
+
+	for _, name := range []string{"", "../evil", ".hidden", "Invoicing", "1invoicing", "invoicing; DROP SCHEMA public CASCADE", `invoicing"`} {
+
+		manifest, _ := json.Marshal(bundleManifest{Name: name, Version: "1.0.0"})
+		if _, err := unpackBundle(map[string][]byte{manifestFileName: manifest}, false, true); err == nil {
+			t.Errorf("Expected an error for the name %q", name)
+		}
+
+	}
+
+}
+
+func TestReadBundleArchiveOutsidePaths(t *testing.T) {
+
+	for _, name := range []string{"../evil.sql", "/etc/evil.sql", "invoicing/../../evil.sql"} {
+
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: 4, Typeflag: tar.TypeReg})
+		tw.Write([]byte("evil"))
+		tw.Close()
+
+		if _, err := readBundleArchive(&buf, false); err == nil {
+			t.Errorf("Expected an error for %s", name)
+		}
+
+	}
+
+}
+
+func TestFetchBundleFromGit(t *testing.T) {
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir, err := os.MkdirTemp("", "ghostbundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo := filepath.Join(dir, "repo")
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-C", repo, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %s", strings.Join(args, " "), out)
+		}
+	}
+
+	for name, contents := range testBundleFiles {
+		os.MkdirAll(filepath.Dir(filepath.Join(repo, name)), os.ModePerm)
+		os.WriteFile(filepath.Join(repo, name), []byte(contents), 0644)
+	}
+	git("init", "-q")
+	git("add", "-A")
+	git("commit", "-q", "-m", "1.2.0")
+	git("tag", "v1.2.0")
+	os.WriteFile(filepath.Join(repo, "install/00_install.sql"), []byte("CREATE TABLE invoices (id bigint);"), 0644)
+	git("commit", "-q", "-a", "-m", "next")
+
+	//The bundle is unpacked relative to the working directory
+	wd, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(wd)
+	ghost.App.FileSystem = afero.NewOsFs()
+
+	installGitRef = "v1.2.0"
+	defer func() { installGitRef = "" }()
+
+	name, err := fetchBundle(repo, false)
+	if err != nil || name != "invoicing" {
+		t.Fatalf("Expected invoicing to be fetched, got %s, %v", name, err)
+	}
+	if err := keepUnpackedBundles(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := os.ReadFile(filepath.Join(dir, "bundles/invoicing/install/00_install.sql"))
+	if string(b) != testBundleFiles["install/00_install.sql"] {
+		t.Errorf("Expected the tagged version, got %s", b)
+	}
+
+	//Names of bundles in 'bundles' are left alone
+	if name, err := fetchBundle("invoicing", false); err != nil || name != "invoicing" {
+		t.Errorf("Expected the name back, got %s, %v", name, err)
+	}
+
+}
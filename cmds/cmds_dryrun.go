@@ -0,0 +1,149 @@
+// Copyright 2017 Jonathan Pincas
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmds
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jpincas/ghost/ghost"
+	"github.com/lib/pq"
+	"github.com/spf13/cobra"
+)
+
+var isDryRun, isValidateDryRun bool
+
+func init() {
+	for _, cmd := range []*cobra.Command{installCmd, unInstallCmd, initDBCmd} {
+		cmd.Flags().BoolVar(&isDryRun, "dry-run", false, "Print the SQL that would run, in order, instead of running it")
+		cmd.Flags().BoolVar(&isValidateDryRun, "validate", false, "With --dry-run, also run the SQL in a transaction that is rolled back, to check it")
+	}
+}
+
+//errNotExecuted is returned for queries in a dry run that isn't run against the database
+var errNotExecuted = errors.New("SQL is not executed in a dry run")
+
+//dryRunOutput is where the SQL of a dry run is printed
+var dryRunOutput io.Writer = os.Stdout
+
+//sqlPlan records the SQL a command would execute, in order, for a dry run.
+//When validating, the SQL is also executed in a transaction, which is rolled back at the end
+type sqlPlan struct {
+	statements []string
+	tx         *sql.Tx
+}
+
+func (p *sqlPlan) Exec(query string, args ...interface{}) (sql.Result, error) {
+
+	p.statements = append(p.statements, withArgs(query, args))
+
+	if p.tx == nil {
+		return driver.RowsAffected(0), nil
+	}
+
+	return p.tx.Exec(query, args...)
+
+}
+
+//Query only reads, so the SQL isn't recorded
+func (p *sqlPlan) Query(query string, args ...interface{}) (*sql.Rows, error) {
+
+	if p.tx == nil {
+		return nil, errNotExecuted
+	}
+
+	return p.tx.Query(query, args...)
+
+}
+
+//withArgs replaces the placeholders in the SQL with the arguments as literals, so it can be run as it is printed
+func withArgs(query string, args []interface{}) string {
+
+	//Highest first, so that $1 doesn't replace the start of $10
+	for i := len(args); i > 0; i-- {
+
+		var literal string
+		switch arg := args[i-1].(type) {
+		case nil:
+			literal = "NULL"
+		case int, int64, float64, bool:
+			literal = fmt.Sprint(arg)
+		case time.Time:
+			literal = pq.QuoteLiteral(arg.Format(time.RFC3339Nano))
+		default:
+			literal = pq.QuoteLiteral(fmt.Sprint(arg))
+		}
+
+		query = strings.Replace(query, "$"+strconv.Itoa(i), literal, -1)
+
+	}
+
+	return query
+
+}
+
+//dryRun prints the SQL that run would execute, in order, instead of executing it.
+//SQL that runs in a single transaction is printed within BEGIN and COMMIT.
+//When validating, the SQL is also executed in a transaction that is rolled back, so nothing changes
+func dryRun(transactional bool, run func(db dbExecutor) error) {
+
+	plan := &sqlPlan{}
+
+	if isValidateDryRun {
+
+		//Establish a temporary connection as the super user
+		db := ghost.SuperUserDBConfig.ReturnDBConnection("")
+		defer db.Close()
+
+		tx, err := db.Begin()
+		if err != nil {
+			ghost.LogFatal("DRYRUN", false, "Could not start a transaction to validate the SQL in", err)
+		}
+		plan.tx = tx
+
+	}
+
+	err := run(plan)
+
+	if transactional {
+		fmt.Fprintln(dryRunOutput, "BEGIN;")
+	}
+	for _, statement := range plan.statements {
+		fmt.Fprintln(dryRunOutput, strings.TrimSpace(statement))
+	}
+	if transactional && err == nil {
+		fmt.Fprintln(dryRunOutput, "COMMIT;")
+	}
+
+	if plan.tx != nil {
+		plan.tx.Rollback()
+	}
+
+	if err != nil {
+		ghost.LogFatal("DRYRUN", false, "The dry run failed, so the SQL would not complete.  Nothing has been changed", err)
+	}
+
+	if isValidateDryRun {
+		ghost.Log("DRYRUN", true, "The SQL ran without errors and has been rolled back", nil)
+	}
+
+}
@@ -0,0 +1,204 @@
+// Copyright 2017 Jonathan Pincas
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmds
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/jpincas/ghost/ghost"
+	"github.com/spf13/afero"
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestWithArgs(t *testing.T) {
+
+	query := withArgs(sqlToRecordMigration, []interface{}{"sh'op", 10, nil, "abc"})
+	expected := `INSERT INTO public.ghost_migrations (bundle, version, name, checksum) VALUES ('sh''op', 10, NULL, 'abc');`
+	if query != expected {
+		t.Errorf("Expected %s, got %s", expected, query)
+	}
+
+}
+
+func TestDryRunInstall(t *testing.T) {
+
+	ghost.App.FileSystem = afero.NewMemMapFs()
+	afero.WriteFile(ghost.App.FileSystem, "bundles/shop/bundle.json", []byte(`{"name": "shop", "version": "1.0.0", "extensions": ["pgcrypto"]}`), 0644)
+	afero.WriteFile(ghost.App.FileSystem, "bundles/shop/install/00_install.sql", []byte("CREATE TABLE products (id int);\n"), 0644)
+	afero.WriteFile(ghost.App.FileSystem, "bundles/shop/migrations/0001_prices.up.sql", []byte("ALTER TABLE products ADD COLUMN price int;"), 0644)
+
+	var out bytes.Buffer
+	dryRunOutput = &out
+	defer func() { dryRunOutput = os.Stdout }()
+
+	m, _ := readManifest("shop")
+	dryRun(true, func(db dbExecutor) error {
+		return installBundleTx(db, m, false)
+	})
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	expected := []string{
+		"BEGIN;",
+		sqlToResetLocalSearchPath,
+		`CREATE EXTENSION IF NOT EXISTS "pgcrypto";`,
+		`CREATE SCHEMA "shop";`,
+		`GRANT USAGE ON SCHEMA "shop" TO admin;`,
+		`SET LOCAL search_path TO "shop", public;`,
+		sqlToCreateSavepoint,
+		"CREATE TABLE products (id int);",
+		sqlToReleaseSavepoint,
+		sqlToCreateMigrationsTable,
+		sqlToCreateSavepoint,
+		`SET LOCAL search_path TO "shop", public;`,
+		"ALTER TABLE products ADD COLUMN price int;",
+		"INSERT INTO public.ghost_migrations (bundle, version, name, checksum) VALUES ('shop', 1, 'prices', ",
+		sqlToReleaseSavepoint,
+		sqlToCreateSavepoint,
+		"CREATE OR REPLACE FUNCTION public.ghost_notify_change()",
+		"DO $$",
+		sqlToReleaseSavepoint,
+		"COMMIT;",
+	}
+
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %d statements, got:\n%s", len(expected), out.String())
+	}
+	for i := range expected {
+		if !strings.HasPrefix(lines[i], expected[i]) {
+			t.Errorf("Expected statement %d to be %s, got %s", i, expected[i], lines[i])
+		}
+	}
+
+	//Nothing is written to the database
+	if _, err := (&sqlPlan{}).Query(sqlToGetAppliedMigrations, "shop"); err != errNotExecuted {
+		t.Errorf("Expected queries not to run, got %v", err)
+	}
+
+}
+
+func TestDryRunInstallDependencies(t *testing.T) {
+
+	ghost.App.FileSystem = afero.NewMemMapFs()
+	afero.WriteFile(ghost.App.FileSystem, "bundles/base/bundle.json", []byte(`{"name": "base", "version": "1.0.0"}`), 0644)
+	afero.WriteFile(ghost.App.FileSystem, "bundles/base/install/00_install.sql", []byte("CREATE TABLE settings (id int);\n"), 0644)
+	afero.WriteFile(ghost.App.FileSystem, "bundles/base/migrations/0001_names.up.sql", []byte("ALTER TABLE settings ADD COLUMN name text;"), 0644)
+	afero.WriteFile(ghost.App.FileSystem, "bundles/shop/bundle.json", []byte(`{"name": "shop", "version": "1.0.0", "dependencies": {"base": "^1.0.0"}, "extensions": ["pgcrypto"]}`), 0644)
+	afero.WriteFile(ghost.App.FileSystem, "bundles/shop/install/00_install.sql", []byte("CREATE TABLE products (id int);\n"), 0644)
+	afero.WriteFile(ghost.App.FileSystem, "bundles/shop/migrations/0001_prices.up.sql", []byte("ALTER TABLE products ADD COLUMN price int;"), 0644)
+
+	var out bytes.Buffer
+	dryRunOutput = &out
+	defer func() { dryRunOutput = os.Stdout }()
+
+	base, _ := readManifest("base")
+	shop, _ := readManifest("shop")
+	dryRun(true, func(db dbExecutor) error {
+		if err := installBundleTx(db, base, true); err != nil {
+			return err
+		}
+		return installBundleTx(db, shop, true)
+	})
+
+	//The search_path set for one bundle lasts for the rest of the transaction,
+	//so the ledger must always be the one in public
+	var ledger int
+	for _, line := range strings.Split(out.String(), "\n") {
+		if !strings.Contains(line, "ghost_migrations") {
+			continue
+		}
+		ledger++
+		if !strings.Contains(line, "public.ghost_migrations") {
+			t.Errorf("Expected the ledger to be public.ghost_migrations, got %s", line)
+		}
+	}
+	if ledger == 0 {
+		t.Fatalf("Expected statements on the ledger, got:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "VALUES ('base', 1, 'names', ") || !strings.Contains(out.String(), "VALUES ('shop', 1, 'prices', ") {
+		t.Errorf("Expected the migrations of both bundles to be recorded, got:\n%s", out.String())
+	}
+
+	//Nor are the extensions of the next bundle created in the schema of the one before
+	searchPath := ""
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.HasPrefix(line, "SET LOCAL search_path") {
+			searchPath = line
+		}
+		if strings.HasPrefix(line, "CREATE EXTENSION") && searchPath != sqlToResetLocalSearchPath {
+			t.Errorf("Expected the search path to be reset before creating extensions, got %s", searchPath)
+		}
+	}
+
+}
+
+func TestSQLPlanValidates(t *testing.T) {
+
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`DROP SCHEMA "shop" CASCADE;`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM public.ghost_migrations").WithArgs("shop").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectRollback()
+
+	tx, _ := db.Begin()
+	plan := &sqlPlan{tx: tx}
+	if err := unInstallBundleSQL(plan, "shop"); err != nil {
+		t.Error(err)
+	}
+	tx.Rollback()
+
+	expected := []string{`DROP SCHEMA "shop" CASCADE;`, "DELETE FROM public.ghost_migrations WHERE bundle = 'shop';"}
+	if strings.Join(plan.statements, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Unexpected statements %v", plan.statements)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+}
+
+func TestRunInitDBStatements(t *testing.T) {
+
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+
+	mock.ExpectExec(regexp.QuoteMeta(initDBStatements[0])).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(initDBStatements[1])).WillReturnError(errors.New("permission denied"))
+
+	//Setup stops at the first failure, just as a validated dry run does
+	if err := runInitDBStatements(db); err == nil || err.Error() != "permission denied" {
+		t.Errorf("Expected the first error to be returned, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	//Every statement can be run again on an initialised database
+	for _, statement := range initDBStatements {
+		if strings.Contains(statement, "CREATE TABLE ") && !strings.Contains(statement, "IF NOT EXISTS") ||
+			strings.Contains(statement, "CREATE ROLE ") && !strings.Contains(statement, "duplicate_object") ||
+			strings.Contains(statement, "CREATE TRIGGER ") && !strings.Contains(statement, "DROP TRIGGER IF EXISTS") {
+			t.Errorf("Expected statement to be safe to run again: %s", statement)
+		}
+	}
+
+}
@@ -23,15 +23,24 @@ import (
 )
 
 const (
-	sqlToCreateAdminRole               = `CREATE ROLE admin BYPASSRLS;`
+	sqlToCreateAdminRole               = `DO $$ BEGIN CREATE ROLE admin BYPASSRLS; EXCEPTION WHEN duplicate_object THEN NULL; END $$;`
 	sqlToGrantAdminPermissions         = `ALTER DEFAULT PRIVILEGES IN SCHEMA public GRANT ALL ON TABLES TO admin; ALTER DEFAULT PRIVILEGES IN SCHEMA public GRANT USAGE ON SEQUENCES TO admin;`
 	sqlToCreateUUIDExtension           = `CREATE EXTENSION IF NOT EXISTS "uuid-ossp";`
-	sqlToCreateUsersTable              = `CREATE TABLE users (id uuid PRIMARY KEY, email varchar(256) UNIQUE, role varchar(16) NOT NULL default 'anon');`
-	sqlToCreateFuncToGenerateNewUserID = `CREATE FUNCTION generate_new_user() RETURNS trigger AS $$ BEGIN NEW.id := uuid_generate_v4(); RETURN NEW; END; $$ LANGUAGE plpgsql;`
-	sqlToCreateTriggerOnNewUserInsert  = `CREATE TRIGGER new_user BEFORE INSERT ON users FOR EACH ROW EXECUTE PROCEDURE generate_new_user();`
-	sqlToCreateServerRole              = `CREATE ROLE server NOINHERIT LOGIN PASSWORD NULL;`
-	sqlToCreateAnonRole                = `CREATE ROLE anon;`
-	sqlToGrantBuiltInPermissions       = `GRANT anon, admin TO server; GRANT SELECT ON TABLE users TO server;`
+	sqlToCreateUsersTable              = `CREATE TABLE IF NOT EXISTS users (id uuid PRIMARY KEY, email varchar(256) UNIQUE, role varchar(16) NOT NULL default 'anon');`
+	sqlToAddPasswordToUsersTable       = `ALTER TABLE users ADD COLUMN IF NOT EXISTS password text;`
+	sqlToAddPasswordVerifiedToUsers    = `ALTER TABLE users ADD COLUMN IF NOT EXISTS password_verified boolean NOT NULL DEFAULT false;`
+	sqlToCreateFuncToGenerateNewUserID = `CREATE OR REPLACE FUNCTION generate_new_user() RETURNS trigger AS $$ BEGIN IF NEW.id IS NULL THEN NEW.id := uuid_generate_v4(); END IF; RETURN NEW; END; $$ LANGUAGE plpgsql;`
+	sqlToCreateTriggerOnNewUserInsert  = `DROP TRIGGER IF EXISTS new_user ON users; CREATE TRIGGER new_user BEFORE INSERT ON users FOR EACH ROW EXECUTE PROCEDURE generate_new_user();`
+	sqlToCreateUserIdentitiesTable     = `CREATE TABLE IF NOT EXISTS user_identities (issuer text NOT NULL, subject text NOT NULL, user_id uuid NOT NULL REFERENCES users ON DELETE CASCADE, PRIMARY KEY (issuer, subject));`
+	sqlToCreateTOTPTable               = `CREATE TABLE IF NOT EXISTS user_totp (user_id uuid PRIMARY KEY REFERENCES users ON DELETE CASCADE, secret text NOT NULL, confirmed boolean NOT NULL DEFAULT false, last_counter bigint NOT NULL DEFAULT 0);`
+	sqlToCreateRecoveryCodesTable      = `CREATE TABLE IF NOT EXISTS user_recovery_codes (user_id uuid NOT NULL REFERENCES users ON DELETE CASCADE, hash text NOT NULL, PRIMARY KEY (user_id, hash));`
+	sqlToCreateAPIKeysTable            = `CREATE TABLE IF NOT EXISTS api_keys (id text PRIMARY KEY, hash text NOT NULL, user_id uuid NOT NULL REFERENCES users ON DELETE CASCADE, role varchar(16) NOT NULL, scopes text[] NOT NULL DEFAULT '{}', name text NOT NULL DEFAULT '', expires timestamptz, created timestamptz NOT NULL DEFAULT now());`
+	sqlToCreateRevokedTokensTable      = `CREATE TABLE IF NOT EXISTS revoked_tokens (jti text PRIMARY KEY, expires timestamptz NOT NULL);`
+	sqlToCreateMagicCodesTable         = `CREATE TABLE IF NOT EXISTS magic_codes (email varchar(256) PRIMARY KEY, hash text NOT NULL, expires timestamptz NOT NULL);`
+	sqlToCreateLoginFailuresTable      = `CREATE TABLE IF NOT EXISTS login_failures (key text PRIMARY KEY, count int NOT NULL, expires timestamptz NOT NULL);`
+	sqlToCreateServerRole              = `DO $$ BEGIN CREATE ROLE server NOINHERIT LOGIN PASSWORD NULL; EXCEPTION WHEN duplicate_object THEN NULL; END $$;`
+	sqlToCreateAnonRole                = `DO $$ BEGIN CREATE ROLE anon; EXCEPTION WHEN duplicate_object THEN NULL; END $$;`
+	sqlToGrantBuiltInPermissions       = `GRANT anon, admin TO server; GRANT SELECT, INSERT (id, email, password), UPDATE (password, password_verified) ON TABLE users TO server; GRANT SELECT, INSERT, DELETE ON TABLE revoked_tokens TO server; GRANT SELECT, INSERT ON TABLE user_identities TO server; GRANT SELECT, INSERT, UPDATE, DELETE ON TABLE user_totp, user_recovery_codes TO server; GRANT SELECT ON TABLE api_keys TO server; GRANT SELECT, INSERT, UPDATE, DELETE ON TABLE magic_codes, login_failures TO server;`
 )
 
 func init() {
@@ -56,7 +65,8 @@ var initDBCmd = &cobra.Command{
 	Short: "Perform the database initialisation for built in tables, roles and permissions",
 	Long: `Executes the initialisation SQL which sets up the built-in tables, as well
 	as creating built-in roles anon,admin, web and server and assigning permissions.
-	Tables will not be overwritten if they already exist.`,
+	Tables and roles will not be overwritten if they already exist, and setup stops
+	at the first statement that fails.`,
 	RunE: initDB,
 }
 
@@ -92,28 +102,56 @@ func initAll(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+//initDBStatements are run in order to initialise the database
+var initDBStatements = []string{
+	sqlToCreateAdminRole,
+	sqlToGrantAdminPermissions, //Do this first so everything created after will have correct admin permissions by default
+	sqlToCreateUUIDExtension,
+	sqlToCreateUsersTable,
+	sqlToAddPasswordToUsersTable,
+	sqlToAddPasswordVerifiedToUsers,
+	sqlToCreateFuncToGenerateNewUserID,
+	sqlToCreateTriggerOnNewUserInsert,
+	sqlToCreateUserIdentitiesTable,
+	sqlToCreateTOTPTable,
+	sqlToCreateRecoveryCodesTable,
+	sqlToCreateAPIKeysTable,
+	sqlToCreateRevokedTokensTable,
+	sqlToCreateMagicCodesTable,
+	sqlToCreateLoginFailuresTable,
+	sqlToCreateMigrationsTable,
+	sqlToCreateServerRole,
+	sqlToCreateAnonRole,
+	sqlToGrantBuiltInPermissions,
+}
+
+//runInitDBStatements runs the initialisation SQL, stopping at the first statement that fails.
+//Every statement can be run again on an initialised database, so a re-init only fails on real errors
+func runInitDBStatements(db dbExecutor) error {
+	for _, statement := range initDBStatements {
+		if _, err := db.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 //initDB initialises the built-in database tables, roles and permissions
 func initDB(cmd *cobra.Command, args []string) error {
 
 	ghost.App.Setup(viper.GetString("configfile"))
 
+	if isDryRun {
+		dryRun(false, runInitDBStatements)
+		return nil
+	}
+
 	//Establish a temporary connection as the super user
 	db := ghost.SuperUserDBConfig.ReturnDBConnection("")
 	defer db.Close()
 
 	//Run initialisation SQL
-	var err error
-	_, err = db.Exec(sqlToCreateAdminRole)
-	_, err = db.Exec(sqlToGrantAdminPermissions) //Do this first so everything created after will have correct admin permissions by default
-	_, err = db.Exec(sqlToCreateUUIDExtension)
-	_, err = db.Exec(sqlToCreateUsersTable)
-	_, err = db.Exec(sqlToCreateFuncToGenerateNewUserID)
-	_, err = db.Exec(sqlToCreateTriggerOnNewUserInsert)
-	_, err = db.Exec(sqlToCreateServerRole)
-	_, err = db.Exec(sqlToCreateAnonRole)
-	_, err = db.Exec(sqlToGrantBuiltInPermissions)
-
-	if err != nil {
+	if err := runInitDBStatements(db); err != nil {
 		ghost.LogFatal("INIT", false, "Could not complete database setup", err)
 	}
 
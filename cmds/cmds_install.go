@@ -19,12 +19,15 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"os"
 	"path"
+	"strconv"
+	"strings"
 
 	"database/sql"
 
 	"github.com/jpincas/ghost/ghost"
+	"github.com/lib/pq"
 	"github.com/spf13/afero"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -32,9 +35,21 @@ import (
 
 const (
 	sqlToDropSchema                  = `DROP SCHEMA %s CASCADE;`
-	sqlToSetSearchPathForBundle      = `SET search_path TO %s, public;`
+	sqlToDropSchemaIfExists          = `DROP SCHEMA IF EXISTS %s CASCADE;`
+	sqlToSetLocalSearchPathForBundle = `SET LOCAL search_path TO %s, public;`
+	sqlToResetLocalSearchPath        = `SET LOCAL search_path TO DEFAULT;`
 	sqlToCreateSchema                = `CREATE SCHEMA %s;`
 	sqlToGrantBundleAdminPermissions = `GRANT USAGE ON SCHEMA %s TO admin; ALTER DEFAULT PRIVILEGES IN SCHEMA %s GRANT ALL ON TABLES TO admin; ALTER DEFAULT PRIVILEGES IN SCHEMA %s GRANT USAGE ON SEQUENCES TO admin;`
+
+	//Each install file and migration runs in a savepoint within the installation transaction
+	sqlToCreateSavepoint     = `SAVEPOINT ghost_install_step;`
+	sqlToRollbackToSavepoint = `ROLLBACK TO SAVEPOINT ghost_install_step;`
+	sqlToReleaseSavepoint    = `RELEASE SAVEPOINT ghost_install_step;`
+
+	//Notifying the server of changes to tables, so that it can invalidate cached results
+	sqlToCreateFuncToNotifyChange = `CREATE OR REPLACE FUNCTION public.ghost_notify_change() RETURNS trigger AS $$ BEGIN PERFORM pg_notify('` + ghost.CacheChannel + `', TG_TABLE_SCHEMA || '.' || TG_TABLE_NAME); RETURN NULL; END; $$ LANGUAGE plpgsql;`
+	//Tables that already have a ghost_notify_change trigger declared by the bundle are left alone
+	sqlToCreateNotifyChangeTriggers = `DO $$ DECLARE t record; BEGIN FOR t IN SELECT c.relname FROM pg_catalog.pg_class c JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace WHERE n.nspname = %s AND c.relkind IN ('r', 'p') AND NOT EXISTS (SELECT 1 FROM pg_catalog.pg_trigger g WHERE g.tgrelid = c.oid AND g.tgname = 'ghost_notify_change') LOOP EXECUTE format('CREATE TRIGGER ghost_notify_change AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON %%I.%%I FOR EACH STATEMENT EXECUTE PROCEDURE public.ghost_notify_change()', %s, t.relname); END LOOP; END $$;`
 )
 
 var isInstallDemoData, isReinstall, demoDataOnly bool
@@ -45,16 +60,27 @@ func init() {
 	installCmd.Flags().BoolVar(&isInstallDemoData, "demodata", false, "Install bundle demo data if available")
 	installCmd.Flags().BoolVar(&demoDataOnly, "demodataonly", false, "Install bundle demo data if available")
 	installCmd.Flags().BoolVarP(&isReinstall, "reinstall", "r", false, "Uninstall bundle before installing")
+	installCmd.Flags().StringVar(&installGitRef, "ref", "", "Branch, tag or commit to install when installing from a git repository (defaults to HEAD)")
+	installCmd.Flags().StringVar(&installSHA256, "sha256", "", "SHA-256 the archive must have, from a source you trust such as the bundle's publisher")
 }
 
 // installCmd represents the install command
 var installCmd = &cobra.Command{
-	Use:   "install [bundle]",
+	Use:   "install [bundle|archive|repository]",
 	Short: "Install a ghost bundle",
-	Long: `Installs a ghost bundle from the named folder.
-	Note: does not download anything, so the bundle folder must
-	exist and contain everything.  Previous to installing, either clone
-	or download the bundle into the 'bundles' directory`,
+	Long: `Installs a ghost bundle from the named folder, after any bundles
+	it depends on according to its bundle.json manifest.
+	Note: does not download anything.  Either the bundle folder must
+	exist in the 'bundles' directory and contain everything, or the bundle
+	must be a local .tar.gz archive made with 'ghost bundle pack', or a local
+	git repository (use --ref for a branch, tag or commit other than HEAD).
+	Archives and repositories are unpacked next to 'bundles', after checking
+	the checksums of their files.  The checksums come with the files, so they
+	only show that an archive isn't corrupted.  To check that it is the archive
+	its publisher packed, give its SHA-256 from them with --sha256.
+	The installation runs in a single transaction, so if any file fails,
+	nothing is installed, and an unpacked bundle only replaces its folder in
+	'bundles' once it is installed`,
 	RunE: installBundle,
 }
 
@@ -77,6 +103,18 @@ func unInstallBundle(cmd *cobra.Command, args []string) error {
 		return errors.New("a bundle name must be provided")
 	}
 
+	//Dropping the schema of a bundle others depend on would break them
+	if dependents := ghost.App.Config.BundlesInstalled.DependentsOf(args[0]); len(dependents) > 0 {
+		return errors.New("bundle " + args[0] + " can't be uninstalled, as " + strings.Join(dependents, ", ") + " depend on it")
+	}
+
+	if isDryRun {
+		dryRun(false, func(db dbExecutor) error {
+			return unInstallBundleSQL(db, args[0])
+		})
+		return nil
+	}
+
 	//If user has used -noprompt flag then we don't prompt for confirmation
 	var proceedWithInit = false
 	if viper.GetBool("noprompt") {
@@ -91,9 +129,8 @@ func unInstallBundle(cmd *cobra.Command, args []string) error {
 		db := ghost.SuperUserDBConfig.ReturnDBConnection("")
 		defer db.Close()
 
-		//Drop the schema
-		//If it doesn't exist, it won't be dropped - no big deal
-		db.Exec(fmt.Sprintf(sqlToDropSchema, args[0]))
+		//If the schema doesn't exist, it won't be dropped - no big deal
+		unInstallBundleSQL(db, args[0])
 
 		//Attempt to updated the bundles installed list
 		if err := ghost.App.Config.UnInstallBundle(args[0]); err != nil {
@@ -114,7 +151,20 @@ func unInstallBundle(cmd *cobra.Command, args []string) error {
 
 }
 
-//installBundle is the entire installation procedure for an ghost Bundle
+//unInstallBundleSQL drops the bundle's schema and forgets its migrations, returning the first error
+func unInstallBundleSQL(db dbExecutor, bundleName string) error {
+
+	_, err := db.Exec(fmt.Sprintf(sqlToDropSchema, pq.QuoteIdentifier(bundleName)))
+	if _, ledgerErr := db.Exec(sqlToDeleteBundleMigrations, bundleName); err == nil {
+		err = ledgerErr
+	}
+
+	return err
+
+}
+
+//installBundle is the entire installation procedure for an ghost Bundle.
+//Everything is installed in a single transaction, so a failed installation leaves the database untouched
 func installBundle(cmd *cobra.Command, args []string) error {
 
 	configFile := viper.GetString("configfile")
@@ -125,30 +175,99 @@ func installBundle(cmd *cobra.Command, args []string) error {
 		return errors.New("a bundle name must be provided")
 	}
 
+	//A dry run doesn't change the bundles folder, so archives and repositories are unpacked in memory
+	if isDryRun {
+		ghost.App.FileSystem = afero.NewCopyOnWriteFs(ghost.App.FileSystem, afero.NewMemMapFs())
+	}
+
+	//Archives and git repositories are unpacked next to 'bundles' first,
+	//and only replace the bundle's folder once they are installed
+	bundleName, err := fetchBundle(args[0], isReinstall)
+	if err != nil {
+		failInstall("Could not get bundle from "+args[0], err)
+	}
+	defer discardUnpackedBundles()
+
+	installed := ghost.App.Config.BundlesInstalled
+
+	//Dropping the schema of a bundle others depend on would break them
+	if dependents := installed.DependentsOf(bundleName); isReinstall && !demoDataOnly && len(dependents) > 0 {
+		return errors.New("bundle " + bundleName + " can't be reinstalled, as " + strings.Join(dependents, ", ") + " depend on it")
+	}
+
+	//Work out the bundles to install: the bundle and any dependencies that are not installed yet
+	bundles := []bundleManifest{{Name: bundleName}}
+	if !demoDataOnly {
+		if bundles, err = installOrder(bundleName, installed, isReinstall); err != nil {
+			failInstall("Bundle '"+bundleName+"' can't be installed", err)
+		}
+	}
+
+	if len(bundles) > 1 {
+		names := []string{}
+		for _, m := range bundles[:len(bundles)-1] {
+			names = append(names, m.Name)
+		}
+		ghost.Log("INSTALL", true, "Installing dependencies first: "+strings.Join(names, ", "), nil)
+	}
+
+	if isDryRun {
+		dryRun(true, func(db dbExecutor) error {
+			for _, m := range bundles {
+				if err := installBundleTx(db, m, isReinstall && m.Name == bundleName); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		return nil
+	}
+
+	//Reinstalling deletes the bundle's data, so unless the user has used -noprompt, confirm first
+	if isReinstall && !demoDataOnly && !viper.GetBool("noprompt") {
+		if !ghost.AskForConfirmation("This will delete the bundle, causing loss of all data in the schema created by the bundle.  Are you sure you want to do this?") {
+			return nil
+		}
+	}
+
 	//Establish a temporary connection as the super user
 	db := ghost.SuperUserDBConfig.ReturnDBConnection("")
 	defer db.Close()
 
-	bundleName := args[0]
-	if demoDataOnly {
-		installBundleDemoData(bundleName, db)
-		return nil
+	tx, err := db.Begin()
+	if err != nil {
+		failInstall("Could not start the installation transaction", err)
 	}
 
-	if isReinstall {
-		ghost.Log("INSTALL", true, "Uninstalling bundle "+bundleName+" before reinstalling", nil)
-		unInstallBundle(cmd, args)
+	for _, m := range bundles {
+		if err := installBundleTx(tx, m, isReinstall && m.Name == bundleName); err != nil {
+			tx.Rollback()
+			failInstall("Installation of bundle '"+m.Name+"' failed and has been rolled back", err)
+		}
 	}
 
-	installBundleSchema(bundleName, db)
+	if err := tx.Commit(); err != nil {
+		failInstall("Installation of bundle '"+bundleName+"' could not be committed", err)
+	}
 
-	if isInstallDemoData {
-		installBundleDemoData(bundleName, db)
+	//Now that it is installed, the unpacked bundle replaces the folder in 'bundles'
+	if err := keepUnpackedBundles(); err != nil {
+		ghost.Log("INSTALL", false, "Bundle installed, but its folder in 'bundles' could not be replaced with the unpacked one", err)
+	}
+
+	if demoDataOnly {
+		ghost.Log("INSTALL", true, "Installation of demo data for bundle "+bundleName+" completed", nil)
+		return nil
 	}
 
 	//Attempt to update the bundles installed list
-	if err := ghost.App.Config.InstallBundle(bundleName); err != nil {
-		ghost.Log("INSTALL", false, "Error installing bundle", err)
+	for _, m := range bundles {
+		if m.Name == bundleName && isReinstall {
+			ghost.App.Config.UnInstallBundle(bundleName)
+		}
+		if err := ghost.App.Config.InstallBundle(m.installed()); err != nil {
+			ghost.Log("INSTALL", false, "Error installing bundle", err)
+		}
 	}
 
 	//Rewrite the config file
@@ -165,100 +284,163 @@ func installBundle(cmd *cobra.Command, args []string) error {
 
 }
 
-func installBundleSchema(bundleName string, db *sql.DB) {
+//failInstall ends an installation that failed, removing any bundle unpacked for it so the bundles folder is as it was
+func failInstall(message string, err error) {
+
+	discardUnpackedBundles()
+	ghost.LogFatal("INSTALL", false, message, err)
+
+}
+
+//installBundleTx runs every step of the installation of a bundle in the transaction
+func installBundleTx(tx dbExecutor, m bundleManifest, reinstall bool) error {
+
+	bundleName := m.Name
+
+	//The search path set for a bundle installed earlier in the transaction lasts until it ends,
+	//so it is reset to stop extensions and anything else unqualified being created in that bundle's schema
+	if _, err := tx.Exec(sqlToResetLocalSearchPath); err != nil {
+		return err
+	}
+
+	if demoDataOnly {
+		return installBundleDemoData(bundleName, tx)
+	}
+
+	if reinstall {
+		ghost.Log("INSTALL", true, "Uninstalling bundle "+bundleName+" before reinstalling", nil)
+		if _, err := tx.Exec(fmt.Sprintf(sqlToDropSchemaIfExists, pq.QuoteIdentifier(bundleName))); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqlToCreateMigrationsTable); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqlToDeleteBundleMigrations, bundleName); err != nil {
+			return err
+		}
+	}
+
+	if err := installExtensions(m, tx); err != nil {
+		return err
+	}
+
+	if err := installBundleSchema(bundleName, tx); err != nil {
+		return err
+	}
+
+	if _, err := applyMigrations(tx, bundleName); err != nil {
+		return err
+	}
+
+	installNotifyChangeTriggers(bundleName, tx)
+
+	if isInstallDemoData {
+		return installBundleDemoData(bundleName, tx)
+	}
+
+	return nil
+
+}
+
+func installBundleSchema(bundleName string, tx dbExecutor) error {
 
 	//Check that bundle installation folder exists
-	basePath := "./bundles/" + bundleName + "/install"
+	basePath := bundlePath(bundleName, "install")
 	exists, err := afero.IsDir(ghost.App.FileSystem, basePath)
 	if !exists || err != nil {
-		ghost.LogFatal("INSTALL", false, "Bundle '"+bundleName+"' install folder not found or unreadable.", err)
+		return errors.New("Bundle '" + bundleName + "' install folder not found or unreadable")
 	}
 
 	//Check for error reading directory or zero files
 	filesInDirectory, err := afero.ReadDir(ghost.App.FileSystem, basePath)
 	if err != nil || len(filesInDirectory) == 0 {
-		ghost.LogFatal("INSTALL", false, "No installation files could be read for bundle", err)
+		return errors.New("No installation files could be read for bundle")
 	}
 
 	ghost.Log("INSTALL", true, "Installing bundle '"+bundleName+"'", nil)
 
 	//Set up a schema for the bundle
-	err = setupDBSchema(db, bundleName)
-	if err != nil {
-		//IF there is any type of error, drop the schema, log and exit
-		db.Exec(fmt.Sprintf(sqlToDropSchema, bundleName))
-		ghost.LogFatal("INSTALL", false, "Schema creation failed", err)
+	if err := setupDBSchema(tx, bundleName); err != nil {
+		return fmt.Errorf("Schema creation failed: %s", err)
 	}
 
-	//Set the search path to the bundle schema so that all SQL commands take
-	//place within the schema
-	_, err = db.Exec(fmt.Sprintf(sqlToSetSearchPathForBundle, bundleName))
-	if err != nil {
-		db.Exec(fmt.Sprintf(sqlToDropSchema, bundleName))
-		ghost.LogFatal("INSTALL", false, "Failed to set schema search path", err)
-	}
+	return processBundleFiles(tx, bundleName, basePath, filesInDirectory)
 
-	//Iterate over the installation files
-	for _, file := range filesInDirectory {
-		//Ignore directories
-		if !file.IsDir() {
-			//Attempt to processes the sqlfile
-			err := processBundleFile(db, path.Join(basePath, file.Name()))
-			if err != nil {
-				//IF there is any type of error, drop the schema, log and exit
-				db.Exec(fmt.Sprintf(sqlToDropSchema, bundleName))
-				ghost.LogFatal("INSTALL", false, "Installation of '"+file.Name()+"' failed", err)
-			}
-			ghost.Log("INSTALL", true, file.Name()+" installed OK", nil)
+}
+
+//installNotifyChangeTriggers adds a trigger to each table in the bundle
+//that notifies the server when its data changes.
+//The triggers are optional, so they are installed in their own savepoint within a transaction
+func installNotifyChangeTriggers(bundleName string, db dbExecutor) {
+
+	err := inTransaction(db, func(tx dbExecutor) error {
+
+		if _, err := tx.Exec(sqlToCreateFuncToNotifyChange); err != nil {
+			return errors.New("Failed to create change notification function: " + err.Error())
 		}
+
+		schema := pq.QuoteLiteral(bundleName)
+		if _, err := tx.Exec(fmt.Sprintf(sqlToCreateNotifyChangeTriggers, schema, schema)); err != nil {
+			return errors.New("Failed to create change notification triggers: " + err.Error())
+		}
+
+		return nil
+
+	})
+
+	if err != nil {
+		ghost.Log("INSTALL", false, "Cached results will only expire", err)
+		return
 	}
 
+	ghost.Log("INSTALL", true, "Change notification triggers installed", nil)
+
 }
 
-func installBundleDemoData(bundleName string, db *sql.DB) {
+func installBundleDemoData(bundleName string, tx dbExecutor) error {
 
 	ghost.Log("INSTALL", true, "Installing demo data", nil)
 
-	basePath := "./bundles/" + bundleName + "/demodata"
+	basePath := bundlePath(bundleName, "demodata")
 
 	//Check for error reading directory or zero files
 	filesInDirectory, err := afero.ReadDir(ghost.App.FileSystem, basePath)
 	if err != nil || len(filesInDirectory) == 0 {
-		//IF there is any type of error, drop the schema, log and exit
-		db.Exec(fmt.Sprintf(sqlToDropSchema, bundleName))
-		ghost.LogFatal("INSTALL", false, "No demo data files could be read for bundle", err)
+		return errors.New("No demo data files could be read for bundle")
 	}
 
-	log.Println("installing demo data...")
+	return processBundleFiles(tx, bundleName, basePath, filesInDirectory)
+
+}
+
+//processBundleFiles runs the files of a bundle folder in the bundle's schema, in order of name
+func processBundleFiles(tx dbExecutor, bundleName, basePath string, files []os.FileInfo) error {
 
 	//Set the search path to the bundle schema so that all SQL commands take
-	//place within the schema
-	_, err = db.Exec(fmt.Sprintf(sqlToSetSearchPathForBundle, bundleName))
-	if err != nil {
-		db.Exec(fmt.Sprintf(sqlToDropSchema, bundleName))
-		ghost.LogFatal("INSTALL", false, "Failed to set schema search path", err)
+	//place within the schema, until the end of the transaction
+	if _, err := tx.Exec(fmt.Sprintf(sqlToSetLocalSearchPathForBundle, pq.QuoteIdentifier(bundleName))); err != nil {
+		return fmt.Errorf("Failed to set schema search path: %s", err)
 	}
 
-	//Iterate over the demodata files
-	for _, file := range filesInDirectory {
+	//Iterate over the files
+	for _, file := range files {
 		//Ignore directories
 		if !file.IsDir() {
 			//Attempt to processes the sqlfile
-			err := processBundleFile(db, path.Join(basePath, file.Name()))
-			if err != nil {
-				//IF there is any type of error, drop the schema, log and exit
-				db.Exec(fmt.Sprintf(sqlToDropSchema, bundleName))
-				ghost.LogFatal("INSTALL", false, "Installation of '"+file.Name()+"' failed", err)
+			if err := processBundleFile(tx, path.Join(basePath, file.Name())); err != nil {
+				return fmt.Errorf("Installation of '%s' failed at %s", file.Name(), err)
 			}
-
 			ghost.Log("INSTALL", true, file.Name()+" installed OK", nil)
-
 		}
 	}
 
+	return nil
+
 }
 
-func processBundleFile(db *sql.DB, filename string) error {
+//processBundleFile runs a SQL file in its own savepoint,
+//so an error is reported against the file and line it came from
+func processBundleFile(db dbExecutor, filename string) error {
 
 	//Attempt to read file
 	sqlBytes, err := afero.ReadFile(ghost.App.FileSystem, filename)
@@ -268,25 +450,27 @@ func processBundleFile(db *sql.DB, filename string) error {
 	}
 
 	//Run the SQL
-	if _, err = db.Exec(string(sqlBytes)); err != nil {
-		return err
-	}
-
-	return nil
+	return inTransaction(db, func(tx dbExecutor) error {
+		if _, err := tx.Exec(string(sqlBytes)); err != nil {
+			return sqlErrorAt(string(sqlBytes), err)
+		}
+		return nil
+	})
 
 }
 
-func setupDBSchema(db *sql.DB, bundleName string) error {
+func setupDBSchema(db dbExecutor, bundleName string) error {
 
 	//Attempt to create a schema matching the bundle's name,
-	_, err := db.Exec(fmt.Sprintf(sqlToCreateSchema, bundleName))
+	schema := pq.QuoteIdentifier(bundleName)
+	_, err := db.Exec(fmt.Sprintf(sqlToCreateSchema, schema))
 
 	if err != nil {
 		return err
 	}
 
 	//Set admin privileges for everything in this schema going forwards
-	_, err = db.Exec(fmt.Sprintf(sqlToGrantBundleAdminPermissions, bundleName, bundleName, bundleName))
+	_, err = db.Exec(fmt.Sprintf(sqlToGrantBundleAdminPermissions, schema, schema, schema))
 
 	if err != nil {
 		return err
@@ -295,3 +479,63 @@ func setupDBSchema(db *sql.DB, bundleName string) error {
 	return nil
 
 }
+
+//dbExecutor is a database connection or a transaction
+type dbExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+//inTransaction runs fn in a transaction, which is committed if fn succeeds and rolled back if not.
+//Within a transaction already, a savepoint is used instead, so that only fn's changes are rolled back
+func inTransaction(db dbExecutor, fn func(tx dbExecutor) error) error {
+
+	if conn, ok := db.(*sql.DB); ok {
+
+		tx, err := conn.Begin()
+		if err != nil {
+			return err
+		}
+
+		if err := fn(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		return tx.Commit()
+
+	}
+
+	if _, err := db.Exec(sqlToCreateSavepoint); err != nil {
+		return err
+	}
+
+	if err := fn(db); err != nil {
+		db.Exec(sqlToRollbackToSavepoint)
+		return err
+	}
+
+	_, err := db.Exec(sqlToReleaseSavepoint)
+	return err
+
+}
+
+//sqlErrorAt adds the line of the SQL a Postgres error occurred on, when it is reported
+func sqlErrorAt(sqlText string, err error) error {
+
+	pqErr, ok := err.(*pq.Error)
+	if !ok || pqErr.Position == "" {
+		return err
+	}
+
+	//The position is a 1 based count of characters
+	position, convErr := strconv.Atoi(pqErr.Position)
+	runes := []rune(sqlText)
+	if convErr != nil || position < 1 || position > len(runes)+1 {
+		return err
+	}
+
+	line := strings.Count(string(runes[:position-1]), "\n") + 1
+	return fmt.Errorf("line %d: %s", line, err)
+
+}
@@ -0,0 +1,85 @@
+// Copyright 2017 Jonathan Pincas
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmds
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/jpincas/ghost/ghost"
+	"github.com/lib/pq"
+	"github.com/spf13/afero"
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestSQLErrorAt(t *testing.T) {
+
+	sqlText := "CREATE TABLE a (id int);\nCREATE TABLE b (id int);\nCREAT TABLE c (id int);"
+
+	cases := []struct {
+		err      error
+		expected string
+	}{
+		{&pq.Error{Message: "syntax error", Position: "51"}, "line 3: pq: syntax error"},
+		{&pq.Error{Message: "syntax error", Position: "1"}, "line 1: pq: syntax error"},
+		{&pq.Error{Message: "no position"}, "pq: no position"},
+		{&pq.Error{Message: "out of range", Position: "1000"}, "pq: out of range"},
+		{errors.New("not from postgres"), "not from postgres"},
+	}
+
+	for _, c := range cases {
+		if err := sqlErrorAt(sqlText, c.err); err.Error() != c.expected {
+			t.Errorf("Expected %q, got %q", c.expected, err.Error())
+		}
+	}
+
+}
+
+func TestProcessBundleFiles(t *testing.T) {
+
+	ghost.App.FileSystem = afero.NewMemMapFs()
+	afero.WriteFile(ghost.App.FileSystem, "bundles/shop/install/01_products.sql", []byte("CREATE TABLE products (id int);"), 0644)
+	afero.WriteFile(ghost.App.FileSystem, "bundles/shop/install/02_prices.sql", []byte("CREATE TABLE prices (\n  id int,\n  product int REFERENCES nothing\n);"), 0644)
+	files, _ := afero.ReadDir(ghost.App.FileSystem, "bundles/shop/install")
+
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+
+	//Each file runs in a savepoint, and the failing one is rolled back and reported
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`SET LOCAL search_path TO "shop", public;`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(sqlToCreateSavepoint)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE products")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(sqlToReleaseSavepoint)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(sqlToCreateSavepoint)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE prices")).WillReturnError(&pq.Error{Message: `relation "nothing" does not exist`, Position: "48"})
+	mock.ExpectExec(regexp.QuoteMeta(sqlToRollbackToSavepoint)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	tx, _ := db.Begin()
+	err := processBundleFiles(tx, "shop", "bundles/shop/install", files)
+	tx.Rollback()
+
+	if err == nil || !strings.Contains(err.Error(), "'02_prices.sql' failed at line 3") {
+		t.Errorf("Expected the failing file and line to be reported, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+}
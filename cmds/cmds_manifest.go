@@ -0,0 +1,298 @@
+// Copyright 2017 Jonathan Pincas
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmds
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jpincas/ghost/ghost"
+	"github.com/lib/pq"
+	"github.com/spf13/afero"
+)
+
+const sqlToCreateExtension = `CREATE EXTENSION IF NOT EXISTS %s;`
+
+//manifestFileName is the manifest in the root of a bundle's folder
+const manifestFileName = "bundle.json"
+
+//bundleNamePattern is what a bundle's name must look like, as it is also its folder and schema
+var bundleNamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+//checkBundleName returns an error if the name can't be used for a bundle
+func checkBundleName(bundleName string) error {
+
+	if !bundleNamePattern.MatchString(bundleName) {
+		return fmt.Errorf("Invalid bundle name '%s'.  Names are lowercase letters, digits and underscores, and can't start with a digit", bundleName)
+	}
+
+	return nil
+
+}
+
+//bundleManifest describes a bundle and what it needs to be installed.
+//Versions are major.minor.patch, and requirements are version constraints as accepted by versionSatisfies
+type bundleManifest struct {
+	Name        string `json:"name"`
+	Version     string `json:"version"`
+	Description string `json:"description"`
+	//Ghost is the ghost version required
+	Ghost string `json:"ghost"`
+	//Extensions are Postgres extensions created before the bundle is installed
+	Extensions []string `json:"extensions"`
+	//Dependencies are the bundles, and their versions, which must be installed first
+	Dependencies map[string]string `json:"dependencies"`
+}
+
+//readManifest reads a bundle's manifest.  Bundles without one have no version or requirements
+func readManifest(bundleName string) (bundleManifest, error) {
+
+	manifest := bundleManifest{Name: bundleName}
+	if err := checkBundleName(bundleName); err != nil {
+		return manifest, err
+	}
+
+	b, err := afero.ReadFile(ghost.App.FileSystem, bundlePath(bundleName, manifestFileName))
+	if os.IsNotExist(err) {
+		return manifest, nil
+	} else if err != nil {
+		return manifest, err
+	}
+
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return manifest, fmt.Errorf("Could not read the manifest of bundle '%s': %s", bundleName, err)
+	}
+
+	if manifest.Name != bundleName {
+		return manifest, fmt.Errorf("The manifest in bundle folder '%s' is for bundle '%s'", bundleName, manifest.Name)
+	}
+
+	if manifest.Version != "" {
+		if _, err := parseVersion(manifest.Version); err != nil {
+			return manifest, fmt.Errorf("Bundle '%s' has an invalid version: %s", bundleName, err)
+		}
+	}
+
+	return manifest, nil
+
+}
+
+//dependencyNames returns the names of the bundles the bundle depends on, in order of name
+func (m bundleManifest) dependencyNames() []string {
+
+	names := []string{}
+	for name := range m.Dependencies {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+
+}
+
+//installed is the record of the bundle kept in the config once it is installed
+func (m bundleManifest) installed() ghost.InstalledBundle {
+
+	return ghost.InstalledBundle{Name: m.Name, Version: m.Version, Dependencies: m.dependencyNames()}
+
+}
+
+//installOrder resolves the bundles that have to be installed for the bundle, in the order to install them,
+//with each bundle's dependencies before it.  Dependencies that are already installed are checked but not reinstalled
+func installOrder(bundleName string, installed ghost.Bundles, reinstall bool) ([]bundleManifest, error) {
+
+	if _, ok := installed.Find(bundleName); ok && !reinstall {
+		return nil, fmt.Errorf("Bundle '%s' is already installed", bundleName)
+	}
+
+	order := []bundleManifest{}
+	manifests := map[string]bundleManifest{}
+	resolving := map[string]bool{}
+
+	var resolve func(name string, chain []string) error
+	resolve = func(name string, chain []string) error {
+
+		chain = append(chain[:len(chain):len(chain)], name)
+		if resolving[name] {
+			return errors.New("Circular dependency " + strings.Join(chain, " -> "))
+		}
+		if _, ok := manifests[name]; ok {
+			return nil
+		}
+
+		m, err := readManifest(name)
+		if err != nil {
+			return err
+		}
+
+		if ok, err := versionSatisfies(ghost.Version, m.Ghost); err != nil || !ok {
+			return fmt.Errorf("Bundle '%s' requires ghost %s, this is ghost %s", name, m.Ghost, ghost.Version)
+		}
+
+		resolving[name] = true
+		for _, dependency := range m.dependencyNames() {
+
+			constraint := m.Dependencies[dependency]
+			version := ""
+
+			if b, ok := installed.Find(dependency); ok && !(reinstall && dependency == bundleName) {
+				version = b.Version
+			} else {
+				if err := resolve(dependency, chain); err != nil {
+					return err
+				}
+				version = manifests[dependency].Version
+			}
+
+			if ok, err := versionSatisfies(version, constraint); err != nil || !ok {
+				if version == "" {
+					version = "unversioned"
+				}
+				return fmt.Errorf("Bundle '%s' requires '%s' %s, but the version available is %s", name, dependency, constraint, version)
+			}
+
+		}
+		resolving[name] = false
+
+		manifests[name] = m
+		order = append(order, m)
+		return nil
+
+	}
+
+	return order, resolve(bundleName, []string{})
+
+}
+
+//installExtensions creates the Postgres extensions the bundle needs, if they don't exist yet
+func installExtensions(m bundleManifest, db dbExecutor) error {
+
+	for _, extension := range m.Extensions {
+		if _, err := db.Exec(fmt.Sprintf(sqlToCreateExtension, pq.QuoteIdentifier(extension))); err != nil {
+			return fmt.Errorf("Could not create extension '%s': %s", extension, err)
+		}
+	}
+
+	return nil
+
+}
+
+//semver is a major.minor.patch version
+type semver [3]int
+
+//parseVersion parses a version of up to three numbers, ignoring any pre-release or build suffix
+func parseVersion(version string) (semver, error) {
+
+	var v semver
+
+	version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+	if i := strings.IndexAny(version, "-+"); i >= 0 {
+		version = version[:i]
+	}
+
+	parts := strings.Split(version, ".")
+	if len(parts) > 3 {
+		return v, errors.New("Version " + version + " has more than three parts")
+	}
+
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return v, errors.New("Version " + version + " is not numeric")
+		}
+		v[i] = n
+	}
+
+	return v, nil
+
+}
+
+//compare returns -1, 0 or 1 as v is lower than, equal to or higher than other
+func (v semver) compare(other semver) int {
+
+	for i := range v {
+		if v[i] < other[i] {
+			return -1
+		} else if v[i] > other[i] {
+			return 1
+		}
+	}
+
+	return 0
+
+}
+
+//versionSatisfies returns whether a version meets a constraint, which is any number of space separated
+//comparisons that must all hold, e.g. ">=1.2.0 <2.0.0".  A comparison is an exact version, a version with
+//one of the operators >=, >, <=, < and =, ^ for compatible versions, or ~ for patch versions.
+//An empty constraint or * is met by any version
+func versionSatisfies(version, constraint string) (bool, error) {
+
+	if strings.TrimSpace(constraint) == "" || strings.TrimSpace(constraint) == "*" {
+		return true, nil
+	}
+
+	v, err := parseVersion(version)
+	if err != nil {
+		return false, err
+	}
+
+	for _, comparison := range strings.Fields(constraint) {
+
+		versionPart := strings.TrimLeft(comparison, "<>=^~")
+		operator := comparison[:len(comparison)-len(versionPart)]
+		required, err := parseVersion(versionPart)
+		if err != nil {
+			return false, err
+		}
+
+		c := v.compare(required)
+		var ok bool
+
+		switch operator {
+		case "", "=":
+			ok = c == 0
+		case ">=":
+			ok = c >= 0
+		case ">":
+			ok = c > 0
+		case "<=":
+			ok = c <= 0
+		case "<":
+			ok = c < 0
+		case "^":
+			//Compatible versions share the major version, or the minor version before 1.0.0
+			ok = c >= 0 && v[0] == required[0] && (required[0] > 0 || v[1] == required[1])
+		case "~":
+			ok = c >= 0 && v[0] == required[0] && v[1] == required[1]
+		default:
+			return false, errors.New("Unknown version operator " + operator)
+		}
+
+		if !ok {
+			return false, nil
+		}
+
+	}
+
+	return true, nil
+
+}
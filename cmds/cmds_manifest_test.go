@@ -0,0 +1,138 @@
+// Copyright 2017 Jonathan Pincas
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmds
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jpincas/ghost/ghost"
+	"github.com/spf13/afero"
+)
+
+func TestVersionSatisfies(t *testing.T) {
+
+	cases := []struct {
+		version, constraint string
+		expected            bool
+	}{
+		{"1.2.3", "", true},
+		{"1.2.3", "*", true},
+		{"1.2.3", "1.2.3", true},
+		{"1.2.3", "=1.2", false},
+		{"1.2.0", "1.2", true},
+		{"1.2.3", ">=1.2.0 <2.0.0", true},
+		{"2.0.0", ">=1.2.0 <2.0.0", false},
+		{"1.2.3", ">1.2.3", false},
+		{"1.2.3", "<=1.2.3", true},
+		{"1.9.0", "^1.2", true},
+		{"2.0.0", "^1.2", false},
+		{"0.2.5", "^0.2.1", true},
+		{"0.3.0", "^0.2.1", false},
+		{"1.2.9", "~1.2.3", true},
+		{"1.3.0", "~1.2.3", false},
+		{"v1.2.3-beta", "1.2.3", true},
+	}
+
+	for _, c := range cases {
+		if ok, err := versionSatisfies(c.version, c.constraint); err != nil || ok != c.expected {
+			t.Errorf("Expected %s %s to be %v, got %v, %v", c.version, c.constraint, c.expected, ok, err)
+		}
+	}
+
+	for _, c := range [][2]string{{"", "1.0.0"}, {"1.0.0", "!1.0.0"}, {"1.0.0", ">=one"}} {
+		if _, err := versionSatisfies(c[0], c[1]); err == nil {
+			t.Errorf("Expected an error for %s %s", c[0], c[1])
+		}
+	}
+
+}
+
+//bundlesFS sets up bundle manifests in memory
+func bundlesFS(manifests map[string]string) {
+
+	ghost.App.FileSystem = afero.NewMemMapFs()
+	for name, manifest := range manifests {
+		afero.WriteFile(ghost.App.FileSystem, "bundles/"+name+"/"+manifestFileName, []byte(manifest), 0644)
+	}
+
+}
+
+func TestInstallOrder(t *testing.T) {
+
+	bundlesFS(map[string]string{
+		"shop":     `{"name": "shop", "version": "1.0.0", "dependencies": {"users": "^1.0", "payments": ">=0.2"}}`,
+		"payments": `{"name": "payments", "version": "0.3.0", "dependencies": {"users": "1.1.0"}, "extensions": ["pgcrypto"]}`,
+		"users":    `{"name": "users", "version": "1.1.0", "ghost": ">=0.1.0"}`,
+	})
+
+	names := func(bundles []bundleManifest) []string {
+		n := []string{}
+		for _, b := range bundles {
+			n = append(n, b.Name)
+		}
+		return n
+	}
+
+	//Dependencies come first, and once each
+	bundles, err := installOrder("shop", ghost.Bundles{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := names(bundles); !reflect.DeepEqual(n, []string{"users", "payments", "shop"}) {
+		t.Errorf("Unexpected install order %v", n)
+	}
+
+	//Installed dependencies are not installed again
+	bundles, err = installOrder("shop", ghost.Bundles{{Name: "users", Version: "1.1.0"}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := names(bundles); !reflect.DeepEqual(n, []string{"payments", "shop"}) {
+		t.Errorf("Unexpected install order %v", n)
+	}
+
+	//But they must be the right version
+	if _, err := installOrder("shop", ghost.Bundles{{Name: "users", Version: "1.0.0"}}, false); err == nil {
+		t.Error("Expected an error for an installed dependency of the wrong version")
+	}
+
+	//Bundles can't be installed twice, unless reinstalling
+	if _, err := installOrder("users", ghost.Bundles{{Name: "users", Version: "1.1.0"}}, false); err == nil {
+		t.Error("Expected an error for an installed bundle")
+	}
+	if _, err := installOrder("users", ghost.Bundles{{Name: "users", Version: "1.1.0"}}, true); err != nil {
+		t.Error(err)
+	}
+
+	//Bundles without a manifest install on their own
+	if bundles, err := installOrder("blog", ghost.Bundles{}, false); err != nil || len(bundles) != 1 {
+		t.Errorf("Expected blog to install alone, got %v, %v", bundles, err)
+	}
+
+	for description, manifests := range map[string]map[string]string{
+		"circular":      {"a": `{"name": "a", "dependencies": {"b": ""}}`, "b": `{"name": "b", "dependencies": {"a": ""}}`},
+		"ghost version": {"a": `{"name": "a", "ghost": ">=99.0.0"}`},
+		"wrong name":    {"a": `{"name": "b"}`},
+		"unversioned":   {"a": `{"name": "a", "dependencies": {"b": "1.0.0"}}`},
+		"invalid name":  {"a": `{"name": "a", "dependencies": {"b; DROP SCHEMA public CASCADE; --": ""}}`},
+	} {
+		bundlesFS(manifests)
+		if _, err := installOrder("a", ghost.Bundles{}, false); err == nil {
+			t.Errorf("Expected an error for %s dependencies", description)
+		}
+	}
+
+}
@@ -0,0 +1,452 @@
+// Copyright 2017 Jonathan Pincas
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmds
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/jpincas/ghost/ghost"
+	"github.com/lib/pq"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	sqlToCreateMigrationsTable  = `CREATE TABLE IF NOT EXISTS public.ghost_migrations (bundle text NOT NULL, version int NOT NULL, name text NOT NULL, checksum text NOT NULL, applied timestamptz NOT NULL DEFAULT now(), PRIMARY KEY (bundle, version));`
+	sqlToGetAppliedMigrations   = `SELECT version, name, checksum FROM public.ghost_migrations WHERE bundle = $1 ORDER BY version;`
+	sqlToRecordMigration        = `INSERT INTO public.ghost_migrations (bundle, version, name, checksum) VALUES ($1, $2, $3, $4);`
+	sqlToDeleteMigration        = `DELETE FROM public.ghost_migrations WHERE bundle = $1 AND version = $2;`
+	sqlToDeleteBundleMigrations = `DELETE FROM public.ghost_migrations WHERE bundle = $1;`
+)
+
+//migrationFileName is {version}_{name}.up.sql or {version}_{name}.down.sql
+var migrationFileName = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+var migrateDownSteps int
+
+func init() {
+	RootCmd.AddCommand(migrateCmd)
+	migrateCmd.AddCommand(migrateUpCmd)
+	migrateCmd.AddCommand(migrateDownCmd)
+	migrateCmd.AddCommand(migrateStatusCmd)
+	migrateDownCmd.Flags().IntVar(&migrateDownSteps, "steps", 1, "Number of migrations to roll back")
+}
+
+// migrateCmd represents the migrate command
+var migrateCmd = &cobra.Command{
+	Use:   "migrate [up|down|status] [bundle]",
+	Short: "Migrate bundle schemas",
+	Long: `Applies or rolls back the numbered migrations in a bundle's 'migrations' folder,
+	named {version}_{name}.up.sql and {version}_{name}.down.sql.
+	Applied migrations are recorded in the ghost_migrations table with a checksum,
+	so changes to a migration after it has been applied are detected.
+	Without a bundle name, every installed bundle is migrated`,
+}
+
+var migrateUpCmd = &cobra.Command{
+	Use:   "up [bundle]",
+	Short: "Apply pending migrations",
+	RunE:  migrateUp,
+}
+
+var migrateDownCmd = &cobra.Command{
+	Use:   "down [bundle]",
+	Short: "Roll back the last applied migration",
+	RunE:  migrateDown,
+}
+
+var migrateStatusCmd = &cobra.Command{
+	Use:   "status [bundle]",
+	Short: "Show applied and pending migrations",
+	RunE:  migrateStatus,
+}
+
+//migration is a numbered change to a bundle's schema, with the files to apply and roll it back
+type migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+//appliedMigration is a migration recorded in the ghost_migrations table
+type appliedMigration struct {
+	Version  int
+	Name     string
+	Checksum string
+}
+
+//migrationBundles are the bundles a migrate command is for: the one named, or else all installed bundles
+func migrationBundles(args []string) []string {
+
+	if len(args) > 0 {
+		return args[:1]
+	}
+
+	return ghost.App.Config.BundlesInstalled.Names()
+
+}
+
+func migrateUp(cmd *cobra.Command, args []string) error {
+
+	ghost.App.Setup(viper.GetString("configfile"))
+
+	//Establish a temporary connection as the super user
+	db := ghost.SuperUserDBConfig.ReturnDBConnection("")
+	defer db.Close()
+
+	for _, bundleName := range migrationBundles(args) {
+
+		count, err := applyMigrations(db, bundleName)
+		if err != nil {
+			ghost.LogFatal("MIGRATE", false, "Migration of bundle '"+bundleName+"' failed", err)
+		}
+
+		//Tables created by the migrations need change notification triggers too
+		if count > 0 {
+			installNotifyChangeTriggers(bundleName, db)
+		}
+
+	}
+
+	return nil
+
+}
+
+func migrateDown(cmd *cobra.Command, args []string) error {
+
+	ghost.App.Setup(viper.GetString("configfile"))
+
+	if len(args) < 1 {
+		return errors.New("a bundle name must be provided")
+	}
+
+	//Establish a temporary connection as the super user
+	db := ghost.SuperUserDBConfig.ReturnDBConnection("")
+	defer db.Close()
+
+	if err := rollbackMigrations(db, args[0], migrateDownSteps); err != nil {
+		ghost.LogFatal("MIGRATE", false, "Rollback of bundle '"+args[0]+"' failed", err)
+	}
+
+	return nil
+
+}
+
+func migrateStatus(cmd *cobra.Command, args []string) error {
+
+	ghost.App.Setup(viper.GetString("configfile"))
+
+	//Establish a temporary connection as the super user
+	db := ghost.SuperUserDBConfig.ReturnDBConnection("")
+	defer db.Close()
+
+	for _, bundleName := range migrationBundles(args) {
+
+		statuses, err := migrationStatuses(db, bundleName)
+		if err != nil {
+			ghost.LogFatal("MIGRATE", false, "Could not read migrations of bundle '"+bundleName+"'", err)
+		}
+
+		fmt.Println(bundleName + ":")
+		if len(statuses) == 0 {
+			fmt.Println("  no migrations")
+		}
+		for _, s := range statuses {
+			fmt.Printf("  %04d %-40s %s\n", s.Version, s.Name, s.Status)
+		}
+
+	}
+
+	return nil
+
+}
+
+//readMigrations reads the migrations in a bundle's migrations folder, in order of version.
+//A bundle without the folder has no migrations
+func readMigrations(bundleName string) ([]migration, error) {
+
+	basePath := bundlePath(bundleName, "migrations")
+	if exists, _ := afero.IsDir(ghost.App.FileSystem, basePath); !exists {
+		return []migration{}, nil
+	}
+
+	files, err := afero.ReadDir(ghost.App.FileSystem, basePath)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*migration{}
+	for _, file := range files {
+
+		match := migrationFileName.FindStringSubmatch(file.Name())
+		if file.IsDir() || match == nil {
+			continue
+		}
+
+		version, _ := strconv.Atoi(match[1])
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("Migration %d is named both %s and %s", version, m.Name, match[2])
+		}
+
+		if match[3] == "up" {
+			m.Up = path.Join(basePath, file.Name())
+		} else {
+			m.Down = path.Join(basePath, file.Name())
+		}
+
+	}
+
+	migrations := []migration{}
+	for _, m := range byVersion {
+
+		if m.Up == "" {
+			return nil, fmt.Errorf("Migration %d_%s has no up file", m.Version, m.Name)
+		}
+
+		b, err := afero.ReadFile(ghost.App.FileSystem, m.Up)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(b)
+		m.Checksum = hex.EncodeToString(sum[:])
+
+		migrations = append(migrations, *m)
+
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+
+}
+
+//appliedMigrations returns the migrations of a bundle recorded as applied, by version
+func appliedMigrations(db dbExecutor, bundleName string) (map[int]appliedMigration, error) {
+
+	if _, err := db.Exec(sqlToCreateMigrationsTable); err != nil {
+		return nil, err
+	}
+
+	applied := map[int]appliedMigration{}
+
+	//A dry run without the database is of an installation, so nothing has been applied yet
+	rows, err := db.Query(sqlToGetAppliedMigrations, bundleName)
+	if err == errNotExecuted {
+		return applied, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a appliedMigration
+		if err := rows.Scan(&a.Version, &a.Name, &a.Checksum); err != nil {
+			return nil, err
+		}
+		applied[a.Version] = a
+	}
+
+	return applied, rows.Err()
+
+}
+
+//applyMigrations applies a bundle's pending migrations in order, each in its own transaction or savepoint
+//along with its record in the ledger, and returns how many were applied.
+//Nothing is applied if a migration has been changed since it was applied
+func applyMigrations(db dbExecutor, bundleName string) (int, error) {
+
+	migrations, err := readMigrations(bundleName)
+	if err != nil {
+		return 0, err
+	}
+
+	applied, err := appliedMigrations(db, bundleName)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, m := range migrations {
+		if a, ok := applied[m.Version]; ok && a.Checksum != m.Checksum {
+			return 0, fmt.Errorf("Migration %d_%s has changed since it was applied", m.Version, m.Name)
+		}
+	}
+
+	count := 0
+	for _, m := range migrations {
+
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+
+		err := runMigrationFile(db, bundleName, m.Up, func(tx dbExecutor) error {
+			_, err := tx.Exec(sqlToRecordMigration, bundleName, m.Version, m.Name, m.Checksum)
+			return err
+		})
+		if err != nil {
+			return count, fmt.Errorf("Migration %d_%s failed: %s", m.Version, m.Name, err)
+		}
+
+		ghost.Log("MIGRATE", true, fmt.Sprintf("%s: applied %d_%s", bundleName, m.Version, m.Name), nil)
+		count++
+
+	}
+
+	if count == 0 {
+		ghost.Log("MIGRATE", true, bundleName+": no pending migrations", nil)
+	}
+
+	return count, nil
+
+}
+
+//rollbackMigrations rolls back the last applied migrations of a bundle, newest first,
+//each in its own transaction along with removing its record from the ledger
+func rollbackMigrations(db dbExecutor, bundleName string, steps int) error {
+
+	migrations, err := readMigrations(bundleName)
+	if err != nil {
+		return err
+	}
+
+	applied, err := appliedMigrations(db, bundleName)
+	if err != nil {
+		return err
+	}
+
+	byVersion := map[int]migration{}
+	for _, m := range migrations {
+		byVersion[m.Version] = m
+	}
+
+	versions := []int{}
+	for version := range applied {
+		versions = append(versions, version)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+
+	if len(versions) == 0 {
+		ghost.Log("MIGRATE", true, bundleName+": no migrations to roll back", nil)
+		return nil
+	}
+
+	for i, version := range versions {
+
+		if i == steps {
+			break
+		}
+
+		m, ok := byVersion[version]
+		if !ok || m.Down == "" {
+			return fmt.Errorf("Migration %d_%s has no down file", version, applied[version].Name)
+		}
+
+		err := runMigrationFile(db, bundleName, m.Down, func(tx dbExecutor) error {
+			_, err := tx.Exec(sqlToDeleteMigration, bundleName, m.Version)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("Rollback of %d_%s failed: %s", m.Version, m.Name, err)
+		}
+
+		ghost.Log("MIGRATE", true, fmt.Sprintf("%s: rolled back %d_%s", bundleName, m.Version, m.Name), nil)
+
+	}
+
+	return nil
+
+}
+
+//runMigrationFile runs a migration file in the bundle's schema and records it, all in one transaction,
+//or in one savepoint when migrating within an installation
+func runMigrationFile(db dbExecutor, bundleName, filename string, record func(tx dbExecutor) error) error {
+
+	sqlBytes, err := afero.ReadFile(ghost.App.FileSystem, filename)
+	if err != nil {
+		return err
+	}
+
+	return inTransaction(db, func(tx dbExecutor) error {
+
+		if _, err := tx.Exec(fmt.Sprintf(sqlToSetLocalSearchPathForBundle, pq.QuoteIdentifier(bundleName))); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(string(sqlBytes)); err != nil {
+			return sqlErrorAt(string(sqlBytes), err)
+		}
+
+		return record(tx)
+
+	})
+
+}
+
+//migrationStatus is whether a migration is applied, pending, changed since it was applied,
+//or applied but missing from the bundle
+type migrationStatus struct {
+	Version int
+	Name    string
+	Status  string
+}
+
+//migrationStatuses returns the status of every migration of a bundle, in order of version
+func migrationStatuses(db dbExecutor, bundleName string) ([]migrationStatus, error) {
+
+	migrations, err := readMigrations(bundleName)
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := appliedMigrations(db, bundleName)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []migrationStatus{}
+	for _, m := range migrations {
+
+		status := "pending"
+		if a, ok := applied[m.Version]; ok && a.Checksum != m.Checksum {
+			status = "changed since applied"
+		} else if ok {
+			status = "applied"
+		}
+
+		statuses = append(statuses, migrationStatus{m.Version, m.Name, status})
+		delete(applied, m.Version)
+
+	}
+
+	for _, a := range applied {
+		statuses = append(statuses, migrationStatus{a.Version, a.Name, "applied, file missing"})
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, nil
+
+}
@@ -0,0 +1,117 @@
+// Copyright 2017 Jonathan Pincas
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmds
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/jpincas/ghost/ghost"
+	"github.com/spf13/afero"
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+//migrationsFS sets up a bundle's migrations folder in memory
+func migrationsFS(files map[string]string) {
+
+	ghost.App.FileSystem = afero.NewMemMapFs()
+	for name, contents := range files {
+		afero.WriteFile(ghost.App.FileSystem, "bundles/shop/migrations/"+name, []byte(contents), 0644)
+	}
+
+}
+
+func TestReadMigrations(t *testing.T) {
+
+	migrationsFS(map[string]string{
+		"0002_add_prices.up.sql":      "ALTER TABLE products ADD COLUMN price int;",
+		"0002_add_prices.down.sql":    "ALTER TABLE products DROP COLUMN price;",
+		"0001_create_products.up.sql": "CREATE TABLE products (id int);",
+		"README.md":                   "not a migration",
+	})
+
+	migrations, err := readMigrations("shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(migrations) != 2 {
+		t.Fatalf("Expected 2 migrations, got %d", len(migrations))
+	}
+	if migrations[0].Version != 1 || migrations[0].Name != "create_products" || migrations[0].Down != "" {
+		t.Errorf("Unexpected first migration %+v", migrations[0])
+	}
+	if migrations[1].Version != 2 || migrations[1].Down != "bundles/shop/migrations/0002_add_prices.down.sql" {
+		t.Errorf("Unexpected second migration %+v", migrations[1])
+	}
+
+	//A bundle without migrations has none
+	if migrations, err := readMigrations("blog"); err != nil || len(migrations) != 0 {
+		t.Errorf("Expected no migrations, got %v, %v", migrations, err)
+	}
+
+	//Down files need an up file, and versions can't be reused
+	for _, files := range []map[string]string{
+		{"0001_create_products.down.sql": "DROP TABLE products;"},
+		{"0001_create_products.up.sql": "", "0001_create_prices.up.sql": ""},
+	} {
+		migrationsFS(files)
+		if _, err := readMigrations("shop"); err == nil {
+			t.Errorf("Expected an error reading %v", files)
+		}
+	}
+
+}
+
+func TestApplyMigrations(t *testing.T) {
+
+	migrationsFS(map[string]string{
+		"0001_create_products.up.sql": "CREATE TABLE products (id int);",
+		"0002_add_prices.up.sql":      "ALTER TABLE products ADD COLUMN price int;",
+	})
+	migrations, _ := readMigrations("shop")
+
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+
+	expectApplied := func(checksum string) {
+		mock.ExpectExec(regexp.QuoteMeta(sqlToCreateMigrationsTable)).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(regexp.QuoteMeta(sqlToGetAppliedMigrations)).WithArgs("shop").
+			WillReturnRows(sqlmock.NewRows([]string{"version", "name", "checksum"}).AddRow(1, "create_products", checksum))
+	}
+
+	//Only the pending migration is applied, along with its record in the same transaction
+	expectApplied(migrations[0].Checksum)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`SET LOCAL search_path TO "shop", public;`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE products ADD COLUMN price int;")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(sqlToRecordMigration)).WithArgs("shop", 2, "add_prices", migrations[1].Checksum).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if count, err := applyMigrations(db, "shop"); err != nil || count != 1 {
+		t.Errorf("Expected 1 migration applied, got %d, %v", count, err)
+	}
+
+	//Nothing is applied if an applied migration has changed
+	expectApplied("changed")
+	if _, err := applyMigrations(db, "shop"); err == nil {
+		t.Error("Expected an error for a changed migration")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+}
@@ -15,27 +15,45 @@
 package cmds
 
 import (
+	"database/sql"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
+	"time"
 
 	"errors"
 
+	"github.com/jpincas/ghost/auth"
 	"github.com/jpincas/ghost/ghost"
 	"github.com/spf13/afero"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
-const sqlToCreateAdministrator = `INSERT INTO users(email, role) VALUES ('%s', '%s');`
+const (
+	sqlToCreateAdministrator = `INSERT INTO users(email, role) VALUES ($1, $2);`
+)
 
-var isAdmin bool
+var (
+	isAdmin      bool
+	apiKeyRole   string
+	apiKeyScopes []string
+	apiKeyExpiry time.Duration
+	apiKeyName   string
+)
 
 func init() {
 	RootCmd.AddCommand(newCmd)
 	newCmd.AddCommand(newUserCmd)
 	newCmd.AddCommand(newBundleCmd)
+	newCmd.AddCommand(newAPIKeyCmd)
 	newUserCmd.Flags().BoolVar(&isAdmin, "admin", false, "Create user with admin role")
+	newAPIKeyCmd.Flags().StringVar(&apiKeyRole, "role", "", "Role for the key (defaults to the user's role)")
+	newAPIKeyCmd.Flags().StringSliceVar(&apiKeyScopes, "scope", []string{}, "Restrict the key to read:{schema} or write:{schema} (repeatable, * for all schemas)")
+	newAPIKeyCmd.Flags().DurationVar(&apiKeyExpiry, "expires", 0, "How long the key is valid for, e.g. 720h (never expires if not set)")
+	newAPIKeyCmd.Flags().StringVar(&apiKeyName, "name", "", "Description of what the key is for")
 
 }
 
@@ -54,6 +72,15 @@ var newUserCmd = &cobra.Command{
 	RunE: createNewUser,
 }
 
+var newAPIKeyCmd = &cobra.Command{
+	Use:   "apikey [email]",
+	Short: "Create a new API key",
+	Long: `Creates an API key for machine-to-machine access, which acts as the user
+	with the given email.  Send it in the X-API-Key header, or as 'Authorization: ApiKey {key}'.
+	Only a hash of the key is stored, so it is only shown once`,
+	RunE: createNewAPIKey,
+}
+
 var newBundleCmd = &cobra.Command{
 	Use:   "bundle [name]",
 	Short: "Create a new ghost Bundle",
@@ -80,7 +107,8 @@ func createNewUser(cmd *cobra.Command, args []string) error {
 		role = "admin"
 	}
 
-	_, err := db.Exec(fmt.Sprintf(sqlToCreateAdministrator, args[0], role))
+	//Stored as logins look it up, however it is typed
+	_, err := db.Exec(sqlToCreateAdministrator, auth.NormaliseEmail(args[0]), role)
 	if err != nil {
 		ghost.LogFatal("NEW", true, "Could not create new user", err)
 		return nil
@@ -91,6 +119,64 @@ func createNewUser(cmd *cobra.Command, args []string) error {
 
 }
 
+func createNewAPIKey(cmd *cobra.Command, args []string) error {
+
+	ghost.App.Setup(viper.GetString("configfile"))
+
+	if len(args) < 1 {
+		return errors.New("user's email must be provided")
+	}
+
+	//Establish a temporary connection as the super user
+	db := ghost.SuperUserDBConfig.ReturnDBConnection("")
+	defer db.Close()
+
+	userID, role, err := findUserAndRole(db, args[0])
+	if err != nil {
+		ghost.LogFatal("NEW", false, "Could not find user "+args[0], err)
+		return nil
+	}
+
+	//Keys act with the user's role unless another is given
+	if apiKeyRole != "" {
+		role = apiKeyRole
+	}
+
+	var expires time.Time
+	if apiKeyExpiry > 0 {
+		expires = time.Now().Add(apiKeyExpiry)
+	}
+
+	key, err := auth.CreateAPIKey(db, auth.APIKey{
+		UserID:  userID,
+		Role:    role,
+		Scopes:  apiKeyScopes,
+		Name:    apiKeyName,
+		Expires: expires,
+	})
+	if err != nil {
+		ghost.LogFatal("NEW", false, "Could not create API key", err)
+		return nil
+	}
+
+	ghost.Log("NEW", true, "Successfully created API key for "+args[0]+" as "+role+".  Store it now, it can't be shown again", nil)
+	fmt.Println(key)
+	return nil
+
+}
+
+//findUserAndRole looks up a user by email in the same way as logins do, and returns their id and role
+func findUserAndRole(db *sql.DB, email string) (userID, role string, err error) {
+
+	if err = db.QueryRow(ghost.SQLToFindUserByEmail, auth.NormaliseEmail(email)).Scan(&userID); err != nil {
+		return "", "", err
+	}
+
+	err = db.QueryRow(ghost.SQLToGetUsersRole, userID).Scan(&role)
+	return userID, role, err
+
+}
+
 func createNewBundle(cmd *cobra.Command, args []string) error {
 
 	fs := afero.NewOsFs()
@@ -99,6 +185,9 @@ func createNewBundle(cmd *cobra.Command, args []string) error {
 	if len(args) < 1 {
 		return errors.New("a bundle name must be provided")
 	}
+	if err := checkBundleName(args[0]); err != nil {
+		return err
+	}
 
 	//Check that bundle doesn't already exists
 	basePath := path.Join("bundles", args[0])
@@ -122,6 +211,20 @@ func createNewBundle(cmd *cobra.Command, args []string) error {
 		ghost.LogFatal("NEW", true, "Could not complete folder setup", err)
 	}
 
+	//Start the manifest at the first version, requiring this version of ghost
+	manifest, _ := json.MarshalIndent(bundleManifest{
+		Name:         args[0],
+		Version:      "0.1.0",
+		Ghost:        ">=" + ghost.Version,
+		Extensions:   []string{},
+		Dependencies: map[string]string{},
+	}, "", "\t")
+	err = ioutil.WriteFile(path.Join(basePath, manifestFileName), manifest, 0644)
+
+	if err != nil {
+		ghost.LogFatal("NEW", true, "Could not complete folder setup", err)
+	}
+
 	//Creates the bundles
 	ghost.Log("NEW", true, "Successfully created bundle "+args[0], err)
 	return nil
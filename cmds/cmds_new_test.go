@@ -0,0 +1,41 @@
+// Copyright 2017 Jonathan Pincas
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmds
+
+import (
+	"testing"
+
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestFindUserAndRole(t *testing.T) {
+
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+
+	//The email is looked up however it is typed, as logins do
+	mock.ExpectQuery("SELECT id from users WHERE lower\\(email\\)").WithArgs("me@me.com").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("692e8a64-7676-4790-b3f8-a86a5083d5bb"))
+	mock.ExpectQuery("SELECT role from users").WithArgs("692e8a64-7676-4790-b3f8-a86a5083d5bb").WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("admin"))
+
+	userID, role, err := findUserAndRole(db, " Me@Me.com")
+	if err != nil || userID != "692e8a64-7676-4790-b3f8-a86a5083d5bb" || role != "admin" {
+		t.Errorf("Expected the user and their role, got %s %s %v", userID, role, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+}
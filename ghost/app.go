@@ -18,11 +18,13 @@ import (
 	"database/sql"
 	"time"
 
-	"github.com/diegobernardes/ttlcache"
 	"github.com/pressly/chi"
 	"github.com/spf13/afero"
 )
 
+//Version is the version of ghost, which bundles can require a minimum of in their manifest
+const Version = "0.1.0"
+
 //App is the container for the app-wide constructs like database, router and mailserver
 var App application
 
@@ -40,8 +42,11 @@ type application struct {
 	//Store is the data abstraction layer
 	//Normally your applications would interact with Store rather than DB or Cache
 	Store store
-	//Cache is the app wide cache for SQL queries
-	Cache *ttlcache.Cache
+	//Cache is the app wide cache for SQL queries.
+	//Replace it with NewExternalCache before serving to use an external cache
+	Cache Cache
+	//Schema is the introspected structure of the installed bundles, loaded at serve time
+	Schema schemaCache
 }
 
 //Setup bootstraps the whole application
@@ -57,9 +62,9 @@ func (a *application) Setup(configFileName string) {
 	//Initialise the filesysem
 	a.FileSystem = afero.NewOsFs()
 
-	//Initialise the cache
-	//TODO: Reimplement the cache with a new library
-	a.Cache = ttlcache.NewCache()
-	a.Cache.SetTTL(time.Duration(5 * time.Second))
+	//Initialise the cache, which tells the invalidation index about the entries it drops
+	cache := NewMemoryCache(a.Config.CacheMaxBytes, time.Duration(a.Config.CacheTTL)*time.Second)
+	cache.OnEvict(cacheTags.forget)
+	a.Cache = cache
 
 }
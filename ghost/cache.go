@@ -0,0 +1,277 @@
+// Copyright 2017 Jonathan Pincas
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ghost
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Cache is the interface of the app wide cache for query results.
+//Values are stored as bytes so that their size is known and they can be held outside the process
+type Cache interface {
+	//Get returns the value stored under key, if present and not expired
+	Get(key string) ([]byte, bool)
+	//Set stores a value under key for the ttl.  A ttl of zero uses the cache's default
+	Set(key string, value []byte, ttl time.Duration)
+	//Delete removes the value stored under key, if any
+	Delete(key string)
+	//Stats returns the cache's usage statistics
+	Stats() CacheStats
+}
+
+//CacheStats are the usage statistics of a cache.
+//Entries and Bytes are only known for the in-memory cache
+type CacheStats struct {
+	Hits, Misses, Evictions uint64
+	Entries                 int
+	Bytes                   int64
+}
+
+//cacheCounters counts hits, misses and evictions and is safe for concurrent use
+type cacheCounters struct {
+	hits, misses, evictions uint64
+}
+
+func (c *cacheCounters) record(ok bool) {
+	if ok {
+		atomic.AddUint64(&c.hits, 1)
+	} else {
+		atomic.AddUint64(&c.misses, 1)
+	}
+}
+
+func (c *cacheCounters) stats() CacheStats {
+	return CacheStats{
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Evictions: atomic.LoadUint64(&c.evictions),
+	}
+}
+
+//MemoryCache is an in-memory least recently used cache, bounded by the total size of its keys and values
+type MemoryCache struct {
+	mu         sync.Mutex
+	maxBytes   int64
+	bytes      int64
+	defaultTTL time.Duration
+	//entries are ordered from most to least recently used
+	entries  *list.List
+	index    map[string]*list.Element
+	counters cacheCounters
+	//onEvict is called with the key of each entry evicted, expired or too big to store
+	onEvict func(key string)
+}
+
+type memoryCacheEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+func (e *memoryCacheEntry) size() int64 {
+	return int64(len(e.key) + len(e.value))
+}
+
+//NewMemoryCache creates an in-memory cache holding up to maxBytes of keys and values.
+//The least recently used entries are evicted to make space for new ones
+func NewMemoryCache(maxBytes int64, defaultTTL time.Duration) *MemoryCache {
+
+	return &MemoryCache{
+		maxBytes:   maxBytes,
+		defaultTTL: defaultTTL,
+		entries:    list.New(),
+		index:      map[string]*list.Element{},
+	}
+
+}
+
+//OnEvict sets a function to be called with the key of each entry the cache drops by itself,
+//because it was evicted, expired or too big to store.  It is called with the cache locked, so must not use the cache
+func (c *MemoryCache) OnEvict(fn func(key string)) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.onEvict = fn
+
+}
+
+//Get returns the value stored under key, if present and not expired
+func (c *MemoryCache) Get(key string) ([]byte, bool) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.index[key]
+	if ok && time.Now().After(element.Value.(*memoryCacheEntry).expires) {
+		c.remove(element)
+		c.evicted(key)
+		ok = false
+	}
+
+	c.counters.record(ok)
+	if !ok {
+		return nil, false
+	}
+
+	c.entries.MoveToFront(element)
+	return element.Value.(*memoryCacheEntry).value, true
+
+}
+
+//Set stores a value under key for the ttl, or the default ttl if zero.
+//Values too big to ever fit in the cache are not stored
+func (c *MemoryCache) Set(key string, value []byte, ttl time.Duration) {
+
+	if ttl <= 0 {
+		ttl = c.defaultTTL
+	}
+
+	entry := &memoryCacheEntry{key: key, value: value, expires: time.Now().Add(ttl)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.index[key]; ok {
+		c.remove(element)
+	}
+
+	if entry.size() > c.maxBytes {
+		c.evicted(key)
+		return
+	}
+
+	c.index[key] = c.entries.PushFront(entry)
+	c.bytes += entry.size()
+
+	for c.bytes > c.maxBytes {
+		c.evicted(c.remove(c.entries.Back()))
+		atomic.AddUint64(&c.counters.evictions, 1)
+	}
+
+}
+
+//Delete removes the value stored under key, if any
+func (c *MemoryCache) Delete(key string) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.index[key]; ok {
+		c.remove(element)
+	}
+
+}
+
+//Stats returns the cache's usage statistics
+func (c *MemoryCache) Stats() CacheStats {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.counters.stats()
+	stats.Entries = c.entries.Len()
+	stats.Bytes = c.bytes
+	return stats
+
+}
+
+//remove takes an entry out of the cache and returns its key.  The lock must be held
+func (c *MemoryCache) remove(element *list.Element) string {
+
+	entry := c.entries.Remove(element).(*memoryCacheEntry)
+	delete(c.index, entry.key)
+	c.bytes -= entry.size()
+	return entry.key
+
+}
+
+//evicted tells the function set with OnEvict, if any, that the cache has dropped the key.  The lock must be held
+func (c *MemoryCache) evicted(key string) {
+
+	if c.onEvict != nil {
+		c.onEvict(key)
+	}
+
+}
+
+//ErrCacheMiss is returned by a CacheClient when there is no value for a key
+var ErrCacheMiss = errors.New("Cache miss")
+
+//CacheClient is the minimal interface of an external cache, such as Redis or Memcached.
+//Wrap a client for one with NewExternalCache to use it as the app wide cache
+type CacheClient interface {
+	//Get returns ErrCacheMiss if there is no value for the key
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte, ttl time.Duration) error
+	Delete(key string) error
+}
+
+//externalCache adapts a CacheClient to the Cache interface
+type externalCache struct {
+	client     CacheClient
+	defaultTTL time.Duration
+	counters   cacheCounters
+}
+
+//NewExternalCache uses an external cache through its client.
+//Errors from the client are logged, and are treated as misses so that queries go to the database instead
+func NewExternalCache(client CacheClient, defaultTTL time.Duration) Cache {
+
+	return &externalCache{client: client, defaultTTL: defaultTTL}
+
+}
+
+func (c *externalCache) Get(key string) ([]byte, bool) {
+
+	value, err := c.client.Get(key)
+	if err != nil && err != ErrCacheMiss {
+		Log("CACHE", false, "Error reading from external cache", err)
+	}
+
+	c.counters.record(err == nil)
+	return value, err == nil
+
+}
+
+func (c *externalCache) Set(key string, value []byte, ttl time.Duration) {
+
+	if ttl <= 0 {
+		ttl = c.defaultTTL
+	}
+
+	if err := c.client.Set(key, value, ttl); err != nil {
+		Log("CACHE", false, "Error writing to external cache", err)
+	}
+
+}
+
+func (c *externalCache) Delete(key string) {
+
+	if err := c.client.Delete(key); err != nil {
+		Log("CACHE", false, "Error deleting from external cache", err)
+	}
+
+}
+
+func (c *externalCache) Stats() CacheStats {
+
+	return c.counters.stats()
+
+}
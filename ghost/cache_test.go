@@ -0,0 +1,185 @@
+package ghost
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestMemoryCache(t *testing.T) {
+
+	//Room for two entries of 1 byte key + 4 byte value
+	c := NewMemoryCache(10, time.Minute)
+
+	c.Set("a", []byte("1111"), 0)
+	c.Set("b", []byte("2222"), 0)
+
+	//Using a makes b the least recently used
+	if v, ok := c.Get("a"); !ok || string(v) != "1111" {
+		t.Errorf("Expected a to be cached, got %s, %v", v, ok)
+	}
+
+	c.Set("c", []byte("3333"), 0)
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("Expected b to have been evicted")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Error("Expected a to still be cached")
+	}
+
+	//Too big to ever fit
+	c.Set("d", []byte("0123456789"), 0)
+	if _, ok := c.Get("d"); ok {
+		t.Error("Expected an oversized value not to be cached")
+	}
+
+	//Replacing a value replaces its size
+	c.Set("a", []byte("1"), 0)
+
+	stats := c.Stats()
+	if stats.Entries != 2 || stats.Bytes != 7 || stats.Evictions != 1 || stats.Hits != 2 || stats.Misses != 2 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+
+	c.Delete("a")
+	if _, ok := c.Get("a"); ok {
+		t.Error("Expected a to have been deleted")
+	}
+
+}
+
+func TestMemoryCacheExpiry(t *testing.T) {
+
+	c := NewMemoryCache(100, time.Minute)
+
+	c.Set("short", []byte("value"), time.Millisecond)
+	c.Set("default", []byte("value"), 0)
+	time.Sleep(5 * time.Millisecond)
+
+	if _, ok := c.Get("short"); ok {
+		t.Error("Expected the entry to have expired")
+	}
+	if _, ok := c.Get("default"); !ok {
+		t.Error("Expected the entry with the default ttl to be cached")
+	}
+
+	if c.Stats().Entries != 1 {
+		t.Errorf("Expected expired entries to be removed, got %+v", c.Stats())
+	}
+
+}
+
+//standInClient is a local stand-in for an external cache
+type standInClient struct {
+	values map[string][]byte
+	ttls   map[string]time.Duration
+	down   bool
+}
+
+func (c *standInClient) Get(key string) ([]byte, error) {
+	if c.down {
+		return nil, errors.New("connection refused")
+	}
+	v, ok := c.values[key]
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+	return v, nil
+}
+
+func (c *standInClient) Set(key string, value []byte, ttl time.Duration) error {
+	c.values[key] = value
+	c.ttls[key] = ttl
+	return nil
+}
+
+func (c *standInClient) Delete(key string) error {
+	delete(c.values, key)
+	return nil
+}
+
+func TestExternalCache(t *testing.T) {
+
+	client := &standInClient{values: map[string][]byte{}, ttls: map[string]time.Duration{}}
+	c := NewExternalCache(client, time.Minute)
+
+	c.Set("a", []byte("1"), 0)
+	c.Set("b", []byte("2"), time.Second)
+
+	if client.ttls["a"] != time.Minute || client.ttls["b"] != time.Second {
+		t.Errorf("Expected the default and given ttls, got %v", client.ttls)
+	}
+
+	if v, ok := c.Get("a"); !ok || string(v) != "1" {
+		t.Errorf("Expected a to be cached, got %s, %v", v, ok)
+	}
+
+	c.Delete("a")
+	if _, ok := c.Get("a"); ok {
+		t.Error("Expected a to have been deleted")
+	}
+
+	//An unavailable cache is a miss
+	client.down = true
+	if _, ok := c.Get("b"); ok {
+		t.Error("Expected a miss when the cache is unavailable")
+	}
+
+	if stats := c.Stats(); stats.Hits != 1 || stats.Misses != 2 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+
+}
+
+func TestExecuteCachesResults(t *testing.T) {
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	App.DB = db
+	defer db.Close()
+
+	client := &standInClient{values: map[string][]byte{}, ttls: map[string]time.Duration{}}
+	App.Cache = NewExternalCache(client, time.Minute)
+	defer func() { App.Cache = nil }()
+
+	//Only the first execution reaches the database
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT").WillReturnRows(sqlmock.NewRows([]string{"json"}).AddRow(`[{"id":1}]`))
+	mock.ExpectQuery(`SELECT count\(\*\)`).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectCommit()
+
+	for i := 0; i < 2; i++ {
+
+		q := Query{Schema: "public", Table: "test_table", IsList: true, CountTotal: true, CacheLevel: "all", CacheExpiry: 30}
+		result, err := App.Store.Execute(&q)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if result != `[{"id":1}]` || q.Total() != 1 {
+			t.Errorf("Unexpected result %s with total %v", result, q.Total())
+		}
+
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	//The query's expiry is used for both the result and the count
+	for key, ttl := range client.ttls {
+		if ttl != 30*time.Second {
+			t.Errorf("Expected %s to be cached for 30s, got %v", key, ttl)
+		}
+	}
+
+	if stats := App.Cache.Stats(); stats.Hits != 2 || stats.Misses != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+
+}
@@ -18,11 +18,88 @@ import (
 	"encoding/json"
 	"errors"
 	"io/ioutil"
+	"reflect"
 
+	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/viper"
 )
 
-type Bundles []string
+//Bundles are the installed bundles, in the order they were installed
+type Bundles []InstalledBundle
+
+//InstalledBundle is a bundle's name, the version installed and the bundles it depends on
+type InstalledBundle struct {
+	Name         string   `json:"name"`
+	Version      string   `json:"version,omitempty"`
+	Dependencies []string `json:"dependencies,omitempty"`
+}
+
+//bundleNameHook decodes a bundle recorded in the config file by just its name, as they were before versions were
+func bundleNameHook(from, to reflect.Type, data interface{}) (interface{}, error) {
+
+	if name, ok := data.(string); ok && to == reflect.TypeOf(InstalledBundle{}) {
+		return InstalledBundle{Name: name}, nil
+	}
+
+	return data, nil
+
+}
+
+//decodeConfig unmarshalls the config read in by viper into a config object.
+//Viper's own hooks are kept, as setting one replaces them.
+//Lists in the config file replace those already in the object, rather than being written over the start of them
+func decodeConfig(v *viper.Viper, c *config) error {
+
+	return v.Unmarshal(c, viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+		bundleNameHook,
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToSliceHookFunc(","),
+	)), func(dc *mapstructure.DecoderConfig) {
+		dc.ZeroFields = true
+	})
+
+}
+
+//Names returns the names of the bundles, which are also their schemas
+func (b Bundles) Names() []string {
+
+	names := make([]string, 0, len(b))
+	for _, bundle := range b {
+		names = append(names, bundle.Name)
+	}
+
+	return names
+
+}
+
+//Find returns the installed bundle with the name, if there is one
+func (b Bundles) Find(bundleName string) (InstalledBundle, bool) {
+
+	for _, bundle := range b {
+		if bundle.Name == bundleName {
+			return bundle, true
+		}
+	}
+
+	return InstalledBundle{}, false
+
+}
+
+//DependentsOf returns the names of the installed bundles that depend on the bundle
+func (b Bundles) DependentsOf(bundleName string) []string {
+
+	dependents := []string{}
+	for _, bundle := range b {
+		for _, dependency := range bundle.Dependencies {
+			if dependency == bundleName {
+				dependents = append(dependents, bundle.Name)
+			}
+		}
+	}
+
+	return dependents
+
+}
 
 //Config is the basic structure of the config.json file
 type config struct {
@@ -40,6 +117,46 @@ type config struct {
 	Host     string `json:"host"`
 	Protocol string `json:"protocol"`
 
+	//JWT Settings
+	//Audience is only set and checked if not empty.  Expiries are in seconds
+	JWTAudience      string `json:"jwtAudience"`
+	JWTExpiry        int    `json:"jwtExpiry"`
+	JWTRefreshExpiry int    `json:"jwtRefreshExpiry"`
+	//Keys for signing tokens instead of the secret, and the id of the one to sign with
+	JWTKeys       []JWTKey `json:"jwtKeys"`
+	JWTSigningKey string   `json:"jwtSigningKey"`
+	//Once there are keys, tokens signed with the secret are refused.  While moving from the secret to keys,
+	//set this to keep accepting them until they have expired, and then unset it
+	JWTAcceptSecret bool `json:"jwtAcceptSecret"`
+
+	//Magic Code Settings
+	//Store is memory or postgres.  Expiry and lockout are in seconds, and a maximum of 0 means no limit
+	MagicCodeStore            string `json:"magicCodeStore"`
+	MagicCodeExpiry           int    `json:"magicCodeExpiry"`
+	MagicCodeMaxAttempts      int    `json:"magicCodeMaxAttempts"`
+	MagicCodeMaxAttemptsPerIP int    `json:"magicCodeMaxAttemptsPerIP"`
+	MagicCodeLockout          int    `json:"magicCodeLockout"`
+	//Magic links are redirected here, with the tokens in the fragment, if set
+	MagicLinkRedirect string `json:"magicLinkRedirect"`
+
+	//Password Settings
+	//Password login is optional.  Hash is argon2id or bcrypt.  Reset links go to the frontend page at the reset URL,
+	//which is needed to send them, and confirmation links go to the confirm URL if set, or otherwise straight to the API
+	PasswordLogin      bool   `json:"passwordLogin"`
+	PasswordHash       string `json:"passwordHash"`
+	PasswordMinLength  int    `json:"passwordMinLength"`
+	PasswordResetURL   string `json:"passwordResetURL"`
+	PasswordConfirmURL string `json:"passwordConfirmURL"`
+
+	//Two-Factor Authentication Settings
+	//Users with these roles can only use the API once they have verified their session with a TOTP code
+	TOTPRoles []string `json:"totpRoles"`
+
+	//OpenID Connect Settings
+	//Logins are redirected to OIDCRedirect, with the tokens in the fragment, if set
+	OIDCProviders []OIDCProvider `json:"oidcProviders"`
+	OIDCRedirect  string         `json:"oidcRedirect"`
+
 	//Email Settings
 	ActivateEmail bool   `json:"activateEmail"`
 	SmtpHost      string `json:"smtpHost"`
@@ -48,6 +165,11 @@ type config struct {
 	SmtpFrom      string `json:"smtpFrom"`
 	EmailFrom     string `json:"emailFrom"`
 
+	//Cache Settings
+	//Maximum total size of cached keys and values, and default time to live in seconds
+	CacheMaxBytes int64 `json:"cacheMaxBytes"`
+	CacheTTL      int   `json:"cacheTTL"`
+
 	//Bundles installed
 	BundlesInstalled Bundles `json:"bundlesInstalled"`
 
@@ -65,6 +187,35 @@ type config struct {
 	CorsMaxAge           int      `json:"corsMaxAge"`
 }
 
+//BaseURL is the URL the API is served at
+func (c config) BaseURL() string {
+	return c.Protocol + "://" + c.Host + ":" + c.ApiPort
+}
+
+//JWTKey is a key pair for signing and verifying tokens, loaded from PEM files.
+//Algorithm is one of RS256, ES256 or EdDSA.
+//Keys without a private key file are only used for verification, e.g. while being rotated out
+type JWTKey struct {
+	ID             string `json:"id"`
+	Algorithm      string `json:"algorithm"`
+	PrivateKeyFile string `json:"privateKeyFile"`
+	PublicKeyFile  string `json:"publicKeyFile"`
+}
+
+//OIDCProvider is an OpenID Connect identity provider users can log in with, at /auth/oidc/login?provider={name}.
+//Its endpoints are discovered from the issuer.  The redirect URL defaults to /auth/oidc/callback on this server,
+//and the client secret can be left out for public clients.  Users are linked by verified email,
+//and only created if CreateUsers is set
+type OIDCProvider struct {
+	Name         string   `json:"name"`
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"clientID"`
+	ClientSecret string   `json:"clientSecret"`
+	RedirectURL  string   `json:"redirectURL"`
+	Scopes       []string `json:"scopes"`
+	CreateUsers  bool     `json:"createUsers"`
+}
+
 //createDafaultConfigFile creates the default config.json template with sane defaults
 //TODO: Will overwrite existing config.json, so ask for confirmation
 func CreateDefaultConfigFile(configFileName string) error {
@@ -89,8 +240,10 @@ func (c *config) Setup(configFileName string) {
 
 	if err := viper.ReadInConfig(); err == nil {
 
-		//Unmarshall the whole config file into a config object
-		if err := viper.Unmarshal(c); err != nil {
+		//Unmarshall the whole config file into a config object,
+		//starting from the defaults so that settings missing from older config files have sane values
+		*c = defaultConfig()
+		if err := decodeConfig(viper.GetViper(), c); err != nil {
 			LogFatal("CONFIG", true, "Error decoding config file. Aborting", err)
 		}
 
@@ -104,19 +257,19 @@ func (c *config) Setup(configFileName string) {
 
 }
 
-func (c *config) InstallBundle(bundleName string) error {
+func (c *config) InstallBundle(bundle InstalledBundle) error {
 
 	b := c.BundlesInstalled
 	//Check if the bundle is already installed (should only happen if user has messed with config.json)
 	//If the name of the bundle being installed coincides with any of the names already in the bundle slice,
 	//then just return the original bundle slice
 	for _, a := range b {
-		if a == bundleName {
+		if a.Name == bundle.Name {
 			return errors.New("Bundle is already installed")
 		}
 	}
 	//Otherwise append
-	b = append(b, bundleName)
+	b = append(b, bundle)
 	//Reset the bundle list on the config object
 	c.BundlesInstalled = b
 
@@ -129,7 +282,7 @@ func (c *config) UnInstallBundle(bundleName string) error {
 	b := c.BundlesInstalled
 	//Search for the bundle to be uninstalled
 	for index, a := range b {
-		if a == bundleName {
+		if a.Name == bundleName {
 			//If found, splice it out
 			c.BundlesInstalled = append(b[:index], b[index+1:]...)
 			return nil
@@ -148,7 +301,7 @@ func compareBundles(b1, b2 Bundles) bool {
 
 	//If any of the elements are not the same
 	for k := range b1 {
-		if b1[k] != b2[k] {
+		if b1[k].Name != b2[k].Name || b1[k].Version != b2[k].Version {
 			return false
 		}
 	}
@@ -0,0 +1,78 @@
+package ghost
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestDecodeConfigBundles(t *testing.T) {
+
+	//Bundles recorded by name only, before versions were, are still read
+	v := viper.New()
+	v.SetConfigType("json")
+	if err := v.ReadConfig(bytes.NewBufferString(`{"bundlesInstalled": ["blog", {"name": "shop", "version": "1.2.0", "dependencies": ["blog"]}]}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	c := defaultConfig()
+	if err := decodeConfig(v, &c); err != nil {
+		t.Fatal(err)
+	}
+
+	b := c.BundlesInstalled
+	expected := Bundles{
+		{Name: "blog"},
+		{Name: "shop", Version: "1.2.0", Dependencies: []string{"blog"}},
+	}
+	if !reflect.DeepEqual(b, expected) {
+		t.Errorf("Expected %v, got %v", expected, b)
+	}
+
+	if names := b.Names(); !reflect.DeepEqual(names, []string{"blog", "shop"}) {
+		t.Errorf("Unexpected names %v", names)
+	}
+
+	if dependents := b.DependentsOf("blog"); !reflect.DeepEqual(dependents, []string{"shop"}) {
+		t.Errorf("Unexpected dependents %v", dependents)
+	}
+
+	if dependents := b.DependentsOf("shop"); len(dependents) != 0 {
+		t.Errorf("Unexpected dependents %v", dependents)
+	}
+
+}
+
+//A shorter list in the config file replaces the default, which is left as it was
+func TestDecodeConfigShorterList(t *testing.T) {
+
+	v := viper.New()
+	v.SetConfigType("json")
+	if err := v.ReadConfig(bytes.NewBufferString(`{"globalMiddleware": ["RequestID", "Logger"], "corsAllowedMethods": ["GET"]}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	defaults := defaultConfig()
+	c := defaultConfig()
+	if err := decodeConfig(v, &c); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{"RequestID", "Logger"}; !reflect.DeepEqual(c.GlobalMiddleware, expected) {
+		t.Errorf("Expected %v, got %v", expected, c.GlobalMiddleware)
+	}
+	if expected := []string{"GET"}; !reflect.DeepEqual(c.CorsAllowedMethods, expected) {
+		t.Errorf("Expected %v, got %v", expected, c.CorsAllowedMethods)
+	}
+
+	//Settings missing from the file keep their defaults, and the defaults are unchanged
+	if !reflect.DeepEqual(c.CorsAllowedHeaders, defaults.CorsAllowedHeaders) {
+		t.Errorf("Expected the default headers, got %v", c.CorsAllowedHeaders)
+	}
+	if !reflect.DeepEqual(Defaults.GlobalMiddleware, defaults.GlobalMiddleware) || !reflect.DeepEqual(Defaults.CorsAllowedMethods, defaults.CorsAllowedMethods) {
+		t.Errorf("Expected the defaults to be unchanged, got %v and %v", Defaults.GlobalMiddleware, Defaults.CorsAllowedMethods)
+	}
+
+}
@@ -30,6 +30,36 @@ var Defaults = config{
 	Host:     "localhost",
 	Protocol: "http",
 
+	//JWT Settings
+	JWTAudience:      "",
+	JWTExpiry:        3600,
+	JWTRefreshExpiry: 30 * 24 * 3600,
+	JWTKeys:          make([]JWTKey, 0, 0),
+	JWTSigningKey:    "",
+	JWTAcceptSecret:  false,
+
+	//Magic Code Settings
+	MagicCodeStore:            "memory",
+	MagicCodeExpiry:           300,
+	MagicCodeMaxAttempts:      5,
+	MagicCodeMaxAttemptsPerIP: 20,
+	MagicCodeLockout:          900,
+	MagicLinkRedirect:         "",
+
+	//Password Settings
+	PasswordLogin:      false,
+	PasswordHash:       "argon2id",
+	PasswordMinLength:  8,
+	PasswordResetURL:   "",
+	PasswordConfirmURL: "",
+
+	//Two-Factor Authentication Settings
+	TOTPRoles: make([]string, 0, 0),
+
+	//OpenID Connect Settings
+	OIDCProviders: make([]OIDCProvider, 0, 0),
+	OIDCRedirect:  "",
+
 	//Email Settings
 	ActivateEmail: false,
 	SmtpHost:      "smtp",
@@ -38,8 +68,12 @@ var Defaults = config{
 	SmtpFrom:      "info@yourdomain.com",
 	EmailFrom:     "Your Name",
 
+	//Cache Settings
+	CacheMaxBytes: 64 << 20,
+	CacheTTL:      5,
+
 	//Bundles installed
-	BundlesInstalled: make([]string, 0, 0),
+	BundlesInstalled: make(Bundles, 0, 0),
 
 	//Global Middleware
 	GlobalMiddleware: []string{"RequestID", "RealIP", "Logger", "Recoverer", "CloseNotify", "Timeout"},
@@ -50,7 +84,37 @@ var Defaults = config{
 	CorsAllowedOrigins:   []string{"*"},
 	CorsAllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS", "PATCH", "SEARCH"},
 	CorsAllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-	CorsExposedHeaders:   []string{"Link"},
+	CorsExposedHeaders:   []string{"Link", "Content-Range"},
 	CorsAllowCredentials: true,
 	CorsMaxAge:           300,
 }
+
+//defaultConfig returns a copy of the defaults which shares no lists with them,
+//so that a config decoded into it or changed later leaves the defaults as they are
+func defaultConfig() config {
+
+	c := Defaults
+
+	c.JWTKeys = append([]JWTKey{}, Defaults.JWTKeys...)
+	c.TOTPRoles = append([]string{}, Defaults.TOTPRoles...)
+	c.GlobalMiddleware = append([]string{}, Defaults.GlobalMiddleware...)
+	c.CorsAllowedOrigins = append([]string{}, Defaults.CorsAllowedOrigins...)
+	c.CorsAllowedMethods = append([]string{}, Defaults.CorsAllowedMethods...)
+	c.CorsAllowedHeaders = append([]string{}, Defaults.CorsAllowedHeaders...)
+	c.CorsExposedHeaders = append([]string{}, Defaults.CorsExposedHeaders...)
+
+	c.OIDCProviders = make([]OIDCProvider, len(Defaults.OIDCProviders))
+	for i, provider := range Defaults.OIDCProviders {
+		provider.Scopes = append([]string{}, provider.Scopes...)
+		c.OIDCProviders[i] = provider
+	}
+
+	c.BundlesInstalled = make(Bundles, len(Defaults.BundlesInstalled))
+	for i, bundle := range Defaults.BundlesInstalled {
+		bundle.Dependencies = append([]string{}, bundle.Dependencies...)
+		c.BundlesInstalled[i] = bundle
+	}
+
+	return c
+
+}
@@ -0,0 +1,291 @@
+package ghost
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+//ForeignKey describes a foreign key constraint from Columns in Schema.Table
+//to ForeignColumns in ForeignSchema.ForeignTable
+type ForeignKey struct {
+	Name                        string
+	Schema, Table               string
+	Columns                     []string
+	ForeignSchema, ForeignTable string
+	ForeignColumns              []string
+}
+
+//EmbedConfig describes rows from a related table to be embedded as nested JSON in each result.
+//Tables are related through a foreign key in either direction
+type EmbedConfig struct {
+	//Table is the related table, which is also the key of the embedded JSON
+	Table string
+	//Hint is the name of the foreign key to use if there is more than one between the tables
+	Hint string
+	//Select fields of the related table
+	Select []string
+	//Embed rows related to the related table
+	Embed []EmbedConfig
+	//ForeignKey joins the tables.  Set by Store.ResolveEmbeds
+	ForeignKey ForeignKey
+	//ToMany is true if the related table references this one, in which case the related rows
+	//are embedded as an array.  Otherwise this table references the related one, and the
+	//single related row is embedded as an object.  Set by Store.ResolveEmbeds
+	ToMany bool
+}
+
+//ParseSelect parses a comma separated list of fields to select, with related tables to embed
+//in parentheses, e.g. id,name,orders(id,total,items(*))
+//If there is more than one foreign key between two tables, name the one to use with a hint:
+//customer!orders_billing_customer_fkey(name)
+func ParseSelect(s string) (fields []string, embeds []EmbedConfig, err error) {
+
+	items, err := splitFilterList(s)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, item := range items {
+
+		i := strings.Index(item, "(")
+
+		//Just a field
+		if i == -1 {
+			if item == "" {
+				return nil, nil, errors.New("Empty field in select")
+			}
+			fields = append(fields, item)
+			continue
+		}
+
+		if !strings.HasSuffix(item, ")") {
+			return nil, nil, errors.New("Invalid embed in select: " + item)
+		}
+
+		embed := EmbedConfig{Table: item[:i]}
+		if parts := strings.SplitN(embed.Table, "!", 2); len(parts) == 2 {
+			embed.Table, embed.Hint = parts[0], parts[1]
+		}
+
+		if embed.Table == "" {
+			return nil, nil, errors.New("Invalid embed in select: " + item)
+		}
+
+		if embed.Select, embed.Embed, err = ParseSelect(item[i+1 : len(item)-1]); err != nil {
+			return nil, nil, err
+		}
+
+		embeds = append(embeds, embed)
+
+	}
+
+	return fields, embeds, nil
+
+}
+
+//resolveEmbed finds the single foreign key relating a table to an embedded table
+//from the foreign keys that table is part of
+func resolveEmbed(schema, table string, embed *EmbedConfig, foreignKeys []ForeignKey) error {
+
+	var candidates []EmbedConfig
+
+	for _, fk := range foreignKeys {
+
+		if embed.Hint != "" && fk.Name != embed.Hint {
+			continue
+		}
+
+		//This table references the embedded one
+		if fk.Schema == schema && fk.Table == table && fk.ForeignTable == embed.Table {
+			candidates = append(candidates, EmbedConfig{ForeignKey: fk, ToMany: false})
+			continue
+		}
+
+		//The embedded table references this one
+		if fk.ForeignSchema == schema && fk.ForeignTable == table && fk.Table == embed.Table {
+			candidates = append(candidates, EmbedConfig{ForeignKey: fk, ToMany: true})
+		}
+
+	}
+
+	switch len(candidates) {
+	case 0:
+		return errors.New("No relationship found between " + table + " and " + embed.Table)
+	case 1:
+		embed.ForeignKey = candidates[0].ForeignKey
+		embed.ToMany = candidates[0].ToMany
+		return nil
+	default:
+		return errors.New("More than one relationship found between " + table + " and " + embed.Table + ". Specify the foreign key to use with " + embed.Table + "!<foreign key name>")
+	}
+
+}
+
+//relatedSchemaAndTable returns the location of the embedded table
+func (e EmbedConfig) relatedSchemaAndTable() (string, string) {
+
+	if e.ToMany {
+		return e.ForeignKey.Schema, e.ForeignKey.Table
+	}
+
+	return e.ForeignKey.ForeignSchema, e.ForeignKey.ForeignTable
+
+}
+
+//embedSelect is the base query when related rows are to be embedded.
+//Each embedded table is added with a lateral join that aggregates its rows to JSON
+func (s queryBuilder) embedSelect(schema string, table string, selectFields []string, embeds []EmbedConfig) (queryBuilder, error) {
+
+	quotedSchema, err := QuoteIdentifier(schema)
+	if err != nil {
+		return s, err
+	}
+
+	quotedTable, err := QuoteIdentifier(table)
+	if err != nil {
+		return s, err
+	}
+
+	//Embedded tables are aliased with a counter, so that the same table
+	//can appear more than once
+	counter := 0
+	s.sql, err = selectWithEmbeds(quotedSchema+"."+quotedTable, quotedTable, "", selectFields, embeds, &counter)
+	s.alias = quotedTable
+	return s, err
+
+}
+
+//selectWithEmbeds selects fields from a table, qualified by its alias, along with the embedded JSON of each related table
+func selectWithEmbeds(from, alias, aliasClause string, selectFields []string, embeds []EmbedConfig, counter *int) (string, error) {
+
+	if len(selectFields) == 0 {
+		selectFields = []string{"*"}
+	}
+
+	var columns []string
+	for _, f := range selectFields {
+
+		if f == "*" {
+			columns = append(columns, alias+".*")
+			continue
+		}
+
+		quoted, err := QuoteIdentifier(f)
+		if err != nil {
+			return "", err
+		}
+		columns = append(columns, alias+"."+quoted)
+
+	}
+
+	joins := ""
+	for _, e := range embeds {
+
+		if err := e.checkName(selectFields); err != nil {
+			return "", err
+		}
+
+		*counter++
+		relatedAlias := fmt.Sprintf(`"t%v"`, *counter)
+		rowsAlias := fmt.Sprintf(`"r%v"`, *counter)
+		joinAlias := fmt.Sprintf(`"j%v"`, *counter)
+
+		name, err := QuoteIdentifier(e.Table)
+		if err != nil {
+			return "", err
+		}
+
+		relatedSchema, relatedTable := e.relatedSchemaAndTable()
+		quotedRelatedSchema, err := QuoteIdentifier(relatedSchema)
+		if err != nil {
+			return "", errors.New("Relationship to " + e.Table + " has not been resolved")
+		}
+		quotedRelatedTable, err := QuoteIdentifier(relatedTable)
+		if err != nil {
+			return "", err
+		}
+
+		//Correlate the related rows with the current row
+		conditions, err := e.joinConditions(alias, relatedAlias)
+		if err != nil {
+			return "", err
+		}
+
+		related, err := selectWithEmbeds(quotedRelatedSchema+"."+quotedRelatedTable, relatedAlias, " AS "+relatedAlias, e.Select, e.Embed, counter)
+		if err != nil {
+			return "", err
+		}
+		related = fmt.Sprintf(sqlToAddWhereClause, related, conditions)
+
+		template := sqlToEmbedOne
+		if e.ToMany {
+			template = sqlToEmbedMany
+		}
+
+		joins = fmt.Sprintf(sqlToAddLateralJoin, joins, fmt.Sprintf(template, rowsAlias, name, related, rowsAlias), joinAlias)
+		columns = append(columns, joinAlias+"."+name)
+
+	}
+
+	return fmt.Sprintf(sqlToSelectFieldsFromWithJoins, strings.Join(columns, ","), from+aliasClause, joins), nil
+
+}
+
+//checkName makes sure the embedded JSON won't have the same key as a selected column.
+//With *, only the columns of the foreign key are known to be selected
+func (e EmbedConfig) checkName(selectFields []string) error {
+
+	for _, f := range selectFields {
+
+		clashes := f == e.Table
+		if f == "*" && !e.ToMany {
+			for _, c := range e.ForeignKey.Columns {
+				clashes = clashes || c == e.Table
+			}
+		}
+
+		if clashes {
+			return errors.New("Cannot embed " + e.Table + " as it has the same name as a selected column")
+		}
+
+	}
+
+	return nil
+
+}
+
+//joinConditions matches each column of the foreign key between the table and the related table
+func (e EmbedConfig) joinConditions(alias, relatedAlias string) (string, error) {
+
+	fk := e.ForeignKey
+	if len(fk.Columns) == 0 || len(fk.Columns) != len(fk.ForeignColumns) {
+		return "", errors.New("Invalid foreign key for relationship to " + e.Table)
+	}
+
+	//The side holding the foreign key columns
+	referencing, referenced := alias, relatedAlias
+	if e.ToMany {
+		referencing, referenced = relatedAlias, alias
+	}
+
+	conditions := make([]string, len(fk.Columns))
+	for k := range fk.Columns {
+
+		column, err := QuoteIdentifier(fk.Columns[k])
+		if err != nil {
+			return "", err
+		}
+
+		foreignColumn, err := QuoteIdentifier(fk.ForeignColumns[k])
+		if err != nil {
+			return "", err
+		}
+
+		conditions[k] = fmt.Sprintf(sqlToJoinOn, referencing, column, referenced, foreignColumn)
+
+	}
+
+	return strings.Join(conditions, " AND "), nil
+
+}
@@ -0,0 +1,230 @@
+package ghost
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var (
+	//orders.customer_id references customers.id
+	ordersCustomerFK = ForeignKey{
+		Name:           "orders_customer_id_fkey",
+		Schema:         "public",
+		Table:          "orders",
+		Columns:        []string{"customer_id"},
+		ForeignSchema:  "public",
+		ForeignTable:   "customers",
+		ForeignColumns: []string{"id"},
+	}
+	//items.order_id references orders.id
+	itemsOrderFK = ForeignKey{
+		Name:           "items_order_id_fkey",
+		Schema:         "public",
+		Table:          "items",
+		Columns:        []string{"order_id"},
+		ForeignSchema:  "public",
+		ForeignTable:   "orders",
+		ForeignColumns: []string{"id"},
+	}
+)
+
+func TestParseSelect(t *testing.T) {
+
+	fields, embeds, err := ParseSelect("id,name,orders(id,total,items(*)),customer!orders_billing_fkey()")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(fields, []string{"id", "name"}) {
+		t.Errorf("Fields: expected [id name], got %v", fields)
+	}
+
+	expected := []EmbedConfig{
+		EmbedConfig{
+			Table:  "orders",
+			Select: []string{"id", "total"},
+			Embed: []EmbedConfig{
+				EmbedConfig{Table: "items", Select: []string{"*"}},
+			},
+		},
+		EmbedConfig{Table: "customer", Hint: "orders_billing_fkey"},
+	}
+
+	if !reflect.DeepEqual(embeds, expected) {
+		t.Errorf("Embeds: expected %+v, got %+v", expected, embeds)
+	}
+
+	for _, s := range []string{"id,,name", "orders(id", "orders)id(", "(id)"} {
+		if _, _, err := ParseSelect(s); err == nil {
+			t.Errorf("Expected an error parsing select: %s", s)
+		}
+	}
+
+}
+
+func TestResolveEmbed(t *testing.T) {
+
+	foreignKeys := []ForeignKey{ordersCustomerFK, itemsOrderFK}
+
+	//From orders, customers are referenced by a foreign key so there is one per order
+	customers := EmbedConfig{Table: "customers"}
+	if err := resolveEmbed("public", "orders", &customers, foreignKeys); err != nil {
+		t.Fatal(err)
+	}
+	if customers.ToMany || customers.ForeignKey.Name != ordersCustomerFK.Name {
+		t.Errorf("Expected customers to be embedded as one row, got %+v", customers)
+	}
+
+	//Items reference orders, so there can be many per order
+	items := EmbedConfig{Table: "items"}
+	if err := resolveEmbed("public", "orders", &items, foreignKeys); err != nil {
+		t.Fatal(err)
+	}
+	if !items.ToMany || items.ForeignKey.Name != itemsOrderFK.Name {
+		t.Errorf("Expected items to be embedded as many rows, got %+v", items)
+	}
+
+	//No relationship
+	unrelated := EmbedConfig{Table: "products"}
+	if err := resolveEmbed("public", "orders", &unrelated, foreignKeys); err == nil {
+		t.Error("Expected an error embedding an unrelated table")
+	}
+
+	//Two relationships need a hint to choose between them
+	billingFK := ordersCustomerFK
+	billingFK.Name = "orders_billing_id_fkey"
+	billingFK.Columns = []string{"billing_id"}
+	foreignKeys = append(foreignKeys, billingFK)
+
+	ambiguous := EmbedConfig{Table: "customers"}
+	if err := resolveEmbed("public", "orders", &ambiguous, foreignKeys); err == nil {
+		t.Error("Expected an error embedding a table with two relationships")
+	}
+
+	hinted := EmbedConfig{Table: "customers", Hint: "orders_billing_id_fkey"}
+	if err := resolveEmbed("public", "orders", &hinted, foreignKeys); err != nil {
+		t.Fatal(err)
+	}
+	if hinted.ForeignKey.Columns[0] != "billing_id" {
+		t.Errorf("Expected the hinted foreign key to be used, got %+v", hinted.ForeignKey)
+	}
+
+}
+
+func TestBuildWithEmbeds(t *testing.T) {
+
+	q := Query{
+		Schema: "public",
+		Table:  "customers",
+		Select: []string{"id", "name"},
+		Embed: []EmbedConfig{
+			EmbedConfig{
+				Table:      "orders",
+				Select:     []string{"id"},
+				ForeignKey: ordersCustomerFK,
+				ToMany:     true,
+				Embed: []EmbedConfig{
+					EmbedConfig{Table: "items", ForeignKey: itemsOrderFK, ToMany: true},
+				},
+			},
+		},
+		Where:  []WhereConfig{WhereConfig{Key: "name", Value: "jon"}},
+		IsList: true,
+	}
+
+	if err := q.Build(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `WITH results AS (SELECT "customers"."id","customers"."name","j1"."orders" FROM "public"."customers" ` +
+		`LEFT JOIN LATERAL (SELECT COALESCE(json_agg("r1"), '[]') AS "orders" FROM (` +
+		`SELECT "t1"."id","j2"."items" FROM "public"."orders" AS "t1" ` +
+		`LEFT JOIN LATERAL (SELECT COALESCE(json_agg("r2"), '[]') AS "items" FROM (` +
+		`SELECT "t2".* FROM "public"."items" AS "t2" WHERE "t2"."order_id" = "t1"."id"` +
+		`) AS "r2") AS "j2" ON true ` +
+		`WHERE "t1"."customer_id" = "customers"."id"` +
+		`) AS "r1") AS "j1" ON true ` +
+		`WHERE "customers"."name" = $1) SELECT array_to_json(array_agg(row_to_json(results))) from results;`
+
+	if q.queryString != expected {
+		t.Errorf("\nExpected: %s\nGot:      %s", expected, q.queryString)
+	}
+
+	//A single related row is embedded as an object
+	q = Query{
+		Schema: "public",
+		Table:  "orders",
+		Embed:  []EmbedConfig{EmbedConfig{Table: "customers", ForeignKey: ordersCustomerFK}},
+	}
+
+	if err := q.Build(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected = `WITH results AS (SELECT "orders".*,"j1"."customers" FROM "public"."orders" ` +
+		`LEFT JOIN LATERAL (SELECT row_to_json("r1") AS "customers" FROM (` +
+		`SELECT "t1".* FROM "public"."customers" AS "t1" WHERE "orders"."customer_id" = "t1"."id"` +
+		`) AS "r1") AS "j1" ON true) SELECT row_to_json(results) from results;`
+
+	if q.queryString != expected {
+		t.Errorf("\nExpected: %s\nGot:      %s", expected, q.queryString)
+	}
+
+	//Relationships must be resolved before building
+	q = Query{Schema: "public", Table: "orders", Embed: []EmbedConfig{EmbedConfig{Table: "customers"}}}
+	if err := q.Build(); err == nil {
+		t.Error("Expected an error building with an unresolved embed")
+	}
+
+}
+
+//The base table's columns can have the same name as an embedded table's columns, but not as the embedded table
+func TestBuildWithEmbedNameClash(t *testing.T) {
+
+	//orders.customer references customer.id
+	customerFK := ForeignKey{
+		Name:           "orders_customer_fkey",
+		Schema:         "public",
+		Table:          "orders",
+		Columns:        []string{"customer"},
+		ForeignSchema:  "public",
+		ForeignTable:   "customer",
+		ForeignColumns: []string{"id"},
+	}
+
+	for _, selectFields := range [][]string{nil, []string{"*"}, []string{"id", "customer"}} {
+		q := Query{
+			Schema: "public",
+			Table:  "orders",
+			Select: selectFields,
+			Embed:  []EmbedConfig{EmbedConfig{Table: "customer", ForeignKey: customerFK}},
+		}
+		if err := q.Build(); err == nil {
+			t.Errorf("Expected embedding customer while selecting %v to be refused", selectFields)
+		}
+	}
+
+	//Columns in conditions and ordering are those of the base table
+	q := Query{
+		Schema: "public",
+		Table:  "customers",
+		Select: []string{"id"},
+		Embed:  []EmbedConfig{EmbedConfig{Table: "orders", Select: []string{"id"}, ForeignKey: ordersCustomerFK, ToMany: true}},
+		Where:  []WhereConfig{WhereConfig{Key: "id", Value: 1}},
+		Order:  []OrderConfig{OrderConfig{Key: "id"}},
+		After:  "WzFd", //[1]
+		IsList: true,
+	}
+
+	if err := q.Build(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{`WHERE ("customers"."id" = $1) AND ("customers"."id" > $2)`, `ORDER BY "customers"."id" ASC`} {
+		if !strings.Contains(q.queryString, expected) {
+			t.Errorf("Expected %s in %s", expected, q.queryString)
+		}
+	}
+
+}
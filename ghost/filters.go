@@ -0,0 +1,286 @@
+package ghost
+
+import (
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+//filterOperators maps the operators available in URL filters to their SQL equivalents.
+//Anything not on this list is rejected
+var filterOperators = map[string]string{
+	"eq":     "=",
+	"neq":    "<>",
+	"gt":     ">",
+	"gte":    ">=",
+	"lt":     "<",
+	"lte":    "<=",
+	"like":   "LIKE",
+	"ilike":  "ILIKE",
+	"match":  "~",
+	"imatch": "~*",
+	"is":     "IS",
+	"in":     "",
+}
+
+//ReservedQueryParameters are URL query parameters that are not filters
+var ReservedQueryParameters = map[string]bool{
+	"select": true,
+	"order":  true,
+	"limit":  true,
+	"offset": true,
+	"after":  true,
+}
+
+//HasFilters reports whether there are any filters in the URL query parameters
+func HasFilters(queries url.Values) bool {
+	for k := range queries {
+		if !ReservedQueryParameters[k] {
+			return true
+		}
+	}
+	return false
+}
+
+//ParseFilters turns URL query parameters into where clauses, all joined with AND.
+//The syntax follows PostgREST:
+//	?age=gt.30&name=ilike.*smith*&status=in.(a,b)&deleted=not.is.null
+//	?or=(age.lt.18,age.gt.65)&not.and=(a.eq.1,b.eq.2)
+//Groups can be nested, e.g. or=(a.eq.1,and(b.eq.2,c.eq.3)).
+//Only the columns provided can be filtered on
+func ParseFilters(queries url.Values, columns []string) ([]WhereConfig, error) {
+
+	knownColumns := map[string]bool{}
+	for _, c := range columns {
+		knownColumns[c] = true
+	}
+
+	//Parameters are processed in a fixed order so that the same URL
+	//always results in the same SQL (and therefore the same cache key)
+	keys := make([]string, 0, len(queries))
+	for k := range queries {
+		if !ReservedQueryParameters[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var whereClauses []WhereConfig
+
+	for _, key := range keys {
+
+		for _, value := range queries[key] {
+
+			var (
+				clause WhereConfig
+				err    error
+			)
+
+			//Logical groups are of the form or=(...), not.and=(...)
+			if negate, conjunction, ok := logicalOperator(key); ok {
+				clause, err = parseGroup(conjunction, value, knownColumns)
+				clause.Negate = negate
+			} else {
+				clause, err = parseFilter(key, value, knownColumns)
+			}
+
+			if err != nil {
+				return nil, err
+			}
+
+			whereClauses = append(whereClauses, clause)
+
+		}
+	}
+
+	return whereClauses, nil
+
+}
+
+//logicalOperator checks for and, or, not.and and not.or
+func logicalOperator(s string) (negate bool, conjunction string, ok bool) {
+
+	if strings.HasPrefix(s, "not.") {
+		negate = true
+		s = strings.TrimPrefix(s, "not.")
+	}
+
+	if s == "and" || s == "or" {
+		return negate, s, true
+	}
+
+	return false, "", false
+}
+
+//parseGroup parses a parenthesised, comma separated list of filters into a group
+//e.g. (age.lt.18,age.gt.65)
+func parseGroup(conjunction, value string, knownColumns map[string]bool) (WhereConfig, error) {
+
+	if !strings.HasPrefix(value, "(") || !strings.HasSuffix(value, ")") {
+		return WhereConfig{}, errors.New("Logical filter must be enclosed in parentheses: " + value)
+	}
+
+	items, err := splitFilterList(value[1 : len(value)-1])
+	if err != nil {
+		return WhereConfig{}, err
+	}
+
+	group := WhereConfig{}
+	for _, item := range items {
+
+		clause, err := parseGroupItem(item, knownColumns)
+		if err != nil {
+			return WhereConfig{}, err
+		}
+
+		clause.JoinWithOr = conjunction == "or"
+		group.Group = append(group.Group, clause)
+
+	}
+
+	if len(group.Group) == 0 {
+		return WhereConfig{}, errors.New("Empty logical filter")
+	}
+
+	return group, nil
+
+}
+
+//parseGroupItem parses an item within a group, which is either a nested
+//group such as not.and(...) or a filter of the form column.operator.value
+func parseGroupItem(item string, knownColumns map[string]bool) (WhereConfig, error) {
+
+	if i := strings.Index(item, "("); i > 0 {
+		if negate, conjunction, ok := logicalOperator(item[:i]); ok {
+			clause, err := parseGroup(conjunction, item[i:], knownColumns)
+			clause.Negate = negate
+			return clause, err
+		}
+	}
+
+	parts := strings.SplitN(item, ".", 2)
+	if len(parts) != 2 {
+		return WhereConfig{}, errors.New("Invalid filter: " + item)
+	}
+
+	return parseFilter(parts[0], parts[1], knownColumns)
+
+}
+
+//parseFilter parses a single filter of the form [not.]operator.value on a column
+func parseFilter(column, filter string, knownColumns map[string]bool) (WhereConfig, error) {
+
+	if !knownColumns[column] {
+		return WhereConfig{}, errors.New("Unknown column: " + column)
+	}
+
+	clause := WhereConfig{Key: column}
+
+	if strings.HasPrefix(filter, "not.") {
+		clause.Negate = true
+		filter = strings.TrimPrefix(filter, "not.")
+	}
+
+	parts := strings.SplitN(filter, ".", 2)
+	if len(parts) != 2 {
+		return WhereConfig{}, errors.New("Invalid filter on column " + column + ": " + filter)
+	}
+
+	operator, ok := filterOperators[parts[0]]
+	if !ok {
+		return WhereConfig{}, errors.New("Operator not allowed in filter: " + parts[0])
+	}
+
+	value := parts[1]
+
+	switch parts[0] {
+
+	case "in":
+		if !strings.HasPrefix(value, "(") || !strings.HasSuffix(value, ")") {
+			return WhereConfig{}, errors.New("List must be enclosed in parentheses: " + value)
+		}
+		items, err := splitFilterList(value[1 : len(value)-1])
+		if err != nil {
+			return WhereConfig{}, err
+		}
+		if len(items) == 0 {
+			return WhereConfig{}, errors.New("Empty list in filter on column " + column)
+		}
+		for _, item := range items {
+			clause.AnyValue = append(clause.AnyValue, unquoteFilterValue(item))
+		}
+		return clause, nil
+
+	case "is":
+		if !allowedIsValues[strings.ToUpper(value)] {
+			return WhereConfig{}, errors.New("Value not allowed after is: " + value)
+		}
+
+	case "like", "ilike":
+		//* is accepted as a URL-friendly wildcard
+		value = strings.Replace(value, "*", "%", -1)
+
+	}
+
+	//An empty value would otherwise be left out of the query, returning everything unfiltered
+	clause.Operator = operator
+	clause.Value = unquoteFilterValue(value)
+	if clause.Value == "" {
+		return WhereConfig{}, errors.New("Empty value in filter on column " + column)
+	}
+
+	return clause, nil
+
+}
+
+//splitFilterList splits a comma separated list, ignoring commas inside
+//double quotes or nested parentheses
+func splitFilterList(s string) ([]string, error) {
+
+	var (
+		items    []string
+		depth    int
+		inQuotes bool
+		start    int
+	)
+
+	for i, c := range s {
+		switch {
+		case c == '"':
+			inQuotes = !inQuotes
+		case inQuotes:
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth < 0 {
+				return nil, errors.New("Unbalanced parentheses in filter: " + s)
+			}
+		case c == ',' && depth == 0:
+			items = append(items, s[start:i])
+			start = i + 1
+		}
+	}
+
+	if depth != 0 || inQuotes {
+		return nil, errors.New("Unbalanced parentheses or quotes in filter: " + s)
+	}
+
+	if s != "" {
+		items = append(items, s[start:])
+	}
+
+	return items, nil
+
+}
+
+//unquoteFilterValue removes the double quotes used to protect reserved characters in a value
+func unquoteFilterValue(s string) string {
+
+	if len(s) >= 2 && strings.HasPrefix(s, `"`) && strings.HasSuffix(s, `"`) {
+		return s[1 : len(s)-1]
+	}
+
+	return s
+}
@@ -0,0 +1,124 @@
+package ghost
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+var filterColumns = []string{"id", "age", "name", "status", "deleted"}
+
+func TestParseFilters(t *testing.T) {
+
+	cases := []struct {
+		rawQuery      string
+		expectedWhere string
+		expectedArgs  []interface{}
+	}{
+		{
+			"age=gt.30",
+			`WHERE "age" > $1`,
+			[]interface{}{"30"},
+		},
+		{
+			"age=gte.18&age=lt.65",
+			`WHERE "age" >= $1 AND "age" < $2`,
+			[]interface{}{"18", "65"},
+		},
+		{
+			"name=ilike.*smith*&select=id,name&limit=10",
+			`WHERE "name" ILIKE $1`,
+			[]interface{}{"%smith%"},
+		},
+		{
+			"status=in.(a,b,\"c,d\")",
+			`WHERE "status" = ANY($1)`,
+			[]interface{}{pq.Array([]interface{}{"a", "b", "c,d"})},
+		},
+		{
+			"deleted=not.is.null",
+			`WHERE NOT "deleted" IS NULL`,
+			nil,
+		},
+		{
+			"or=(age.lt.18,age.gt.65)&name=eq.jon",
+			`WHERE "name" = $1 AND ("age" < $2 OR "age" > $3)`,
+			[]interface{}{"jon", "18", "65"},
+		},
+		{
+			"or=(id.eq.1,and(age.gt.18,status.not.in.(a,b)))",
+			`WHERE ("id" = $1 OR ("age" > $2 AND NOT "status" = ANY($3)))`,
+			[]interface{}{"1", "18", pq.Array([]interface{}{"a", "b"})},
+		},
+		{
+			"not.and=(id.eq.1,name.neq.jon)",
+			`WHERE NOT ("id" = $1 AND "name" <> $2)`,
+			[]interface{}{"1", "jon"},
+		},
+	}
+
+	for _, c := range cases {
+
+		queries, _ := url.ParseQuery(c.rawQuery)
+		where, err := ParseFilters(queries, filterColumns)
+		if err != nil {
+			TestErrorFatal(t, c.rawQuery, err.Error(), c.expectedWhere)
+			continue
+		}
+
+		q := Query{Schema: "public", Table: "test_table", Where: where}
+		q.Build()
+
+		expected := fmt.Sprintf(`WITH results AS (SELECT * FROM "public"."test_table" %s) SELECT row_to_json(results) from results;`, c.expectedWhere)
+		if q.queryString != expected {
+			TestErrorFatal(t, c.rawQuery, q.queryString, expected)
+		}
+		if !argsEqual(q.queryArgs, c.expectedArgs) {
+			TestErrorFatal(t, c.rawQuery, fmt.Sprint(q.queryArgs), fmt.Sprint(c.expectedArgs))
+		}
+
+	}
+
+}
+
+func TestParseFiltersRejectsInvalid(t *testing.T) {
+
+	rawQueries := []string{
+		"password=eq.secret",
+		"age=between.1",
+		"age=gt",
+		"deleted=is.everything",
+		"status=in.a,b",
+		"or=age.lt.18",
+		"or=(age.lt.18,xor(id.eq.1))",
+		"or=(age.lt.18",
+		"age=eq.",
+		"name=not.eq.",
+		`name=eq.""`,
+		"or=(age.eq.,age.gt.65)",
+	}
+
+	for _, rawQuery := range rawQueries {
+		queries, _ := url.ParseQuery(rawQuery)
+		if _, err := ParseFilters(queries, filterColumns); err == nil {
+			TestErrorFatal(t, rawQuery, "no error", "an error")
+		}
+	}
+
+}
+
+func TestHasFilters(t *testing.T) {
+
+	queries, _ := url.ParseQuery("select=id&order=id.desc")
+	if HasFilters(queries) {
+		t.Error("Reserved parameters are not filters")
+	}
+
+	queries, _ = url.ParseQuery("select=id&id=eq.1")
+	if !HasFilters(queries) {
+		t.Error("id=eq.1 is a filter")
+	}
+
+}
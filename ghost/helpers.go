@@ -16,13 +16,15 @@ package ghost
 
 import (
 	"bufio"
+	"crypto/rand"
+	"encoding/json"
 	"fmt"
 	"log"
-	"math/rand"
+	"math/big"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
-	"time"
 
 	"github.com/lib/pq"
 )
@@ -61,6 +63,9 @@ func DBErrorCodeToHTTPErrorCode(dbCode pq.ErrorCode) (httpCode int) {
 		httpCode = http.StatusForbidden
 	case dbCode == "42P01":
 		httpCode = http.StatusNotFound
+	case dbCode == "57014":
+		//Cancelled, normally by the statement timeout
+		httpCode = http.StatusGatewayTimeout
 	default:
 		//Default to 400
 		httpCode = http.StatusBadRequest
@@ -68,13 +73,16 @@ func DBErrorCodeToHTTPErrorCode(dbCode pq.ErrorCode) (httpCode int) {
 	return httpCode
 }
 
-//RandomString generates a random string of int length
+//RandomString generates a cryptographically random string of int length
 func RandomString(strlen int) string {
-	rand.Seed(time.Now().UTC().UnixNano())
 	const chars = "abcdefghijklmnopqrstuvwxyz0123456789"
 	result := make([]byte, strlen)
 	for i := 0; i < strlen; i++ {
-		result[i] = chars[rand.Intn(len(chars))]
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(chars))))
+		if err != nil {
+			LogFatal("RANDOM", false, "Could not generate random string", err)
+		}
+		result[i] = chars[n.Int64()]
 	}
 	return string(result)
 }
@@ -123,20 +131,46 @@ func HyphensToUnderscores(table string) string {
 }
 
 //MapToValsAndCols iterates over the map resulting from binding a JSON request body
-//and creates cols and vals strings to be used in SQL query
-func MapToValsAndCols(r map[string]interface{}) (cols, vals string) {
-	//Iterate over the map and set the keys and values on the context
-	for k, v := range r {
-		cols = cols + k + ", "
-		//The value can be anything, so we Sprintf to the default format %v to avoid any printing errors
-		//We also surround with '' to make everything a string in the SQL, this way strings don't fail
-		//and the database automatically types numebers.  If you don't do this, strings will fail.
-		vals = vals + fmt.Sprintf(`'%v'`, v) + ", "
+//and creates a cols string of quoted column names, a vals string of positional placeholders
+//and the corresponding args to be bound, for use in an SQL query.
+//Placeholders are numbered starting from firstPlaceholder, so that other parameters
+//(e.g. an id in a WHERE clause) can come before them.  Keys are processed in sorted order
+//so that the same body always produces the same SQL
+func MapToValsAndCols(r map[string]interface{}, firstPlaceholder int) (cols, vals string, args []interface{}, err error) {
+
+	keys := make([]string, 0, len(r))
+	for k := range r {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	colList := make([]string, len(keys))
+	valList := make([]string, len(keys))
+	for i, k := range keys {
+		col, err := QuoteIdentifier(k)
+		if err != nil {
+			return "", "", nil, err
+		}
+		colList[i] = col
+		valList[i] = fmt.Sprintf("$%v", firstPlaceholder+i)
+
+		//Nested objects and arrays can't be bound directly, so pass them as JSON text
+		//and let the database type them
+		switch v := r[k].(type) {
+		case map[string]interface{}, []interface{}:
+			b, err := json.Marshal(v)
+			if err != nil {
+				return "", "", nil, err
+			}
+			args = append(args, string(b))
+		default:
+			args = append(args, v)
+		}
 	}
-	//Trim the trailing commas
-	cols = strings.TrimSuffix(cols, ", ")
-	vals = strings.TrimSuffix(vals, ", ")
-	return
+
+	cols = strings.Join(colList, ", ")
+	vals = strings.Join(valList, ", ")
+	return cols, vals, args, nil
 }
 
 // AskForConfirmation asks the user for confirmation. A user must type in "yes" or "no" and
@@ -0,0 +1,188 @@
+// Copyright 2017 Jonathan Pincas
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ghost
+
+import "sync"
+
+//CacheChannel is the channel on which the database notifies changes to a table,
+//with the payload schema.table.  A payload of * invalidates everything.
+//Bundles get a trigger on each table that does this on install,
+//and can notify the channel themselves for anything else, e.g. SELECT pg_notify('ghost_cache', 'shop.orders');
+const CacheChannel = "ghost_cache"
+
+//invalidateAll is the tag that invalidates every cached result
+const invalidateAll = "*"
+
+//cacheTagIndex records the keys of the results cached by this process for each schema.table they read from.
+//Each process deletes its own keys when a table changes, so this also works with a shared external cache,
+//as long as every process is listening
+type cacheTagIndex struct {
+	mu   sync.Mutex
+	keys map[string]map[string]bool
+	//tagged records the tags of each key, so that the key can be dropped from all of them
+	tagged map[string][]string
+	//generations count the invalidations of each tag, so that results read before an invalidation,
+	//but only ready to cache after it, are not cached
+	generations map[string]uint64
+	all         uint64
+	//evicted are the keys the cache has dropped by itself since the index was last pruned.
+	//They have their own lock, as the cache tells the index about them while it is locked
+	evictedMu sync.Mutex
+	evicted   map[string]bool
+}
+
+var cacheTags = newCacheTagIndex()
+
+func newCacheTagIndex() *cacheTagIndex {
+
+	return &cacheTagIndex{
+		keys:        map[string]map[string]bool{},
+		tagged:      map[string][]string{},
+		generations: map[string]uint64{},
+		evicted:     map[string]bool{},
+	}
+
+}
+
+//forget records that the cache has dropped a key, so that it is dropped from the index when it is next pruned.
+//It is set with MemoryCache.OnEvict, so that the index doesn't grow beyond the cache
+func (c *cacheTagIndex) forget(key string) {
+
+	c.evictedMu.Lock()
+	defer c.evictedMu.Unlock()
+
+	c.evicted[key] = true
+
+}
+
+//prune drops the keys the cache has dropped from the index.  The lock must be held
+func (c *cacheTagIndex) prune() {
+
+	c.evictedMu.Lock()
+	evicted := c.evicted
+	c.evicted = map[string]bool{}
+	c.evictedMu.Unlock()
+
+	for key := range evicted {
+		c.untag(key)
+	}
+
+}
+
+//untag drops a key from all of its tags.  The lock must be held
+func (c *cacheTagIndex) untag(key string) {
+
+	for _, tag := range c.tagged[key] {
+		delete(c.keys[tag], key)
+		if len(c.keys[tag]) == 0 {
+			delete(c.keys, tag)
+		}
+	}
+	delete(c.tagged, key)
+
+}
+
+//generation returns a number that changes whenever any of the tags are invalidated
+func (c *cacheTagIndex) generation(tags []string) uint64 {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	generation := c.all
+	for _, tag := range tags {
+		generation += c.generations[tag]
+	}
+	return generation
+
+}
+
+//set calls fn to cache results under keys, and tags the keys, unless the tags
+//have been invalidated since the generation was taken.
+//Keys dropped before fn are pruned first, so that keys cached again stay tagged, and those dropped by fn after
+func (c *cacheTagIndex) set(tags []string, generation uint64, keys []string, fn func()) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	current := c.all
+	for _, tag := range tags {
+		current += c.generations[tag]
+	}
+	if current != generation {
+		return
+	}
+
+	c.prune()
+	fn()
+
+	for _, tag := range tags {
+		if c.keys[tag] == nil {
+			c.keys[tag] = map[string]bool{}
+		}
+		for _, key := range keys {
+			c.keys[tag][key] = true
+		}
+	}
+	for _, key := range keys {
+		c.tagged[key] = tags
+	}
+
+	c.prune()
+
+}
+
+//invalidate deletes the cached results tagged with any of the tags from the cache.
+//An empty tag, or *, invalidates everything
+func (c *cacheTagIndex) invalidate(cache Cache, tags ...string) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, tag := range tags {
+
+		if tag == "" || tag == invalidateAll {
+			c.all++
+			for t := range c.keys {
+				c.deleteTag(cache, t)
+			}
+			continue
+		}
+
+		c.generations[tag]++
+		c.deleteTag(cache, tag)
+
+	}
+
+}
+
+//deleteTag deletes all the keys with a tag, dropping them from their other tags too.  The lock must be held
+func (c *cacheTagIndex) deleteTag(cache Cache, tag string) {
+
+	for key := range c.keys[tag] {
+		if cache != nil {
+			cache.Delete(key)
+		}
+		c.untag(key)
+	}
+
+}
+
+//Invalidate removes cached results that read from any of the given tables, named schema.table.
+//Use * to remove everything cached
+func (s store) Invalidate(tables ...string) {
+
+	cacheTags.invalidate(App.Cache, tables...)
+
+}
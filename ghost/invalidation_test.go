@@ -0,0 +1,156 @@
+package ghost
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestInvalidate(t *testing.T) {
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	App.DB = db
+	defer db.Close()
+
+	App.Cache = NewMemoryCache(1<<20, time.Hour)
+	defer func() { App.Cache = nil }()
+
+	execute := func() {
+		q := Query{Schema: "public", Table: "test_table", IsList: true, CacheLevel: "all"}
+		if _, err := App.Store.Execute(&q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expectQuery := func() {
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT").WillReturnRows(sqlmock.NewRows([]string{"json"}).AddRow(`[{"id":1}]`))
+		mock.ExpectCommit()
+	}
+
+	//Cached on the first execution
+	expectQuery()
+	execute()
+	execute()
+
+	//Changes to other tables make no difference
+	App.Store.Invalidate("public.other_table")
+	execute()
+
+	//Changes to the table mean it is read again
+	App.Store.Invalidate("public.test_table")
+	expectQuery()
+	execute()
+	execute()
+
+	//As does invalidating everything
+	App.Store.Invalidate("*")
+	expectQuery()
+	execute()
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+}
+
+func TestCacheTagIndex(t *testing.T) {
+
+	c := NewMemoryCache(1<<20, time.Hour)
+	index := newCacheTagIndex()
+	tags := []string{"shop.orders", "shop.customers"}
+
+	set := func(generation uint64, key string) {
+		index.set(tags, generation, []string{key}, func() { c.Set(key, []byte("result"), 0) })
+	}
+
+	set(index.generation(tags), "before")
+
+	//A result read before an invalidation is not cached after it
+	generation := index.generation(tags)
+	index.invalidate(c, "shop.customers")
+	set(generation, "during")
+
+	if _, ok := c.Get("during"); ok {
+		t.Error("Expected the result read during the invalidation not to be cached")
+	}
+	if _, ok := c.Get("before"); ok {
+		t.Error("Expected the result tagged with shop.customers to have been deleted")
+	}
+
+}
+
+//Keys the cache drops by itself are dropped from the index too, so it doesn't grow beyond the cache
+func TestCacheTagIndexEvictions(t *testing.T) {
+
+	c := NewMemoryCache(100, time.Hour)
+	index := newCacheTagIndex()
+	c.OnEvict(index.forget)
+	tags := []string{"shop.orders"}
+
+	set := func(key string, ttl time.Duration) {
+		index.set(tags, index.generation(tags), []string{key}, func() { c.Set(key, []byte("result"), ttl) })
+	}
+
+	//Each distinct filter value is a new key
+	for i := 0; i < 100; i++ {
+		set(fmt.Sprintf("orders?id=eq.%d", i), 0)
+	}
+
+	entries := c.Stats().Entries
+	if entries == 0 || c.Stats().Evictions == 0 {
+		t.Fatalf("Expected the cache to have been filled past its limit, got %+v", c.Stats())
+	}
+	if len(index.tagged) != entries || len(index.keys["shop.orders"]) != entries {
+		t.Errorf("Expected the index to have %d keys, got %d and %d", entries, len(index.tagged), len(index.keys["shop.orders"]))
+	}
+
+	//Expired keys are dropped too, once the cache finds they have expired
+	set("expiring", time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	c.Get("expiring")
+	set("orders?id=eq.0", 0)
+	if _, ok := index.tagged["expiring"]; ok {
+		t.Error("Expected the expired key to have been dropped from the index")
+	}
+
+	//Keys still cached are still invalidated
+	index.invalidate(c, "shop.orders")
+	if _, ok := c.Get("orders?id=eq.0"); ok {
+		t.Error("Expected the cached result to have been deleted")
+	}
+	if len(index.tagged) != 0 || len(index.keys) != 0 {
+		t.Errorf("Expected the index to be empty, got %v", index.tagged)
+	}
+
+}
+
+func TestQueryCacheTags(t *testing.T) {
+
+	q := Query{
+		Schema: "public",
+		Table:  "customers",
+		Embed: []EmbedConfig{
+			EmbedConfig{Table: "orders", ForeignKey: ordersCustomerFK, ToMany: true},
+		},
+		Tags: []string{"public.audit"},
+	}
+
+	expected := []string{"public.audit", "public.customers", "public.orders"}
+	if tags := q.cacheTags(); !reflect.DeepEqual(tags, expected) {
+		t.Errorf("Expected tags %v, got %v", expected, tags)
+	}
+
+	//Tables read by SQL can't be known, so must be given
+	q = Query{BaseSQL: "SELECT * FROM shop.orders", Schema: "public", Table: "customers"}
+	if tags := q.cacheTags(); len(tags) != 0 {
+		t.Errorf("Expected no tags, got %v", tags)
+	}
+
+}
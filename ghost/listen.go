@@ -0,0 +1,82 @@
+// Copyright 2017 Jonathan Pincas
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ghost
+
+import (
+	"time"
+
+	"github.com/lib/pq"
+)
+
+//listen passes the payload of each notification on a channel to that channel's handler, for as long as the server runs.
+//Notifications may have been missed while the connection was down, so every handler is
+//called with an empty payload after a reconnection
+func listen(dbConnectionString string, handlers map[string]func(payload string)) error {
+
+	listener := pq.NewListener(dbConnectionString, 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			Log("LISTEN", false, "Listener error", err)
+		}
+	})
+
+	for channel := range handlers {
+		if err := listener.Listen(channel); err != nil {
+			listener.Close()
+			return err
+		}
+	}
+
+	go func() {
+		for {
+			select {
+			case n := <-listener.Notify:
+				//A nil notification means the connection was re-established
+				if n == nil {
+					for _, handler := range handlers {
+						handler("")
+					}
+					continue
+				}
+				if handler, ok := handlers[n.Channel]; ok {
+					handler(n.Extra)
+				}
+			case <-time.After(90 * time.Second):
+				//Check the connection is still alive
+				go listener.Ping()
+			}
+		}
+	}()
+
+	return nil
+
+}
+
+//ListenForChanges refreshes the introspected schemas and invalidates cached results
+//when notified of changes by the database
+func ListenForChanges(dbConnectionString string) error {
+
+	return listen(dbConnectionString, map[string]func(string){
+		SchemaChannel: func(string) {
+			if err := App.Schema.Refresh(); err != nil {
+				Log("SCHEMA", false, "Error refreshing introspected schemas", err)
+			}
+		},
+		CacheChannel: func(payload string) {
+			LogDebug("CACHE", true, "Invalidating cached results for "+payload, nil)
+			App.Store.Invalidate(payload)
+		},
+	})
+
+}
@@ -0,0 +1,133 @@
+package ghost
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+//ParseOrder parses a comma separated list of columns to sort by,
+//each with an optional direction, e.g. age.desc,name.asc,id
+//Only the columns provided can be sorted on
+func ParseOrder(s string, columns []string) ([]OrderConfig, error) {
+
+	knownColumns := map[string]bool{}
+	for _, c := range columns {
+		knownColumns[c] = true
+	}
+
+	var order []OrderConfig
+	for _, item := range strings.Split(s, ",") {
+
+		parts := strings.SplitN(item, ".", 2)
+		o := OrderConfig{Key: parts[0]}
+
+		if !knownColumns[o.Key] {
+			return nil, errors.New("Unknown column: " + o.Key)
+		}
+
+		if len(parts) == 2 {
+			switch parts[1] {
+			case "asc":
+			case "desc":
+				o.Descending = true
+			default:
+				return nil, errors.New("Invalid sort direction: " + parts[1])
+			}
+		}
+
+		order = append(order, o)
+
+	}
+
+	return order, nil
+
+}
+
+//Total returns the total number of rows matching the query,
+//if CountTotal was requested
+func (q *Query) Total() int64 {
+	return q.total
+}
+
+//NextCursor returns the cursor to pass as After to get the following page
+//of a keyset paginated list.  It is empty if there are no more pages
+func (q *Query) NextCursor() string {
+	return q.nextCursor
+}
+
+//setNextCursor reads the values of the order columns from the last row of a result.
+//A cursor is only produced for a full page of an ordered list - a short page must be the last
+func (q *Query) setNextCursor(JSONResponse string) error {
+
+	q.nextCursor = ""
+
+	if !q.IsList || q.Limit == 0 || len(q.Order) == 0 || JSONResponse == "" {
+		return nil
+	}
+
+	//Keep numbers exactly as the database sent them
+	var rows []map[string]interface{}
+	d := json.NewDecoder(strings.NewReader(JSONResponse))
+	d.UseNumber()
+	if err := d.Decode(&rows); err != nil {
+		return err
+	}
+
+	if len(rows) < q.Limit {
+		return nil
+	}
+
+	lastRow := rows[len(rows)-1]
+	values := make([]interface{}, len(q.Order))
+	for k, o := range q.Order {
+		value, ok := lastRow[o.Key]
+		if !ok {
+			return errors.New("Order column missing from results: " + o.Key)
+		}
+		values[k] = value
+	}
+
+	cursor, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+
+	q.nextCursor = base64.RawURLEncoding.EncodeToString(cursor)
+	return nil
+
+}
+
+//decodeCursor returns the values held in a cursor, checking that there
+//is one for every order column
+func decodeCursor(cursor string, orderColumns int) ([]interface{}, error) {
+
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errors.New("Invalid cursor")
+	}
+
+	var values []interface{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(&values); err != nil {
+		return nil, errors.New("Invalid cursor")
+	}
+
+	if orderColumns == 0 || len(values) != orderColumns {
+		return nil, errors.New("Cursor does not match the sort order")
+	}
+
+	//Nested values can't be compared, so can't have come from a valid cursor
+	for _, v := range values {
+		switch v.(type) {
+		case map[string]interface{}, []interface{}:
+			return nil, errors.New("Invalid cursor")
+		}
+	}
+
+	return values, nil
+
+}
@@ -0,0 +1,129 @@
+package ghost
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestBuildOrderLimitOffset(t *testing.T) {
+
+	q := Query{
+		Schema: "public",
+		Table:  "test_table",
+		Where:  []WhereConfig{WhereConfig{Key: "age", Operator: ">", Value: 18}},
+		Order:  []OrderConfig{OrderConfig{Key: "age", Descending: true}, OrderConfig{Key: "id"}},
+		Limit:  10,
+		Offset: 20,
+		IsList: true,
+	}
+	q.Build()
+
+	expected := `WITH results AS (SELECT * FROM "public"."test_table" WHERE "age" > $1 ORDER BY "age" DESC, "id" ASC LIMIT 10 OFFSET 20) SELECT array_to_json(array_agg(row_to_json(results))) from results;`
+	if q.queryString != expected {
+		TestErrorFatal(t, "Order, limit and offset", q.queryString, expected)
+	}
+
+	q.Limit = -1
+	if err := q.Build(); err == nil {
+		t.Error("Negative limit should be an error")
+	}
+
+}
+
+func TestBuildCountTotal(t *testing.T) {
+
+	q := Query{
+		Schema:     "public",
+		Table:      "test_table",
+		Where:      []WhereConfig{WhereConfig{Key: "age", Operator: ">", Value: 18}},
+		Limit:      10,
+		IsList:     true,
+		CountTotal: true,
+	}
+	q.Build()
+
+	expected := `SELECT count(*) FROM (SELECT * FROM "public"."test_table" WHERE "age" > $1) AS results;`
+	if q.countString != expected {
+		TestErrorFatal(t, "Count total", q.countString, expected)
+	}
+	if !argsEqual(q.countArgs, []interface{}{18}) {
+		TestErrorFatal(t, "Count total args", fmt.Sprint(q.countArgs), "[18]")
+	}
+
+}
+
+func TestKeysetPagination(t *testing.T) {
+
+	order := []OrderConfig{OrderConfig{Key: "age", Descending: true}, OrderConfig{Key: "id"}}
+
+	//First page
+	first := Query{Schema: "public", Table: "test_table", Order: order, Limit: 2, IsList: true}
+	first.Build()
+	if err := first.setNextCursor(`[{"id":1,"age":40},{"id":7,"age":35}]`); err != nil {
+		t.Error(err)
+	}
+	if first.NextCursor() == "" {
+		t.Fatal("A full page should produce a cursor")
+	}
+
+	//Second page continues after the last row of the first
+	second := Query{
+		Schema: "public",
+		Table:  "test_table",
+		Where:  []WhereConfig{WhereConfig{Key: "name", Value: "jon"}, WhereConfig{Key: "name", Value: "jessi", JoinWithOr: true}},
+		Order:  order,
+		Limit:  2,
+		After:  first.NextCursor(),
+		IsList: true,
+	}
+	if err := second.Build(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `WITH results AS (SELECT * FROM "public"."test_table" WHERE ("name" = $1 OR "name" = $2) AND ("age" < $3 OR ("age" = $3 AND "id" > $4)) ORDER BY "age" DESC, "id" ASC LIMIT 2) SELECT array_to_json(array_agg(row_to_json(results))) from results;`
+	if second.queryString != expected {
+		TestErrorFatal(t, "Keyset continuation", second.queryString, expected)
+	}
+	expectedArgs := []interface{}{"jon", "jessi", json.Number("35"), json.Number("7")}
+	if !argsEqual(second.queryArgs, expectedArgs) {
+		TestErrorFatal(t, "Keyset continuation args", fmt.Sprint(second.queryArgs), fmt.Sprint(expectedArgs))
+	}
+
+	//A short page is the last
+	if second.setNextCursor(`[{"id":9,"age":30}]`); second.NextCursor() != "" {
+		t.Error("A short page should not produce a cursor")
+	}
+
+	//A cursor must match the order
+	third := Query{Schema: "public", Table: "test_table", Order: order[:1], After: first.NextCursor()}
+	if err := third.Build(); err == nil {
+		t.Error("Cursor with the wrong number of values should be an error")
+	}
+
+	fourth := Query{Schema: "public", Table: "test_table", Order: order, After: "not a cursor"}
+	if err := fourth.Build(); err == nil {
+		t.Error("Invalid cursor should be an error")
+	}
+
+}
+
+func TestParseOrder(t *testing.T) {
+
+	order, err := ParseOrder("age.desc,name.asc,id", filterColumns)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []OrderConfig{OrderConfig{"age", true}, OrderConfig{"name", false}, OrderConfig{"id", false}}
+	if fmt.Sprint(order) != fmt.Sprint(expected) {
+		TestErrorFatal(t, "Parse order", fmt.Sprint(order), fmt.Sprint(expected))
+	}
+
+	for _, s := range []string{"password", "age.sideways", ""} {
+		if _, err := ParseOrder(s, filterColumns); err == nil {
+			TestErrorFatal(t, "Parse order "+s, "no error", "an error")
+		}
+	}
+
+}
@@ -1,7 +1,5 @@
 package ghost
 
-import "fmt"
-
 //WhereConfig describes one or more where clauses
 type WhereConfig struct {
 	Key        string
@@ -9,23 +7,50 @@ type WhereConfig struct {
 	Value      interface{}
 	AnyValue   []interface{}
 	JoinWithOr bool
+	//Negate prefixes the clause (or group) with NOT
+	Negate bool
+	//Group is a set of clauses to be evaluated together, in parentheses.
+	//If present, Key, Operator and Value are ignored
+	Group []WhereConfig
+}
+
+//OrderConfig describes one column in an ORDER BY clause
+type OrderConfig struct {
+	Key        string
+	Descending bool
 }
 
 //Query is the basic building block of an SQL query
 type Query struct {
 	//userQueryString is for when you need to provide complete, preformed SQL
-	//This option will override any BaseAQL + args
+	//This option will override any BaseAQL and will be executed exactly as provided,
+	//with SQLArgs bound to any placeholders
 	OverrideQueryString string
-	//BaseSQL is a formatted SQL string with placeholder for SQLArgs
+	//BaseSQL is an SQL string with positional placeholders ($1, $2...) for SQLArgs
 	BaseSQL string
-	//SQLArgs are inserted into the BaseSQL in the order they appear
+	//SQLArgs are bound to the placeholders in BaseSQL in the order they appear
 	SQLArgs []interface{}
 	//SELECT fields
 	Select []string
+	//Embed rows from related tables in each result.  Relationships must first be
+	//resolved with Store.ResolveEmbeds.  Ignored if BaseSQL is supplied
+	Embed []EmbedConfig
 	//From Schema.Table
 	Schema, Table string
 	//Where
 	Where []WhereConfig
+	//Order is the list of columns to sort by, in order of precedence.
+	//For keyset pagination, the combination of columns must be unique,
+	//so end the list with the primary key
+	Order []OrderConfig
+	//Limit and Offset restrict the rows returned.  Zero means no limit or offset
+	Limit, Offset int
+	//After is an opaque cursor, as returned by NextCursor, from which to continue
+	//a keyset paginated list.  The Order must be the same as for the previous page
+	After string
+	//CountTotal requests the total number of rows matching the Where clauses,
+	//ignoring Limit, Offset and After, available from Total after execution
+	CountTotal bool
 	//Indicate whether to rquest JSON array or object
 	//and when unmarshalling, whether map or slice of maps
 	IsList bool
@@ -38,72 +63,144 @@ type Query struct {
 	CacheLevel string
 	//cacheKey is the key used to store the SQL query in the cache
 	cacheKey string
-	//CacheExpiry
+	//Tags are the schema.table names of any tables read by BaseSQL or OverrideQueryString,
+	//so that cached results are invalidated when those tables change.
+	//The tables given by Schema, Table and Embed are tagged automatically
+	Tags []string
+	//CacheExpiry is the number of seconds to cache the result for.
+	//Zero uses the cache's default
 	CacheExpiry int
 	//queryString is the output sql string ready to be executed
 	queryString string
+	//queryArgs are the bind parameters for queryString, in placeholder order
+	queryArgs []interface{}
+	//countString and countArgs are the query to count the total rows, if requested
+	countString string
+	countArgs   []interface{}
+	//total and nextCursor are set by the store after execution
+	total      int64
+	nextCursor string
 }
 
-//Build runs a query against the data store and returns JSON
+//Build assembles the SQL string and its ordered bind parameters, ready to be run against the data store
 func (q *Query) Build() error {
 
 	//If any override SQL is present, set the output query to its value
 	//and exit immediately
 	if q.OverrideQueryString != "" {
 		q.queryString = q.OverrideQueryString
+		q.queryArgs = q.SQLArgs
 		return nil
 	}
 
-	tempQueryString := queryBuilder("")
+	var (
+		tempQueryString queryBuilder
+		err             error
+	)
 
-	//If base sql + args have been supplied, use them
+	//If base sql has been supplied, use it along with its args
 	//otherwise build from parameters
-	if q.BaseSQL != "" && len(q.SQLArgs) != 0 {
-		tempQueryString = queryBuilder(fmt.Sprintf(q.BaseSQL, q.SQLArgs...))
+	if q.BaseSQL != "" {
+		tempQueryString = queryBuilder{sql: q.BaseSQL, args: append([]interface{}{}, q.SQLArgs...)}
+	} else if len(q.Embed) != 0 {
+		tempQueryString, err = tempQueryString.embedSelect(q.Schema, q.Table, q.Select, q.Embed)
+		if err != nil {
+			return err
+		}
 	} else {
-		tempQueryString = tempQueryString.basicSelect(q.Schema, q.Table, q.Select)
+		tempQueryString, err = tempQueryString.basicSelect(q.Schema, q.Table, q.Select)
+		if err != nil {
+			return err
+		}
 	}
 
 	//For WHERE clauses
-	if len(q.Where) != 0 {
-		tempQueryString = tempQueryString.addWhereClauses(q.Where)
+	where, err := tempQueryString.whereExpression(q.Where)
+	if err != nil {
+		return err
 	}
 
-	//Return JSON array or object
-	if q.IsList {
-		tempQueryString = tempQueryString.requestMultipleResultsAsJSONArray()
-	} else {
-		tempQueryString = tempQueryString.requestSingleResultAsJSONObject()
+	//The total count covers everything matching the WHERE clauses,
+	//so is taken before anything restricting the page
+	if q.CountTotal {
+		countQueryString := tempQueryString.addWhere(where, "").requestCount()
+		q.countString = countQueryString.toSQLString()
+		q.countArgs = countQueryString.args
 	}
 
-	//Add sql role and user id, caching as you go depending
-	//on the cache level specified
-	if q.CacheLevel == "all" {
-		q.cacheKey = tempQueryString.toSQLCacheKey()
+	//Continue from a keyset cursor
+	keyset := ""
+	if q.After != "" {
+		values, err := decodeCursor(q.After, len(q.Order))
+		if err != nil {
+			return err
+		}
+		if keyset, err = tempQueryString.keysetExpression(q.Order, values); err != nil {
+			return err
+		}
 	}
 
-	//Add role
-	if q.Role != "" {
-		tempQueryString = tempQueryString.setQueryRole(q.Role)
+	tempQueryString = tempQueryString.addWhere(where, keyset)
+
+	//Sorting and paging
+	if len(q.Order) != 0 {
+		if tempQueryString, err = tempQueryString.addOrderBy(q.Order); err != nil {
+			return err
+		}
 	}
 
-	if q.CacheLevel == "role" {
-		q.cacheKey = tempQueryString.toSQLCacheKey()
+	if tempQueryString, err = tempQueryString.addLimitAndOffset(q.Limit, q.Offset); err != nil {
+		return err
 	}
 
-	//Add user id
-	if q.UserID != "" {
-		tempQueryString = tempQueryString.setUserID(q.UserID)
+	//Return JSON array or object
+	if q.IsList {
+		tempQueryString = tempQueryString.requestMultipleResultsAsJSONArray()
+	} else {
+		tempQueryString = tempQueryString.requestSingleResultAsJSONObject()
 	}
 
-	if q.CacheLevel == "user" {
+	//Set the cache key depending on the cache level specified.
+	//Role and user id are not part of the SQL itself, so they
+	//are added to the key where relevant
+	switch q.CacheLevel {
+	case "all":
 		q.cacheKey = tempQueryString.toSQLCacheKey()
+	case "role":
+		q.cacheKey = tempQueryString.toSQLCacheKey(q.Role)
+	case "user":
+		q.cacheKey = tempQueryString.toSQLCacheKey(q.Role, q.UserID)
 	}
 
 	//Transform to SQL string and reset on the struct
 	q.queryString = tempQueryString.toSQLString()
+	q.queryArgs = tempQueryString.args
 
-	//Execute the query
 	return nil
 
 }
+
+//cacheTags returns the schema.table name of every table the query reads from, as far as is known
+func (q *Query) cacheTags() []string {
+
+	tags := append([]string{}, q.Tags...)
+
+	if q.OverrideQueryString == "" && q.BaseSQL == "" && q.Table != "" {
+		tags = append(tags, q.Schema+"."+q.Table)
+		tags = appendEmbedTags(tags, q.Embed)
+	}
+
+	return tags
+
+}
+
+func appendEmbedTags(tags []string, embeds []EmbedConfig) []string {
+
+	for _, e := range embeds {
+		schema, table := e.relatedSchemaAndTable()
+		tags = appendEmbedTags(append(tags, schema+"."+table), e.Embed)
+	}
+
+	return tags
+
+}
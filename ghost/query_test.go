@@ -1,6 +1,9 @@
 package ghost
 
 import (
+	"fmt"
+	"reflect"
+	"regexp"
 	"strings"
 	"testing"
 )
@@ -12,6 +15,111 @@ func TestBuild(t *testing.T) {
 		if strings.ToLower(c.query.queryString) != strings.ToLower(c.expectedQueryString) {
 			TestErrorFatal(t, c.description, c.query.queryString, c.expectedQueryString)
 		}
+		if !argsEqual(c.query.queryArgs, c.expectedArgs) {
+			TestErrorFatal(t, c.description, fmt.Sprint(c.query.queryArgs), fmt.Sprint(c.expectedArgs))
+		}
+	}
+
+}
+
+func TestBuildRejectsUnsafeInput(t *testing.T) {
+
+	queries := map[string]Query{
+		"Empty table": Query{Schema: "public"},
+		"Operator injection": Query{
+			Schema: "public",
+			Table:  "test_table",
+			Where:  []WhereConfig{WhereConfig{Key: "id", Operator: "= 1 OR 1 =", Value: "1"}},
+		},
+		"Identifier too long": Query{
+			Schema: "public",
+			Table:  strings.Repeat("t", 64),
+		},
+	}
+
+	for description, q := range queries {
+		if err := q.Build(); err == nil {
+			TestErrorFatal(t, description, q.queryString, "an error")
+		}
+	}
+
+}
+
+func TestBuildQuotesIdentifiers(t *testing.T) {
+
+	q := Query{
+		Select: []string{`field"; DROP TABLE users; --`},
+		Schema: "public",
+		Table:  "test_table",
+	}
+	q.Build()
+
+	expected := `WITH results AS (SELECT "field""; DROP TABLE users; --" FROM "public"."test_table") SELECT row_to_json(results) from results;`
+	if q.queryString != expected {
+		TestErrorFatal(t, "Select field containing a quote", q.queryString, expected)
+	}
+
+}
+
+func TestBuildCacheKeys(t *testing.T) {
+
+	build := func(value, role, userID string) string {
+		q := Query{
+			Schema:     "public",
+			Table:      "test_table",
+			Where:      []WhereConfig{WhereConfig{Key: "id", Value: value}},
+			Role:       role,
+			UserID:     userID,
+			CacheLevel: "user",
+		}
+		q.Build()
+		return q.cacheKey
+	}
+
+	if build("1", "admin", "a") == build("2", "admin", "a") {
+		t.Error("Queries with different args should not share a cache key")
+	}
+	if build("1", "admin", "a") == build("1", "anon", "a") {
+		t.Error("Queries with different roles should not share a cache key")
+	}
+	if build("1", "admin", "a") == build("1", "admin", "b") {
+		t.Error("Queries with different user ids should not share a cache key")
+	}
+
+	//Keys are short, plain and hold no values, so any external cache can take them
+	if key := build("a value with spaces\n", "admin", "a"); !regexp.MustCompile(`^[0-9a-f]{64}$`).MatchString(key) {
+		t.Errorf("Expected a hex SHA-256 cache key, got %q", key)
+	}
+
+}
+
+func TestMapToValsAndCols(t *testing.T) {
+
+	cols, vals, args, err := MapToValsAndCols(map[string]interface{}{
+		"name": "jon",
+		"age":  30,
+		"tags": []interface{}{"a"},
+	}, 2)
+
+	if err != nil {
+		t.Error(err)
+	}
+	if cols != `"age", "name", "tags"` {
+		TestErrorFatal(t, "Columns", cols, `"age", "name", "tags"`)
+	}
+	if vals != "$2, $3, $4" {
+		TestErrorFatal(t, "Placeholders", vals, "$2, $3, $4")
+	}
+	if !argsEqual(args, []interface{}{30, "jon", `["a"]`}) {
+		TestErrorFatal(t, "Args", fmt.Sprint(args), fmt.Sprint([]interface{}{30, "jon", `["a"]`}))
 	}
 
 }
+
+//argsEqual compares bind parameters, treating nil and empty as the same
+func argsEqual(a, b []interface{}) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
@@ -1,9 +1,13 @@
 package ghost
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"reflect"
 	"strings"
+
+	"github.com/lib/pq"
 )
 
 const (
@@ -12,98 +16,340 @@ const (
 	sqlToRequestMultipleResultsAsJSONArray = `WITH results AS (%s) SELECT array_to_json(array_agg(row_to_json(results))) from results;`
 	sqlToRequestSingleResultAsJSONObject   = `WITH results AS (%s) SELECT row_to_json(results) from results;`
 
-	//Setting local role and user id
-	sqlToSetLocalRole = `SET LOCAL ROLE %s; %s`
-	sqlToSetUserID    = `SET my.user_id = '%s'; %s`
+	//Settings for the current transaction only, such as the role and user id
+	sqlToSelectSettings = `SELECT %s;`
+	sqlToSetLocalConfig = `set_config('%s', $%v, true)`
 
 	//Basics
 	sqlToSelectFieldsFromTableSchema = `SELECT %s FROM %s.%s`
+	sqlToCountResults                = `SELECT count(*) FROM (%s) AS results;`
 
 	//Where clauses
-	sqlToAddFirstWhereClause          = `%s WHERE %s %s '%v'` //safe to escape here
-	sqlToAddFirstWhereAnyClause       = `%s WHERE %s = ANY(ARRAY%s)`
-	sqlToAddSubsequentWhereClauses    = `%s %s %s %s '%v'` //safe to escape here
-	sqlToAddSubsequentWhereAnyClauses = `%s %s %s = ANY(ARRAY%s)`
+	sqlToAddWhereClause       = `%s WHERE %s`
+	sqlToWhereCondition       = `%s %s %s`
+	sqlToWhereAnyCondition    = `%s = ANY(%s)`
+	sqlToNegateWhereCondition = `NOT %s`
+	sqlToGroupWhereConditions = `(%s)`
+
+	//Sorting and paging
+	sqlToAddOrderBy = `%s ORDER BY %s`
+	sqlToAddLimit   = `%s LIMIT %d`
+	sqlToAddOffset  = `%s OFFSET %d`
+
+	//Embedding related rows with lateral joins
+	sqlToSelectFieldsFromWithJoins = `SELECT %s FROM %s%s`
+	sqlToAddLateralJoin            = `%s LEFT JOIN LATERAL (%s) AS %s ON true`
+	sqlToEmbedMany                 = `SELECT COALESCE(json_agg(%s), '[]') AS %s FROM (%s) AS %s`
+	sqlToEmbedOne                  = `SELECT row_to_json(%s) AS %s FROM (%s) AS %s`
+	sqlToJoinOn                    = `%s.%s = %s.%s`
 )
 
-//queryBuilder is an SQL query string with various methods available for transformation
-type queryBuilder string
+//maxIdentifierLength is the longest identifier Postgres will accept without truncation
+const maxIdentifierLength = 63
+
+//allowedWhereOperators is the whitelist of comparison operators that can be used in a WhereConfig.
+//Operators are spliced directly into the SQL, so anything not on this list is rejected
+var allowedWhereOperators = map[string]bool{
+	"=":         true,
+	"!=":        true,
+	"<>":        true,
+	"<":         true,
+	"<=":        true,
+	">":         true,
+	">=":        true,
+	"LIKE":      true,
+	"ILIKE":     true,
+	"NOT LIKE":  true,
+	"NOT ILIKE": true,
+	"~":         true,
+	"~*":        true,
+	"!~":        true,
+	"!~*":       true,
+	"IS":        true,
+	"IS NOT":    true,
+}
+
+//allowedIsValues are the only values that can follow IS or IS NOT.
+//They are keywords rather than values, so can't be bound as parameters
+var allowedIsValues = map[string]bool{
+	"NULL":    true,
+	"TRUE":    true,
+	"FALSE":   true,
+	"UNKNOWN": true,
+}
+
+//queryBuilder is an SQL query string, together with its ordered bind parameters,
+//with various methods available for transformation
+type queryBuilder struct {
+	sql  string
+	args []interface{}
+	//alias qualifies the columns in conditions and ordering, when other tables are joined to the base one
+	alias string
+}
+
+//nextPlaceholder appends a bind parameter and returns its positional placeholder ($1, $2...)
+func (s *queryBuilder) nextPlaceholder(arg interface{}) string {
+
+	s.args = append(s.args, arg)
+	return fmt.Sprintf("$%v", len(s.args))
+
+}
+
+//column quotes a column of the base table, qualified by its alias if set
+func (s queryBuilder) column(name string) (string, error) {
+
+	quoted, err := QuoteIdentifier(name)
+	if err != nil || s.alias == "" {
+		return quoted, err
+	}
+
+	return s.alias + "." + quoted, nil
+
+}
 
 //basicSelect is the simple type of base query
-func (s queryBuilder) basicSelect(schema string, table string, selectFields []string) queryBuilder {
+func (s queryBuilder) basicSelect(schema string, table string, selectFields []string) (queryBuilder, error) {
 
-	return queryBuilder(fmt.Sprintf(sqlToSelectFieldsFromTableSchema, toListString(selectFields), schema, table))
+	quotedSchema, err := QuoteIdentifier(schema)
+	if err != nil {
+		return s, err
+	}
+
+	quotedTable, err := QuoteIdentifier(table)
+	if err != nil {
+		return s, err
+	}
+
+	fields, err := toSelectListString(selectFields)
+	if err != nil {
+		return s, err
+	}
+
+	s.sql = fmt.Sprintf(sqlToSelectFieldsFromTableSchema, fields, quotedSchema, quotedTable)
+	return s, nil
+
+}
+
+//addWhere appends a WHERE clause from an expression built by whereExpression
+//and an optional keyset condition, which must apply to the expression as a whole.
+//Either may be empty (e.g. if all the clauses were skipped for having no value)
+func (s queryBuilder) addWhere(expression, keyset string) queryBuilder {
+
+	switch {
+	case expression != "" && keyset != "":
+		expression = fmt.Sprintf(sqlToWhereCondition, fmt.Sprintf(sqlToGroupWhereConditions, expression), "AND", keyset)
+	case keyset != "":
+		expression = keyset
+	}
+
+	if expression != "" {
+		s.sql = fmt.Sprintf(sqlToAddWhereClause, s.sql, expression)
+	}
+
+	return s
 
 }
 
-//addWhere clauses appends multiple where clauses conjoined with AND or OR
-func (s queryBuilder) addWhereClauses(whereClauses []WhereConfig) queryBuilder {
+//whereExpression builds the boolean expression for a list of where clauses,
+//adding their values as bind parameters as it goes.  Groups are built recursively
+func (s *queryBuilder) whereExpression(whereClauses []WhereConfig) (string, error) {
 
 	//Set up a where clause counter
 	//and only increment it when a WHERE clause is actually appended
 	//We do this instead of using the main for loop index,
 	//because on some loops, no Where clause is actually appended
 	whereClauseCounter := 0
+	expression := ""
 
 	for _, v := range whereClauses {
 
-		//Default the key to id
-		if v.Key == "" {
-			v.Key = "id"
+		condition, err := s.whereCondition(v)
+		if err != nil {
+			return "", err
 		}
 
-		//For the first where clause
-		if whereClauseCounter == 0 {
-
-			if len(v.AnyValue) != 0 {
-				//For strings, must surround with ''
-				//But for numbers, doing so causes an error
-				//This is unlike regular behaviour (not in arrays),
-				//where postgres CAN deal with numbers in ''
-				valueType := reflect.TypeOf(v.AnyValue[0]).Name()
-				s = queryBuilder(fmt.Sprintf(sqlToAddFirstWhereAnyClause, s, v.Key, toCsvSqlArrayString(v.AnyValue, valueType)))
-				whereClauseCounter++
-
-			} else {
-
-				//Only append a where clause if there's actually something in the value
-				//This gives you the option to specify nil or blank value fields on the query
-				//builder without messing up the query
-				//Useful for when assigning some kind of argument to the value
-				//but when you don't know 100% that the argument will be present.
-				if v.Value != nil && v.Value != "" {
-					s = queryBuilder(fmt.Sprintf(sqlToAddFirstWhereClause, s, v.Key, v.Operator, v.Value))
-					whereClauseCounter++
-				}
+		//Nothing to append for this clause
+		if condition == "" {
+			continue
+		}
 
-			}
+		if v.Negate {
+			condition = fmt.Sprintf(sqlToNegateWhereCondition, condition)
+		}
 
-			//For subsequent where clauses
+		if whereClauseCounter == 0 {
+			expression = condition
 		} else {
-
 			conjunction := "AND"
 			if v.JoinWithOr {
 				conjunction = "OR"
 			}
+			expression = fmt.Sprintf(sqlToWhereCondition, expression, conjunction, condition)
+		}
+		whereClauseCounter++
+
+	}
 
-			if len(v.AnyValue) != 0 {
+	return expression, nil
 
-				valueType := reflect.TypeOf(v.AnyValue[0]).Name()
-				s = queryBuilder(fmt.Sprintf(sqlToAddSubsequentWhereAnyClauses, s, conjunction, v.Key, toCsvSqlArrayString(v.AnyValue, valueType)))
-				whereClauseCounter++
+}
 
-			} else {
+//whereCondition builds a single condition, or a parenthesised group of conditions.
+//Returns an empty string if there is nothing to append
+func (s *queryBuilder) whereCondition(v WhereConfig) (string, error) {
 
-				if v.Value != nil && v.Value != "" {
-					s = queryBuilder(fmt.Sprintf(sqlToAddSubsequentWhereClauses, s, conjunction, v.Key, v.Operator, v.Value))
-					whereClauseCounter++
-				}
+	//Groups are evaluated together, regardless of the clauses either side
+	if len(v.Group) != 0 {
 
-			}
+		expression, err := s.whereExpression(v.Group)
+		if err != nil || expression == "" {
+			return "", err
+		}
+
+		return fmt.Sprintf(sqlToGroupWhereConditions, expression), nil
+
+	}
+
+	//Default the key to id
+	if v.Key == "" {
+		v.Key = "id"
+	}
+
+	key, err := s.column(v.Key)
+	if err != nil {
+		return "", err
+	}
+
+	//Default the operator to equality
+	operator := strings.ToUpper(strings.TrimSpace(v.Operator))
+	if operator == "" {
+		operator = "="
+	}
+
+	if !allowedWhereOperators[operator] {
+		return "", errors.New("Operator not allowed in WHERE clause: " + v.Operator)
+	}
+
+	if len(v.AnyValue) != 0 {
+
+		//The whole list of values is bound as a single array parameter
+		//and Postgres infers the element type from the column
+		return fmt.Sprintf(sqlToWhereAnyCondition, key, s.nextPlaceholder(pq.Array(v.AnyValue))), nil
+
+	}
+
+	//Only append a where clause if there's actually something in the value
+	//This gives you the option to specify nil or blank value fields on the query
+	//builder without messing up the query
+	//Useful for when assigning some kind of argument to the value
+	//but when you don't know 100% that the argument will be present.
+	if v.Value == nil || v.Value == "" {
+		return "", nil
+	}
+
+	//IS takes a keyword rather than a value
+	if operator == "IS" || operator == "IS NOT" {
+
+		keyword := strings.ToUpper(fmt.Sprint(v.Value))
+		if !allowedIsValues[keyword] {
+			return "", errors.New("Value not allowed after IS: " + fmt.Sprint(v.Value))
 		}
 
+		return fmt.Sprintf(sqlToWhereCondition, key, operator, keyword), nil
+
+	}
+
+	return fmt.Sprintf(sqlToWhereCondition, key, operator, s.nextPlaceholder(v.Value)), nil
+
+}
+
+//keysetExpression builds the condition to select only rows that come after the
+//given values of the order columns.  For columns a ASC, b DESC this is:
+//("a" > $1 OR ("a" = $1 AND "b" < $2))
+func (s *queryBuilder) keysetExpression(order []OrderConfig, values []interface{}) (string, error) {
+
+	var (
+		alternatives []string
+		equalities   []string
+	)
+
+	for k, o := range order {
+
+		key, err := s.column(o.Key)
+		if err != nil {
+			return "", err
+		}
+
+		comparison := ">"
+		if o.Descending {
+			comparison = "<"
+		}
+
+		placeholder := s.nextPlaceholder(values[k])
+		condition := fmt.Sprintf(sqlToWhereCondition, key, comparison, placeholder)
+		alternatives = append(alternatives, strings.Join(append(equalities, condition), " AND "))
+		equalities = append(equalities, fmt.Sprintf(sqlToWhereCondition, key, "=", placeholder))
+
+	}
+
+	for k, a := range alternatives {
+		if k > 0 {
+			alternatives[k] = fmt.Sprintf(sqlToGroupWhereConditions, a)
+		}
+	}
+
+	return fmt.Sprintf(sqlToGroupWhereConditions, strings.Join(alternatives, " OR ")), nil
+
+}
+
+//addOrderBy appends the ORDER BY clause
+func (s queryBuilder) addOrderBy(order []OrderConfig) (queryBuilder, error) {
+
+	columns := make([]string, len(order))
+	for k, o := range order {
+
+		key, err := s.column(o.Key)
+		if err != nil {
+			return s, err
+		}
+
+		direction := "ASC"
+		if o.Descending {
+			direction = "DESC"
+		}
+
+		columns[k] = key + " " + direction
+
 	}
 
+	s.sql = fmt.Sprintf(sqlToAddOrderBy, s.sql, strings.Join(columns, ", "))
+	return s, nil
+
+}
+
+//addLimitAndOffset appends LIMIT and OFFSET, if set
+func (s queryBuilder) addLimitAndOffset(limit, offset int) (queryBuilder, error) {
+
+	if limit < 0 || offset < 0 {
+		return s, errors.New("Limit and offset cannot be negative")
+	}
+
+	if limit > 0 {
+		s.sql = fmt.Sprintf(sqlToAddLimit, s.sql, limit)
+	}
+
+	if offset > 0 {
+		s.sql = fmt.Sprintf(sqlToAddOffset, s.sql, offset)
+	}
+
+	return s, nil
+
+}
+
+//requestCount transforms the SQL query to return the number of results
+func (s queryBuilder) requestCount() queryBuilder {
+
+	s.sql = fmt.Sprintf(sqlToCountResults, s.sql)
 	return s
 
 }
@@ -112,7 +358,8 @@ func (s queryBuilder) addWhereClauses(whereClauses []WhereConfig) queryBuilder {
 //Use when multiple lines are going to be returned
 func (s queryBuilder) requestMultipleResultsAsJSONArray() queryBuilder {
 
-	return queryBuilder(fmt.Sprintf(sqlToRequestMultipleResultsAsJSONArray, s))
+	s.sql = fmt.Sprintf(sqlToRequestMultipleResultsAsJSONArray, s.sql)
+	return s
 
 }
 
@@ -120,78 +367,71 @@ func (s queryBuilder) requestMultipleResultsAsJSONArray() queryBuilder {
 //Used when a single line is going to be returned
 func (s queryBuilder) requestSingleResultAsJSONObject() queryBuilder {
 
-	return queryBuilder(fmt.Sprintf(sqlToRequestSingleResultAsJSONObject, s))
+	s.sql = fmt.Sprintf(sqlToRequestSingleResultAsJSONObject, s.sql)
+	return s
 
 }
 
-//SetQueryRole prepends the database role with which to execute the query
-func (s queryBuilder) setQueryRole(role string) queryBuilder {
+//ToSQLCacheKey transforms the SQL query and its parameters into a cacheable string key
+//Any extra values (such as role and user id) are appended to the key.
+//It is hashed, so that it is short and plain enough for any external cache, and holds no argument values
+func (s queryBuilder) toSQLCacheKey(extra ...string) string {
 
-	return queryBuilder(fmt.Sprintf(sqlToSetLocalRole, role, s))
+	sum := sha256.Sum256([]byte(fmt.Sprint(s.sql, s.args, extra)))
+	return hex.EncodeToString(sum[:])
 
 }
 
-//SetUserID prepends the user id variable with which to execute the query
-func (s queryBuilder) setUserID(userID string) queryBuilder {
-
-	return queryBuilder(fmt.Sprintf(sqlToSetUserID, userID, s))
+//ToSQLString transforms the query to a plain string
+//Generally the last step before execution
+func (s queryBuilder) toSQLString() string {
 
+	LogDebug("SQL", true, fmt.Sprint(s.sql, " ", s.args), nil)
+	return s.sql
 }
 
-//ToSQLCacheKey transforms the SQL query into a cacheable string key
-func (s queryBuilder) toSQLCacheKey() string {
+//QuoteIdentifier validates a schema, table or column name and quotes it
+//so that it can be safely spliced into an SQL string
+func QuoteIdentifier(identifier string) (string, error) {
 
-	return fmt.Sprint(s)
+	if identifier == "" {
+		return "", errors.New("Empty SQL identifier")
+	}
 
-}
+	if len(identifier) > maxIdentifierLength || strings.ContainsRune(identifier, 0) {
+		return "", errors.New("Invalid SQL identifier: " + identifier)
+	}
 
-//ToSQLString transforms an SqlQuery to a plain string
-//Generally the last step before execution
-func (s queryBuilder) toSQLString() string {
+	return pq.QuoteIdentifier(identifier), nil
 
-	LogDebug("SQL", true, fmt.Sprint(s), nil)
-	return fmt.Sprint(s)
 }
 
 //Helpers
-//toCsvSqlArrayString
-func toCsvSqlArrayString(i []interface{}, valueType string) string {
 
-	tempArrayString := "["
+//toSelectListString quotes each of the select fields and returns the comma separated string
+//The wildcard * is passed through unquoted, and is the default if no fields are given
+func toSelectListString(l []string) (string, error) {
 
-	//For strings, wrap in ''
-	if valueType == "string" {
+	if len(l) == 0 {
+		return "*", nil
+	}
 
-		for k, v := range i {
-			if k == 0 {
-				tempArrayString += fmt.Sprintf(`'%s'`, v)
-			} else {
-				tempArrayString += fmt.Sprintf(`, '%s'`, v)
-			}
-		}
+	fields := make([]string, len(l))
+	for k, v := range l {
 
-		// For anything else other than string, dont wrap
-	} else {
+		if v == "*" {
+			fields[k] = v
+			continue
+		}
 
-		for k, v := range i {
-			if k == 0 {
-				tempArrayString += fmt.Sprintf(`%v`, v)
-			} else {
-				tempArrayString += fmt.Sprintf(`, %v`, v)
-			}
+		quoted, err := QuoteIdentifier(v)
+		if err != nil {
+			return "", err
 		}
+		fields[k] = quoted
 
 	}
 
-	tempArrayString += "]"
-
-	return tempArrayString
-
-}
-
-//toListString removes the [] from a slice and returns the comma separated string
-func toListString(l []string) string {
-
-	return strings.Replace(strings.TrimPrefix(strings.TrimSuffix(fmt.Sprintf(`%s`, l), "]"), "["), " ", ",", -1)
+	return strings.Join(fields, ","), nil
 
 }
@@ -0,0 +1,265 @@
+// Copyright 2017 Jonathan Pincas
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ghost
+
+import (
+	"database/sql"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+//SchemaChannel is the channel to NOTIFY when the structure of the database has changed,
+//e.g. NOTIFY ghost_schema; at the end of a migration
+const SchemaChannel = "ghost_schema"
+
+//Column is the introspected structure of a table column
+type Column struct {
+	Name string
+	//Type is the SQL type, as given by format_type, e.g. character varying(255)
+	Type string
+	//Nullable columns accept null, and columns with a default can be omitted on insert
+	Nullable, HasDefault bool
+}
+
+//Table is the introspected structure of a table or view
+type Table struct {
+	Schema, Name string
+	//Columns in order
+	Columns []Column
+	//PrimaryKey columns in order. Empty for views and tables without one
+	PrimaryKey []string
+	//ForeignKeys from or to the table
+	ForeignKeys []ForeignKey
+	//Grants maps each role (or PUBLIC) to its privileges on the table, e.g. SELECT, INSERT
+	Grants map[string][]string
+}
+
+//ColumnNames returns the names of the table's columns, in order
+func (t Table) ColumnNames() []string {
+
+	names := make([]string, len(t.Columns))
+	for k, c := range t.Columns {
+		names[k] = c.Name
+	}
+	return names
+
+}
+
+//HasPrivilege reports whether a role has been granted a privilege on the table, either directly or through PUBLIC.
+//Membership of other roles is not taken into account
+func (t Table) HasPrivilege(role, privilege string) bool {
+
+	for _, grantee := range []string{role, "PUBLIC"} {
+		for _, p := range t.Grants[grantee] {
+			if p == privilege {
+				return true
+			}
+		}
+	}
+	return false
+
+}
+
+//schemaCache holds the introspected structure of the schemas of installed bundles.
+//It is safe for concurrent use, and is reloaded in full on Refresh
+type schemaCache struct {
+	mu      sync.RWMutex
+	schemas []string
+	tables  map[string]Table
+	loaded  time.Time
+}
+
+//Load introspects the tables in the given schemas, replacing anything previously loaded
+func (s *schemaCache) Load(schemas []string) error {
+
+	tables, err := introspect(App.DB, schemas)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.schemas = schemas
+	s.tables = tables
+	s.loaded = time.Now()
+
+	return nil
+
+}
+
+//Refresh reloads the schemas that were last loaded
+func (s *schemaCache) Refresh() error {
+
+	s.mu.RLock()
+	schemas := s.schemas
+	s.mu.RUnlock()
+
+	Log("SCHEMA", true, "Refreshing introspected schemas", nil)
+	return s.Load(schemas)
+
+}
+
+//Table returns the structure of a table, if it has been loaded
+func (s *schemaCache) Table(schema, table string) (Table, bool) {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.tables[schema+"."+table]
+	return t, ok
+
+}
+
+//Tables returns all the loaded tables, sorted by schema and name
+func (s *schemaCache) Tables() []Table {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tables := make([]Table, 0, len(s.tables))
+	for _, t := range s.tables {
+		tables = append(tables, t)
+	}
+
+	sort.Slice(tables, func(i, j int) bool {
+		if tables[i].Schema != tables[j].Schema {
+			return tables[i].Schema < tables[j].Schema
+		}
+		return tables[i].Name < tables[j].Name
+	})
+
+	return tables
+
+}
+
+//Loaded returns the time the schemas were last loaded, which is zero if they never have been
+func (s *schemaCache) Loaded() time.Time {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.loaded
+
+}
+
+//introspect reads the structure of every table and view in the given schemas from the catalog
+func introspect(db *sql.DB, schemas []string) (map[string]Table, error) {
+
+	tables := map[string]Table{}
+
+	//Columns, which also determines the set of tables
+	rows, err := db.Query(SQLToIntrospectColumns, pq.Array(schemas))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			schema, table string
+			c             Column
+		)
+		if err := rows.Scan(&schema, &table, &c.Name, &c.Type, &c.Nullable, &c.HasDefault); err != nil {
+			return nil, err
+		}
+		key := schema + "." + table
+		t, ok := tables[key]
+		if !ok {
+			t = Table{Schema: schema, Name: table, Grants: map[string][]string{}}
+		}
+		t.Columns = append(t.Columns, c)
+		tables[key] = t
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	//Primary keys
+	if err := scanTableRows(db, SQLToIntrospectPrimaryKeys, schemas, 1, func(key string, values []string) {
+		if t, ok := tables[key]; ok {
+			t.PrimaryKey = append(t.PrimaryKey, values[0])
+			tables[key] = t
+		}
+	}); err != nil {
+		return nil, err
+	}
+
+	//Grants
+	if err := scanTableRows(db, SQLToIntrospectGrants, schemas, 2, func(key string, values []string) {
+		if t, ok := tables[key]; ok {
+			t.Grants[values[0]] = append(t.Grants[values[0]], values[1])
+		}
+	}); err != nil {
+		return nil, err
+	}
+
+	//Foreign keys are added to the tables at both ends
+	fkRows, err := db.Query(SQLToIntrospectForeignKeys, pq.Array(schemas))
+	if err != nil {
+		return nil, err
+	}
+	defer fkRows.Close()
+
+	for fkRows.Next() {
+		fk, err := scanForeignKey(fkRows)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range []string{fk.Schema + "." + fk.Table, fk.ForeignSchema + "." + fk.ForeignTable} {
+			if t, ok := tables[key]; ok {
+				t.ForeignKeys = append(t.ForeignKeys, fk)
+				tables[key] = t
+			}
+			//Self references only need adding once
+			if fk.Schema == fk.ForeignSchema && fk.Table == fk.ForeignTable {
+				break
+			}
+		}
+	}
+
+	return tables, fkRows.Err()
+
+}
+
+//scanTableRows runs a query whose rows are the schema and table name followed by
+//a number of text values, and passes the schema.table key and values of each row to fn
+func scanTableRows(db *sql.DB, query string, schemas []string, columns int, fn func(key string, values []string)) error {
+
+	rows, err := db.Query(query, pq.Array(schemas))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+
+		values := make([]string, columns+2)
+		dest := make([]interface{}, len(values))
+		for k := range values {
+			dest[k] = &values[k]
+		}
+
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+
+		fn(values[0]+"."+values[1], values[2:])
+
+	}
+
+	return rows.Err()
+
+}
@@ -0,0 +1,110 @@
+package ghost
+
+import (
+	"reflect"
+	"testing"
+
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestSchemaLoad(t *testing.T) {
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	App.DB = db
+	defer db.Close()
+
+	mock.ExpectQuery("format_type").WillReturnRows(sqlmock.NewRows([]string{"nspname", "relname", "attname", "type", "nullable", "hasdefault"}).
+		AddRow("shop", "customers", "id", "integer", false, true).
+		AddRow("shop", "customers", "name", "text", false, false).
+		AddRow("shop", "orders", "id", "integer", false, true).
+		AddRow("shop", "orders", "customer_id", "integer", true, false))
+	mock.ExpectQuery("contype = 'p'").WillReturnRows(sqlmock.NewRows([]string{"nspname", "relname", "attname"}).
+		AddRow("shop", "customers", "id").
+		AddRow("shop", "orders", "id"))
+	mock.ExpectQuery("aclexplode").WillReturnRows(sqlmock.NewRows([]string{"nspname", "relname", "grantee", "privilege"}).
+		AddRow("shop", "customers", "PUBLIC", "SELECT").
+		AddRow("shop", "orders", "admin", "INSERT").
+		AddRow("shop", "orders", "admin", "SELECT"))
+	mock.ExpectQuery("contype = 'f'").WillReturnRows(sqlmock.NewRows([]string{"conname", "nspname", "relname", "columns", "fnspname", "frelname", "fcolumns"}).
+		AddRow("orders_customer_id_fkey", "shop", "orders", "{customer_id}", "shop", "customers", "{id}"))
+
+	var s schemaCache
+	if err := s.Load([]string{"shop"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	orders, ok := s.Table("shop", "orders")
+	if !ok {
+		t.Fatal("Expected shop.orders to be loaded")
+	}
+
+	if !reflect.DeepEqual(orders.ColumnNames(), []string{"id", "customer_id"}) {
+		t.Errorf("Expected columns [id customer_id], got %v", orders.ColumnNames())
+	}
+
+	if !reflect.DeepEqual(orders.PrimaryKey, []string{"id"}) {
+		t.Errorf("Expected primary key [id], got %v", orders.PrimaryKey)
+	}
+
+	if !orders.HasPrivilege("admin", "SELECT") || orders.HasPrivilege("anon", "SELECT") {
+		t.Errorf("Unexpected grants on orders: %v", orders.Grants)
+	}
+
+	//Foreign keys are available from both tables
+	customers, _ := s.Table("shop", "customers")
+	if len(orders.ForeignKeys) != 1 || len(customers.ForeignKeys) != 1 {
+		t.Errorf("Expected the foreign key on both tables, got %v and %v", orders.ForeignKeys, customers.ForeignKeys)
+	}
+
+	//Granted to PUBLIC
+	if !customers.HasPrivilege("anon", "SELECT") {
+		t.Error("Expected anon to be able to select from customers")
+	}
+
+	if tables := s.Tables(); len(tables) != 2 || tables[0].Name != "customers" {
+		t.Errorf("Expected tables in order, got %v", tables)
+	}
+
+	if s.Loaded().IsZero() {
+		t.Error("Expected the load time to be set")
+	}
+
+}
+
+func TestStoreUsesSchemaCache(t *testing.T) {
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer func() { App.Schema = schemaCache{} }()
+
+	App.DB = db
+	App.Schema = schemaCache{tables: map[string]Table{
+		"shop.orders": Table{Schema: "shop", Name: "orders", Columns: []Column{Column{Name: "id"}, Column{Name: "total"}}},
+	}}
+
+	//Loaded tables are not looked up in the database
+	columns, err := App.Store.TableColumns("shop", "orders")
+	if err != nil || !reflect.DeepEqual(columns, []string{"id", "total"}) {
+		t.Errorf("Expected cached columns, got %v, %v", columns, err)
+	}
+
+	//Other tables are
+	mock.ExpectQuery("pg_catalog.pg_attribute").WithArgs("shop", "products").WillReturnRows(sqlmock.NewRows([]string{"attname"}).AddRow("sku"))
+	if columns, err = App.Store.TableColumns("shop", "products"); err != nil || !reflect.DeepEqual(columns, []string{"sku"}) {
+		t.Errorf("Expected columns from the database, got %v, %v", columns, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+}
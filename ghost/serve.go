@@ -12,8 +12,6 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-//Use the forked version of the go-jwt-middlware, not the auth0 version
-
 package ghost
 
 import (
@@ -67,10 +65,10 @@ func preServe() {
 		App.MailServer.Setup()
 	}
 
-	//Check to make sure a secret has been provided
+	//Check to make sure a secret or signing keys have been provided
 	//No default provided as a security measure, server will exit of nothing provided
-	if viper.GetString("secret") == "" {
-		LogFatal("SERVE", false, "No signing secret provided", nil)
+	if viper.GetString("secret") == "" && len(App.Config.JWTKeys) == 0 {
+		LogFatal("SERVE", false, "No signing secret or keys provided", nil)
 	}
 
 	//Establish a temporary connection as the super user
@@ -88,6 +86,16 @@ func preServe() {
 	//Establish a permanent connection
 	App.DB = ServerUserDBConfig.ReturnDBConnection(serverPW)
 
+	//Introspect the installed bundles, and keep up to date with any changes
+	if err := App.Schema.Load(App.Config.BundlesInstalled.Names()); err != nil {
+		Log("SERVE", false, "Error introspecting installed bundles:", err)
+	}
+
+	//Keep the introspected schemas and cached results up to date with changes in the database
+	if err := ListenForChanges(ServerUserDBConfig.getDBConnectionString(serverPW)); err != nil {
+		Log("SERVE", false, "Error listening for changes:", err)
+	}
+
 	BeforeServe()
 
 }
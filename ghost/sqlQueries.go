@@ -2,21 +2,85 @@ package ghost
 
 //SQl query strings for application-wide use
 const (
-	SQLToFindUserByEmail = `SELECT id from users WHERE email = '%s';`
-	SQLToGetUsersRole    = `SELECT role from users WHERE id = '%s';`
+	SQLToFindUserByEmail = `SELECT id from users WHERE lower(email) = $1;`
+	SQLToGetUsersRole    = `SELECT role from users WHERE id = $1;`
+	SQLToGetUsersEmail   = `SELECT email from users WHERE id = $1;`
+
+	//Passwords.  Registered passwords are unverified until the link emailed to the address is used
+	SQLToGetUsersPassword       = `SELECT id, password, password_verified FROM users WHERE lower(email) = $1;`
+	SQLToGetUsersPasswordByID   = `SELECT password FROM users WHERE id = $1;`
+	SQLToSetUsersPassword       = `UPDATE users SET password = $2, password_verified = true WHERE id = $1;`
+	SQLToRegisterUser           = `INSERT INTO users (email, password) VALUES ($1, $2) RETURNING id;`
+	SQLToVerifyUsersPassword    = `UPDATE users SET password_verified = true WHERE id = $1 AND password IS NOT NULL;`
+	SQLToDropUnverifiedPassword = `UPDATE users SET password = NULL WHERE id = $1 AND NOT password_verified;`
+
+	//External identities
+	SQLToFindUserByIdentity  = `SELECT user_id FROM user_identities WHERE issuer = $1 AND subject = $2;`
+	SQLToLinkIdentity        = `INSERT INTO user_identities (issuer, subject, user_id) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING;`
+	SQLToCreateUserWithEmail = `INSERT INTO users (email) VALUES ($1) RETURNING id;`
+
+	//Anonymous users keep their id when they register
+	SQLToRegisterAnonUser = `INSERT INTO users (id, email) VALUES ($1, $2);`
+
+	//Two-factor authentication.  Each TOTP time step can only be used once
+	SQLToGetTOTP             = `SELECT secret, confirmed, last_counter FROM user_totp WHERE user_id = $1;`
+	SQLToSetTOTP             = `INSERT INTO user_totp (user_id, secret) VALUES ($1, $2) ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, confirmed = false, last_counter = 0;`
+	SQLToConfirmTOTP         = `UPDATE user_totp SET confirmed = true, last_counter = $2 WHERE user_id = $1 AND NOT confirmed;`
+	SQLToUseTOTPCounter      = `UPDATE user_totp SET last_counter = $2 WHERE user_id = $1 AND confirmed AND last_counter < $2;`
+	SQLToDeleteTOTP          = `DELETE FROM user_totp WHERE user_id = $1;`
+	SQLToAddRecoveryCode     = `INSERT INTO user_recovery_codes (user_id, hash) VALUES ($1, $2);`
+	SQLToUseRecoveryCode     = `DELETE FROM user_recovery_codes WHERE user_id = $1 AND hash = $2;`
+	SQLToDeleteRecoveryCodes = `DELETE FROM user_recovery_codes WHERE user_id = $1;`
+
+	//API keys.  Expired keys are never returned
+	SQLToCreateAPIKey = `INSERT INTO api_keys (id, hash, user_id, role, scopes, name, expires) VALUES ($1, $2, $3, $4, $5, $6, $7);`
+	SQLToGetAPIKey    = `SELECT hash, user_id, role, scopes FROM api_keys WHERE id = $1 AND (expires IS NULL OR expires > now());`
+
+	//Token revocation
+	SQLToRevokeToken        = `INSERT INTO revoked_tokens (jti, expires) VALUES ($1, $2) ON CONFLICT DO NOTHING;`
+	SQLToPruneRevokedTokens = `DELETE FROM revoked_tokens WHERE expires < now();`
+	SQLToIsTokenRevoked     = `SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = $1);`
+
+	//Magic codes and failed login attempts.  Lifetimes are in seconds
+	SQLToSetMagicCode       = `INSERT INTO magic_codes (email, hash, expires) VALUES ($1, $2, now() + $3 * interval '1 second') ON CONFLICT (email) DO UPDATE SET hash = EXCLUDED.hash, expires = EXCLUDED.expires;`
+	SQLToUseMagicCode       = `DELETE FROM magic_codes WHERE email = $1 AND hash = $2 AND expires > now();`
+	SQLToDeleteMagicCode    = `DELETE FROM magic_codes WHERE email = $1;`
+	SQLToPruneMagicCodes    = `DELETE FROM magic_codes WHERE expires < now(); DELETE FROM login_failures WHERE expires < now();`
+	SQLToAddLoginFailure    = `INSERT INTO login_failures (key, count, expires) VALUES ($1, 1, now() + $2 * interval '1 second') ON CONFLICT (key) DO UPDATE SET count = CASE WHEN login_failures.expires < now() THEN 1 ELSE login_failures.count + 1 END, expires = CASE WHEN login_failures.expires < now() THEN EXCLUDED.expires ELSE login_failures.expires END RETURNING count;`
+	SQLToGetLoginFailures   = `SELECT count FROM login_failures WHERE key = $1 AND expires > now();`
+	SQLToResetLoginFailures = `DELETE FROM login_failures WHERE key = $1;`
 
 	//General
 	//NO SEMI COLONS AT THE END
+	//Schema, table and column names should be quoted with QuoteIdentifier before formatting.
+	//Values are always passed as bind parameters ($1, $2...)
 	SQLToSelectAllFieldsFrom = `SELECT * FROM %s.%s`
-	SQLToSelectWhere         = `SELECT * FROM %s.%s WHERE id = '%v'` //depracated
-	SQLToSelectByID          = `SELECT * FROM %s.%s WHERE id = '%v'`
-	SQLToSelectWhereXEqualsY = `SELECT * FROM %s.%s WHERE %s = '%v'`
+	SQLToSelectWhere         = `SELECT * FROM %s.%s WHERE id = $1` //depracated
+	SQLToSelectByID          = `SELECT * FROM %s.%s WHERE id = $1`
+	SQLToSelectWhereXEqualsY = `SELECT * FROM %s.%s WHERE %s = $1`
 
 	SQLToInsertReturningJSON            = `INSERT INTO %s.%s(%s) VALUES (%s) returning row_to_json(%s)`
 	SQLToInsertAllDefaultsReturningJSON = `INSERT INTO %s.%s DEFAULT VALUES returning row_to_json(%s)`
-	SQLToDeleteWhere                    = `DELETE FROM %s.%s WHERE id = '%v'`
-	SQLToUpdateWhereReturningJSON       = `UPDATE %s.%s SET (%s) = (%s) WHERE id = '%v' returning row_to_json(%s)`
+	SQLToDeleteWhere                    = `DELETE FROM %s.%s WHERE id = $1`
+	SQLToDeleteWhereReturningJSON       = `DELETE FROM %s.%s WHERE id = $1 returning row_to_json(%s)`
+	SQLToUpdateWhereReturningJSON       = `UPDATE %s.%s SET (%s) = ROW(%s) WHERE id = $1 returning row_to_json(%s)`
+	SQLToUpsertWhereReturningJSON       = `INSERT INTO %s.%s(id, %s) VALUES ($1, %s) ON CONFLICT (id) DO UPDATE SET (%s) = ROW(%s) returning row_to_json(%s)`
+
+	//Introspection
+	SQLToGetTableColumns = `SELECT a.attname FROM pg_catalog.pg_attribute a JOIN pg_catalog.pg_class c ON c.oid = a.attrelid JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace WHERE n.nspname = $1 AND c.relname = $2 AND a.attnum > 0 AND NOT a.attisdropped ORDER BY a.attnum`
+	//Foreign keys from or to a table, with their columns in order
+	SQLToGetForeignKeys = sqlToSelectForeignKeys + ` AND ((fs.nspname = $1 AND ft.relname = $2) OR (rs.nspname = $1 AND rt.relname = $2)) ORDER BY c.conname`
+
+	//Introspection of whole schemas, for the schema cache.  $1 is an array of schema names
+	SQLToIntrospectColumns     = `SELECT n.nspname, c.relname, a.attname, format_type(a.atttypid, a.atttypmod), NOT a.attnotnull, a.atthasdef FROM pg_catalog.pg_attribute a JOIN pg_catalog.pg_class c ON c.oid = a.attrelid JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace WHERE n.nspname = ANY($1) AND c.relkind IN ('r', 'v', 'm', 'f', 'p') AND a.attnum > 0 AND NOT a.attisdropped ORDER BY n.nspname, c.relname, a.attnum`
+	SQLToIntrospectPrimaryKeys = `SELECT n.nspname, c.relname, a.attname FROM pg_catalog.pg_constraint k JOIN pg_catalog.pg_class c ON c.oid = k.conrelid JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace CROSS JOIN LATERAL unnest(k.conkey) WITH ORDINALITY AS u(attnum, n) JOIN pg_catalog.pg_attribute a ON a.attrelid = k.conrelid AND a.attnum = u.attnum WHERE k.contype = 'p' AND n.nspname = ANY($1) ORDER BY n.nspname, c.relname, u.n`
+	SQLToIntrospectGrants      = `SELECT n.nspname, c.relname, CASE WHEN g.grantee = 0 THEN 'PUBLIC' ELSE pg_catalog.pg_get_userbyid(g.grantee) END, g.privilege_type FROM pg_catalog.pg_class c JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace CROSS JOIN LATERAL aclexplode(c.relacl) g WHERE n.nspname = ANY($1) AND c.relkind IN ('r', 'v', 'm', 'f', 'p') ORDER BY 1, 2, 3, 4`
+	SQLToIntrospectForeignKeys = sqlToSelectForeignKeys + ` AND (fs.nspname = ANY($1) OR rs.nspname = ANY($1)) ORDER BY c.conname`
 
 	//Full text search_path
-	SQLToFullTextSearch = `with item as (select to_tsvector(%s::text) @@ to_tsquery('%s') AS found, %s.* FROM %s.%s) select array_to_json(array_agg(row_to_json(item))) FROM item WHERE item.found = TRUE`
+	SQLToFullTextSearch = `with item as (select to_tsvector(%s::text) @@ to_tsquery($1) AS found, %s.* FROM %s.%s) select array_to_json(array_agg(row_to_json(item))) FROM item WHERE item.found = TRUE`
 )
+
+//sqlToSelectForeignKeys selects the name, referencing schema, table and columns,
+//and referenced schema, table and columns of foreign keys, to be scanned by scanForeignKey
+const sqlToSelectForeignKeys = `SELECT c.conname, fs.nspname, ft.relname, (SELECT array_agg(a.attname ORDER BY k.n) FROM unnest(c.conkey) WITH ORDINALITY AS k(attnum, n) JOIN pg_catalog.pg_attribute a ON a.attrelid = c.conrelid AND a.attnum = k.attnum), rs.nspname, rt.relname, (SELECT array_agg(a.attname ORDER BY k.n) FROM unnest(c.confkey) WITH ORDINALITY AS k(attnum, n) JOIN pg_catalog.pg_attribute a ON a.attrelid = c.confrelid AND a.attnum = k.attnum) FROM pg_catalog.pg_constraint c JOIN pg_catalog.pg_class ft ON ft.oid = c.conrelid JOIN pg_catalog.pg_namespace fs ON fs.oid = ft.relnamespace JOIN pg_catalog.pg_class rt ON rt.oid = c.confrelid JOIN pg_catalog.pg_namespace rs ON rs.oid = rt.relnamespace WHERE c.contype = 'f'`
@@ -1,49 +1,221 @@
 package ghost
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/lib/pq"
 )
 
 type store struct{}
 
+//ErrQueryTimeout is returned when a query is cancelled because the deadline of its context has passed
+var ErrQueryTimeout = errors.New("Query timed out")
+
+//Execute runs a query against the datastore and returns the JSON result
 func (s store) Execute(q *Query) (string, error) {
 
+	return s.ExecuteContext(context.Background(), q)
+
+}
+
+//ExecuteContext runs a query against the datastore and returns the JSON result.
+//The query is cancelled if the context is done, and any deadline is applied as the statement timeout
+func (s store) ExecuteContext(ctx context.Context, q *Query) (string, error) {
+
 	if err := q.Build(); err != nil {
-		return "", nil
+		return "", err
 	}
 
 	//Caching case
 	//Return the cached result if there is a cache key present
 	//AND there is a result from the cache
-	if q.cacheKey != "" {
-		cacheResult, ok := App.Cache.Get(q.cacheKey)
-		if ok {
+	caching := q.cacheKey != "" && App.Cache != nil
+	if caching {
+		if JSONResponse, ok := s.fromCache(q); ok {
 			LogDebug("STORE", true, "Returning from cache, using key: "+q.cacheKey, nil)
-			return cacheResult.(string), nil
+			return JSONResponse, q.setNextCursor(JSONResponse)
 		}
 	}
 
+	//Taken before running the query, so that a result is not cached if the
+	//tables it reads from change while it is running
+	tags := q.cacheTags()
+	generation := cacheTags.generation(tags)
+
 	//No caching case
-	var JSONResponse string
-	if err := App.DB.QueryRow(q.queryString).Scan(&JSONResponse); err != nil {
+	JSONResponse, err := s.queryJSON(ctx, q)
+	if err != nil {
+		return "", err
+	}
+
+	//Set the cache if a cache key has been provided
+	if caching {
+		keys := []string{q.cacheKey}
+		if q.CountTotal {
+			keys = append(keys, q.cacheKey+countCacheKeySuffix)
+		}
+		cacheTags.set(tags, generation, keys, func() {
+			LogDebug("STORE", true, "Caching result with key: "+q.cacheKey, nil)
+			ttl := time.Duration(q.CacheExpiry) * time.Second
+			App.Cache.Set(q.cacheKey, []byte(JSONResponse), ttl)
+			if q.CountTotal {
+				App.Cache.Set(q.cacheKey+countCacheKeySuffix, []byte(strconv.FormatInt(q.total, 10)), ttl)
+			}
+		})
+	}
+	return JSONResponse, q.setNextCursor(JSONResponse)
+
+}
+
+//fromCache returns the cached result of a query, and its total count if requested.
+//Both must be present for the cached result to be used
+func (s store) fromCache(q *Query) (string, bool) {
+
+	cacheResult, ok := App.Cache.Get(q.cacheKey)
+	if !ok {
+		return "", false
+	}
+
+	if q.CountTotal {
+		cacheTotal, ok := App.Cache.Get(q.cacheKey + countCacheKeySuffix)
+		if !ok {
+			return "", false
+		}
+		total, err := strconv.ParseInt(string(cacheTotal), 10, 64)
+		if err != nil {
+			return "", false
+		}
+		q.total = total
+	}
+
+	return string(cacheResult), true
+
+}
+
+//countCacheKeySuffix distinguishes the cached total count from the cached result of a query
+const countCacheKeySuffix = ":count"
+
+//queryJSON runs the built query with its bind parameters and scans the single JSON value returned,
+//along with the total count if requested.  An empty result is returned as an empty string
+func (s store) queryJSON(ctx context.Context, q *Query) (JSONResponse string, err error) {
+
+	err = s.Tx(ctx, q.Role, q.UserID, func(tx *sql.Tx) error {
+
 		//Only one row is returned as JSON is returned by Postgres
-		//Empty result
-		if strings.Contains(err.Error(), "sql") {
-			return "", nil
+		//No rows, or an aggregate over no rows, is an empty result
+		var result sql.NullString
+		if err := tx.QueryRowContext(ctx, q.queryString, q.queryArgs...).Scan(&result); err != nil && err != sql.ErrNoRows {
+			return err
 		}
+		JSONResponse = result.String
 
-		//Else its a database error
-		return "", err
+		if q.CountTotal {
+			return tx.QueryRowContext(ctx, q.countString, q.countArgs...).Scan(&q.total)
+		}
+
+		return nil
+
+	})
+
+	return JSONResponse, err
+
+}
 
+//Tx runs fn within a transaction, as the given role and with the given user id set for
+//the duration of the transaction only, so nothing leaks to other users of the pooled connection.
+//Either may be empty, in which case the server role is used, or the user id is left unset.
+//If the context has a deadline, it is also set as the statement timeout, and ErrQueryTimeout is returned
+//if it is exceeded.  The transaction is committed if fn returns nil, and rolled back otherwise
+func (s store) Tx(ctx context.Context, role, userID string, fn func(tx *sql.Tx) error) error {
+
+	return timeoutError(ctx, s.tx(ctx, role, userID, fn))
+
+}
+
+func (s store) tx(ctx context.Context, role, userID string, fn func(tx *sql.Tx) error) error {
+
+	tx, err := App.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
 	}
+	//Has no effect once the transaction has been committed
+	defer tx.Rollback()
 
-	//Set the cache if a cache key has been provided
-	if q.cacheKey != "" {
-		LogDebug("STORE", true, "Caching result with key: "+q.cacheKey, nil)
-		App.Cache.Set(q.cacheKey, JSONResponse)
+	var settings [][2]string
+	if role != "" {
+		settings = append(settings, [2]string{"role", role})
+	}
+	if userID != "" {
+		settings = append(settings, [2]string{"my.user_id", userID})
+	}
+
+	//Postgres stops the work itself once the deadline has passed,
+	//even if the cancellation from the client doesn't get through
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout := time.Until(deadline)
+		if timeout <= 0 {
+			return context.DeadlineExceeded
+		}
+		settings = append(settings, [2]string{"statement_timeout", strconv.FormatInt(int64((timeout+time.Millisecond-1)/time.Millisecond), 10)})
+	}
+
+	if len(settings) != 0 {
+		query, args := localSettings(settings)
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return err
+		}
+	}
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+
+}
+
+//localSettings builds a single statement to apply settings for the current transaction only.
+//The settings are values rather than identifiers, so are passed as bind parameters
+func localSettings(settings [][2]string) (string, []interface{}) {
+
+	var (
+		calls []string
+		args  []interface{}
+	)
+
+	for _, setting := range settings {
+		args = append(args, setting[1])
+		calls = append(calls, fmt.Sprintf(sqlToSetLocalConfig, setting[0], len(args)))
 	}
-	return JSONResponse, nil
+
+	return fmt.Sprintf(sqlToSelectSettings, strings.Join(calls, ", ")), args
+
+}
+
+//timeoutError replaces any error caused by the deadline of the context passing with ErrQueryTimeout.
+//Postgres reports both a statement timeout and a cancelled query as query_canceled
+func timeoutError(ctx context.Context, err error) error {
+
+	if err == nil {
+		return nil
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return ErrQueryTimeout
+	}
+
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "57014" && strings.Contains(pqErr.Message, "statement timeout") {
+		return ErrQueryTimeout
+	}
+
+	return err
 
 }
 
@@ -53,9 +225,16 @@ func (s store) Execute(q *Query) (string, error) {
 //The corresponding unused data structure is set to nil
 func (s store) ExecuteAndUnmarshall(q *Query) (list []map[string]interface{}, single map[string]interface{}, err error) {
 
+	return s.ExecuteAndUnmarshallContext(context.Background(), q)
+
+}
+
+//ExecuteAndUnmarshallContext is ExecuteAndUnmarshall, cancelled if the context is done
+func (s store) ExecuteAndUnmarshallContext(ctx context.Context, q *Query) (list []map[string]interface{}, single map[string]interface{}, err error) {
+
 	//Execute to JSON first
 	var dbResponse string
-	dbResponse, err = s.Execute(q)
+	dbResponse, err = s.ExecuteContext(ctx, q)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -86,3 +265,93 @@ func (s store) ExecuteAndUnmarshall(q *Query) (list []map[string]interface{}, si
 	return nil, single, nil
 
 }
+
+//TableColumns returns the names of a table's columns, in order, from the schema cache if the table is loaded.
+//Columns are read from the catalog so are returned regardless of the privileges of any role
+func (s store) TableColumns(schema, table string) (columns []string, err error) {
+
+	if t, ok := App.Schema.Table(schema, table); ok {
+		return t.ColumnNames(), nil
+	}
+
+	rows, err := App.DB.Query(SQLToGetTableColumns, schema, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return nil, err
+		}
+		columns = append(columns, column)
+	}
+
+	return columns, rows.Err()
+
+}
+
+//ForeignKeys returns the foreign keys from or to a table, ordered by name,
+//from the schema cache if the table is loaded
+func (s store) ForeignKeys(schema, table string) (foreignKeys []ForeignKey, err error) {
+
+	if t, ok := App.Schema.Table(schema, table); ok {
+		return t.ForeignKeys, nil
+	}
+
+	rows, err := App.DB.Query(SQLToGetForeignKeys, schema, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		fk, err := scanForeignKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		foreignKeys = append(foreignKeys, fk)
+	}
+
+	return foreignKeys, rows.Err()
+
+}
+
+//scanForeignKey scans a row selected by sqlToSelectForeignKeys
+func scanForeignKey(rows *sql.Rows) (fk ForeignKey, err error) {
+
+	err = rows.Scan(&fk.Name, &fk.Schema, &fk.Table, pq.Array(&fk.Columns), &fk.ForeignSchema, &fk.ForeignTable, pq.Array(&fk.ForeignColumns))
+	return fk, err
+
+}
+
+//ResolveEmbeds sets the foreign key relating each embedded table to its parent,
+//starting from schema.table and working down through any nested embeds
+func (s store) ResolveEmbeds(schema, table string, embeds []EmbedConfig) error {
+
+	if len(embeds) == 0 {
+		return nil
+	}
+
+	foreignKeys, err := s.ForeignKeys(schema, table)
+	if err != nil {
+		return err
+	}
+
+	for k := range embeds {
+
+		if err := resolveEmbed(schema, table, &embeds[k], foreignKeys); err != nil {
+			return err
+		}
+
+		relatedSchema, relatedTable := embeds[k].relatedSchemaAndTable()
+		if err := s.ResolveEmbeds(relatedSchema, relatedTable, embeds[k].Embed); err != nil {
+			return err
+		}
+
+	}
+
+	return nil
+
+}
@@ -0,0 +1,108 @@
+package ghost
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestTx(t *testing.T) {
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	App.DB = db
+	defer db.Close()
+
+	//Role and user id are set together, for the transaction only
+	mock.ExpectBegin()
+	mock.ExpectExec(`set_config\('role', \$1, true\), set_config\('my.user_id', \$2, true\)`).WithArgs("admin", "42").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("UPDATE orders").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE stock").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err = App.Store.Tx(context.Background(), "admin", "42", func(tx *sql.Tx) error {
+		if _, err := tx.Exec("UPDATE orders SET status = 'shipped'"); err != nil {
+			return err
+		}
+		_, err := tx.Exec("UPDATE stock SET quantity = quantity - 1")
+		return err
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	//Just the user id
+	mock.ExpectBegin()
+	mock.ExpectExec(`set_config\('my.user_id', \$1, true\)`).WithArgs("42").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	if err := App.Store.Tx(context.Background(), "", "42", func(tx *sql.Tx) error { return nil }); err != nil {
+		t.Error(err)
+	}
+
+	//Errors roll back the whole transaction
+	mock.ExpectBegin()
+	mock.ExpectExec(`set_config\('role', \$1, true\)`).WithArgs("anon").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	failure := errors.New("failure")
+	if err := App.Store.Tx(context.Background(), "anon", "", func(tx *sql.Tx) error { return failure }); err != failure {
+		t.Errorf("Expected the error from the transaction function, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+}
+
+func TestTxDeadline(t *testing.T) {
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	App.DB = db
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	//The deadline is applied as the statement timeout, along with the role
+	mock.ExpectBegin()
+	mock.ExpectExec(`set_config\('role', \$1, true\), set_config\('statement_timeout', \$2, true\)`).WithArgs("admin", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT pg_sleep").WillReturnError(&pq.Error{Code: "57014", Message: "canceling statement due to statement timeout"})
+	mock.ExpectRollback()
+
+	err = App.Store.Tx(ctx, "admin", "", func(tx *sql.Tx) error {
+		return tx.QueryRowContext(ctx, "SELECT pg_sleep(120)").Scan(new(string))
+	})
+	if err != ErrQueryTimeout {
+		t.Errorf("Expected ErrQueryTimeout, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	//Nothing is run once the deadline has passed
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	if _, err := App.Store.ExecuteContext(expired, &Query{BaseSQL: "SELECT 1"}); err != ErrQueryTimeout {
+		t.Errorf("Expected ErrQueryTimeout, got %v", err)
+	}
+
+	//Other errors are returned as they are
+	if err := timeoutError(context.Background(), sql.ErrNoRows); err != sql.ErrNoRows {
+		t.Errorf("Expected the original error, got %v", err)
+	}
+
+}
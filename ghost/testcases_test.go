@@ -1,17 +1,21 @@
 package ghost
 
+import "github.com/lib/pq"
+
 var testCases = []struct {
 	query               Query
 	expectedQueryString string
+	expectedArgs        []interface{}
 	mockResult          string
 	description         string
 }{
 	{
 		Query{
-			BaseSQL: "SELECT * FROM %s.%s",
-			SQLArgs: []interface{}{"public", "test_table"},
+			BaseSQL: "SELECT * FROM public.test_table WHERE id = $1",
+			SQLArgs: []interface{}{"test"},
 		},
-		"WITH results AS (SELECT * FROM public.test_table) SELECT row_to_json(results) from results;",
+		"WITH results AS (SELECT * FROM public.test_table WHERE id = $1) SELECT row_to_json(results) from results;",
+		[]interface{}{"test"},
 		"[{'some':'object'}]",
 		"Base SQL + Args",
 	},
@@ -21,7 +25,8 @@ var testCases = []struct {
 			Schema: "public",
 			Table:  "test_table",
 		},
-		"WITH results AS (SELECT * FROM public.test_table) SELECT row_to_json(results) from results;",
+		"WITH results AS (SELECT * FROM \"public\".\"test_table\") SELECT row_to_json(results) from results;",
+		nil,
 		"[{'some':'object'}]",
 		"Select specified with schema and table",
 	},
@@ -31,7 +36,8 @@ var testCases = []struct {
 			Schema: "public",
 			Table:  "test_table",
 		},
-		"WITH results AS (SELECT field1,field2 FROM public.test_table) SELECT row_to_json(results) from results;",
+		"WITH results AS (SELECT \"field1\",\"field2\" FROM \"public\".\"test_table\") SELECT row_to_json(results) from results;",
+		nil,
 		"[{'some':'object'}]",
 		"Multiple select fields",
 	},
@@ -48,7 +54,8 @@ var testCases = []struct {
 				},
 			},
 		},
-		"WITH results AS (SELECT field1,field2 FROM public.test_table WHERE id = 'test') SELECT row_to_json(results) from results;",
+		"WITH results AS (SELECT \"field1\",\"field2\" FROM \"public\".\"test_table\" WHERE \"id\" = $1) SELECT row_to_json(results) from results;",
+		[]interface{}{"test"},
 		"[{'some':'object'}]",
 		"Single Where clause",
 	},
@@ -70,7 +77,8 @@ var testCases = []struct {
 				},
 			},
 		},
-		"WITH results AS (SELECT field1,field2 FROM public.test_table WHERE id = 'test' AND id2 = 'test2') SELECT row_to_json(results) from results;",
+		"WITH results AS (SELECT \"field1\",\"field2\" FROM \"public\".\"test_table\" WHERE \"id\" = $1 AND \"id2\" = $2) SELECT row_to_json(results) from results;",
+		[]interface{}{"test", "test2"},
 		"[{'some':'object'}]",
 		"Two Where clauses joined by AND",
 	},
@@ -93,7 +101,8 @@ var testCases = []struct {
 				},
 			},
 		},
-		"WITH results AS (SELECT field1,field2 FROM public.test_table WHERE id = 'test' OR id2 = 'test2') SELECT row_to_json(results) from results;",
+		"WITH results AS (SELECT \"field1\",\"field2\" FROM \"public\".\"test_table\" WHERE \"id\" = $1 OR \"id2\" = $2) SELECT row_to_json(results) from results;",
+		[]interface{}{"test", "test2"},
 		"[{'some':'object'}]",
 		"Two Where clauses joined by OR",
 	},
@@ -121,7 +130,8 @@ var testCases = []struct {
 				},
 			},
 		},
-		"WITH results AS (SELECT field1,field2 FROM public.test_table WHERE id = 'test' AND id2 = 'test2' OR id3 = 'test3') SELECT row_to_json(results) from results;",
+		"WITH results AS (SELECT \"field1\",\"field2\" FROM \"public\".\"test_table\" WHERE \"id\" = $1 AND \"id2\" = $2 OR \"id3\" = $3) SELECT row_to_json(results) from results;",
+		[]interface{}{"test", "test2", "test3"},
 		"[{'some':'object'}]",
 		"3 Where clauses joined by AND then OR",
 	},
@@ -137,7 +147,8 @@ var testCases = []struct {
 				},
 			},
 		},
-		"WITH results AS (SELECT field1,field2 FROM public.test_table WHERE id = ANY(ARRAY[1, 2, 3])) SELECT row_to_json(results) from results;",
+		"WITH results AS (SELECT \"field1\",\"field2\" FROM \"public\".\"test_table\" WHERE \"id\" = ANY($1)) SELECT row_to_json(results) from results;",
+		[]interface{}{pq.Array([]interface{}{1, 2, 3})},
 		"[{'some':'object'}]",
 		"Single multiple Value WHERE CLAUSE",
 	},
@@ -159,7 +170,8 @@ var testCases = []struct {
 				},
 			},
 		},
-		"WITH results AS (SELECT field1,field2 FROM public.test_table WHERE id = 'test' OR name = ANY(ARRAY['jon', 'jessi'])) SELECT row_to_json(results) from results;",
+		"WITH results AS (SELECT \"field1\",\"field2\" FROM \"public\".\"test_table\" WHERE \"id\" = $1 OR \"name\" = ANY($2)) SELECT row_to_json(results) from results;",
+		[]interface{}{"test", pq.Array([]interface{}{"jon", "jessi"})},
 		"[{'some':'object'}]",
 		"Simple WHERE clause + multiple-Value any WHERE clause joined with OR",
 	},
@@ -180,7 +192,8 @@ var testCases = []struct {
 				},
 			},
 		},
-		"WITH results AS (SELECT field1,field2 FROM public.test_table WHERE name = ANY(ARRAY['jon', 'jessi'])) SELECT row_to_json(results) from results;",
+		"WITH results AS (SELECT \"field1\",\"field2\" FROM \"public\".\"test_table\" WHERE \"name\" = ANY($1)) SELECT row_to_json(results) from results;",
+		[]interface{}{pq.Array([]interface{}{"jon", "jessi"})},
 		"[{'some':'object'}]",
 		"Nil WHERE clause + multiple-Value any WHERE clause",
 	},
@@ -201,7 +214,8 @@ var testCases = []struct {
 				},
 			},
 		},
-		"WITH results AS (SELECT field1,field2 FROM public.test_table WHERE name = ANY(ARRAY['jon', 'jessi'])) SELECT row_to_json(results) from results;",
+		"WITH results AS (SELECT \"field1\",\"field2\" FROM \"public\".\"test_table\" WHERE \"name\" = ANY($1)) SELECT row_to_json(results) from results;",
+		[]interface{}{pq.Array([]interface{}{"jon", "jessi"})},
 		"[{'some':'object'}]",
 		"Blank string WHERE clause + multiple-Value any WHERE clause",
 	},
@@ -222,7 +236,8 @@ var testCases = []struct {
 				},
 			},
 		},
-		"WITH results AS (SELECT field1,field2 FROM public.test_table WHERE name = ANY(ARRAY['jon', 'jessi'])) SELECT row_to_json(results) from results;",
+		"WITH results AS (SELECT \"field1\",\"field2\" FROM \"public\".\"test_table\" WHERE \"name\" = ANY($1)) SELECT row_to_json(results) from results;",
+		[]interface{}{pq.Array([]interface{}{"jon", "jessi"})},
 		"[{'some':'object'}]",
 		"Multiple-Value any WHERE clause + Nil WHERE clause",
 	},
@@ -243,7 +258,8 @@ var testCases = []struct {
 				},
 			},
 		},
-		"WITH results AS (SELECT field1,field2 FROM public.test_table WHERE id = ANY(ARRAY[1, 2, 3]) OR name = ANY(ARRAY['jon', 'jessi'])) SELECT row_to_json(results) from results;",
+		"WITH results AS (SELECT \"field1\",\"field2\" FROM \"public\".\"test_table\" WHERE \"id\" = ANY($1) OR \"name\" = ANY($2)) SELECT row_to_json(results) from results;",
+		[]interface{}{pq.Array([]interface{}{1, 2, 3}), pq.Array([]interface{}{"jon", "jessi"})},
 		"[{'some':'object'}]",
 		"2 x multiple-Value any WHERE clause joined with OR",
 	},
@@ -254,7 +270,8 @@ var testCases = []struct {
 			Table:  "test_table",
 			IsList: true,
 		},
-		"WITH results AS (SELECT * FROM public.test_table) SELECT array_to_json(array_agg(row_to_json(results))) from results;",
+		"WITH results AS (SELECT * FROM \"public\".\"test_table\") SELECT array_to_json(array_agg(row_to_json(results))) from results;",
+		nil,
 		"[{'some':'object'}]",
 		"Select specified with schema and table, return a list",
 	},
@@ -266,7 +283,8 @@ var testCases = []struct {
 			IsList: true,
 			Role:   "admin",
 		},
-		"SET LOCAL ROLE admin; WITH results AS (SELECT * FROM public.test_table) SELECT array_to_json(array_agg(row_to_json(results))) from results;",
+		"WITH results AS (SELECT * FROM \"public\".\"test_table\") SELECT array_to_json(array_agg(row_to_json(results))) from results;",
+		nil,
 		"[{'some':'object'}]",
 		"Select specified with schema and table, return a list, add role",
 	},
@@ -279,7 +297,8 @@ var testCases = []struct {
 			Role:   "admin",
 			UserID: "123456",
 		},
-		"SET my.user_id = '123456'; SET LOCAL ROLE admin; WITH results AS (SELECT * FROM public.test_table) SELECT array_to_json(array_agg(row_to_json(results))) from results;",
+		"WITH results AS (SELECT * FROM \"public\".\"test_table\") SELECT array_to_json(array_agg(row_to_json(results))) from results;",
+		nil,
 		"[{'some':'object'}]",
 		"Select specified with schema and table, return a list, add role and user id",
 	},
@@ -0,0 +1,475 @@
+// Copyright 2017 Jonathan Pincas
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/jpincas/ghost/ghost"
+	"github.com/lib/pq"
+)
+
+//requestContext holds the values placed on the request context by
+//the schema/table, record and authorization middleware
+type requestContext struct {
+	//ctx is the request's own context, which is done when the request times out or the client goes away
+	ctx                   context.Context
+	schema, table, record string
+	role, userID          string
+	queries               url.Values
+}
+
+//readContext extracts the values needed to build a query from the request context
+func readContext(r *http.Request) (c requestContext) {
+
+	ctx := r.Context()
+	c.ctx = ctx
+	c.schema, _ = ctx.Value("schema").(string)
+	c.table, _ = ctx.Value("table").(string)
+	c.record, _ = ctx.Value("record").(string)
+	c.role, _ = ctx.Value("role").(string)
+	c.queries, _ = ctx.Value("queries").(url.Values)
+
+	//The user id comes straight from the JWT claims, so could be of any type
+	if userID := ctx.Value("userID"); userID != nil {
+		c.userID = fmt.Sprint(userID)
+	}
+
+	return c
+}
+
+//quotedSchemaAndTable returns the schema and table ready to be formatted into one of the SQL templates
+func (c requestContext) quotedSchemaAndTable() (schema, table string, err error) {
+
+	if schema, err = ghost.QuoteIdentifier(c.schema); err != nil {
+		return "", "", err
+	}
+
+	if table, err = ghost.QuoteIdentifier(c.table); err != nil {
+		return "", "", err
+	}
+
+	return schema, table, nil
+}
+
+//applySelect sets the fields to select and any related tables to embed from the select query parameter,
+//e.g. ?select=id,name,orders(id,total).  Embedded tables are resolved through their foreign keys
+func (c requestContext) applySelect(q *ghost.Query) (err error) {
+
+	sel := c.queries.Get("select")
+	if sel == "" {
+		return nil
+	}
+
+	if q.Select, q.Embed, err = ghost.ParseSelect(sel); err != nil {
+		return err
+	}
+
+	return ghost.App.Store.ResolveEmbeds(c.schema, c.table, q.Embed)
+
+}
+
+//applyListParameters sets the filters, sort order and paging from the URL query parameters on a list query.
+//The table's columns are only looked up if there are filters or a sort order to validate
+func (c requestContext) applyListParameters(q *ghost.Query) (err error) {
+
+	var columns []string
+	if ghost.HasFilters(c.queries) || c.queries.Get("order") != "" {
+		if columns, err = ghost.App.Store.TableColumns(c.schema, c.table); err != nil {
+			return err
+		}
+	}
+
+	if q.Where, err = ghost.ParseFilters(c.queries, columns); err != nil {
+		return err
+	}
+
+	if order := c.queries.Get("order"); order != "" {
+
+		if q.Order, err = ghost.ParseOrder(order, columns); err != nil {
+			return err
+		}
+
+		//Pages can only follow on from each other if the order is unique,
+		//so finish with the id if the table has one
+		if hasColumn(columns, "id") && !hasOrderKey(q.Order, "id") {
+			q.Order = append(q.Order, ghost.OrderConfig{Key: "id"})
+		}
+
+	}
+
+	if limit := c.queries.Get("limit"); limit != "" {
+		if q.Limit, err = strconv.Atoi(limit); err != nil {
+			return errors.New("Invalid limit: " + limit)
+		}
+	}
+
+	if offset := c.queries.Get("offset"); offset != "" {
+		if q.Offset, err = strconv.Atoi(offset); err != nil {
+			return errors.New("Invalid offset: " + offset)
+		}
+	}
+
+	q.After = c.queries.Get("after")
+	return nil
+
+}
+
+//getList returns all the records in a table that the user's role has access to,
+//optionally filtered, sorted and paginated by the URL query parameters.
+//Send the header 'Prefer: count=exact' to get the total number of records in a Content-Range header
+func getList(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", ghost.ContentTypeJSON)
+	c := readContext(r)
+
+	q := ghost.Query{
+		Schema:     c.schema,
+		Table:      c.table,
+		Select:     []string{"*"},
+		IsList:     true,
+		Role:       c.role,
+		UserID:     c.userID,
+		CountTotal: r.Header.Get("Prefer") == "count=exact",
+	}
+
+	if err := c.applySelect(&q); err != nil {
+		respondWithError(w, c, err)
+		return
+	}
+
+	if err := c.applyListParameters(&q); err != nil {
+		respondWithError(w, c, err)
+		return
+	}
+
+	dbResponse, err := ghost.App.Store.ExecuteContext(c.ctx, &q)
+	if err != nil {
+		respondWithError(w, c, err)
+		return
+	}
+
+	//No records is not an error, just an empty list
+	if dbResponse == "" {
+		dbResponse = "[]"
+	}
+
+	if q.CountTotal {
+		w.Header().Set("Content-Range", contentRange(q.Offset, dbResponse, q.Total()))
+	}
+
+	//Link to the next page of a keyset paginated list
+	if cursor := q.NextCursor(); cursor != "" {
+		next := url.Values{}
+		for k, v := range c.queries {
+			next[k] = v
+		}
+		next.Set("after", cursor)
+		w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, next.Encode()))
+	}
+
+	w.Write([]byte(dbResponse))
+	return
+
+}
+
+//getRecord returns a single record by id
+func getRecord(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", ghost.ContentTypeJSON)
+	c := readContext(r)
+
+	q := ghost.Query{
+		Schema: c.schema,
+		Table:  c.table,
+		Select: []string{"*"},
+		Where: []ghost.WhereConfig{
+			ghost.WhereConfig{
+				Key:      "id",
+				Operator: "=",
+				Value:    c.record,
+			},
+		},
+		Role:   c.role,
+		UserID: c.userID,
+	}
+
+	if err := c.applySelect(&q); err != nil {
+		respondWithError(w, c, err)
+		return
+	}
+
+	executeAndRespond(w, c, &q, http.StatusOK)
+	return
+
+}
+
+//createRecord inserts a new record using the fields in the request body.
+//An empty body inserts a record with all default values
+func createRecord(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", ghost.ContentTypeJSON)
+	c := readContext(r)
+
+	requestBody, err := readRequestBody(r, false)
+	if err != nil {
+		respondWithError(w, c, err)
+		return
+	}
+
+	schema, table, err := c.quotedSchemaAndTable()
+	if err != nil {
+		respondWithError(w, c, err)
+		return
+	}
+
+	q := ghost.Query{
+		Role:   c.role,
+		UserID: c.userID,
+	}
+
+	if len(requestBody) == 0 {
+		q.OverrideQueryString = fmt.Sprintf(ghost.SQLToInsertAllDefaultsReturningJSON, schema, table, table)
+	} else {
+		cols, vals, args, err := ghost.MapToValsAndCols(requestBody, 1)
+		if err != nil {
+			respondWithError(w, c, err)
+			return
+		}
+		q.OverrideQueryString = fmt.Sprintf(ghost.SQLToInsertReturningJSON, schema, table, cols, vals, table)
+		q.SQLArgs = args
+	}
+
+	executeAndRespond(w, c, &q, http.StatusCreated)
+	return
+
+}
+
+//updateRecord updates only the fields present in the request body of an existing record
+func updateRecord(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", ghost.ContentTypeJSON)
+	c := readContext(r)
+
+	requestBody, err := readRequestBody(r, true)
+	if err != nil {
+		respondWithError(w, c, err)
+		return
+	}
+
+	schema, table, err := c.quotedSchemaAndTable()
+	if err != nil {
+		respondWithError(w, c, err)
+		return
+	}
+
+	//The record id takes the first placeholder
+	cols, vals, args, err := ghost.MapToValsAndCols(requestBody, 2)
+	if err != nil {
+		respondWithError(w, c, err)
+		return
+	}
+
+	q := ghost.Query{
+		OverrideQueryString: fmt.Sprintf(ghost.SQLToUpdateWhereReturningJSON, schema, table, cols, vals, table),
+		SQLArgs:             append([]interface{}{c.record}, args...),
+		Role:                c.role,
+		UserID:              c.userID,
+	}
+
+	executeAndRespond(w, c, &q, http.StatusOK)
+	return
+
+}
+
+//replaceRecord creates the record with the id in the URL,
+//or updates it with the fields in the request body if it already exists
+func replaceRecord(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", ghost.ContentTypeJSON)
+	c := readContext(r)
+
+	requestBody, err := readRequestBody(r, true)
+	if err != nil {
+		respondWithError(w, c, err)
+		return
+	}
+
+	//The id always comes from the URL
+	delete(requestBody, "id")
+	if len(requestBody) == 0 {
+		respondWithError(w, c, errors.New("No fields to set other than id"))
+		return
+	}
+
+	schema, table, err := c.quotedSchemaAndTable()
+	if err != nil {
+		respondWithError(w, c, err)
+		return
+	}
+
+	//The record id takes the first placeholder
+	cols, vals, args, err := ghost.MapToValsAndCols(requestBody, 2)
+	if err != nil {
+		respondWithError(w, c, err)
+		return
+	}
+
+	//On conflict, every column is set to the value that was proposed for insertion
+	excluded := "EXCLUDED." + strings.Join(strings.Split(cols, ", "), ", EXCLUDED.")
+
+	q := ghost.Query{
+		OverrideQueryString: fmt.Sprintf(ghost.SQLToUpsertWhereReturningJSON, schema, table, cols, vals, cols, excluded, table),
+		SQLArgs:             append([]interface{}{c.record}, args...),
+		Role:                c.role,
+		UserID:              c.userID,
+	}
+
+	executeAndRespond(w, c, &q, http.StatusOK)
+	return
+
+}
+
+//deleteRecord deletes a record by id and returns the deleted record
+func deleteRecord(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", ghost.ContentTypeJSON)
+	c := readContext(r)
+
+	schema, table, err := c.quotedSchemaAndTable()
+	if err != nil {
+		respondWithError(w, c, err)
+		return
+	}
+
+	q := ghost.Query{
+		OverrideQueryString: fmt.Sprintf(ghost.SQLToDeleteWhereReturningJSON, schema, table, table),
+		SQLArgs:             []interface{}{c.record},
+		Role:                c.role,
+		UserID:              c.userID,
+	}
+
+	executeAndRespond(w, c, &q, http.StatusOK)
+	return
+
+}
+
+//contentRange describes the records returned out of the total, e.g. 0-24/3573
+func contentRange(offset int, dbResponse string, total int64) string {
+
+	var records []json.RawMessage
+	json.Unmarshal([]byte(dbResponse), &records)
+
+	if len(records) == 0 {
+		return fmt.Sprintf("*/%v", total)
+	}
+
+	return fmt.Sprintf("%v-%v/%v", offset, offset+len(records)-1, total)
+
+}
+
+func hasColumn(columns []string, column string) bool {
+	for _, c := range columns {
+		if c == column {
+			return true
+		}
+	}
+	return false
+}
+
+func hasOrderKey(order []ghost.OrderConfig, key string) bool {
+	for _, o := range order {
+		if o.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+//executeAndRespond runs a query that returns a single record and writes it out with the given status.
+//An empty result means the record doesn't exist, or the user's role can't see it
+func executeAndRespond(w http.ResponseWriter, c requestContext, q *ghost.Query, status int) {
+
+	dbResponse, err := ghost.App.Store.ExecuteContext(c.ctx, q)
+	if err != nil {
+		respondWithError(w, c, err)
+		return
+	}
+
+	if dbResponse == "" {
+		respondWithResponseError(w, ghost.ResponseError{http.StatusNotFound, "", "Record not found", c.schema, c.table, c.record})
+		return
+	}
+
+	w.WriteHeader(status)
+	w.Write([]byte(dbResponse))
+
+}
+
+//readRequestBody decodes the JSON object in the request body.
+//If the body is required, an absent or empty object is an error
+func readRequestBody(r *http.Request, required bool) (requestBody map[string]interface{}, err error) {
+
+	//If r.body is not nil (as in, body doesn't even exist), read and decode
+	//A blank body decodes to EOF, which is just treated as empty
+	if r.Body != nil {
+		if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+
+	if required && len(requestBody) == 0 {
+		return nil, errors.New("Invalid or absent request body")
+	}
+
+	return requestBody, nil
+
+}
+
+//respondWithError writes out an error, translating database errors into
+//meaningful HTTP codes.  Anything else is considered a bad request
+func respondWithError(w http.ResponseWriter, c requestContext, err error) {
+
+	responseError := ghost.ResponseError{http.StatusBadRequest, "", err.Error(), c.schema, c.table, c.record}
+
+	if err == ghost.ErrQueryTimeout {
+		responseError.HTTPCode = http.StatusGatewayTimeout
+	}
+
+	if dbError, ok := err.(*pq.Error); ok {
+		responseError.HTTPCode = ghost.DBErrorCodeToHTTPErrorCode(dbError.Code)
+		responseError.DBErrorCode = dbError.Code
+		responseError.ErrorMessage = dbError.Message
+	}
+
+	respondWithResponseError(w, responseError)
+
+}
+
+func respondWithResponseError(w http.ResponseWriter, responseError ghost.ResponseError) {
+
+	w.WriteHeader(responseError.HTTPCode)
+	b, _ := json.Marshal(responseError)
+	w.Write(b)
+
+}
@@ -0,0 +1,320 @@
+// Copyright 2017 Jonathan Pincas
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+
+	"github.com/jpincas/ghost/ghost"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/suite"
+)
+
+type RestHandlerTests struct {
+	suite.Suite
+	Rr   *httptest.ResponseRecorder
+	Mock sqlmock.Sqlmock
+}
+
+//Run test suits
+func TestRestHandlerTests(t *testing.T) {
+	suite.Run(t, new(RestHandlerTests))
+}
+
+//Tests setup
+func (suite *RestHandlerTests) SetupTest() {
+	suite.Rr = httptest.NewRecorder()
+	ghost.App.DB, suite.Mock, _ = sqlmock.New()
+}
+
+func (suite *RestHandlerTests) TearDownTest() {
+	suite.Nil(suite.Mock.ExpectationsWereMet())
+	ghost.App.DB.Close()
+}
+
+//newRequest creates a request with the context values that would be set by the middleware
+func newRequest(method, body, record, role string) *http.Request {
+
+	req, _ := http.NewRequest(method, "", bytes.NewBufferString(body))
+	ctx := context.WithValue(req.Context(), "schema", "public")
+	ctx = context.WithValue(ctx, "table", "test_table")
+	ctx = context.WithValue(ctx, "record", record)
+	ctx = context.WithValue(ctx, "role", role)
+	return req.WithContext(ctx)
+
+}
+
+func jsonRows(json string) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"json"}).AddRow(json)
+}
+
+func (suite *RestHandlerTests) TestGetList() {
+
+	suite.Mock.ExpectBegin()
+	suite.Mock.ExpectQuery(`SELECT \* FROM "public"."test_table"`).WillReturnRows(jsonRows(`[{"id":1}]`))
+	suite.Mock.ExpectCommit()
+
+	http.HandlerFunc(getList).ServeHTTP(suite.Rr, newRequest("GET", "", "", ""))
+	suite.Equal(http.StatusOK, suite.Rr.Code)
+	suite.Equal(`[{"id":1}]`, fmt.Sprint(suite.Rr.Body))
+
+}
+
+func (suite *RestHandlerTests) TestGetList_empty() {
+
+	suite.Mock.ExpectBegin()
+	suite.Mock.ExpectQuery(`SELECT \* FROM "public"."test_table"`).WillReturnRows(sqlmock.NewRows([]string{"json"}))
+	suite.Mock.ExpectCommit()
+
+	http.HandlerFunc(getList).ServeHTTP(suite.Rr, newRequest("GET", "", "", ""))
+	suite.Equal(http.StatusOK, suite.Rr.Code)
+	suite.Equal(`[]`, fmt.Sprint(suite.Rr.Body))
+
+}
+
+func (suite *RestHandlerTests) TestGetList_withrole() {
+
+	suite.Mock.ExpectBegin()
+	suite.Mock.ExpectExec(`set_config\('role', \$1, true\)`).WithArgs("admin").WillReturnResult(sqlmock.NewResult(0, 0))
+	suite.Mock.ExpectQuery(`SELECT \* FROM "public"."test_table"`).WillReturnRows(jsonRows(`[{"id":1}]`))
+	suite.Mock.ExpectCommit()
+
+	http.HandlerFunc(getList).ServeHTTP(suite.Rr, newRequest("GET", "", "", "admin"))
+	suite.Equal(http.StatusOK, suite.Rr.Code)
+
+}
+
+func (suite *RestHandlerTests) TestGetList_forbidden() {
+
+	suite.Mock.ExpectBegin()
+	suite.Mock.ExpectQuery(`SELECT \* FROM "public"."test_table"`).WillReturnError(&pq.Error{Code: "42501", Message: "permission denied"})
+	suite.Mock.ExpectRollback()
+
+	http.HandlerFunc(getList).ServeHTTP(suite.Rr, newRequest("GET", "", "", ""))
+	suite.Equal(http.StatusForbidden, suite.Rr.Code)
+
+}
+
+func (suite *RestHandlerTests) TestGetRecord() {
+
+	suite.Mock.ExpectBegin()
+	suite.Mock.ExpectQuery(`WHERE "id" = \$1`).WithArgs("1").WillReturnRows(jsonRows(`{"id":1}`))
+	suite.Mock.ExpectCommit()
+
+	http.HandlerFunc(getRecord).ServeHTTP(suite.Rr, newRequest("GET", "", "1", ""))
+	suite.Equal(http.StatusOK, suite.Rr.Code)
+	suite.Equal(`{"id":1}`, fmt.Sprint(suite.Rr.Body))
+
+}
+
+func (suite *RestHandlerTests) TestGetRecord_notfound() {
+
+	suite.Mock.ExpectBegin()
+	suite.Mock.ExpectQuery(`WHERE "id" = \$1`).WithArgs("2").WillReturnRows(sqlmock.NewRows([]string{"json"}))
+	suite.Mock.ExpectCommit()
+
+	http.HandlerFunc(getRecord).ServeHTTP(suite.Rr, newRequest("GET", "", "2", ""))
+	suite.Equal(http.StatusNotFound, suite.Rr.Code)
+
+}
+
+func (suite *RestHandlerTests) TestCreateRecord() {
+
+	suite.Mock.ExpectBegin()
+	suite.Mock.ExpectQuery(`INSERT INTO "public"."test_table"\("name"\) VALUES \(\$1\)`).WithArgs("jon").WillReturnRows(jsonRows(`{"id":1,"name":"jon"}`))
+	suite.Mock.ExpectCommit()
+
+	http.HandlerFunc(createRecord).ServeHTTP(suite.Rr, newRequest("POST", `{"name":"jon"}`, "", ""))
+	suite.Equal(http.StatusCreated, suite.Rr.Code)
+	suite.Equal(`{"id":1,"name":"jon"}`, fmt.Sprint(suite.Rr.Body))
+
+}
+
+func (suite *RestHandlerTests) TestCreateRecord_defaults() {
+
+	suite.Mock.ExpectBegin()
+	suite.Mock.ExpectQuery(`INSERT INTO "public"."test_table" DEFAULT VALUES`).WillReturnRows(jsonRows(`{"id":1}`))
+	suite.Mock.ExpectCommit()
+
+	http.HandlerFunc(createRecord).ServeHTTP(suite.Rr, newRequest("POST", "", "", ""))
+	suite.Equal(http.StatusCreated, suite.Rr.Code)
+
+}
+
+func (suite *RestHandlerTests) TestCreateRecord_badbody() {
+
+	http.HandlerFunc(createRecord).ServeHTTP(suite.Rr, newRequest("POST", "{gdf4}", "", ""))
+	suite.Equal(http.StatusBadRequest, suite.Rr.Code)
+
+}
+
+func (suite *RestHandlerTests) TestUpdateRecord() {
+
+	suite.Mock.ExpectBegin()
+	suite.Mock.ExpectQuery(`UPDATE "public"."test_table" SET \("name"\) = ROW\(\$2\) WHERE id = \$1`).WithArgs("1", "jon").WillReturnRows(jsonRows(`{"id":1,"name":"jon"}`))
+	suite.Mock.ExpectCommit()
+
+	http.HandlerFunc(updateRecord).ServeHTTP(suite.Rr, newRequest("PATCH", `{"name":"jon"}`, "1", ""))
+	suite.Equal(http.StatusOK, suite.Rr.Code)
+
+}
+
+func (suite *RestHandlerTests) TestUpdateRecord_nobody() {
+
+	http.HandlerFunc(updateRecord).ServeHTTP(suite.Rr, newRequest("PATCH", "", "1", ""))
+	suite.Equal(http.StatusBadRequest, suite.Rr.Code)
+
+}
+
+func (suite *RestHandlerTests) TestReplaceRecord() {
+
+	suite.Mock.ExpectBegin()
+	suite.Mock.ExpectQuery(`ON CONFLICT \(id\) DO UPDATE SET \("name"\) = ROW\(EXCLUDED."name"\)`).WithArgs("1", "jon").WillReturnRows(jsonRows(`{"id":1,"name":"jon"}`))
+	suite.Mock.ExpectCommit()
+
+	http.HandlerFunc(replaceRecord).ServeHTTP(suite.Rr, newRequest("PUT", `{"id":5,"name":"jon"}`, "1", ""))
+	suite.Equal(http.StatusOK, suite.Rr.Code)
+
+}
+
+func (suite *RestHandlerTests) TestDeleteRecord_notfound() {
+
+	suite.Mock.ExpectBegin()
+	suite.Mock.ExpectQuery(`DELETE FROM "public"."test_table" WHERE id = \$1`).WithArgs("1").WillReturnRows(sqlmock.NewRows([]string{"json"}))
+	suite.Mock.ExpectCommit()
+
+	http.HandlerFunc(deleteRecord).ServeHTTP(suite.Rr, newRequest("DELETE", "", "1", ""))
+	suite.Equal(http.StatusNotFound, suite.Rr.Code)
+
+}
+
+func (suite *RestHandlerTests) TestGetList_filtered() {
+
+	suite.Mock.ExpectQuery("pg_catalog.pg_attribute").WithArgs("public", "test_table").WillReturnRows(sqlmock.NewRows([]string{"attname"}).AddRow("id").AddRow("age"))
+	suite.Mock.ExpectBegin()
+	suite.Mock.ExpectQuery(`WHERE "age" > \$1`).WithArgs("30").WillReturnRows(jsonRows(`[{"id":1}]`))
+	suite.Mock.ExpectCommit()
+
+	req := newRequest("GET", "", "", "")
+	req = req.WithContext(context.WithValue(req.Context(), "queries", url.Values{"age": []string{"gt.30"}}))
+
+	http.HandlerFunc(getList).ServeHTTP(suite.Rr, req)
+	suite.Equal(http.StatusOK, suite.Rr.Code)
+
+}
+
+func (suite *RestHandlerTests) TestGetList_unknowncolumn() {
+
+	suite.Mock.ExpectQuery("pg_catalog.pg_attribute").WithArgs("public", "test_table").WillReturnRows(sqlmock.NewRows([]string{"attname"}).AddRow("id"))
+
+	req := newRequest("GET", "", "", "")
+	req = req.WithContext(context.WithValue(req.Context(), "queries", url.Values{"password": []string{"eq.secret"}}))
+
+	http.HandlerFunc(getList).ServeHTTP(suite.Rr, req)
+	suite.Equal(http.StatusBadRequest, suite.Rr.Code)
+
+}
+
+func (suite *RestHandlerTests) TestGetList_emptyfiltervalue() {
+
+	suite.Mock.ExpectQuery("pg_catalog.pg_attribute").WithArgs("public", "test_table").WillReturnRows(sqlmock.NewRows([]string{"attname"}).AddRow("id").AddRow("age"))
+
+	req := newRequest("GET", "", "", "")
+	req = req.WithContext(context.WithValue(req.Context(), "queries", url.Values{"age": []string{"eq."}}))
+
+	http.HandlerFunc(getList).ServeHTTP(suite.Rr, req)
+	suite.Equal(http.StatusBadRequest, suite.Rr.Code)
+
+}
+
+func (suite *RestHandlerTests) TestGetList_paginated() {
+
+	suite.Mock.ExpectQuery("pg_catalog.pg_attribute").WithArgs("public", "test_table").WillReturnRows(sqlmock.NewRows([]string{"attname"}).AddRow("id").AddRow("age"))
+	suite.Mock.ExpectBegin()
+	suite.Mock.ExpectQuery(`ORDER BY "age" DESC, "id" ASC LIMIT 2`).WillReturnRows(jsonRows(`[{"id":1,"age":40},{"id":2,"age":30}]`))
+	suite.Mock.ExpectQuery(`SELECT count\(\*\)`).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(5))
+	suite.Mock.ExpectCommit()
+
+	req := newRequest("GET", "", "", "")
+	req.Header.Set("Prefer", "count=exact")
+	req = req.WithContext(context.WithValue(req.Context(), "queries", url.Values{"order": []string{"age.desc"}, "limit": []string{"2"}}))
+
+	http.HandlerFunc(getList).ServeHTTP(suite.Rr, req)
+	suite.Equal(http.StatusOK, suite.Rr.Code)
+	suite.Equal("0-1/5", suite.Rr.Header().Get("Content-Range"))
+	suite.Contains(suite.Rr.Header().Get("Link"), `rel="next"`)
+	suite.Contains(suite.Rr.Header().Get("Link"), "after=")
+
+}
+
+func (suite *RestHandlerTests) TestGetList_badlimit() {
+
+	req := newRequest("GET", "", "", "")
+	req = req.WithContext(context.WithValue(req.Context(), "queries", url.Values{"limit": []string{"ten"}}))
+
+	http.HandlerFunc(getList).ServeHTTP(suite.Rr, req)
+	suite.Equal(http.StatusBadRequest, suite.Rr.Code)
+
+}
+
+func (suite *RestHandlerTests) TestGetList_embedded() {
+
+	suite.Mock.ExpectQuery("pg_catalog.pg_constraint").WithArgs("public", "test_table").WillReturnRows(
+		sqlmock.NewRows([]string{"conname", "nspname", "relname", "columns", "fnspname", "frelname", "fcolumns"}).
+			AddRow("orders_test_id_fkey", "public", "orders", "{test_id}", "public", "test_table", "{id}"))
+	suite.Mock.ExpectBegin()
+	suite.Mock.ExpectQuery(`SELECT "test_table"."id","j1"."orders" FROM "public"."test_table" LEFT JOIN LATERAL`).WillReturnRows(jsonRows(`[{"id":1,"orders":[]}]`))
+	suite.Mock.ExpectCommit()
+
+	req := newRequest("GET", "", "", "")
+	req = req.WithContext(context.WithValue(req.Context(), "queries", url.Values{"select": []string{"id,orders(id,total)"}}))
+
+	http.HandlerFunc(getList).ServeHTTP(suite.Rr, req)
+	suite.Equal(http.StatusOK, suite.Rr.Code)
+	suite.Equal(`[{"id":1,"orders":[]}]`, fmt.Sprint(suite.Rr.Body))
+
+}
+
+func (suite *RestHandlerTests) TestGetRecord_unrelated() {
+
+	suite.Mock.ExpectQuery("pg_catalog.pg_constraint").WithArgs("public", "test_table").WillReturnRows(
+		sqlmock.NewRows([]string{"conname", "nspname", "relname", "columns", "fnspname", "frelname", "fcolumns"}))
+
+	req := newRequest("GET", "", "1", "")
+	req = req.WithContext(context.WithValue(req.Context(), "queries", url.Values{"select": []string{"*,products(*)"}}))
+
+	http.HandlerFunc(getRecord).ServeHTTP(suite.Rr, req)
+	suite.Equal(http.StatusBadRequest, suite.Rr.Code)
+
+}
+
+func (suite *RestHandlerTests) TestGetList_timeout() {
+
+	suite.Mock.ExpectBegin()
+	suite.Mock.ExpectQuery(`SELECT \* FROM "public"."test_table"`).WillReturnError(&pq.Error{Code: "57014", Message: "canceling statement due to statement timeout"})
+	suite.Mock.ExpectRollback()
+
+	http.HandlerFunc(getList).ServeHTTP(suite.Rr, newRequest("GET", "", "", ""))
+	suite.Equal(http.StatusGatewayTimeout, suite.Rr.Code)
+
+}
@@ -0,0 +1,330 @@
+// Copyright 2017 Jonathan Pincas
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jpincas/ghost/ghost"
+)
+
+//OpenAPIPath is the route at which the OpenAPI document is served
+const OpenAPIPath = "/openapi.json"
+
+//The subset of the OpenAPI 3 specification needed to describe the generic CRUD routes
+
+type openAPIDocument struct {
+	OpenAPI    string                                 `json:"openapi"`
+	Info       openAPIInfo                            `json:"info"`
+	Servers    []openAPIServer                        `json:"servers"`
+	Paths      map[string]map[string]openAPIOperation `json:"paths"`
+	Components openAPIComponents                      `json:"components"`
+	Security   []map[string][]string                  `json:"security"`
+}
+
+type openAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type openAPIServer struct {
+	URL string `json:"url"`
+}
+
+type openAPIComponents struct {
+	Schemas         map[string]openAPISchema         `json:"schemas"`
+	Parameters      map[string]openAPIParameter      `json:"parameters"`
+	SecuritySchemes map[string]openAPISecurityScheme `json:"securitySchemes"`
+}
+
+type openAPISecurityScheme struct {
+	Type         string `json:"type"`
+	Scheme       string `json:"scheme"`
+	BearerFormat string `json:"bearerFormat"`
+}
+
+type openAPISchema struct {
+	Ref        string                   `json:"$ref,omitempty"`
+	Type       string                   `json:"type,omitempty"`
+	Format     string                   `json:"format,omitempty"`
+	Nullable   bool                     `json:"nullable,omitempty"`
+	Items      *openAPISchema           `json:"items,omitempty"`
+	Properties map[string]openAPISchema `json:"properties,omitempty"`
+	Required   []string                 `json:"required,omitempty"`
+}
+
+type openAPIParameter struct {
+	Ref         string         `json:"$ref,omitempty"`
+	Name        string         `json:"name,omitempty"`
+	In          string         `json:"in,omitempty"`
+	Description string         `json:"description,omitempty"`
+	Required    bool           `json:"required,omitempty"`
+	Schema      *openAPISchema `json:"schema,omitempty"`
+}
+
+type openAPIOperation struct {
+	Tags        []string                   `json:"tags"`
+	Summary     string                     `json:"summary"`
+	OperationID string                     `json:"operationId"`
+	Parameters  []openAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]openAPIResponse `json:"responses"`
+}
+
+type openAPIRequestBody struct {
+	Required bool                        `json:"required"`
+	Content  map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIMediaType struct {
+	Schema openAPISchema `json:"schema"`
+}
+
+type openAPIResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]openAPIMediaType `json:"content,omitempty"`
+}
+
+//getOpenAPI serves the OpenAPI document describing the CRUD routes of the tables in the installed bundles,
+//with only the operations the caller's role has been granted
+func getOpenAPI(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", ghost.ContentTypeJSON)
+	json.NewEncoder(w).Encode(newOpenAPIDocument(ghost.App.Schema.Tables(), openAPIRole(r)))
+	return
+
+}
+
+//openAPIRole is the role the document is described for: the one the caller is authorised as, or anon.
+//Callers can't ask about any other role, so the grants of other roles aren't given away
+func openAPIRole(r *http.Request) string {
+
+	if role, _ := r.Context().Value("role").(string); role != "" {
+		return role
+	}
+
+	return "anon"
+
+}
+
+//newOpenAPIDocument describes the routes for each table.  If a role is given, only
+//operations for which that role has the necessary privileges are included
+func newOpenAPIDocument(tables []ghost.Table, role string) openAPIDocument {
+
+	c := ghost.App.Config
+	doc := openAPIDocument{
+		OpenAPI: "3.0.0",
+		Info: openAPIInfo{
+			Title: c.JWTRealm,
+			//The document changes whenever the schemas are reloaded
+			Version: ghost.App.Schema.Loaded().UTC().Format(time.RFC3339),
+		},
+		Servers: []openAPIServer{openAPIServer{URL: c.BaseURL()}},
+		Paths:   map[string]map[string]openAPIOperation{},
+		Components: openAPIComponents{
+			Schemas:    map[string]openAPISchema{},
+			Parameters: openAPIListParameters,
+			SecuritySchemes: map[string]openAPISecurityScheme{
+				"bearerAuth": openAPISecurityScheme{Type: "http", Scheme: "bearer", BearerFormat: "JWT"},
+			},
+		},
+		Security: []map[string][]string{map[string][]string{"bearerAuth": []string{}}},
+	}
+
+	for _, t := range tables {
+
+		allowed := func(privileges ...string) bool {
+			if role == "" {
+				return true
+			}
+			for _, p := range privileges {
+				if !t.HasPrivilege(role, p) {
+					return false
+				}
+			}
+			return true
+		}
+
+		name := t.Schema + "." + t.Name
+		ref := openAPISchema{Ref: "#/components/schemas/" + name}
+		body := &openAPIRequestBody{Required: true, Content: map[string]openAPIMediaType{"application/json": openAPIMediaType{Schema: ref}}}
+		single := openAPIResponse{Description: "The " + t.Name + " record", Content: map[string]openAPIMediaType{"application/json": openAPIMediaType{Schema: ref}}}
+		notFound := openAPIResponse{Description: "No such record"}
+		tags := []string{name}
+
+		list := map[string]openAPIOperation{}
+		record := map[string]openAPIOperation{}
+
+		if allowed("SELECT") {
+
+			parameters := []openAPIParameter{
+				openAPIParameter{Ref: "#/components/parameters/select"},
+				openAPIParameter{Ref: "#/components/parameters/order"},
+				openAPIParameter{Ref: "#/components/parameters/limit"},
+				openAPIParameter{Ref: "#/components/parameters/offset"},
+				openAPIParameter{Ref: "#/components/parameters/after"},
+				openAPIParameter{Ref: "#/components/parameters/prefer"},
+			}
+			for _, column := range t.Columns {
+				parameters = append(parameters, openAPIParameter{
+					Name:        column.Name,
+					In:          "query",
+					Description: "Filter on " + column.Name + ", e.g. eq.value, gt.value, in.(a,b), not.is.null",
+					Schema:      &openAPISchema{Type: "string"},
+				})
+			}
+
+			list["get"] = openAPIOperation{
+				Tags:        tags,
+				Summary:     "List " + t.Name,
+				OperationID: "list." + name,
+				Parameters:  parameters,
+				Responses: map[string]openAPIResponse{
+					"200": openAPIResponse{Description: "The matching " + t.Name + " records", Content: map[string]openAPIMediaType{"application/json": openAPIMediaType{Schema: openAPISchema{Type: "array", Items: &ref}}}},
+				},
+			}
+
+		}
+
+		if allowed("INSERT") {
+			list["post"] = openAPIOperation{
+				Tags:        tags,
+				Summary:     "Create a " + t.Name + " record",
+				OperationID: "create." + name,
+				RequestBody: body,
+				Responses:   map[string]openAPIResponse{"201": single},
+			}
+		}
+
+		//Individual records are addressed by id
+		if hasColumn(t.ColumnNames(), "id") {
+
+			parameters := []openAPIParameter{openAPIParameter{Ref: "#/components/parameters/record"}}
+
+			if allowed("SELECT") {
+				parameters := append(parameters, openAPIParameter{Ref: "#/components/parameters/select"})
+				record["get"] = openAPIOperation{Tags: tags, Summary: "Get a " + t.Name + " record", OperationID: "get." + name, Parameters: parameters, Responses: map[string]openAPIResponse{"200": single, "404": notFound}}
+			}
+
+			if allowed("UPDATE") {
+				record["patch"] = openAPIOperation{Tags: tags, Summary: "Update fields of a " + t.Name + " record", OperationID: "update." + name, Parameters: parameters, RequestBody: body, Responses: map[string]openAPIResponse{"200": single, "404": notFound}}
+			}
+
+			if allowed("INSERT", "UPDATE") {
+				record["put"] = openAPIOperation{Tags: tags, Summary: "Create or replace a " + t.Name + " record", OperationID: "replace." + name, Parameters: parameters, RequestBody: body, Responses: map[string]openAPIResponse{"200": single}}
+			}
+
+			if allowed("DELETE") {
+				record["delete"] = openAPIOperation{Tags: tags, Summary: "Delete a " + t.Name + " record", OperationID: "delete." + name, Parameters: parameters, Responses: map[string]openAPIResponse{"200": single, "404": notFound}}
+			}
+
+		}
+
+		//Tables the role can't do anything with are left out altogether
+		if len(list) == 0 && len(record) == 0 {
+			continue
+		}
+
+		path := "/" + t.Schema + "/" + t.Name
+		if len(list) != 0 {
+			doc.Paths[path] = list
+		}
+		if len(record) != 0 {
+			doc.Paths[path+"/{record}"] = record
+		}
+		doc.Components.Schemas[name] = tableSchema(t)
+
+	}
+
+	return doc
+
+}
+
+//openAPIListParameters are the query parameters shared by all lists
+var openAPIListParameters = map[string]openAPIParameter{
+	"select": openAPIParameter{Name: "select", In: "query", Description: "Fields to return, and related tables to embed, e.g. id,name,orders(id,total)", Schema: &openAPISchema{Type: "string"}},
+	"order":  openAPIParameter{Name: "order", In: "query", Description: "Sort order, e.g. age.desc,name", Schema: &openAPISchema{Type: "string"}},
+	"limit":  openAPIParameter{Name: "limit", In: "query", Description: "Maximum number of records to return", Schema: &openAPISchema{Type: "integer"}},
+	"offset": openAPIParameter{Name: "offset", In: "query", Description: "Number of records to skip", Schema: &openAPISchema{Type: "integer"}},
+	"after":  openAPIParameter{Name: "after", In: "query", Description: "Cursor from the Link header of the previous page", Schema: &openAPISchema{Type: "string"}},
+	"prefer": openAPIParameter{Name: "Prefer", In: "header", Description: "Send count=exact for the total in the Content-Range header", Schema: &openAPISchema{Type: "string"}},
+	"record": openAPIParameter{Name: "record", In: "path", Description: "The record id", Required: true, Schema: &openAPISchema{Type: "string"}},
+}
+
+//tableSchema describes the JSON representation of a record.
+//Columns that can't be null and have no default are required
+func tableSchema(t ghost.Table) openAPISchema {
+
+	schema := openAPISchema{Type: "object", Properties: map[string]openAPISchema{}}
+
+	for _, c := range t.Columns {
+
+		property := columnSchema(c.Type)
+		property.Nullable = c.Nullable
+		schema.Properties[c.Name] = property
+
+		if !c.Nullable && !c.HasDefault {
+			schema.Required = append(schema.Required, c.Name)
+		}
+
+	}
+
+	return schema
+
+}
+
+//columnSchema maps an SQL type to the type and format of its JSON representation.
+//JSON columns can hold anything, so have no type
+func columnSchema(sqlType string) openAPISchema {
+
+	if strings.HasSuffix(sqlType, "[]") {
+		items := columnSchema(strings.TrimSuffix(sqlType, "[]"))
+		return openAPISchema{Type: "array", Items: &items}
+	}
+
+	//Remove any modifiers, e.g. character varying(255)
+	if i := strings.Index(sqlType, "("); i != -1 {
+		sqlType = sqlType[:i]
+	}
+
+	switch sqlType {
+	case "smallint", "integer":
+		return openAPISchema{Type: "integer", Format: "int32"}
+	case "bigint":
+		return openAPISchema{Type: "integer", Format: "int64"}
+	case "real":
+		return openAPISchema{Type: "number", Format: "float"}
+	case "double precision":
+		return openAPISchema{Type: "number", Format: "double"}
+	case "numeric":
+		return openAPISchema{Type: "number"}
+	case "boolean":
+		return openAPISchema{Type: "boolean"}
+	case "json", "jsonb":
+		return openAPISchema{}
+	case "uuid":
+		return openAPISchema{Type: "string", Format: "uuid"}
+	case "date":
+		return openAPISchema{Type: "string", Format: "date"}
+	case "timestamp without time zone", "timestamp with time zone":
+		return openAPISchema{Type: "string", Format: "date-time"}
+	}
+
+	return openAPISchema{Type: "string"}
+
+}
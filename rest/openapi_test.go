@@ -0,0 +1,101 @@
+// Copyright 2017 Jonathan Pincas
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jpincas/ghost/ghost"
+	"github.com/stretchr/testify/assert"
+)
+
+var openAPITables = []ghost.Table{
+	ghost.Table{
+		Schema: "shop",
+		Name:   "orders",
+		Columns: []ghost.Column{
+			ghost.Column{Name: "id", Type: "integer", HasDefault: true},
+			ghost.Column{Name: "reference", Type: "character varying(20)"},
+			ghost.Column{Name: "placed", Type: "timestamp with time zone", Nullable: true},
+			ghost.Column{Name: "tags", Type: "text[]", Nullable: true},
+		},
+		PrimaryKey: []string{"id"},
+		Grants: map[string][]string{
+			"anon":  []string{"SELECT"},
+			"admin": []string{"SELECT", "INSERT", "UPDATE", "DELETE"},
+		},
+	},
+	ghost.Table{
+		Schema: "shop",
+		Name:   "audit",
+		Columns: []ghost.Column{
+			ghost.Column{Name: "event", Type: "jsonb"},
+		},
+		Grants: map[string][]string{"admin": []string{"SELECT"}},
+	},
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+
+	doc := newOpenAPIDocument(openAPITables, "")
+
+	assert.Equal(t, "3.0.0", doc.OpenAPI)
+	assert.Len(t, doc.Paths["/shop/orders"], 2)
+	assert.Len(t, doc.Paths["/shop/orders/{record}"], 4)
+	assert.Len(t, doc.Paths["/shop/audit"], 2)
+
+	//No id, so no record routes
+	assert.NotContains(t, doc.Paths, "/shop/audit/{record}")
+
+	schema := doc.Components.Schemas["shop.orders"]
+	assert.Equal(t, []string{"reference"}, schema.Required)
+	assert.Equal(t, "int32", schema.Properties["id"].Format)
+	assert.Equal(t, "string", schema.Properties["reference"].Type)
+	assert.Equal(t, "date-time", schema.Properties["placed"].Format)
+	assert.True(t, schema.Properties["placed"].Nullable)
+	assert.Equal(t, "array", schema.Properties["tags"].Type)
+	assert.Equal(t, "string", schema.Properties["tags"].Items.Type)
+
+	//The document must marshal cleanly, with references in place
+	b, err := json.Marshal(doc)
+	assert.Nil(t, err)
+	assert.Contains(t, string(b), `"$ref":"#/components/schemas/shop.orders"`)
+
+}
+
+func TestOpenAPIDocument_role(t *testing.T) {
+
+	doc := newOpenAPIDocument(openAPITables, "anon")
+
+	//anon can only read orders, and can't see audit at all
+	assert.Contains(t, doc.Paths["/shop/orders"], "get")
+	assert.NotContains(t, doc.Paths["/shop/orders"], "post")
+	assert.Len(t, doc.Paths["/shop/orders/{record}"], 1)
+	assert.NotContains(t, doc.Paths, "/shop/audit")
+	assert.NotContains(t, doc.Components.Schemas, "shop.audit")
+
+}
+
+func TestOpenAPIRole(t *testing.T) {
+
+	//The caller's own role is described, whatever they ask for
+	req := httptest.NewRequest("GET", OpenAPIPath+"?role=admin", nil)
+	assert.Equal(t, "anon", openAPIRole(req))
+	assert.Equal(t, "web", openAPIRole(req.WithContext(context.WithValue(req.Context(), "role", "web"))))
+
+}
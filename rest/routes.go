@@ -0,0 +1,50 @@
+// Copyright 2017 Jonathan Pincas
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// 	http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"github.com/jpincas/ghost/auth"
+	"github.com/jpincas/ghost/ghost"
+	"github.com/pressly/chi"
+)
+
+//SetRoutes adds the generic CRUD routes to the router
+//Every table in every schema is exposed - access is controlled
+//entirely by the database, using the role the user is authorized as
+func setRoutes() {
+
+	ghost.App.Router.With(auth.Authenticator).Get(OpenAPIPath, getOpenAPI)
+
+	ghost.App.Router.Route("/{schema}/{table}", func(r chi.Router) {
+
+		r.Use(ghost.AddSchemaAndTableToContext)
+		r.Use(auth.Authenticator)
+
+		r.Get("/", getList)
+		r.Post("/", createRecord)
+
+		r.Route("/{record}", func(r chi.Router) {
+
+			r.Use(ghost.AddRecordToContext)
+
+			r.Get("/", getRecord)
+			r.Patch("/", updateRecord)
+			r.Put("/", replaceRecord)
+			r.Delete("/", deleteRecord)
+
+		})
+
+	})
+}